@@ -700,8 +700,8 @@ func (ca *CA) initUserRegistry() error {
 	}
 
 	// Use the DB for the user registry
-	dbAccessor := new(Accessor)
-	dbAccessor.SetDB(ca.db)
+	dbAccessor := NewDBAccessor(ca.db)
+	dbAccessor.CAMaxEnrollments = ca.Config.Registry.MaxEnrollments
 	ca.registry = dbAccessor
 	log.Debug("Initialized DB identity registry")
 	return nil
@@ -747,8 +747,12 @@ func (ca *CA) initEnrollmentSigner() (err error) {
 func (ca *CA) loadUsersTable() error {
 	log.Debug("Loading identity table")
 	registry := &ca.Config.Registry
-	for _, id := range registry.Identities {
+	for i, id := range registry.Identities {
 		log.Debugf("Loading identity '%s'", id.Name)
+		// The first identity is the admin given when the server was bootstrapped
+		if i == 0 {
+			id.Bootstrap = true
+		}
 		err := ca.addIdentity(&id, false)
 		if err != nil {
 			return errors.WithMessage(err, "Failed to load identity table")
@@ -843,6 +847,7 @@ func (ca *CA) addIdentity(id *CAConfigIdentity, errIfFound bool) error {
 		Attributes:     attrs,
 		MaxEnrollments: id.MaxEnrollments,
 		Level:          ca.levels.Identity,
+		IsBootstrap:    id.Bootstrap,
 	}
 	err = ca.registry.InsertUser(&rec)
 	if err != nil {
@@ -853,7 +858,13 @@ func (ca *CA) addIdentity(id *CAConfigIdentity, errIfFound bool) error {
 }
 
 func (ca *CA) addAffiliation(path, parentPath string) error {
-	return ca.registry.InsertAffiliation(path, parentPath, ca.levels.Affiliation)
+	err := ca.registry.InsertAffiliation(path, parentPath, ca.levels.Affiliation)
+	if isAffiliationExistsError(err) {
+		// Affiliations from the configuration are added every time the CA starts
+		log.Debugf("Affiliation '%s' already exists", path)
+		return nil
+	}
+	return err
 }
 
 // CertDBAccessor returns the certificate DB accessor for CA
@@ -151,6 +151,9 @@ type CAConfigIdentity struct {
 	Affiliation    string
 	MaxEnrollments int
 	Attrs          map[string]string
+	// Bootstrap marks the bootstrap admin, which can not be deleted. The
+	// first identity of the registry is always the bootstrap admin.
+	Bootstrap bool
 }
 
 // ParentServer contains URL for the parent server and the name of CA inside
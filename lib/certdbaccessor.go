@@ -19,6 +19,7 @@ package lib
 import (
 	"fmt"
 	"math/big"
+	"sort"
 	"strings"
 	"time"
 
@@ -41,7 +42,8 @@ INSERT INTO certificates (id, serial_number, authority_key_identifier, ca_label,
 
 	selectSQLbyID = `
 SELECT %s FROM certificates
-WHERE (id = ?);`
+WHERE (id = ?)
+ORDER BY serial_number;`
 
 	selectSQL = `
 SELECT %s FROM certificates
@@ -52,6 +54,13 @@ UPDATE certificates
 SET status='revoked', revoked_at=CURRENT_TIMESTAMP, reason=:reason
 WHERE (id = :id AND status != 'revoked');`
 
+	// The previous columns are assigned first since MySQL evaluates the
+	// assignments in order, using the values already assigned
+	rotateUserSerialSQL = `
+UPDATE users
+SET previous_serial_number = serial_number, previous_aki = aki, serial_number = ?, aki = ?
+WHERE (id = ?);`
+
 	deleteCertificatebyID = `
 DELETE FROM certificates
 		WHERE (ID = ?);`
@@ -126,12 +135,38 @@ func (d *CertDBAccessor) InsertCertificate(cr certdb.CertificateRecord) error {
 	record.PEM = cr.PEM
 	record.Level = d.level
 
-	res, err := d.db.NamedExec(insertSQL, record)
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "Failed to begin transaction")
+	}
+	err = insertCertificateTx(tx, record)
+	if err != nil {
+		err2 := tx.Rollback()
+		if err2 != nil {
+			log.Errorf("Error encounted while rolling back transaction: %s", err2)
+		}
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "Error encountered while committing transaction")
+	}
+
+	return nil
+}
+
+// insertCertificateTx inserts the certificate record and makes it the current
+// certificate of its identity, shifting the current one to previous
+func insertCertificateTx(tx *sqlx.Tx, record *CertRecord) error {
+	res, err := tx.NamedExec(insertSQL, record)
 	if err != nil {
 		return errors.Wrap(err, "Failed to insert record into database")
 	}
 
 	numRowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
 
 	if numRowsAffected == 0 {
 		return errors.New("Failed to insert the certificate record; no rows affected")
@@ -142,7 +177,14 @@ func (d *CertDBAccessor) InsertCertificate(cr certdb.CertificateRecord) error {
 			numRowsAffected)
 	}
 
-	return err
+	// Certificates of CAs and other subjects that are not identities in the
+	// registry leave no identity to update
+	_, err = tx.Exec(tx.Rebind(rotateUserSerialSQL), record.Serial, record.AKI, record.ID)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to record certificate of identity '%s'", record.ID)
+	}
+
+	return nil
 }
 
 // GetCertificatesByID gets a CertificateRecord indexed by id.
@@ -207,7 +249,7 @@ func (d *CertDBAccessor) GetRevokedCertificates(expiredAfter, expiredBefore, rev
 		return nil, err
 	}
 	var crs []certdb.CertificateRecord
-	revokedSQL := "SELECT %s FROM certificates WHERE (WHERE_CLAUSE);"
+	revokedSQL := "SELECT %s FROM certificates WHERE (WHERE_CLAUSE) ORDER BY serial_number;"
 	whereConds := []string{"status='revoked' AND expiry > ? AND revoked_at > ?"}
 	args := []interface{}{expiredAfter, revokedAfter}
 	if !expiredBefore.IsZero() {
@@ -259,7 +301,7 @@ func (d *CertDBAccessor) RevokeCertificatesByID(id string, reasonCode int) (crs
 	record.ID = id
 	record.Reason = reasonCode
 
-	err = d.db.Select(&crs, d.db.Rebind("SELECT * FROM certificates WHERE (id = ? AND status != 'revoked')"), id)
+	err = d.db.Select(&crs, d.db.Rebind(fmt.Sprintf("SELECT %s FROM certificates WHERE (id = ? AND status != 'revoked')", sqlstruct.Columns(CertRecord{}))), id)
 	if err != nil {
 		return nil, err
 	}
@@ -280,6 +322,127 @@ func (d *CertDBAccessor) RevokeCertificate(serial, aki string, reasonCode int) e
 	return err
 }
 
+// FindDuplicateSerials returns the ids of the identities owning each serial
+// number that was issued to more than one identity, keyed by serial number.
+// Certificates of different identities should never share a serial number, so
+// any result indicates a problem with the issuing CA.
+func (d *CertDBAccessor) FindDuplicateSerials() (map[string][]string, error) {
+	log.Debug("DB: Find serial numbers issued to more than one identity")
+
+	err := d.checkDB()
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+SELECT DISTINCT serial_number, id FROM certificates
+	WHERE serial_number IN (SELECT serial_number FROM certificates GROUP BY serial_number HAVING COUNT(DISTINCT id) > 1)
+	ORDER BY serial_number, id`
+	var rows []struct {
+		Serial string `db:"serial_number"`
+		ID     string `db:"id"`
+	}
+	err = d.db.Select(&rows, query)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to find duplicate serial numbers")
+	}
+
+	duplicates := map[string][]string{}
+	for _, row := range rows {
+		duplicates[row.Serial] = append(duplicates[row.Serial], row.ID)
+	}
+	if len(duplicates) > 0 {
+		log.Warningf("Found %d serial numbers issued to more than one identity", len(duplicates))
+	}
+
+	return duplicates, nil
+}
+
+// GetCertsNeedingNotification returns the unrevoked certificates that expire
+// within window from now and for which no expiry notification has been sent
+func (d *CertDBAccessor) GetCertsNeedingNotification(window time.Duration) ([]CertRecord, error) {
+	log.Debugf("DB: Get certificates expiring within %s that need notification", window)
+
+	err := d.checkDB()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	query := fmt.Sprintf("SELECT %s FROM certificates WHERE (status != 'revoked' AND notified_at IS NULL AND expiry >= ? AND expiry <= ?) ORDER BY expiry, serial_number", sqlstruct.Columns(CertRecord{}))
+	var crs []CertRecord
+	err = d.db.Select(&crs, d.db.Rebind(query), now, now.Add(window))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get certificates needing notification")
+	}
+
+	return crs, nil
+}
+
+// MarkNotified records that the expiry notification for a certificate has
+// been sent, so that GetCertsNeedingNotification no longer returns it
+func (d *CertDBAccessor) MarkNotified(serial, aki string) error {
+	log.Debugf("DB: Mark certificate with serial (%s) and aki (%s) notified", serial, aki)
+
+	err := d.checkDB()
+	if err != nil {
+		return err
+	}
+
+	res, err := d.db.Exec(d.db.Rebind("UPDATE certificates SET notified_at = ? WHERE (serial_number = ? AND authority_key_identifier = ?)"), time.Now().UTC(), serial, aki)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to mark certificate with serial '%s' and aki '%s' notified", serial, aki)
+	}
+	numRowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "Failed to get number of rows affected")
+	}
+	if numRowsAffected == 0 {
+		return errors.Errorf("No certificate with serial '%s' and aki '%s' was found", serial, aki)
+	}
+
+	return nil
+}
+
+// CRLEntry is a revoked certificate as it is listed in a CRL
+type CRLEntry struct {
+	Serial    string    `db:"serial_number"`
+	AKI       string    `db:"authority_key_identifier"`
+	RevokedAt time.Time `db:"revoked_at"`
+	Reason    int       `db:"reason"`
+}
+
+// GetCRLEntries returns the certificates that are revoked and have not
+// expired as of thisUpdate, the issue time of the CRL, ordered by the
+// numeric value of their serial numbers
+func (d *CertDBAccessor) GetCRLEntries(thisUpdate time.Time) ([]CRLEntry, error) {
+	log.Debugf("DB: Get CRL entries as of %s", thisUpdate)
+
+	err := d.checkDB()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []CRLEntry{}
+	err = d.db.Select(&entries, d.db.Rebind("SELECT serial_number, authority_key_identifier, revoked_at, reason FROM certificates WHERE (status = 'revoked' AND expiry > ?)"), thisUpdate.UTC())
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get revoked certificates")
+	}
+
+	// Serials are stored as hex strings without leading zeros, which do not
+	// sort numerically as strings
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, aOK := new(big.Int).SetString(entries[i].Serial, 16)
+		b, bOK := new(big.Int).SetString(entries[j].Serial, 16)
+		if !aOK || !bOK {
+			return entries[i].Serial < entries[j].Serial
+		}
+		return a.Cmp(b) < 0
+	})
+
+	return entries, nil
+}
+
 // InsertOCSP puts a new certdb.OCSPRecord into the db.
 func (d *CertDBAccessor) InsertOCSP(rr certdb.OCSPRecord) error {
 	return d.accessor.InsertOCSP(rr)
@@ -399,7 +562,7 @@ func (d *CertDBAccessor) GetCertificates(req server.CertificateRequest, callersA
 		whereClause := strings.Join(whereConds, " AND ")
 		getCertificateSQL = getCertificateSQL + " WHERE (" + whereClause + ")"
 	}
-	getCertificateSQL = getCertificateSQL + ";"
+	getCertificateSQL = getCertificateSQL + " ORDER BY certificates.serial_number;"
 
 	log.Debugf("Executing get certificates query: %s, with args: %s", getCertificateSQL, args)
 	rows, err := d.db.Queryx(d.db.Rebind(getCertificateSQL), args...)
@@ -17,18 +17,41 @@ limitations under the License.
 package lib_test
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"math/big"
 	"os"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/cloudflare/cfssl/certdb"
 	"github.com/hyperledger/fabric-ca/api"
 	. "github.com/hyperledger/fabric-ca/lib"
 	"github.com/hyperledger/fabric-ca/lib/dbutil"
 	"github.com/hyperledger/fabric-ca/lib/spi"
+	"github.com/hyperledger/fabric-ca/util"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ocsp"
 )
 
 const (
@@ -37,6 +60,9 @@ const (
 	sqliteTruncateTables = `
 DELETE FROM Users;
 DELETE FROM affiliations;
+DELETE FROM enrollment_events;
+DELETE FROM deleted_users;
+DELETE FROM certificates;
 `
 
 	rootDB = "rootDir/fabric_ca.db"
@@ -80,6 +106,218 @@ func TestSQLite(t *testing.T) {
 	testEverything(ta, t)
 }
 
+func TestReadDB(t *testing.T) {
+	cleanTestSlateSQ(t)
+	defer cleanTestSlateSQ(t)
+
+	err := os.MkdirAll(dbPath, 0755)
+	assert.NoError(t, err, "Failed to create directory")
+
+	primary, err := dbutil.NewUserRegistrySQLLite3(dbPath + "/primary.db")
+	assert.NoError(t, err, "Failed to open primary DB")
+	defer primary.Close()
+	replica, err := dbutil.NewUserRegistrySQLLite3(dbPath + "/replica.db")
+	assert.NoError(t, err, "Failed to open replica DB")
+	defer replica.Close()
+
+	accessor := NewDBAccessor(primary)
+	insert := spi.UserInfo{
+		Name:       "testId",
+		Pass:       "123456",
+		Type:       "client",
+		Attributes: []api.Attribute{},
+	}
+	err = accessor.InsertUser(&insert)
+	assert.NoError(t, err, "Failed to insert user")
+
+	accessor.SetReadDB(replica)
+	_, err = accessor.GetUser("testId", nil)
+	assert.Error(t, err, "User should have been read from the empty replica")
+
+	// Write went to the primary, not the replica
+	insert.Name = "testId2"
+	err = accessor.InsertUser(&insert)
+	assert.NoError(t, err, "Failed to insert user")
+	_, err = NewDBAccessor(primary).GetUser("testId2", nil)
+	assert.NoError(t, err, "User should have been written to the primary")
+
+	err = NewDBAccessor(replica).InsertUser(&insert)
+	assert.NoError(t, err, "Failed to insert user into replica")
+	_, err = accessor.GetUser("testId2", nil)
+	assert.NoError(t, err, "User should have been read from the replica")
+
+	accessor.SetReadDB(nil)
+	_, err = accessor.GetUser("testId", nil)
+	assert.NoError(t, err, "User should have been read from the primary")
+}
+
+func TestConsistentReads(t *testing.T) {
+	cleanTestSlateSQ(t)
+	defer cleanTestSlateSQ(t)
+
+	err := os.MkdirAll(dbPath, 0755)
+	assert.NoError(t, err, "Failed to create directory")
+
+	primary, err := dbutil.NewUserRegistrySQLLite3(dbPath + "/primary.db")
+	assert.NoError(t, err, "Failed to open primary DB")
+	defer primary.Close()
+	replica, err := dbutil.NewUserRegistrySQLLite3(dbPath + "/replica.db")
+	assert.NoError(t, err, "Failed to open replica DB")
+	defer replica.Close()
+
+	// The replica has a copy of the user that does not receive later writes
+	insert := spi.UserInfo{Name: "testId", Pass: "123456", Type: "client", MaxEnrollments: -1}
+	err = NewDBAccessor(primary).InsertUser(&insert)
+	assert.NoError(t, err, "Failed to insert user into primary")
+	err = NewDBAccessor(replica).InsertUser(&insert)
+	assert.NoError(t, err, "Failed to insert user into replica")
+
+	accessor := NewDBAccessor(primary)
+	accessor.SetReadDB(replica)
+	getType := func() string {
+		user, err := accessor.GetUser("testId", nil)
+		if !assert.NoError(t, err, "Failed to get user") {
+			return ""
+		}
+		return user.GetType()
+	}
+
+	insert.Type = "peer"
+	err = accessor.UpdateUser(&insert, false)
+	assert.NoError(t, err, "Failed to update user")
+	assert.Equal(t, "client", getType(), "Without consistent reads the user should have been read from the replica")
+
+	accessor.ConsistentReads = true
+	accessor.ConsistentReadWindow = 500 * time.Millisecond
+	insert.Type = "orderer"
+	err = accessor.UpdateUser(&insert, false)
+	assert.NoError(t, err, "Failed to update user")
+	assert.Equal(t, "orderer", getType(), "The user should have been read from the primary right after it was written")
+	// Other reads of the identity also go to the primary
+	rec, err := accessor.GetUserRecord(" testId ")
+	if assert.NoError(t, err, "Failed to get user record") {
+		assert.Equal(t, "orderer", rec.Type, "The user record should have been read from the primary")
+	}
+	fields, err := accessor.GetUserFields("testId", FieldType)
+	if assert.NoError(t, err, "Failed to get user fields") {
+		assert.Equal(t, "orderer", fields[FieldType], "The user fields should have been read from the primary")
+	}
+
+	time.Sleep(600 * time.Millisecond)
+	assert.Equal(t, "client", getType(), "The user should have been read from the replica after the window passed")
+
+	// Writes through the user, such as completing an enrollment, are also seen
+	user, err := accessor.GetUser("testId", nil)
+	if assert.NoError(t, err, "Failed to get user") {
+		err = user.LoginComplete()
+		assert.NoError(t, err, "Failed to complete login")
+		user, err = accessor.GetUser("testId", nil)
+		if assert.NoError(t, err, "Failed to get user") {
+			assert.Equal(t, 1, user.(*DBUser).State, "The enrollment should have been read from the primary")
+		}
+	}
+
+	// So are writes of single fields and batch writes
+	time.Sleep(600 * time.Millisecond)
+	err = accessor.UpdateField("testId", FieldLevel, 2)
+	assert.NoError(t, err, "Failed to update field")
+	user, err = accessor.GetUser("testId", nil)
+	if assert.NoError(t, err, "Failed to get user") {
+		assert.Equal(t, 2, user.GetLevel(), "The field should have been read from the primary")
+	}
+	time.Sleep(600 * time.Millisecond)
+	_, err = accessor.UpdateFieldBatch([]string{"testId"}, FieldType, "user")
+	assert.NoError(t, err, "Failed to update field of multiple users")
+	assert.Equal(t, "user", getType(), "The batch update should have been read from the primary")
+}
+
+func TestSQLiteForeignKeys(t *testing.T) {
+	cleanTestSlateSQ(t)
+	defer cleanTestSlateSQ(t)
+
+	err := os.MkdirAll(dbPath, 0755)
+	assert.NoError(t, err, "Failed to create directory")
+
+	db, err := dbutil.NewUserRegistrySQLLite3(dbPath + "/fk.db")
+	if !assert.NoError(t, err, "Failed to open DB") {
+		return
+	}
+	defer db.Close()
+	foreignKeys := func(conn *sql.Conn) int {
+		var enabled int
+		err := conn.QueryRowContext(context.Background(), "PRAGMA foreign_keys").Scan(&enabled)
+		assert.NoError(t, err, "Failed to check foreign keys pragma")
+		return enabled
+	}
+
+	accessor := NewDBAccessor(db)
+	accessor.SetDB(db)
+	conn, err := db.Conn(context.Background())
+	if assert.NoError(t, err, "Failed to get connection") {
+		assert.Equal(t, 0, foreignKeys(conn), "Foreign keys should not be enforced by default")
+		conn.Close()
+	}
+
+	// Every connection of the reopened DB enforces foreign keys
+	accessor.EnforceForeignKeys = true
+	accessor.SetDB(db)
+	db.SetMaxOpenConns(2)
+	conns := []*sql.Conn{}
+	for i := 0; i < 2; i++ {
+		conn, err := db.Conn(context.Background())
+		if assert.NoError(t, err, "Failed to get connection") {
+			conns = append(conns, conn)
+			assert.Equal(t, 1, foreignKeys(conn), "Foreign keys should be enabled on connection %d", i)
+		}
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+	db.SetMaxOpenConns(1)
+
+	err = accessor.InsertAffiliation("org1", "", 0)
+	assert.NoError(t, err, "Failed to insert affiliation through the reopened DB")
+}
+
+func TestValidateSchema(t *testing.T) {
+	cleanTestSlateSQ(t)
+	defer cleanTestSlateSQ(t)
+
+	err := os.MkdirAll(dbPath, 0755)
+	assert.NoError(t, err, "Failed to create directory")
+
+	db, err := dbutil.NewUserRegistrySQLLite3(dbPath + "/schema.db")
+	if !assert.NoError(t, err, "Failed to open DB") {
+		return
+	}
+	defer db.Close()
+	accessor := NewDBAccessor(db)
+
+	err = accessor.ValidateSchema()
+	assert.NoError(t, err, "The schema of a newly created DB should be valid")
+
+	// Recreate the users table without the level column and with a text state
+	_, err = db.Exec("DROP TABLE users")
+	assert.NoError(t, err, "Failed to drop users table")
+	_, err = db.Exec("CREATE TABLE users (id VARCHAR(255) NOT NULL, token bytea, type VARCHAR(256), affiliation VARCHAR(1024), attributes TEXT, state TEXT, max_enrollments INTEGER, incorrect_password_attempts INTEGER DEFAULT 0, locked_until timestamp, created_at timestamp, created_by VARCHAR(255), revocation_reason INTEGER, revoked_at timestamp, attr_count INTEGER, expires_at timestamp, idempotency_key VARCHAR(255), last_enrolled_at timestamp, initial_secret INTEGER DEFAULT 0, serial_number VARCHAR(128), aki VARCHAR(128), previous_serial_number VARCHAR(128), previous_aki VARCHAR(128), ca_name VARCHAR(255) NOT NULL DEFAULT '')")
+	assert.NoError(t, err, "Failed to create users table")
+
+	err = accessor.ValidateSchema()
+	if assert.Error(t, err, "Validating a schema with a missing column should have failed") {
+		assert.Contains(t, err.Error(), fmt.Sprintf("code: %d", ErrInvalidSchema))
+		assert.Contains(t, err.Error(), "column 'level' of table 'users' is missing")
+		assert.Contains(t, err.Error(), "column 'state' of table 'users' has type 'TEXT'")
+		assert.NotContains(t, err.Error(), "affiliations")
+	}
+
+	_, err = db.Exec("DROP TABLE affiliations")
+	assert.NoError(t, err, "Failed to drop affiliations table")
+	err = accessor.ValidateSchema()
+	if assert.Error(t, err, "Validating a schema with a missing table should have failed") {
+		assert.Contains(t, err.Error(), "table 'affiliations' is missing")
+	}
+}
+
 // Truncate truncates the DB
 func Truncate(db *dbutil.DB) {
 	var sql []string
@@ -241,11 +479,105 @@ func cleanTestSlateSQ(t *testing.T) {
 
 func testEverything(ta TestAccessor, t *testing.T) {
 	testInsertAndGetUser(ta, t)
+	testGetUserSafe(ta, t)
+	testInsertDuplicateUser(ta, t)
 	testModifyAttribute(ta, t)
+	testAttributesRoundTrip(ta, t)
 	testDeleteUser(ta, t)
 	testUpdateUser(ta, t)
+	testUpdateFieldBatch(ta, t)
+	testIsUserLocked(ta, t)
 	testInsertAndGetAffiliation(ta, t)
 	testDeleteAffiliation(ta, t)
+	testInsertAffiliationMaxDepth(ta, t)
+	testGetEffectiveAttributes(ta, t)
+	testGetUserProvenance(ta, t)
+	testResetAllEnrollments(ta, t)
+	testAffiliationCache(ta, t)
+	testUpdateFieldWrongType(ta, t)
+	testRestoreAffiliation(ta, t)
+	testStreamUsers(ta, t)
+	testGetUserECert(ta, t)
+	testMoveAffiliation(ta, t)
+	testCanEnroll(ta, t)
+	testIDNormalizer(ta, t)
+	testGetAffiliationDTO(ta, t)
+	testTransitionState(ta, t)
+	testGetRevocationInfo(ta, t)
+	testCountUsersByType(ta, t)
+	testReparentOrphans(ta, t)
+	testHTTPStatusForError(ta, t)
+	testVacuum(ta, t)
+	testGetAttributeCount(ta, t)
+	testUserExpiry(ta, t)
+	testDeleteAffiliationWithMembers(ta, t)
+	testListUsersAfter(ta, t)
+	testDefaultUserType(ta, t)
+	testGetUserDetail(ta, t)
+	testRegisterWithSecret(ta, t)
+	testUpdateAffiliationParent(ta, t)
+	testPatchUserAttributes(ta, t)
+	testListAffiliations(ta, t)
+	testStats(ta, t)
+	testGetTypedAttribute(ta, t)
+	testInsertUserIdempotent(ta, t)
+	testUserHasAttribute(ta, t)
+	testMigrateAttributeFormat(ta, t)
+	testGetUserFields(ta, t)
+	testInsertDuplicateAffiliation(ta, t)
+	testSQLiteBusyRetries(ta, t)
+	testGetUserETag(ta, t)
+	testAuthenticator(ta, t)
+	testDuplicateAttributes(ta, t)
+	testAffiliationsExist(ta, t)
+	testInsertUserPreHashed(ta, t)
+	testSearchUsers(ta, t)
+	testAffiliationMetadata(ta, t)
+	testGetRecentEnrollments(ta, t)
+	testUpdateUserIfExists(ta, t)
+	testEnrollmentHistory(ta, t)
+	testHasInitialSecret(ta, t)
+	testRevokeAffiliationMembers(ta, t)
+	testCaseInsensitiveAffiliations(ta, t)
+	testListOrdering(ta, t)
+	testSecretResolver(ta, t)
+	testAddAttributeToType(ta, t)
+	testFindDuplicateSerials(ta, t)
+	testGetAttributesAs(ta, t)
+	testAuditDB(ta, t)
+	testSerialHistory(ta, t)
+	testReconcileCertificates(ta, t)
+	testGetDisplayName(ta, t)
+	testResolveAffiliationPathPrefix(ta, t)
+	testCountEnrollmentsBetween(ta, t)
+	testCompressAttributes(ta, t)
+	testGetRegistrarRoles(ta, t)
+	testCanRegisterType(ta, t)
+	testCanRegisterInAffiliation(ta, t)
+	testCertNotification(ta, t)
+	testGetUserRecord(ta, t)
+	testSetStates(ta, t)
+	testCAName(ta, t)
+	testGetUserWithAffiliationCheck(ta, t)
+	testExportImportAffiliations(ta, t)
+	testLockUser(ta, t)
+	testFindUsers(ta, t)
+	testTruncateTables(ta, t)
+	testSortAttributes(ta, t)
+	testEventSink(ta, t)
+	testGetExpiringCertsInAffiliation(ta, t)
+	testIDValidator(ta, t)
+	testNeedsReenrollment(ta, t)
+	testSwapToken(ta, t)
+	testGetMergedAttributes(ta, t)
+	testGetCRLEntries(ta, t)
+	testInsertUserWithWarnings(ta, t)
+	testGetEmptyAffiliations(ta, t)
+	testMaxAttributeLengths(ta, t)
+	testIsSecretExpired(ta, t)
+	testUpgradeTokensToBcrypt(ta, t)
+	testBootstrapAdmin(ta, t)
+	testPurgeDeletedBefore(ta, t)
 }
 
 func testInsertAndGetUser(ta TestAccessor, t *testing.T) {
@@ -291,6 +623,80 @@ func testInsertAndGetUser(ta TestAccessor, t *testing.T) {
 	}
 }
 
+func testGetUserSafe(ta TestAccessor, t *testing.T) {
+	t.Log("TestGetUserSafe")
+
+	user, err := ta.Accessor.GetUserSafe("testId")
+	assert.NoError(t, err, "Failed to get user")
+	assert.Equal(t, "testId", user.GetName())
+
+	dbUser, ok := user.(*DBUser)
+	if assert.True(t, ok, "Expected a DBUser") {
+		assert.Empty(t, dbUser.Pass, "Password should have been masked")
+	}
+
+	err = user.Login("123456", -1)
+	assert.Error(t, err, "Login should fail for a user with a masked password")
+
+	_, err = ta.Accessor.GetUserSafe("unknownId")
+	assert.Error(t, err, "Getting an unknown user should have failed")
+}
+
+func testInsertDuplicateUser(ta TestAccessor, t *testing.T) {
+	t.Log("TestInsertDuplicateUser")
+
+	insert := spi.UserInfo{
+		Name:       "testId",
+		Pass:       "123456",
+		Type:       "client",
+		Attributes: []api.Attribute{},
+	}
+	err := ta.Accessor.InsertUser(&insert)
+	if assert.Error(t, err, "Inserting a duplicate user should have failed") {
+		assert.Contains(t, err.Error(), fmt.Sprintf("code: %d", ErrIdentityExists))
+		assert.Contains(t, err.Error(), "Identity 'testId' already exists")
+		assert.NotContains(t, err.Error(), "UNIQUE", "Error should not expose the driver error")
+		assert.NotContains(t, err.Error(), "INSERT", "Error should not expose the SQL statement")
+	}
+}
+
+func testAttributesRoundTrip(ta TestAccessor, t *testing.T) {
+	t.Log("TestAttributesRoundTrip")
+	ta.Truncate()
+
+	attrs := []api.Attribute{
+		api.Attribute{
+			Name:  "hf.Registrar.Roles",
+			Value: "peer,client",
+			ECert: true,
+		},
+		api.Attribute{
+			Name:  "quoted",
+			Value: `say "hello", {"nested": [1, 2]}`,
+		},
+		api.Attribute{
+			Name:  "unicode",
+			Value: "日本語 ü ✓",
+		},
+	}
+	err := ta.Accessor.InsertUser(&spi.UserInfo{
+		Name:       "roundTrip",
+		Pass:       "123456",
+		Type:       "client",
+		Attributes: attrs,
+	})
+	assert.NoError(t, err, "Failed to insert user")
+
+	user, err := ta.Accessor.GetUser("roundTrip", nil)
+	assert.NoError(t, err, "Failed to get user")
+	for _, expected := range attrs {
+		attr, err := user.GetAttribute(expected.Name)
+		if assert.NoError(t, err, "Failed to get attribute %s", expected.Name) {
+			assert.Equal(t, expected, *attr)
+		}
+	}
+}
+
 func testModifyAttribute(ta TestAccessor, t *testing.T) {
 
 	user, err := ta.Accessor.GetUser("testId", nil)
@@ -406,6 +812,115 @@ func testUpdateUser(ta TestAccessor, t *testing.T) {
 		t.Error("Failed to login in user: ", err)
 	}
 
+	// Identity names are normalized like they are on insert
+	insert.Name = " testId "
+	insert.Type = "peer"
+	err = ta.Accessor.UpdateUser(&insert, false)
+	assert.NoError(t, err, "Failed to update user with a name that is not normalized")
+	err = ta.Accessor.UpdateField(" testId ", FieldLevel, 3)
+	assert.NoError(t, err, "Failed to update field of user with a name that is not normalized")
+	user, err = ta.Accessor.GetUser("testId", nil)
+	if assert.NoError(t, err, "Failed to get user") {
+		assert.Equal(t, "peer", user.GetType())
+		assert.Equal(t, 3, user.GetLevel())
+	}
+}
+
+func testUpdateFieldBatch(ta TestAccessor, t *testing.T) {
+	t.Log("TestUpdateFieldBatch")
+	ta.Truncate()
+
+	for _, name := range []string{"user1", "user2", "user3"} {
+		err := ta.Accessor.InsertUser(&spi.UserInfo{
+			Name:           name,
+			Pass:           "123456",
+			Type:           "client",
+			Attributes:     []api.Attribute{},
+			MaxEnrollments: 1,
+		})
+		assert.NoError(t, err, "Failed to insert user %s", name)
+	}
+
+	updated, err := ta.Accessor.UpdateFieldBatch([]string{"user1", " user3 ", "unknown"}, FieldType, "peer")
+	assert.NoError(t, err, "Failed to update field of multiple users")
+	assert.Equal(t, 2, updated, "Incorrect number of users updated")
+
+	expected := map[string]string{"user1": "peer", "user2": "client", "user3": "peer"}
+	for name, userType := range expected {
+		user, err := ta.Accessor.GetUser(name, nil)
+		assert.NoError(t, err, "Failed to get user %s", name)
+		assert.Equal(t, userType, user.GetType(), "Incorrect type for user %s", name)
+	}
+
+	updated, err = ta.Accessor.UpdateFieldBatch([]string{}, FieldType, "peer")
+	assert.NoError(t, err, "Updating an empty list of users should not fail")
+	assert.Equal(t, 0, updated)
+
+	_, err = ta.Accessor.UpdateFieldBatch([]string{"user1"}, Field(100), "peer")
+	assert.Error(t, err, "Updating an unknown field should have failed")
+}
+
+func testIsUserLocked(ta TestAccessor, t *testing.T) {
+	t.Log("TestIsUserLocked")
+	ta.Truncate()
+	ta.Accessor.MaxIncorrectPasswordAttempts = 2
+	ta.Accessor.LockoutDuration = time.Hour
+	defer func() {
+		ta.Accessor.MaxIncorrectPasswordAttempts = 0
+		ta.Accessor.LockoutDuration = 0
+	}()
+
+	for _, name := range []string{"lockedUser", "unlockedUser"} {
+		err := ta.Accessor.InsertUser(&spi.UserInfo{
+			Name:           name,
+			Pass:           "123456",
+			Type:           "client",
+			Attributes:     []api.Attribute{},
+			MaxEnrollments: -1,
+		})
+		assert.NoError(t, err, "Failed to insert user %s", name)
+	}
+
+	for i := 0; i < 2; i++ {
+		user, err := ta.Accessor.GetUser("lockedUser", nil)
+		assert.NoError(t, err, "Failed to get user")
+		err = user.Login("badpass", -1)
+		assert.Error(t, err, "Login with an incorrect password should have failed")
+	}
+
+	locked, until, err := ta.Accessor.IsUserLocked("lockedUser")
+	assert.NoError(t, err, "Failed to check if user is locked")
+	assert.True(t, locked, "User should be locked after too many incorrect passwords")
+	assert.True(t, until.After(time.Now().Add(50*time.Minute)), "Incorrect lock expiration: %s", until)
+
+	// The name is normalized by IDNormalizer like on login
+	locked, _, err = ta.Accessor.IsUserLocked(" lockedUser ")
+	assert.NoError(t, err, "Failed to check if user is locked by an unnormalized name")
+	assert.True(t, locked, "User should be locked when checked by an unnormalized name")
+
+	user, err := ta.Accessor.GetUser("lockedUser", nil)
+	assert.NoError(t, err, "Failed to get user")
+	err = user.Login("123456", -1)
+	assert.Error(t, err, "Login of a locked user should have failed")
+
+	locked, until, err = ta.Accessor.IsUserLocked("unlockedUser")
+	assert.NoError(t, err, "Failed to check if user is locked")
+	assert.False(t, locked, "User should not be locked")
+	assert.True(t, until.IsZero(), "Unlocked user should not have a lock expiration")
+
+	// A lock that has expired no longer applies
+	_, err = ta.DB.Exec(ta.DB.Rebind("UPDATE users SET locked_until = ? WHERE (id = ?)"), time.Now().Add(-time.Minute).UTC(), "lockedUser")
+	assert.NoError(t, err, "Failed to update lock expiration")
+	locked, _, err = ta.Accessor.IsUserLocked("lockedUser")
+	assert.NoError(t, err, "Failed to check if user is locked")
+	assert.False(t, locked, "User should not be locked after the lock expired")
+	user, err = ta.Accessor.GetUser("lockedUser", nil)
+	assert.NoError(t, err, "Failed to get user")
+	err = user.Login("123456", -1)
+	assert.NoError(t, err, "Login should succeed after the lock expired")
+
+	_, _, err = ta.Accessor.IsUserLocked("unknownUser")
+	assert.Error(t, err, "Checking an unknown user should have failed")
 }
 
 func testInsertAndGetAffiliation(ta TestAccessor, t *testing.T) {
@@ -446,6 +961,83 @@ func testDeleteAffiliation(ta TestAccessor, t *testing.T) {
 	}
 }
 
+func testInsertAffiliationMaxDepth(ta TestAccessor, t *testing.T) {
+	ta.Truncate()
+	ta.Accessor.MaxAffiliationDepth = 3
+	defer func() { ta.Accessor.MaxAffiliationDepth = 0 }()
+
+	err := ta.Accessor.InsertAffiliation("org1", "", 0)
+	assert.NoError(t, err, "Failed to insert affiliation 'org1'")
+	err = ta.Accessor.InsertAffiliation("org1.dept1", "org1", 0)
+	assert.NoError(t, err, "Failed to insert affiliation 'org1.dept1'")
+	err = ta.Accessor.InsertAffiliation("org1.dept1.team1", "org1.dept1", 0)
+	assert.NoError(t, err, "Affiliation at the maximum depth should have been inserted")
+
+	err = ta.Accessor.InsertAffiliation("org1.dept1.team1.sub1", "org1.dept1.team1", 0)
+	if assert.Error(t, err, "Affiliation past the maximum depth should have been rejected") {
+		assert.Contains(t, err.Error(), "exceeds the maximum depth")
+	}
+	_, err = ta.Accessor.GetAffiliation("org1.dept1.team1.sub1")
+	assert.Error(t, err, "Rejected affiliation should not have been stored")
+}
+
+func testGetEffectiveAttributes(ta TestAccessor, t *testing.T) {
+	ta.Truncate()
+
+	err := ta.Accessor.InsertAffiliation("org1", "", 0)
+	assert.NoError(t, err, "Failed to insert affiliation 'org1'")
+	_, err = ta.DB.Exec(ta.DB.Rebind("UPDATE affiliations SET attributes = ? WHERE (name = ?)"),
+		`[{"name":"policy","value":"strict"},{"name":"region","value":"us"}]`, "org1")
+	assert.NoError(t, err, "Failed to set attributes of affiliation 'org1'")
+
+	insert := spi.UserInfo{
+		Name:        "testId",
+		Pass:        "123456",
+		Type:        "client",
+		Affiliation: "org1",
+		Attributes: []api.Attribute{
+			api.Attribute{
+				Name:  "region",
+				Value: "eu",
+			},
+			api.Attribute{
+				Name:  "xyz",
+				Value: "xyz",
+			},
+		},
+	}
+	err = ta.Accessor.InsertUser(&insert)
+	assert.NoError(t, err, "Failed to insert user")
+
+	attrs, err := ta.Accessor.GetEffectiveAttributes("testId")
+	assert.NoError(t, err, "Failed to get effective attributes")
+	values := map[string]string{}
+	for _, attr := range attrs {
+		values[attr.Name] = attr.Value
+	}
+	assert.Equal(t, 3, len(values))
+	assert.Equal(t, "strict", values["policy"], "Attribute should have been inherited from affiliation")
+	assert.Equal(t, "eu", values["region"], "Attribute of identity should override attribute of affiliation")
+	assert.Equal(t, "xyz", values["xyz"])
+
+	ta.Accessor.CaseInsensitiveAffiliations = true
+	defer func() { ta.Accessor.CaseInsensitiveAffiliations = false }()
+	_, err = ta.DB.Exec(ta.DB.Rebind("UPDATE users SET affiliation = ? WHERE (id = ?)"), "ORG1", "testId")
+	assert.NoError(t, err, "Failed to change case of affiliation of user")
+	attrs, err = ta.Accessor.GetEffectiveAttributes("testId")
+	assert.NoError(t, err, "Failed to get effective attributes")
+	assert.Equal(t, 3, len(attrs), "Affiliation of identity should match regardless of case")
+
+	err = ta.Accessor.SoftDeleteAffiliation("org1")
+	assert.NoError(t, err, "Failed to soft delete affiliation 'org1'")
+	attrs, err = ta.Accessor.GetEffectiveAttributes("testId")
+	assert.NoError(t, err, "Failed to get effective attributes")
+	assert.Equal(t, 2, len(attrs), "Soft deleted affiliation should not contribute attributes")
+
+	_, err = ta.Accessor.GetEffectiveAttributes("unknownId")
+	assert.Error(t, err, "Getting attributes of an unknown user should have failed")
+}
+
 func TestDBErrorMessages(t *testing.T) {
 	var err error
 
@@ -494,3 +1086,3780 @@ func TestDBErrorMessages(t *testing.T) {
 		assert.Contains(t, err.Error(), fmt.Sprintf(expectedErr, "Certificate"))
 	}
 }
+
+func testGetUserProvenance(ta TestAccessor, t *testing.T) {
+	t.Log("TestGetUserProvenance")
+	ta.Truncate()
+
+	before := time.Now().Add(-time.Second)
+	err := ta.Accessor.InsertUser(&spi.UserInfo{
+		Name:           "provUser",
+		Pass:           "123456",
+		Type:           "client",
+		Attributes:     []api.Attribute{},
+		MaxEnrollments: -1,
+		CreatedBy:      "admin",
+	})
+	assert.NoError(t, err, "Failed to insert user")
+
+	createdAt, createdBy, err := ta.Accessor.GetUserProvenance("provUser")
+	assert.NoError(t, err, "Failed to get provenance of user")
+	assert.Equal(t, "admin", createdBy, "Incorrect creator of user")
+	assert.True(t, createdAt.After(before), "Incorrect creation time of user: %s", createdAt)
+	assert.True(t, createdAt.Before(time.Now().Add(time.Second)), "Incorrect creation time of user: %s", createdAt)
+
+	_, createdBy, err = ta.Accessor.GetUserProvenance(" provUser ")
+	assert.NoError(t, err, "Failed to get provenance of user by an unnormalized name")
+	assert.Equal(t, "admin", createdBy, "Incorrect creator of user")
+
+	_, _, err = ta.Accessor.GetUserProvenance("unknownUser")
+	assert.Error(t, err, "Getting provenance of a non-existent user should have failed")
+}
+
+func testResetAllEnrollments(ta TestAccessor, t *testing.T) {
+	t.Log("TestResetAllEnrollments")
+	ta.Truncate()
+
+	names := []string{"enrolled1", "enrolled2", "enrolled3"}
+	for i, name := range names {
+		err := ta.Accessor.InsertUser(&spi.UserInfo{
+			Name:           name,
+			Pass:           "123456",
+			Type:           "client",
+			Attributes:     []api.Attribute{},
+			State:          i + 1,
+			MaxEnrollments: -1,
+		})
+		assert.NoError(t, err, "Failed to insert user %s", name)
+	}
+
+	_, err := ta.Accessor.ResetAllEnrollments(false)
+	assert.Error(t, err, "Resetting enrollments without confirmation should have failed")
+	user, err := ta.Accessor.GetUser("enrolled1", nil)
+	assert.NoError(t, err, "Failed to get user")
+	assert.Equal(t, 1, user.(*DBUser).State, "State should not change without confirmation")
+
+	affected, err := ta.Accessor.ResetAllEnrollments(true)
+	assert.NoError(t, err, "Failed to reset enrollments")
+	assert.Equal(t, len(names), affected, "Incorrect number of identities reset")
+	for _, name := range names {
+		user, err := ta.Accessor.GetUser(name, nil)
+		assert.NoError(t, err, "Failed to get user %s", name)
+		assert.Equal(t, 0, user.(*DBUser).State, "State of %s was not reset", name)
+	}
+}
+
+func testAffiliationCache(ta TestAccessor, t *testing.T) {
+	t.Log("TestAffiliationCache")
+	ta.Truncate()
+	ta.Accessor.CacheAffiliations = true
+	defer func() { ta.Accessor.CacheAffiliations = false }()
+	err := ta.Accessor.RefreshAffiliationCache()
+	assert.NoError(t, err, "Failed to refresh affiliation cache")
+
+	err = ta.Accessor.InsertAffiliation("org1", "", 0)
+	assert.NoError(t, err, "Failed to insert affiliation 'org1'")
+	err = ta.Accessor.InsertAffiliation("org1.dept1", "org1", 0)
+	assert.NoError(t, err, "Failed to insert affiliation 'org1.dept1'")
+	err = ta.Accessor.InsertAffiliation("org1.dept1.team1", "org1.dept1", 0)
+	assert.NoError(t, err, "Failed to insert affiliation 'org1.dept1.team1'")
+
+	// Inserting invalidates the cache, so the new affiliations are found
+	aff, err := ta.Accessor.GetAffiliation("org1.dept1.team1")
+	assert.NoError(t, err, "Failed to get affiliation 'org1.dept1.team1'")
+	assert.Equal(t, "org1.dept1", aff.GetPrekey())
+	isAncestor, err := ta.Accessor.IsAncestorAffiliation("org1", "org1.dept1.team1")
+	assert.NoError(t, err, "Failed to check ancestor of affiliation")
+	assert.True(t, isAncestor, "'org1' should be an ancestor of 'org1.dept1.team1'")
+	isAncestor, err = ta.Accessor.IsAncestorAffiliation("org1.dept1.team1", "org1")
+	assert.NoError(t, err, "Failed to check ancestor of affiliation")
+	assert.False(t, isAncestor, "'org1.dept1.team1' should not be an ancestor of 'org1'")
+
+	// Changes made directly in the database are not seen until the cache is refreshed
+	_, err = ta.DB.Exec("INSERT INTO affiliations (name, prekey, level) VALUES ('org2', '', 0)")
+	assert.NoError(t, err, "Failed to insert affiliation directly into the database")
+	_, err = ta.DB.Exec("DELETE FROM affiliations WHERE name = 'org1.dept1.team1'")
+	assert.NoError(t, err, "Failed to delete affiliation directly from the database")
+	_, err = ta.Accessor.GetAffiliation("org1.dept1.team1")
+	assert.NoError(t, err, "Affiliation 'org1.dept1.team1' should have been found in the cache")
+	_, err = ta.Accessor.GetAffiliation("org2")
+	assert.Error(t, err, "Affiliation 'org2' should not be in the cache yet")
+
+	err = ta.Accessor.RefreshAffiliationCache()
+	assert.NoError(t, err, "Failed to refresh affiliation cache")
+	_, err = ta.Accessor.GetAffiliation("org1.dept1.team1")
+	assert.Error(t, err, "Affiliation 'org1.dept1.team1' should have been removed from the cache")
+	_, err = ta.Accessor.GetAffiliation("org2")
+	assert.NoError(t, err, "Affiliation 'org2' should be in the cache after refresh")
+
+	// Renaming and deleting invalidate the cache
+	_, err = ta.Accessor.ModifyAffiliation("org1.dept1", "org1.dept2", true, true)
+	assert.NoError(t, err, "Failed to rename affiliation 'org1.dept1'")
+	_, err = ta.Accessor.GetAffiliation("org1.dept1")
+	assert.Error(t, err, "Renamed affiliation 'org1.dept1' should not be found")
+	_, err = ta.Accessor.GetAffiliation("org1.dept2")
+	assert.NoError(t, err, "Failed to get renamed affiliation 'org1.dept2'")
+
+	_, err = ta.Accessor.DeleteAffiliation("org2", true, true, true)
+	assert.NoError(t, err, "Failed to delete affiliation 'org2'")
+	_, err = ta.Accessor.GetAffiliation("org2")
+	assert.Error(t, err, "Deleted affiliation 'org2' should not be found")
+}
+
+func testUpdateFieldWrongType(ta TestAccessor, t *testing.T) {
+	t.Log("TestUpdateFieldWrongType")
+	ta.Truncate()
+
+	err := ta.Accessor.InsertUser(&spi.UserInfo{
+		Name:           "fieldUser",
+		Pass:           "123456",
+		Type:           "client",
+		Attributes:     []api.Attribute{},
+		MaxEnrollments: 1,
+	})
+	assert.NoError(t, err, "Failed to insert user")
+
+	err = ta.Accessor.UpdateField("fieldUser", FieldMaxEnrollments, 5)
+	assert.NoError(t, err, "Failed to update field of user")
+	user, err := ta.Accessor.GetUser("fieldUser", nil)
+	assert.NoError(t, err, "Failed to get user")
+	assert.Equal(t, 5, user.GetMaxEnrollments(), "Field of user was not updated")
+
+	err = ta.Accessor.UpdateField("unknownUser", FieldMaxEnrollments, 5)
+	assert.Error(t, err, "Updating a field of a non-existent user should have failed")
+
+	err = ta.Accessor.UpdateField("fieldUser", FieldType, 5)
+	if assert.Error(t, err, "Updating a string field with an int should have failed") {
+		assert.Contains(t, err.Error(), "expects type string")
+	}
+	err = ta.Accessor.UpdateField("fieldUser", FieldState, "1")
+	if assert.Error(t, err, "Updating an int field with a string should have failed") {
+		assert.Contains(t, err.Error(), "expects type int")
+	}
+	_, err = ta.Accessor.UpdateFieldBatch([]string{"fieldUser"}, FieldLevel, nil)
+	if assert.Error(t, err, "Updating an int field with nil should have failed") {
+		assert.Contains(t, err.Error(), "expects type int")
+	}
+
+	user, err = ta.Accessor.GetUser("fieldUser", nil)
+	assert.NoError(t, err, "Failed to get user")
+	assert.Equal(t, "client", user.GetType(), "Field of user should not have changed")
+}
+
+func testRestoreAffiliation(ta TestAccessor, t *testing.T) {
+	t.Log("TestRestoreAffiliation")
+	ta.Truncate()
+
+	err := ta.Accessor.InsertAffiliation("org1", "", 0)
+	assert.NoError(t, err, "Failed to insert affiliation 'org1'")
+	err = ta.Accessor.InsertAffiliation("org1.dept1", "org1", 0)
+	assert.NoError(t, err, "Failed to insert affiliation 'org1.dept1'")
+	err = ta.Accessor.InsertAffiliation("org2", "", 0)
+	assert.NoError(t, err, "Failed to insert affiliation 'org2'")
+
+	err = ta.Accessor.RestoreAffiliation("org1")
+	if assert.Error(t, err, "Restoring an affiliation that is not deleted should have failed") {
+		assert.Contains(t, err.Error(), fmt.Sprintf("code: %d", ErrInvalidStateTransition))
+	}
+
+	err = ta.Accessor.SoftDeleteAffiliation("org1")
+	assert.NoError(t, err, "Failed to soft delete affiliation 'org1'")
+	_, err = ta.Accessor.GetAffiliation("org1")
+	assert.Error(t, err, "Soft deleted affiliation 'org1' should not be found")
+	_, err = ta.Accessor.GetAffiliation("org1.dept1")
+	assert.Error(t, err, "Affiliation 'org1.dept1' below a soft deleted affiliation should not be found")
+	tree, err := ta.Accessor.GetAffiliationTree("")
+	assert.NoError(t, err, "Failed to get affiliation tree")
+	assert.Equal(t, 1, len(tree.Affiliations), "Soft deleted affiliations should not be in the affiliation tree")
+
+	err = ta.Accessor.RestoreAffiliation("org1")
+	assert.NoError(t, err, "Failed to restore affiliation 'org1'")
+	_, err = ta.Accessor.GetAffiliation("org1")
+	assert.NoError(t, err, "Restored affiliation 'org1' should be found")
+	aff, err := ta.Accessor.GetAffiliation("org1.dept1")
+	assert.NoError(t, err, "Restored affiliation 'org1.dept1' should be found")
+	assert.Equal(t, "org1", aff.GetPrekey())
+
+	err = ta.Accessor.RestoreAffiliation("unknown")
+	if assert.Error(t, err, "Restoring a non-existent affiliation should have failed") {
+		assert.Contains(t, err.Error(), fmt.Sprintf("code: %d", ErrDBGet))
+	}
+}
+
+func testStreamUsers(ta TestAccessor, t *testing.T) {
+	t.Log("TestStreamUsers")
+	ta.Truncate()
+
+	for i := 0; i < 10; i++ {
+		err := ta.Accessor.InsertUser(&spi.UserInfo{
+			Name:           fmt.Sprintf("streamUser%d", i),
+			Pass:           "123456",
+			Type:           "client",
+			Attributes:     []api.Attribute{},
+			MaxEnrollments: -1,
+		})
+		assert.NoError(t, err, "Failed to insert user")
+	}
+
+	seen := map[string]bool{}
+	err := ta.Accessor.StreamUsers(func(user spi.UserInfo) error {
+		seen[user.Name] = true
+		assert.Equal(t, "client", user.Type, "Incorrect type of streamed user %s", user.Name)
+		return nil
+	})
+	assert.NoError(t, err, "Failed to stream users")
+	assert.Equal(t, 10, len(seen), "Incorrect number of users streamed")
+
+	count := 0
+	err = ta.Accessor.StreamUsers(func(user spi.UserInfo) error {
+		count++
+		if count == 3 {
+			return errors.New("stop streaming")
+		}
+		return nil
+	})
+	if assert.Error(t, err, "Error returned by callback should have been returned") {
+		assert.Equal(t, "stop streaming", err.Error())
+	}
+	assert.Equal(t, 3, count, "Streaming should have stopped when the callback returned an error")
+}
+
+func testGetUserECert(ta TestAccessor, t *testing.T) {
+	t.Log("TestGetUserECert")
+	ta.Truncate()
+
+	err := ta.Accessor.InsertUser(&spi.UserInfo{
+		Name: "ecertUser",
+		Pass: "123456",
+		Type: "client",
+		Attributes: []api.Attribute{
+			{Name: "attr1", Value: "val1", ECert: true},
+			{Name: "attr2", Value: "val2"},
+			{Name: "attr3", Value: "val3", ECert: true},
+		},
+		MaxEnrollments: -1,
+	})
+	assert.NoError(t, err, "Failed to insert user")
+
+	user, err := ta.Accessor.GetUserECert("ecertUser")
+	assert.NoError(t, err, "Failed to get user with ECert attributes")
+	attrs, err := user.GetAttributes(nil)
+	assert.NoError(t, err, "Failed to get attributes of user")
+	assert.Equal(t, 2, len(attrs), "Only attributes with ECert set should be returned")
+	for _, name := range []string{"attr1", "attr3"} {
+		_, err = user.GetAttribute(name)
+		assert.NoError(t, err, "Attribute '%s' with ECert set should be found", name)
+	}
+	_, err = user.GetAttribute("attr2")
+	assert.Error(t, err, "Attribute without ECert set should not be found")
+
+	err = user.ModifyAttributes([]api.Attribute{{Name: "attr4", Value: "val4"}})
+	assert.Error(t, err, "Modifying attributes of a user with only ECert attributes should have failed")
+
+	user, err = ta.Accessor.GetUser("ecertUser", nil)
+	assert.NoError(t, err, "Failed to get user")
+	attrs, err = user.GetAttributes(nil)
+	assert.NoError(t, err, "Failed to get attributes of user")
+	assert.Equal(t, 3, len(attrs), "All attributes should be returned by GetUser")
+
+	_, err = ta.Accessor.GetUserECert("unknownUser")
+	assert.Error(t, err, "Getting a non-existent user should have failed")
+}
+
+func testMoveAffiliation(ta TestAccessor, t *testing.T) {
+	t.Log("TestMoveAffiliation")
+	ta.Truncate()
+
+	affs := [][]string{{"org1", ""}, {"org1.dept1", "org1"}, {"org1.dept1.team1", "org1.dept1"}, {"org2", ""}}
+	for _, aff := range affs {
+		err := ta.Accessor.InsertAffiliation(aff[0], aff[1], 0)
+		assert.NoError(t, err, "Failed to insert affiliation '%s'", aff[0])
+	}
+	err := ta.Accessor.InsertUser(&spi.UserInfo{
+		Name:           "moveUser",
+		Pass:           "123456",
+		Type:           "client",
+		Affiliation:    "org1.dept1.team1",
+		Attributes:     []api.Attribute{{Name: "hf.Affiliation", Value: "org1.dept1.team1"}},
+		MaxEnrollments: -1,
+	})
+	assert.NoError(t, err, "Failed to insert user")
+
+	err = ta.Accessor.MoveAffiliation("org1.dept1", "org2")
+	assert.NoError(t, err, "Failed to move affiliation 'org1.dept1' under 'org2'")
+	_, err = ta.Accessor.GetAffiliation("org1.dept1")
+	assert.Error(t, err, "Moved affiliation should not be found under its old parent")
+	aff, err := ta.Accessor.GetAffiliation("org2.dept1")
+	assert.NoError(t, err, "Failed to get moved affiliation")
+	assert.Equal(t, "org2", aff.GetPrekey(), "Incorrect parent of moved affiliation")
+	aff, err = ta.Accessor.GetAffiliation("org2.dept1.team1")
+	assert.NoError(t, err, "Failed to get affiliation below the moved affiliation")
+	assert.Equal(t, "org2.dept1", aff.GetPrekey(), "Incorrect parent of affiliation below the moved affiliation")
+	user, err := ta.Accessor.GetUser("moveUser", nil)
+	assert.NoError(t, err, "Failed to get user")
+	assert.Equal(t, "org2.dept1.team1", GetUserAffiliation(user), "Affiliation of user was not moved")
+
+	err = ta.Accessor.MoveAffiliation("org2", "org2.dept1.team1")
+	assert.Error(t, err, "Moving an affiliation under its descendant should have failed")
+	err = ta.Accessor.MoveAffiliation("org2", "org2")
+	assert.Error(t, err, "Moving an affiliation under itself should have failed")
+	err = ta.Accessor.MoveAffiliation("org2.dept1", "org3")
+	assert.Error(t, err, "Moving an affiliation under a non-existent parent should have failed")
+
+	err = ta.Accessor.MoveAffiliation("org2.dept1.team1", "")
+	assert.NoError(t, err, "Failed to move affiliation to the root")
+	aff, err = ta.Accessor.GetAffiliation("team1")
+	assert.NoError(t, err, "Failed to get affiliation moved to the root")
+	assert.Equal(t, "", aff.GetPrekey(), "Affiliation moved to the root should not have a parent")
+}
+
+func testCanEnroll(ta TestAccessor, t *testing.T) {
+	t.Log("TestCanEnroll")
+	ta.Truncate()
+	ta.Accessor.MaxIncorrectPasswordAttempts = 1
+	ta.Accessor.LockoutDuration = time.Hour
+	defer func() {
+		ta.Accessor.MaxIncorrectPasswordAttempts = 0
+		ta.Accessor.LockoutDuration = 0
+	}()
+
+	users := []spi.UserInfo{
+		{Name: "canEnroll", MaxEnrollments: 2, State: 1},
+		{Name: "maxReached", MaxEnrollments: 2, State: 2},
+		{Name: "revoked", MaxEnrollments: -1, State: -1},
+		{Name: "locked", MaxEnrollments: -1},
+		{Name: "secretExpired", MaxEnrollments: -1, SecretExpiresAt: time.Now().Add(-time.Hour)},
+	}
+	for _, user := range users {
+		user.Pass = "123456"
+		user.Type = "client"
+		user.Attributes = []api.Attribute{}
+		err := ta.Accessor.InsertUser(&user)
+		assert.NoError(t, err, "Failed to insert user %s", user.Name)
+	}
+	user, err := ta.Accessor.GetUser("locked", nil)
+	assert.NoError(t, err, "Failed to get user")
+	err = user.Login("badpass", -1)
+	assert.Error(t, err, "Login with an incorrect password should have failed")
+
+	ok, reason, err := ta.Accessor.CanEnroll("canEnroll")
+	assert.NoError(t, err)
+	assert.True(t, ok, "User should be allowed to enroll: %s", reason)
+	assert.Empty(t, reason)
+
+	ta.Accessor.CAMaxEnrollments = 1
+	ok, reason, err = ta.Accessor.CanEnroll("canEnroll")
+	ta.Accessor.CAMaxEnrollments = -1
+	assert.NoError(t, err)
+	assert.False(t, ok, "User should not be allowed to enroll past the CA maximum enrollments")
+	assert.Contains(t, reason, "maximum enrollment")
+
+	ok, reason, err = ta.Accessor.CanEnroll("maxReached")
+	assert.NoError(t, err)
+	assert.False(t, ok, "User that reached its maximum enrollments should not be allowed to enroll")
+	assert.Contains(t, reason, "maximum enrollment")
+
+	ok, reason, err = ta.Accessor.CanEnroll("revoked")
+	assert.NoError(t, err)
+	assert.False(t, ok, "Revoked user should not be allowed to enroll")
+	assert.Contains(t, reason, "revoked")
+
+	ok, reason, err = ta.Accessor.CanEnroll("locked")
+	assert.NoError(t, err)
+	assert.False(t, ok, "Locked user should not be allowed to enroll")
+	assert.Contains(t, reason, "locked")
+
+	ok, reason, err = ta.Accessor.CanEnroll("secretExpired")
+	assert.NoError(t, err)
+	assert.False(t, ok, "User with an expired secret should not be allowed to enroll")
+	assert.Contains(t, reason, "expired")
+
+	ok, reason, err = ta.Accessor.CanEnroll("unknownUser")
+	assert.NoError(t, err)
+	assert.False(t, ok, "Non-existent user should not be allowed to enroll")
+	assert.Contains(t, reason, "does not exist")
+
+	user, err = ta.Accessor.GetUser("canEnroll", nil)
+	assert.NoError(t, err, "Failed to get user")
+	assert.Equal(t, 1, user.(*DBUser).State, "CanEnroll should not change the state of the user")
+}
+
+func testIDNormalizer(ta TestAccessor, t *testing.T) {
+	t.Log("TestIDNormalizer")
+	ta.Truncate()
+
+	err := ta.Accessor.InsertUser(&spi.UserInfo{
+		Name:           " alice ",
+		Pass:           "123456",
+		Type:           "client",
+		Attributes:     []api.Attribute{},
+		MaxEnrollments: -1,
+	})
+	assert.NoError(t, err, "Failed to insert user")
+
+	user, err := ta.Accessor.GetUser("alice", nil)
+	assert.NoError(t, err, "Failed to get user by its normalized name")
+	assert.Equal(t, "alice", user.GetName(), "Name of user was not normalized")
+	user, err = ta.Accessor.GetUser(" alice ", nil)
+	assert.NoError(t, err, "Failed to get user by its original name")
+	assert.Equal(t, "alice", user.GetName(), "Name of user was not normalized")
+	err = user.Login("123456", -1)
+	assert.NoError(t, err, "Failed to login user")
+
+	err = ta.Accessor.InsertUser(&spi.UserInfo{
+		Name:           "alice",
+		Pass:           "123456",
+		Type:           "client",
+		Attributes:     []api.Attribute{},
+		MaxEnrollments: -1,
+	})
+	assert.Error(t, err, "Inserting a user with an equivalent name should have failed")
+
+	_, err = ta.Accessor.DeleteUser("alice\t")
+	assert.NoError(t, err, "Failed to delete user by an equivalent name")
+	_, err = ta.Accessor.GetUser("alice", nil)
+	assert.Error(t, err, "User should have been deleted")
+
+	ta.Accessor.IDNormalizer = func(id string) string { return strings.ToLower(strings.TrimSpace(id)) }
+	defer func() { ta.Accessor.IDNormalizer = TrimIDNormalizer }()
+	err = ta.Accessor.InsertUser(&spi.UserInfo{
+		Name:           "Bob",
+		Pass:           "123456",
+		Type:           "client",
+		Attributes:     []api.Attribute{},
+		MaxEnrollments: -1,
+	})
+	assert.NoError(t, err, "Failed to insert user")
+	_, err = ta.Accessor.GetUser(" BOB", nil)
+	assert.NoError(t, err, "Failed to get user with a custom normalizer")
+}
+
+func testGetAffiliationDTO(ta TestAccessor, t *testing.T) {
+	t.Log("TestGetAffiliationDTO")
+	ta.Truncate()
+
+	affs := [][]string{{"org1", ""}, {"org1.dept1", "org1"}, {"org1.dept2", "org1"}, {"org1.dept1.team1", "org1.dept1"}}
+	for _, aff := range affs {
+		err := ta.Accessor.InsertAffiliation(aff[0], aff[1], 0)
+		assert.NoError(t, err, "Failed to insert affiliation '%s'", aff[0])
+	}
+
+	dto, err := ta.Accessor.GetAffiliationDTO("org1.dept1")
+	assert.NoError(t, err, "Failed to get affiliation DTO")
+	dtoJSON, err := json.Marshal(dto)
+	assert.NoError(t, err, "Failed to marshal affiliation DTO")
+	assert.JSONEq(t, `{"name":"dept1","path":"org1.dept1","parent":"org1","childCount":1}`, string(dtoJSON))
+
+	dto, err = ta.Accessor.GetAffiliationDTO("org1")
+	assert.NoError(t, err, "Failed to get affiliation DTO")
+	dtoJSON, err = json.Marshal(dto)
+	assert.NoError(t, err, "Failed to marshal affiliation DTO")
+	assert.JSONEq(t, `{"name":"org1","path":"org1","childCount":2}`, string(dtoJSON))
+
+	_, err = ta.Accessor.GetAffiliationDTO("org2")
+	assert.Error(t, err, "Getting a non-existent affiliation should have failed")
+}
+
+func testTransitionState(ta TestAccessor, t *testing.T) {
+	t.Log("TestTransitionState")
+	ta.Truncate()
+
+	err := ta.Accessor.InsertUser(&spi.UserInfo{
+		Name:           "stateUser",
+		Pass:           "123456",
+		Type:           "client",
+		Attributes:     []api.Attribute{},
+		MaxEnrollments: 2,
+	})
+	assert.NoError(t, err, "Failed to insert user")
+
+	err = ta.Accessor.TransitionState(" stateUser ", 1)
+	assert.NoError(t, err, "Failed to transition state from 0 to 1")
+	err = ta.Accessor.TransitionState("stateUser", EnrollmentStateNotEnrolled)
+	assert.Error(t, err, "Transition of state back to 0 should have failed")
+	err = ta.Accessor.TransitionState("stateUser", 3)
+	assert.Error(t, err, "Skipping a state should have failed")
+	err = ta.Accessor.TransitionState("stateUser", 2)
+	assert.NoError(t, err, "Failed to transition state from 1 to 2")
+	err = ta.Accessor.TransitionState("stateUser", 3)
+	assert.Error(t, err, "Transition of state past the maximum enrollments should have failed")
+
+	user, err := ta.Accessor.GetUser("stateUser", nil)
+	assert.NoError(t, err, "Failed to get user")
+	assert.Equal(t, 2, user.(*DBUser).State, "Incorrect state of user")
+
+	err = ta.Accessor.TransitionState("stateUser", EnrollmentStateRevoked)
+	assert.NoError(t, err, "Failed to revoke user")
+	err = ta.Accessor.TransitionState("stateUser", EnrollmentStateNotEnrolled)
+	assert.Error(t, err, "Transition of state of a revoked user should have failed")
+
+	err = ta.Accessor.TransitionState("unknownUser", 1)
+	assert.Error(t, err, "Transition of state of a non-existent user should have failed")
+}
+
+func testGetRevocationInfo(ta TestAccessor, t *testing.T) {
+	t.Log("TestGetRevocationInfo")
+	ta.Truncate()
+
+	for _, name := range []string{"revokedUser", "activeUser"} {
+		err := ta.Accessor.InsertUser(&spi.UserInfo{
+			Name:           name,
+			Pass:           "123456",
+			Type:           "client",
+			Attributes:     []api.Attribute{},
+			MaxEnrollments: -1,
+		})
+		assert.NoError(t, err, "Failed to insert user %s", name)
+	}
+
+	before := time.Now().Add(-time.Second)
+	user, err := ta.Accessor.GetUser("revokedUser", nil)
+	assert.NoError(t, err, "Failed to get user")
+	err = user.(*DBUser).RevokeWithReason(ocsp.KeyCompromise)
+	assert.NoError(t, err, "Failed to revoke user")
+
+	reason, at, err := ta.Accessor.GetRevocationInfo("revokedUser")
+	assert.NoError(t, err, "Failed to get revocation information")
+	assert.Equal(t, ocsp.KeyCompromise, reason, "Incorrect revocation reason")
+	assert.True(t, at.After(before), "Incorrect revocation time: %s", at)
+
+	reason, at, err = ta.Accessor.GetRevocationInfo("activeUser")
+	assert.NoError(t, err, "Failed to get revocation information")
+	assert.Equal(t, 0, reason, "Active user should not have a revocation reason")
+	assert.True(t, at.IsZero(), "Active user should not have a revocation time")
+
+	_, _, err = ta.Accessor.GetRevocationInfo("unknownUser")
+	assert.Error(t, err, "Getting revocation information of a non-existent user should have failed")
+}
+
+func testCountUsersByType(ta TestAccessor, t *testing.T) {
+	t.Log("TestCountUsersByType")
+	ta.Truncate()
+
+	counts, err := ta.Accessor.CountUsersByType()
+	assert.NoError(t, err, "Failed to count users by type")
+	assert.Empty(t, counts, "No users should be counted in an empty store")
+
+	types := []string{"client", "peer", "client", "orderer", "client", "peer"}
+	for i, userType := range types {
+		err = ta.Accessor.InsertUser(&spi.UserInfo{
+			Name:           fmt.Sprintf("countUser%d", i),
+			Pass:           "123456",
+			Type:           userType,
+			Attributes:     []api.Attribute{},
+			MaxEnrollments: -1,
+		})
+		assert.NoError(t, err, "Failed to insert user")
+	}
+
+	counts, err = ta.Accessor.CountUsersByType()
+	assert.NoError(t, err, "Failed to count users by type")
+	assert.Equal(t, map[string]int{"client": 3, "peer": 2, "orderer": 1}, counts)
+}
+
+func testReparentOrphans(ta TestAccessor, t *testing.T) {
+	t.Log("TestReparentOrphans")
+	ta.Truncate()
+
+	affs := [][]string{{"org1", ""}, {"org1.dept1", "org1"}, {"gone.dept2", "gone"}, {"gone.dept2.team1", "gone.dept2"}, {"lost.dept3", "lost"}}
+	for _, aff := range affs {
+		err := ta.Accessor.InsertAffiliation(aff[0], aff[1], 0)
+		assert.NoError(t, err, "Failed to insert affiliation '%s'", aff[0])
+	}
+
+	orphans, err := ta.Accessor.FindOrphanAffiliations()
+	assert.NoError(t, err, "Failed to find orphan affiliations")
+	names := []string{}
+	for _, orphan := range orphans {
+		names = append(names, orphan.GetName())
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"gone.dept2", "lost.dept3"}, names, "Incorrect orphan affiliations")
+
+	_, err = ta.Accessor.ReparentOrphans("org2")
+	assert.Error(t, err, "Reparenting orphans under a non-existent affiliation should have failed")
+
+	count, err := ta.Accessor.ReparentOrphans("org1")
+	assert.NoError(t, err, "Failed to reparent orphan affiliations")
+	assert.Equal(t, 2, count, "Incorrect number of orphan affiliations reparented")
+
+	orphans, err = ta.Accessor.FindOrphanAffiliations()
+	assert.NoError(t, err, "Failed to find orphan affiliations")
+	assert.Empty(t, orphans, "No orphan affiliations should remain")
+	aff, err := ta.Accessor.GetAffiliation("org1.dept2.team1")
+	assert.NoError(t, err, "Affiliation below an orphan should have been moved with it")
+	assert.Equal(t, "org1.dept2", aff.GetPrekey())
+	aff, err = ta.Accessor.GetAffiliation("org1.dept3")
+	assert.NoError(t, err, "Failed to get reparented affiliation")
+	assert.Equal(t, "org1", aff.GetPrekey())
+}
+
+func testHTTPStatusForError(ta TestAccessor, t *testing.T) {
+	t.Log("TestHTTPStatusForError")
+	ta.Truncate()
+
+	insert := spi.UserInfo{
+		Name:           "statusUser",
+		Pass:           "123456",
+		Type:           "client",
+		Attributes:     []api.Attribute{},
+		MaxEnrollments: -1,
+	}
+	err := ta.Accessor.InsertUser(&insert)
+	assert.NoError(t, err, "Failed to insert user")
+	assert.Equal(t, 200, HTTPStatusForError(err))
+
+	err = ta.Accessor.InsertUser(nil)
+	assert.Equal(t, 400, HTTPStatusForError(err), "Inserting an undefined user is an invalid request: %s", err)
+	err = ta.Accessor.InsertUser(&insert)
+	assert.Equal(t, 400, HTTPStatusForError(err), "Inserting a duplicate user is an invalid request: %s", err)
+	err = ta.Accessor.UpdateField("statusUser", FieldType, 1)
+	assert.Equal(t, 400, HTTPStatusForError(err), "Updating a field with the wrong type is an invalid request: %s", err)
+	_, err = ta.Accessor.ResetAllEnrollments(false)
+	assert.Equal(t, 400, HTTPStatusForError(err), "Resetting enrollments without confirmation is an invalid request: %s", err)
+
+	_, err = ta.Accessor.GetUser("unknownUser", nil)
+	assert.Equal(t, 404, HTTPStatusForError(err), "Getting a non-existent user should not be found: %s", err)
+	err = ta.Accessor.UpdateField("unknownUser", FieldType, "peer")
+	assert.Equal(t, 404, HTTPStatusForError(err), "Updating a non-existent user should not be found: %s", err)
+	_, err = ta.Accessor.GetAffiliation("unknownAffiliation")
+	assert.Equal(t, 404, HTTPStatusForError(err), "Getting a non-existent affiliation should not be found: %s", err)
+
+	assert.Equal(t, 404, HTTPStatusForError(errors.Wrap(err, "wrapped")), "Wrapped errors should keep their status code")
+
+	_, err = NewDBAccessor(nil).GetUser("statusUser", nil)
+	assert.Equal(t, 500, HTTPStatusForError(err), "Accessor without a database is a server error: %s", err)
+	assert.Equal(t, 500, HTTPStatusForError(errors.New("plain error")), "Errors without a status code are server errors")
+}
+
+func testVacuum(ta TestAccessor, t *testing.T) {
+	t.Log("TestVacuum")
+	ta.Truncate()
+
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("vacuumUser%d", i)
+		err := ta.Accessor.InsertUser(&spi.UserInfo{
+			Name:           name,
+			Pass:           "123456",
+			Type:           "client",
+			Attributes:     []api.Attribute{},
+			MaxEnrollments: -1,
+		})
+		assert.NoError(t, err, "Failed to insert user %s", name)
+		_, err = ta.Accessor.DeleteUser(name)
+		assert.NoError(t, err, "Failed to delete user %s", name)
+	}
+
+	err := ta.Accessor.Vacuum()
+	assert.NoError(t, err, "Failed to vacuum database")
+
+	err = NewDBAccessor(nil).Vacuum()
+	assert.Error(t, err, "Vacuum without a database should have failed")
+}
+
+func testGetAttributeCount(ta TestAccessor, t *testing.T) {
+	t.Log("TestGetAttributeCount")
+	ta.Truncate()
+
+	insert := spi.UserInfo{
+		Name:           "countAttrUser",
+		Pass:           "123456",
+		Type:           "client",
+		Attributes:     []api.Attribute{{Name: "attr1", Value: "val1"}, {Name: "attr2", Value: "val2"}},
+		MaxEnrollments: -1,
+	}
+	err := ta.Accessor.InsertUser(&insert)
+	assert.NoError(t, err, "Failed to insert user")
+	count, err := ta.Accessor.GetAttributeCount("countAttrUser")
+	assert.NoError(t, err, "Failed to get attribute count")
+	assert.Equal(t, 2, count, "Incorrect attribute count after insert")
+
+	user, err := ta.Accessor.GetUser("countAttrUser", nil)
+	assert.NoError(t, err, "Failed to get user")
+	err = user.ModifyAttributes([]api.Attribute{{Name: "attr3", Value: "val3"}})
+	assert.NoError(t, err, "Failed to add attribute")
+	count, err = ta.Accessor.GetAttributeCount("countAttrUser")
+	assert.NoError(t, err, "Failed to get attribute count")
+	assert.Equal(t, 3, count, "Incorrect attribute count after adding an attribute")
+
+	insert.Attributes = []api.Attribute{{Name: "attr1", Value: "val1"}}
+	err = ta.Accessor.UpdateUser(&insert, false)
+	assert.NoError(t, err, "Failed to update user")
+	count, err = ta.Accessor.GetAttributeCount("countAttrUser")
+	assert.NoError(t, err, "Failed to get attribute count")
+	assert.Equal(t, 1, count, "Incorrect attribute count after update")
+
+	// Users written before the count was maintained have their attributes decoded
+	_, err = ta.DB.Exec("UPDATE users SET attr_count = NULL")
+	assert.NoError(t, err, "Failed to clear attribute count")
+	count, err = ta.Accessor.GetAttributeCount("countAttrUser")
+	assert.NoError(t, err, "Failed to get attribute count")
+	assert.Equal(t, 1, count, "Incorrect attribute count without a recorded count")
+
+	_, err = ta.Accessor.GetAttributeCount("unknownUser")
+	assert.Error(t, err, "Getting attribute count of a non-existent user should have failed")
+}
+
+func testUserExpiry(ta TestAccessor, t *testing.T) {
+	t.Log("TestUserExpiry")
+	ta.Truncate()
+
+	expiries := map[string]time.Time{
+		"unexpiredUser": time.Now().Add(time.Hour),
+		"expiredUser":   time.Now().Add(-time.Hour),
+		"noExpiryUser":  time.Time{},
+	}
+	for name, expiresAt := range expiries {
+		err := ta.Accessor.InsertUser(&spi.UserInfo{
+			Name:           name,
+			Pass:           "123456",
+			Type:           "client",
+			Attributes:     []api.Attribute{},
+			MaxEnrollments: -1,
+			ExpiresAt:      expiresAt,
+		})
+		assert.NoError(t, err, "Failed to insert user %s", name)
+	}
+
+	for _, name := range []string{"unexpiredUser", "noExpiryUser"} {
+		user, err := ta.Accessor.GetUser(name, nil)
+		assert.NoError(t, err, "Failed to get user %s", name)
+		err = user.Login("123456", -1)
+		assert.NoError(t, err, "Login of user %s that has not expired should have succeeded", name)
+	}
+	user, err := ta.Accessor.GetUser("expiredUser", nil)
+	assert.NoError(t, err, "Failed to get user")
+	err = user.Login("123456", -1)
+	if assert.Error(t, err, "Login of an expired user should have failed") {
+		assert.Contains(t, err.Error(), "expired")
+	}
+
+	expired, err := ta.Accessor.GetExpiredUsers()
+	assert.NoError(t, err, "Failed to get expired users")
+	if assert.Equal(t, 1, len(expired), "Incorrect number of expired users") {
+		assert.Equal(t, "expiredUser", expired[0].Name)
+	}
+}
+
+func testDeleteAffiliationWithMembers(ta TestAccessor, t *testing.T) {
+	t.Log("TestDeleteAffiliationWithMembers")
+	ta.Truncate()
+
+	affs := [][]string{{"org1", ""}, {"org1.dept1", "org1"}, {"org2", ""}}
+	for _, aff := range affs {
+		err := ta.Accessor.InsertAffiliation(aff[0], aff[1], 0)
+		assert.NoError(t, err, "Failed to insert affiliation '%s'", aff[0])
+	}
+	members := map[string]string{"member1": "org1", "member2": "org1.dept1", "member3": "org2"}
+	for name, aff := range members {
+		err := ta.Accessor.InsertUser(&spi.UserInfo{
+			Name:           name,
+			Pass:           "123456",
+			Type:           "client",
+			Affiliation:    aff,
+			Attributes:     []api.Attribute{},
+			MaxEnrollments: -1,
+		})
+		assert.NoError(t, err, "Failed to insert user %s", name)
+	}
+
+	// Make deleting the affiliations fail after the identities were deleted
+	_, err := ta.DB.Exec("CREATE TRIGGER fail_delete_affiliation BEFORE DELETE ON affiliations BEGIN SELECT RAISE(ABORT, 'induced failure'); END")
+	assert.NoError(t, err, "Failed to create trigger")
+	_, _, err = ta.Accessor.DeleteAffiliationWithMembers("org1")
+	assert.Error(t, err, "Deleting affiliation should have failed")
+	_, err = ta.DB.Exec("DROP TRIGGER fail_delete_affiliation")
+	assert.NoError(t, err, "Failed to drop trigger")
+	for _, name := range []string{"member1", "member2"} {
+		_, err = ta.Accessor.GetUser(name, nil)
+		assert.NoError(t, err, "User %s should not have been deleted by a failed transaction", name)
+	}
+
+	usersDeleted, affsDeleted, err := ta.Accessor.DeleteAffiliationWithMembers("org1")
+	assert.NoError(t, err, "Failed to delete affiliation with its members")
+	assert.Equal(t, 2, usersDeleted, "Incorrect number of users deleted")
+	assert.Equal(t, 2, affsDeleted, "Incorrect number of affiliations deleted")
+	for _, name := range []string{"member1", "member2"} {
+		_, err = ta.Accessor.GetUser(name, nil)
+		assert.Error(t, err, "User %s should have been deleted", name)
+	}
+	_, err = ta.Accessor.GetAffiliation("org1.dept1")
+	assert.Error(t, err, "Affiliation below the deleted affiliation should have been deleted")
+	_, err = ta.Accessor.GetUser("member3", nil)
+	assert.NoError(t, err, "User in another affiliation should not have been deleted")
+}
+
+func testListUsersAfter(ta TestAccessor, t *testing.T) {
+	t.Log("TestListUsersAfter")
+	ta.Truncate()
+
+	expected := []string{}
+	for i := 0; i < 7; i++ {
+		name := fmt.Sprintf("pageUser%d", i)
+		expected = append(expected, name)
+		err := ta.Accessor.InsertUser(&spi.UserInfo{
+			Name:           name,
+			Pass:           "123456",
+			Type:           "client",
+			Attributes:     []api.Attribute{},
+			MaxEnrollments: -1,
+		})
+		assert.NoError(t, err, "Failed to insert user %s", name)
+	}
+
+	names := []string{}
+	pages := 0
+	cursor := ""
+	for {
+		users, next, err := ta.Accessor.ListUsersAfter(cursor, 3)
+		assert.NoError(t, err, "Failed to list users")
+		pages++
+		for _, user := range users {
+			names = append(names, user.Name)
+		}
+		if next == "" || pages > 3 {
+			break
+		}
+		assert.Equal(t, 3, len(users), "Incorrect number of users on a page that is not the last")
+		cursor = next
+	}
+	assert.Equal(t, 3, pages, "Incorrect number of pages")
+	assert.Equal(t, expected, names, "Pages should return every user once in order")
+
+	users, next, err := ta.Accessor.ListUsersAfter("", 7)
+	assert.NoError(t, err, "Failed to list users")
+	assert.Equal(t, 7, len(users))
+	assert.Empty(t, next, "Cursor should be empty when all users fit on one page")
+
+	_, _, err = ta.Accessor.ListUsersAfter("", 0)
+	assert.Error(t, err, "Listing users with a limit of zero should have failed")
+}
+
+func testDefaultUserType(ta TestAccessor, t *testing.T) {
+	t.Log("TestDefaultUserType")
+	ta.Truncate()
+
+	for name, userType := range map[string]string{"noTypeUser": "", "peerUser": "peer"} {
+		err := ta.Accessor.InsertUser(&spi.UserInfo{
+			Name:           name,
+			Pass:           "123456",
+			Type:           userType,
+			Attributes:     []api.Attribute{},
+			MaxEnrollments: -1,
+		})
+		assert.NoError(t, err, "Failed to insert user %s", name)
+	}
+
+	user, err := ta.Accessor.GetUser("noTypeUser", nil)
+	assert.NoError(t, err, "Failed to get user")
+	assert.Equal(t, "client", user.GetType(), "Default type should have been applied")
+	user, err = ta.Accessor.GetUser("peerUser", nil)
+	assert.NoError(t, err, "Failed to get user")
+	assert.Equal(t, "peer", user.GetType(), "Explicit type should have been respected")
+}
+
+func testGetUserDetail(ta TestAccessor, t *testing.T) {
+	t.Log("TestGetUserDetail")
+	ta.Truncate()
+
+	before := time.Now().Add(-time.Second)
+	err := ta.Accessor.InsertUser(&spi.UserInfo{
+		Name:           "detailUser",
+		Pass:           "123456",
+		Type:           "client",
+		Affiliation:    "org1",
+		Attributes:     []api.Attribute{{Name: "attr1", Value: "val1"}},
+		MaxEnrollments: -1,
+		CreatedBy:      "admin",
+		ExpiresAt:      time.Now().Add(time.Hour),
+	})
+	assert.NoError(t, err, "Failed to insert user")
+	user, err := ta.Accessor.GetUser("detailUser", nil)
+	assert.NoError(t, err, "Failed to get user")
+	err = user.(*DBUser).RevokeWithReason(ocsp.Superseded)
+	assert.NoError(t, err, "Failed to revoke user")
+
+	detail, err := ta.Accessor.GetUserDetail("detailUser")
+	assert.NoError(t, err, "Failed to get user detail")
+	assert.Equal(t, "detailUser", detail.Name)
+	assert.Equal(t, "org1", detail.Affiliation)
+	assert.Empty(t, detail.Pass, "Password should not be returned")
+	assert.Equal(t, "admin", detail.CreatedBy)
+	assert.True(t, detail.CreatedAt.After(before), "Incorrect creation time: %s", detail.CreatedAt)
+	assert.True(t, detail.ExpiresAt.After(time.Now()), "Incorrect expiry time: %s", detail.ExpiresAt)
+	assert.True(t, detail.RevokedAt.After(before), "Incorrect revocation time: %s", detail.RevokedAt)
+	assert.Equal(t, ocsp.Superseded, detail.RevocationReason)
+	assert.True(t, detail.LockedUntil.IsZero(), "User that was never locked should have a zero lock time")
+
+	// Rows written before the timestamp columns existed have NULL timestamps
+	_, err = ta.DB.Exec("INSERT INTO users (id, token, type, affiliation, attributes, state, max_enrollments, level) VALUES ('oldUser', '', 'client', 'org1', '[]', 0, -1, 0)")
+	assert.NoError(t, err, "Failed to insert user without timestamps")
+	detail, err = ta.Accessor.GetUserDetail("oldUser")
+	assert.NoError(t, err, "Failed to get detail of user without timestamps")
+	assert.True(t, detail.CreatedAt.IsZero(), "NULL creation time should be zero")
+	assert.True(t, detail.ExpiresAt.IsZero(), "NULL expiry time should be zero")
+	assert.True(t, detail.RevokedAt.IsZero(), "NULL revocation time should be zero")
+	assert.Empty(t, detail.CreatedBy)
+
+	_, err = ta.Accessor.GetUserDetail("unknownUser")
+	assert.Error(t, err, "Getting detail of a non-existent user should have failed")
+}
+
+func testRegisterWithSecret(ta TestAccessor, t *testing.T) {
+	t.Log("TestRegisterWithSecret")
+	ta.Truncate()
+
+	secret, err := ta.Accessor.RegisterWithSecret(spi.UserInfo{
+		Name:           "onboarded",
+		Type:           "client",
+		Affiliation:    "org1",
+		MaxEnrollments: -1,
+	})
+	assert.NoError(t, err, "Failed to register user with generated secret")
+	assert.NotEmpty(t, secret, "Generated secret should not be empty")
+
+	user, err := ta.Accessor.GetUser("onboarded", nil)
+	assert.NoError(t, err, "Failed to get registered user")
+	err = user.Login(secret, -1)
+	assert.NoError(t, err, "Generated secret should authenticate the user")
+	err = user.Login(secret+"x", -1)
+	assert.Error(t, err, "Login with an incorrect secret should have failed")
+
+	_, err = ta.Accessor.RegisterWithSecret(spi.UserInfo{Name: "onboarded", Affiliation: "org1"})
+	assert.Error(t, err, "Registering an existing user should have failed")
+	user, err = ta.Accessor.GetUser("onboarded", nil)
+	assert.NoError(t, err, "Failed to get registered user")
+	err = user.Login(secret, -1)
+	assert.NoError(t, err, "Failed registration should not have changed the secret")
+}
+
+func testUpdateAffiliationParent(ta TestAccessor, t *testing.T) {
+	t.Log("TestUpdateAffiliationParent")
+	ta.Truncate()
+
+	err := ta.Accessor.InsertAffiliation("org1", "", 0)
+	assert.NoError(t, err, "Failed to insert affiliation org1")
+	err = ta.Accessor.InsertAffiliation("org1.dept1", "org1", 1)
+	assert.NoError(t, err, "Failed to insert affiliation org1.dept1")
+	err = ta.Accessor.InsertAffiliation("org1.dept1.team1", "org1.dept1", 2)
+	assert.NoError(t, err, "Failed to insert affiliation org1.dept1.team1")
+	err = ta.Accessor.InsertAffiliation("org2", "", 0)
+	assert.NoError(t, err, "Failed to insert affiliation org2")
+
+	err = ta.Accessor.UpdateAffiliationParent("org1.dept1", "org2")
+	assert.NoError(t, err, "Failed to update parent of affiliation")
+	aff, err := ta.Accessor.GetAffiliation("org1.dept1")
+	assert.NoError(t, err, "Failed to get affiliation")
+	assert.Equal(t, "org2", aff.GetPrekey())
+	_, err = ta.Accessor.GetAffiliation("org1.dept1.team1")
+	assert.NoError(t, err, "Child affiliation should not have been renamed")
+
+	err = ta.Accessor.UpdateAffiliationParent("org1.dept1", "org3")
+	assert.Error(t, err, "Updating parent to a non-existent affiliation should have failed")
+	assert.Contains(t, err.Error(), fmt.Sprintf("code: %d", ErrParentAffiliationNotFound))
+
+	err = ta.Accessor.UpdateAffiliationParent("org2", "org1.dept1.team1")
+	assert.Error(t, err, "Updating parent to a descendant should have failed")
+	assert.Contains(t, err.Error(), fmt.Sprintf("code: %d", ErrAffiliationCycle))
+	err = ta.Accessor.UpdateAffiliationParent("org2", "org2")
+	assert.Error(t, err, "Updating parent to itself should have failed")
+	assert.Contains(t, err.Error(), fmt.Sprintf("code: %d", ErrAffiliationCycle))
+	aff, err = ta.Accessor.GetAffiliation("org2")
+	assert.NoError(t, err, "Failed to get affiliation")
+	assert.Equal(t, "", aff.GetPrekey(), "Failed update should not have changed the parent")
+
+	err = ta.Accessor.UpdateAffiliationParent("org1.dept1", "")
+	assert.NoError(t, err, "Failed to make affiliation a root affiliation")
+	aff, err = ta.Accessor.GetAffiliation("org1.dept1")
+	assert.NoError(t, err, "Failed to get affiliation")
+	assert.Equal(t, "", aff.GetPrekey())
+}
+
+func testPatchUserAttributes(ta TestAccessor, t *testing.T) {
+	t.Log("TestPatchUserAttributes")
+	ta.Truncate()
+
+	err := ta.Accessor.InsertUser(&spi.UserInfo{
+		Name:        "patchUser",
+		Pass:        "123456",
+		Type:        "client",
+		Affiliation: "org1",
+		Attributes: []api.Attribute{
+			{Name: "attr1", Value: "val1"},
+			{Name: "attr2", Value: "val2"},
+		},
+	})
+	assert.NoError(t, err, "Failed to insert user")
+
+	getAttrs := func() []api.Attribute {
+		user, err := ta.Accessor.GetUser("patchUser", nil)
+		assert.NoError(t, err, "Failed to get user")
+		attrs, err := user.GetAttributes(nil)
+		assert.NoError(t, err, "Failed to get attributes")
+		sort.Slice(attrs, func(i, j int) bool { return attrs[i].Name < attrs[j].Name })
+		return attrs
+	}
+
+	err = ta.Accessor.PatchUserAttributes("patchUser", []byte(`[{"op": "add", "path": "/-", "value": {"name": "attr3", "value": "val3", "ecert": true}}]`))
+	assert.NoError(t, err, "Failed to add attribute")
+	assert.Equal(t, []api.Attribute{{Name: "attr1", Value: "val1"}, {Name: "attr2", Value: "val2"}, {Name: "attr3", Value: "val3", ECert: true}}, getAttrs())
+
+	err = ta.Accessor.PatchUserAttributes("patchUser", []byte(`[{"op": "replace", "path": "/1/value", "value": "newval2"}]`))
+	assert.NoError(t, err, "Failed to replace attribute value")
+	assert.Equal(t, []api.Attribute{{Name: "attr1", Value: "val1"}, {Name: "attr2", Value: "newval2"}, {Name: "attr3", Value: "val3", ECert: true}}, getAttrs())
+
+	err = ta.Accessor.PatchUserAttributes("patchUser", []byte(`[{"op": "test", "path": "/0/name", "value": "attr1"}, {"op": "remove", "path": "/0"}]`))
+	assert.NoError(t, err, "Failed to remove attribute")
+	assert.Equal(t, []api.Attribute{{Name: "attr2", Value: "newval2"}, {Name: "attr3", Value: "val3", ECert: true}}, getAttrs())
+	count, err := ta.Accessor.GetAttributeCount("patchUser")
+	assert.NoError(t, err, "Failed to get attribute count")
+	assert.Equal(t, 2, count)
+
+	invalidPatches := []string{
+		`not json`,
+		`[{"op": "remove", "path": "/5"}]`,
+		`[{"op": "unknown", "path": "/0"}]`,
+		`[{"op": "add", "path": "/-"}]`,
+		`[{"op": "test", "path": "/0/name", "value": "attr1"}, {"op": "remove", "path": "/0"}]`,
+		`[{"op": "replace", "path": "/0/name", "value": "attr3"}]`,
+		`[{"op": "replace", "path": "", "value": {"name": "attr1"}}]`,
+	}
+	for _, patch := range invalidPatches {
+		err = ta.Accessor.PatchUserAttributes("patchUser", []byte(patch))
+		if assert.Error(t, err, "Applying patch %s should have failed", patch) {
+			assert.Contains(t, err.Error(), fmt.Sprintf("code: %d", ErrInvalidRequest))
+		}
+	}
+	assert.Equal(t, []api.Attribute{{Name: "attr2", Value: "newval2"}, {Name: "attr3", Value: "val3", ECert: true}}, getAttrs(), "Failed patches should not have changed the attributes")
+
+	err = ta.Accessor.PatchUserAttributes("unknownUser", []byte(`[]`))
+	assert.Error(t, err, "Patching attributes of a non-existent user should have failed")
+}
+
+func testListAffiliations(ta TestAccessor, t *testing.T) {
+	t.Log("TestListAffiliations")
+	ta.Truncate()
+
+	names := []string{}
+	for i := 0; i < 12; i++ {
+		name := fmt.Sprintf("org%02d", i)
+		err := ta.Accessor.InsertAffiliation(name, "", 0)
+		assert.NoError(t, err, "Failed to insert affiliation %s", name)
+		names = append(names, name)
+	}
+
+	listed := []string{}
+	for offset := 0; ; offset += 5 {
+		affs, err := ta.Accessor.ListAffiliations(offset, 5)
+		assert.NoError(t, err, "Failed to list affiliations at offset %d", offset)
+		if len(affs) == 0 {
+			break
+		}
+		assert.True(t, len(affs) <= 5, "Page has more affiliations than the limit")
+		for _, aff := range affs {
+			listed = append(listed, aff.GetName())
+		}
+	}
+	assert.Equal(t, names, listed, "Pages should contain every affiliation once, in order")
+
+	affs, err := ta.Accessor.ListAffiliations(10, 5)
+	assert.NoError(t, err, "Failed to list last page of affiliations")
+	assert.Len(t, affs, 2)
+
+	affs, err = ta.Accessor.ListAffiliations(100, 5)
+	assert.NoError(t, err, "Listing past the last affiliation should not fail")
+	assert.NotNil(t, affs)
+	assert.Empty(t, affs)
+
+	_, err = ta.Accessor.ListAffiliations(0, 0)
+	assert.Error(t, err, "Listing with a zero limit should have failed")
+	_, err = ta.Accessor.ListAffiliations(-1, 5)
+	assert.Error(t, err, "Listing with a negative offset should have failed")
+}
+
+func testStats(ta TestAccessor, t *testing.T) {
+	t.Log("TestStats")
+	ta.Truncate()
+
+	stats, err := ta.Accessor.Stats()
+	assert.NoError(t, err, "Failed to get stats of empty registry")
+	assert.Equal(t, &AccessorStats{Driver: "sqlite3"}, stats)
+
+	for _, name := range []string{"org1", "org2", "org3"} {
+		err = ta.Accessor.InsertAffiliation(name, "", 0)
+		assert.NoError(t, err, "Failed to insert affiliation %s", name)
+	}
+	err = ta.Accessor.SoftDeleteAffiliation("org3")
+	assert.NoError(t, err, "Failed to soft delete affiliation")
+	for i, state := range []int{0, 1, 2, -1} {
+		err = ta.Accessor.InsertUser(&spi.UserInfo{
+			Name:        fmt.Sprintf("user%d", i),
+			Pass:        "123456",
+			Affiliation: "org1",
+			State:       state,
+		})
+		assert.NoError(t, err, "Failed to insert user")
+	}
+
+	stats, err = ta.Accessor.Stats()
+	assert.NoError(t, err, "Failed to get stats")
+	assert.Equal(t, &AccessorStats{Users: 4, Affiliations: 2, Enrolled: 2, Driver: "sqlite3"}, stats)
+}
+
+func testGetTypedAttribute(ta TestAccessor, t *testing.T) {
+	t.Log("TestGetTypedAttribute")
+	ta.Truncate()
+
+	err := ta.Accessor.InsertUser(&spi.UserInfo{
+		Name:        "typedUser",
+		Pass:        "123456",
+		Affiliation: "org1",
+		Attributes: []api.Attribute{
+			{Name: "hf.Revoker", Value: "true"},
+			{Name: "quota", Value: "42"},
+			{Name: "ratio", Value: "0.5"},
+			{Name: "badQuota", Value: "many"},
+			{Name: "dept", Value: "sales"},
+		},
+	})
+	assert.NoError(t, err, "Failed to insert user")
+
+	accessor := ta.Accessor
+	defer func() { accessor.AttributeTypes = nil }()
+	accessor.AttributeTypes = map[string]AttributeType{
+		"hf.Revoker": AttributeTypeBool,
+		"quota":      AttributeTypeInt,
+		"ratio":      AttributeTypeFloat,
+		"badQuota":   AttributeTypeInt,
+	}
+
+	value, err := accessor.GetTypedAttribute("typedUser", "hf.Revoker")
+	assert.NoError(t, err, "Failed to get boolean attribute")
+	assert.Equal(t, true, value)
+	value, err = accessor.GetTypedAttribute("typedUser", "quota")
+	assert.NoError(t, err, "Failed to get integer attribute")
+	assert.Equal(t, int64(42), value)
+	value, err = accessor.GetTypedAttribute("typedUser", "ratio")
+	assert.NoError(t, err, "Failed to get floating point attribute")
+	assert.Equal(t, 0.5, value)
+	value, err = accessor.GetTypedAttribute("typedUser", "badQuota")
+	assert.NoError(t, err, "Failed to get attribute that does not have its declared type")
+	assert.Equal(t, "many", value)
+	value, err = accessor.GetTypedAttribute("typedUser", "dept")
+	assert.NoError(t, err, "Failed to get attribute without a declared type")
+	assert.Equal(t, "sales", value)
+
+	_, err = accessor.GetTypedAttribute("typedUser", "missing")
+	assert.Error(t, err, "Getting a missing attribute should have failed")
+	_, err = accessor.GetTypedAttribute("unknownUser", "quota")
+	assert.Error(t, err, "Getting an attribute of a non-existent user should have failed")
+}
+
+func testInsertUserIdempotent(ta TestAccessor, t *testing.T) {
+	t.Log("TestInsertUserIdempotent")
+	ta.Truncate()
+
+	user := spi.UserInfo{
+		Name:        "idemUser",
+		Pass:        "123456",
+		Affiliation: "org1",
+	}
+	created, err := ta.Accessor.InsertUserIdempotent(user, "key1")
+	assert.NoError(t, err, "Failed to insert user")
+	assert.True(t, created, "First request should have inserted the user")
+
+	created, err = ta.Accessor.InsertUserIdempotent(user, "key1")
+	assert.NoError(t, err, "Retried request should not fail")
+	assert.False(t, created, "Retried request should not have inserted the user")
+
+	user2 := user
+	user2.Name = "idemUser2"
+	created, err = ta.Accessor.InsertUserIdempotent(user2, "key1")
+	assert.NoError(t, err, "Request with a seen key should not fail")
+	assert.False(t, created, "Request with a seen key should not have inserted a user")
+	_, err = ta.Accessor.GetUser("idemUser2", nil)
+	assert.Error(t, err, "User should not have been inserted for a seen key")
+
+	created, err = ta.Accessor.InsertUserIdempotent(user2, "key2")
+	assert.NoError(t, err, "Failed to insert user with a different key")
+	assert.True(t, created, "Request with a different key should have inserted the user")
+
+	_, err = ta.Accessor.InsertUserIdempotent(user, "key2")
+	assert.NoError(t, err, "Request with a seen key should not fail")
+	_, err = ta.Accessor.InsertUserIdempotent(user, "key3")
+	assert.Error(t, err, "New request for an existing user should have failed")
+
+	// Once the key expires, it is no longer recognized
+	_, err = ta.DB.Exec("UPDATE users SET created_at = ? WHERE (id = 'idemUser')", time.Now().Add(-48*time.Hour).UTC())
+	assert.NoError(t, err, "Failed to update creation time")
+	user3 := user
+	user3.Name = "idemUser3"
+	created, err = ta.Accessor.InsertUserIdempotent(user3, "key1")
+	assert.NoError(t, err, "Failed to insert user with an expired key")
+	assert.True(t, created, "Request with an expired key should have inserted the user")
+
+	_, err = ta.Accessor.InsertUserIdempotent(user, "")
+	assert.Error(t, err, "Request without a key should have failed")
+}
+
+func testUserHasAttribute(ta TestAccessor, t *testing.T) {
+	t.Log("TestUserHasAttribute")
+	ta.Truncate()
+
+	err := ta.Accessor.InsertUser(&spi.UserInfo{
+		Name:        "attrUser",
+		Pass:        "123456",
+		Affiliation: "org1",
+		Attributes:  []api.Attribute{{Name: "role", Value: "auditor"}},
+	})
+	assert.NoError(t, err, "Failed to insert user")
+
+	has, err := ta.Accessor.UserHasAttribute("attrUser", "role", []string{"admin", "auditor"})
+	assert.NoError(t, err, "Failed to check matching attribute")
+	assert.True(t, has, "User should have attribute with an allowed value")
+
+	has, err = ta.Accessor.UserHasAttribute("attrUser", "role", []string{"admin"})
+	assert.NoError(t, err, "Failed to check non-matching attribute")
+	assert.False(t, has, "User attribute value is not allowed")
+
+	has, err = ta.Accessor.UserHasAttribute("attrUser", "dept", []string{"auditor"})
+	assert.NoError(t, err, "Failed to check absent attribute")
+	assert.False(t, has, "User does not have the attribute")
+
+	_, err = ta.Accessor.UserHasAttribute("unknownUser", "role", []string{"auditor"})
+	assert.Error(t, err, "Checking attribute of a non-existent user should have failed")
+}
+
+func testMigrateAttributeFormat(ta TestAccessor, t *testing.T) {
+	t.Log("TestMigrateAttributeFormat")
+	ta.Truncate()
+
+	currentAttrs := []api.Attribute{{Name: "attr1", Value: "val1", ECert: true}}
+	err := ta.Accessor.InsertUser(&spi.UserInfo{
+		Name:        "currentUser",
+		Pass:        "123456",
+		Affiliation: "org1",
+		Attributes:  currentAttrs,
+	})
+	assert.NoError(t, err, "Failed to insert user")
+	_, err = ta.DB.Exec(`INSERT INTO users (id, token, type, affiliation, attributes, state, max_enrollments, level) VALUES ('legacyUser', '', 'client', 'org1', '{"role": "auditor", "hf.Revoker": "true", "quota": 5}', 0, -1, 0)`)
+	assert.NoError(t, err, "Failed to insert user with legacy attributes")
+
+	migrated, err := ta.Accessor.MigrateAttributeFormat()
+	assert.NoError(t, err, "Failed to migrate attributes")
+	assert.Equal(t, 1, migrated, "Only the legacy user should have been migrated")
+
+	user, err := ta.Accessor.GetUser("legacyUser", nil)
+	assert.NoError(t, err, "Failed to get migrated user")
+	attr, err := user.GetAttribute("role")
+	assert.NoError(t, err, "Migrated user should have attribute role")
+	assert.Equal(t, "auditor", attr.Value)
+	attr, err = user.GetAttribute("quota")
+	assert.NoError(t, err, "Migrated user should have attribute quota")
+	assert.Equal(t, "5", attr.Value)
+	count, err := ta.Accessor.GetAttributeCount("legacyUser")
+	assert.NoError(t, err, "Failed to get attribute count")
+	assert.Equal(t, 3, count)
+
+	user, err = ta.Accessor.GetUser("currentUser", nil)
+	assert.NoError(t, err, "Failed to get current user")
+	attrs, err := user.GetAttributes(nil)
+	assert.NoError(t, err, "Failed to get attributes")
+	assert.Equal(t, currentAttrs, attrs, "Current format attributes should be unchanged")
+
+	migrated, err = ta.Accessor.MigrateAttributeFormat()
+	assert.NoError(t, err, "Failed to migrate attributes again")
+	assert.Equal(t, 0, migrated, "Migration should be idempotent")
+}
+
+func testGetUserFields(ta TestAccessor, t *testing.T) {
+	t.Log("TestGetUserFields")
+	ta.Truncate()
+
+	err := ta.Accessor.InsertUser(&spi.UserInfo{
+		Name:           "fieldsUser",
+		Pass:           "123456",
+		Type:           "peer",
+		Affiliation:    "org1",
+		MaxEnrollments: 3,
+		Level:          2,
+	})
+	assert.NoError(t, err, "Failed to insert user")
+
+	fields, err := ta.Accessor.GetUserFields("fieldsUser", FieldType, FieldMaxEnrollments)
+	assert.NoError(t, err, "Failed to get user fields")
+	assert.Equal(t, map[Field]interface{}{FieldType: "peer", FieldMaxEnrollments: 3}, fields)
+
+	fields, err = ta.Accessor.GetUserFields("fieldsUser", FieldAffiliation, FieldState, FieldLevel)
+	assert.NoError(t, err, "Failed to get user fields")
+	assert.Equal(t, map[Field]interface{}{FieldAffiliation: "org1", FieldState: 0, FieldLevel: 2}, fields)
+
+	_, err = ta.Accessor.GetUserFields("fieldsUser", FieldType, Field(100))
+	if assert.Error(t, err, "Getting an unknown field should have failed") {
+		assert.Contains(t, err.Error(), fmt.Sprintf("code: %d", ErrInvalidRequest))
+	}
+	_, err = ta.Accessor.GetUserFields("fieldsUser")
+	assert.Error(t, err, "Getting no fields should have failed")
+	_, err = ta.Accessor.GetUserFields("unknownUser", FieldType)
+	assert.Error(t, err, "Getting fields of a non-existent user should have failed")
+}
+
+func testInsertDuplicateAffiliation(ta TestAccessor, t *testing.T) {
+	t.Log("TestInsertDuplicateAffiliation")
+	ta.Truncate()
+
+	err := ta.Accessor.InsertAffiliation("org1", "", 0)
+	assert.NoError(t, err, "Failed to insert affiliation")
+	_, err = ta.Accessor.GetAffiliation("org1")
+	assert.NoError(t, err, "Failed to get inserted affiliation")
+
+	err = ta.Accessor.InsertAffiliation("org1", "", 0)
+	if assert.Error(t, err, "Inserting a duplicate affiliation should have failed") {
+		assert.Contains(t, err.Error(), fmt.Sprintf("code: %d", ErrAffiliationExists))
+		assert.Contains(t, err.Error(), "Affiliation 'org1' already exists")
+	}
+
+	err = ta.Accessor.SoftDeleteAffiliation("org1")
+	assert.NoError(t, err, "Failed to soft delete affiliation")
+	err = ta.Accessor.InsertAffiliation("org1", "", 0)
+	assert.Error(t, err, "Inserting a soft deleted affiliation should have failed")
+
+	var count int
+	err = ta.DB.Get(&count, "SELECT COUNT(*) FROM affiliations WHERE (name = 'org1')")
+	assert.NoError(t, err, "Failed to count affiliations")
+	assert.Equal(t, 1, count, "Affiliation should be stored once")
+}
+
+func testSQLiteBusyRetries(ta TestAccessor, t *testing.T) {
+	t.Log("TestSQLiteBusyRetries")
+	ta.Truncate()
+
+	// A second connection that fails immediately instead of waiting for locks
+	busyDB, err := sqlx.Open("sqlite3", dbPath+"/fabric-ca.db?_busy_timeout=0")
+	if !assert.NoError(t, err, "Failed to open second connection to DB") {
+		return
+	}
+	defer busyDB.Close()
+	accessor := NewDBAccessor(&dbutil.DB{DB: busyDB, IsDBInitialized: true})
+
+	// Hold a write lock on the database from the first connection
+	tx, err := ta.DB.Beginx()
+	if !assert.NoError(t, err, "Failed to begin transaction") {
+		return
+	}
+	_, err = tx.Exec("INSERT INTO affiliations (name, prekey, level) VALUES ('locker', '', 0)")
+	assert.NoError(t, err, "Failed to lock database")
+
+	user := &spi.UserInfo{Name: "busyUser", Pass: "123456", Affiliation: "org1"}
+	accessor.SQLiteBusyRetries = 0
+	err = accessor.InsertUser(user)
+	assert.Error(t, err, "Insert without retries should have failed while the database is locked")
+	_, err = accessor.RegisterWithSecret(spi.UserInfo{Name: "busyTxUser", Affiliation: "org1"})
+	assert.Error(t, err, "Insert in a transaction without retries should have failed while the database is locked")
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		tx.Commit()
+	}()
+	accessor.SQLiteBusyRetries = 10
+	err = accessor.InsertUser(user)
+	assert.NoError(t, err, "Insert with retries should have succeeded once the database was unlocked")
+
+	_, err = ta.Accessor.GetUser("busyUser", nil)
+	assert.NoError(t, err, "Failed to get user inserted with retries")
+
+	// Transactions are retried as a whole
+	tx, err = ta.DB.Beginx()
+	if !assert.NoError(t, err, "Failed to begin transaction") {
+		return
+	}
+	_, err = tx.Exec("INSERT INTO affiliations (name, prekey, level) VALUES ('locker2', '', 0)")
+	assert.NoError(t, err, "Failed to lock database")
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		tx.Commit()
+	}()
+	_, err = accessor.RegisterWithSecret(spi.UserInfo{Name: "busyTxUser", Affiliation: "org1"})
+	assert.NoError(t, err, "Insert in a transaction with retries should have succeeded once the database was unlocked")
+	_, err = ta.Accessor.GetUser("busyTxUser", nil)
+	assert.NoError(t, err, "Failed to get user inserted in a transaction with retries")
+}
+
+func testGetUserETag(ta TestAccessor, t *testing.T) {
+	t.Log("TestGetUserETag")
+	ta.Truncate()
+
+	err := ta.Accessor.InsertUser(&spi.UserInfo{
+		Name:        "etagUser",
+		Pass:        "123456",
+		Type:        "client",
+		Affiliation: "org1",
+	})
+	assert.NoError(t, err, "Failed to insert user")
+	err = ta.Accessor.InsertUser(&spi.UserInfo{
+		Name:        "otherUser",
+		Pass:        "123456",
+		Type:        "client",
+		Affiliation: "org1",
+	})
+	assert.NoError(t, err, "Failed to insert user")
+
+	etag, err := ta.Accessor.GetUserETag("etagUser")
+	assert.NoError(t, err, "Failed to get ETag")
+	assert.NotEmpty(t, etag)
+	etag2, err := ta.Accessor.GetUserETag("etagUser")
+	assert.NoError(t, err, "Failed to get ETag")
+	assert.Equal(t, etag, etag2, "ETag should be stable while the user is unchanged")
+	otherETag, err := ta.Accessor.GetUserETag("otherUser")
+	assert.NoError(t, err, "Failed to get ETag")
+	assert.NotEqual(t, etag, otherETag, "Different users should have different ETags")
+
+	err = ta.Accessor.UpdateField("etagUser", FieldType, "peer")
+	assert.NoError(t, err, "Failed to update user")
+	etag2, err = ta.Accessor.GetUserETag("etagUser")
+	assert.NoError(t, err, "Failed to get ETag")
+	assert.NotEqual(t, etag, etag2, "ETag should change after the user is updated")
+
+	_, err = ta.Accessor.GetUserETag("unknownUser")
+	assert.Error(t, err, "Getting the ETag of a non-existent user should have failed")
+}
+
+// hmacAuthenticator accepts the hex encoded HMAC of the identity name
+type hmacAuthenticator struct {
+	key []byte
+}
+
+func (a hmacAuthenticator) Authenticate(user *spi.UserInfo, token []byte, credential string) error {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(user.Name))
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(credential)) {
+		return errors.New("Invalid HMAC token")
+	}
+	return nil
+}
+
+func testAuthenticator(ta TestAccessor, t *testing.T) {
+	t.Log("TestAuthenticator")
+	ta.Truncate()
+
+	err := ta.Accessor.InsertUser(&spi.UserInfo{
+		Name:           "serviceAccount",
+		Pass:           "123456",
+		Affiliation:    "org1",
+		MaxEnrollments: -1,
+	})
+	assert.NoError(t, err, "Failed to insert user")
+
+	// The default authenticator checks the password
+	user, err := ta.Accessor.GetUser("serviceAccount", nil)
+	assert.NoError(t, err, "Failed to get user")
+	err = user.Login("123456", -1)
+	assert.NoError(t, err, "Failed to login with the password")
+	err = user.Login("654321", -1)
+	assert.Error(t, err, "Login with an incorrect password should have failed")
+
+	accessor := ta.Accessor
+	defer func() { accessor.Authenticator = PasswordAuthenticator{} }()
+	auth := hmacAuthenticator{key: []byte("secret key")}
+	accessor.Authenticator = auth
+	mac := hmac.New(sha256.New, auth.key)
+	mac.Write([]byte("serviceAccount"))
+	token := hex.EncodeToString(mac.Sum(nil))
+
+	user, err = accessor.GetUser("serviceAccount", nil)
+	assert.NoError(t, err, "Failed to get user")
+	err = user.Login(token, -1)
+	assert.NoError(t, err, "Failed to login with the HMAC token")
+	err = user.Login("123456", -1)
+	assert.Error(t, err, "Login with the password should fail with the HMAC authenticator")
+}
+
+func testDuplicateAttributes(ta TestAccessor, t *testing.T) {
+	t.Log("TestDuplicateAttributes")
+	ta.Truncate()
+
+	legacyAttrs := `[{"name": "role", "value": "old"}, {"name": "dept", "value": "sales"}, {"name": "role", "value": "new"}]`
+	_, err := ta.DB.Exec("INSERT INTO users (id, token, type, affiliation, attributes, state, max_enrollments, level) VALUES ('dupUser', '', 'client', 'org1', ?, 0, -1, 0)", legacyAttrs)
+	assert.NoError(t, err, "Failed to insert user with duplicate attributes")
+
+	user, err := ta.Accessor.GetUser("dupUser", nil)
+	assert.NoError(t, err, "Failed to get user")
+	attrs, err := user.GetAttributes(nil)
+	assert.NoError(t, err, "Failed to get attributes")
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].Name < attrs[j].Name })
+	assert.Equal(t, []api.Attribute{{Name: "dept", Value: "sales"}, {Name: "role", Value: "new"}}, attrs, "Duplicates should be collapsed keeping the last value")
+	assert.Equal(t, []api.Attribute{{Name: "role", Value: "new"}, {Name: "dept", Value: "sales"}}, user.(*DBUser).Attributes)
+
+	var stored string
+	err = ta.DB.Get(&stored, "SELECT attributes FROM users WHERE (id = 'dupUser')")
+	assert.NoError(t, err, "Failed to get stored attributes")
+	assert.Equal(t, legacyAttrs, stored, "Stored attributes should not be rewritten unless repair is enabled")
+
+	accessor := ta.Accessor
+	defer func() { accessor.RepairDuplicateAttributes = false }()
+	accessor.RepairDuplicateAttributes = true
+	_, err = accessor.GetUser("dupUser", nil)
+	assert.NoError(t, err, "Failed to get user")
+	err = ta.DB.Get(&stored, "SELECT attributes FROM users WHERE (id = 'dupUser')")
+	assert.NoError(t, err, "Failed to get stored attributes")
+	assert.JSONEq(t, `[{"name": "role", "value": "new"}, {"name": "dept", "value": "sales"}]`, stored, "Stored attributes should have been repaired")
+	count, err := accessor.GetAttributeCount("dupUser")
+	assert.NoError(t, err, "Failed to get attribute count")
+	assert.Equal(t, 2, count)
+}
+
+func testAffiliationsExist(ta TestAccessor, t *testing.T) {
+	t.Log("TestAffiliationsExist")
+	ta.Truncate()
+
+	for _, name := range []string{"org1", "org1.dept1", "org2"} {
+		err := ta.Accessor.InsertAffiliation(name, "", 0)
+		assert.NoError(t, err, "Failed to insert affiliation %s", name)
+	}
+	err := ta.Accessor.SoftDeleteAffiliation("org2")
+	assert.NoError(t, err, "Failed to soft delete affiliation")
+
+	exist, err := ta.Accessor.AffiliationsExist([]string{"org1", "org1.dept1", "org2", "org3", "org1.dept2"})
+	assert.NoError(t, err, "Failed to check if affiliations exist")
+	assert.Equal(t, map[string]bool{
+		"org1":       true,
+		"org1.dept1": true,
+		"org2":       false,
+		"org3":       false,
+		"org1.dept2": false,
+	}, exist)
+
+	exist, err = ta.Accessor.AffiliationsExist(nil)
+	assert.NoError(t, err, "Failed to check if no affiliations exist")
+	assert.Empty(t, exist)
+}
+
+func testInsertUserPreHashed(ta TestAccessor, t *testing.T) {
+	t.Log("TestInsertUserPreHashed")
+	ta.Truncate()
+
+	// A hash exported from another CA
+	hash, err := bcrypt.GenerateFromPassword([]byte("migratedpw"), bcrypt.MinCost)
+	assert.NoError(t, err, "Failed to hash password")
+
+	err = ta.Accessor.InsertUserPreHashed(spi.UserInfo{
+		Name:           "migratedUser",
+		Pass:           "ignored",
+		Affiliation:    "org1",
+		MaxEnrollments: -1,
+	}, string(hash))
+	assert.NoError(t, err, "Failed to insert user with a pre-hashed password")
+
+	var stored []byte
+	err = ta.DB.Get(&stored, "SELECT token FROM users WHERE (id = 'migratedUser')")
+	assert.NoError(t, err, "Failed to get stored token")
+	assert.Equal(t, hash, stored, "Hash should be stored verbatim")
+
+	user, err := ta.Accessor.GetUser("migratedUser", nil)
+	assert.NoError(t, err, "Failed to get user")
+	err = user.Login("migratedpw", -1)
+	assert.NoError(t, err, "Migrated hash should authenticate its plaintext")
+	err = user.Login("ignored", -1)
+	assert.Error(t, err, "Password passed with the user should have been ignored")
+
+	err = ta.Accessor.InsertUserPreHashed(spi.UserInfo{Name: "badHashUser", Affiliation: "org1"}, "migratedpw")
+	assert.Error(t, err, "Inserting a user with a plaintext password as hash should have failed")
+}
+
+func testSearchUsers(ta TestAccessor, t *testing.T) {
+	t.Log("TestSearchUsers")
+	ta.Truncate()
+
+	for _, name := range []string{"alice", "alicia", "bob", "malice", "a_b", "axb", "100%", "1000", "x!y"} {
+		err := ta.Accessor.InsertUser(&spi.UserInfo{Name: name, Pass: "123456", Affiliation: "org1"})
+		assert.NoError(t, err, "Failed to insert user %s", name)
+	}
+	search := func(pattern string, limit int) []string {
+		users, err := ta.Accessor.SearchUsers(pattern, limit)
+		assert.NoError(t, err, "Failed to search for '%s'", pattern)
+		names := []string{}
+		for _, user := range users {
+			names = append(names, user.Name)
+		}
+		return names
+	}
+
+	assert.Equal(t, []string{"alice", "alicia", "malice"}, search("ali", 10), "Prefix search")
+	assert.Equal(t, []string{"alice", "malice"}, search("lice", 10), "Substring search")
+	assert.Equal(t, []string{"alice", "alicia"}, search("ali", 2), "Results should be bounded by the limit")
+	assert.Equal(t, []string{"a_b"}, search("a_b", 10), "Underscore should match only itself")
+	assert.Equal(t, []string{"100%"}, search("0%", 10), "Percent sign should match only itself")
+	assert.Equal(t, []string{"x!y"}, search("!", 10), "Escape character should match only itself")
+	assert.Empty(t, search("carol", 10))
+
+	_, err := ta.Accessor.SearchUsers("ali", 0)
+	assert.Error(t, err, "Searching with a zero limit should have failed")
+}
+
+func testAffiliationMetadata(ta TestAccessor, t *testing.T) {
+	t.Log("TestAffiliationMetadata")
+	ta.Truncate()
+
+	err := ta.Accessor.InsertAffiliation("org1", "", 0)
+	assert.NoError(t, err, "Failed to insert affiliation")
+
+	metadata, err := ta.Accessor.GetAffiliationMetadata("org1")
+	assert.NoError(t, err, "Failed to get metadata of affiliation without metadata")
+	assert.Empty(t, metadata)
+
+	expected := map[string]string{"displayName": "Organization One", "restricted": "true"}
+	err = ta.Accessor.SetAffiliationMetadata("org1", expected)
+	assert.NoError(t, err, "Failed to set metadata")
+	metadata, err = ta.Accessor.GetAffiliationMetadata("org1")
+	assert.NoError(t, err, "Failed to get metadata")
+	assert.Equal(t, expected, metadata)
+
+	aff, err := ta.Accessor.GetAffiliation("org1")
+	assert.NoError(t, err, "Failed to get affiliation with metadata")
+	assert.Equal(t, "org1", aff.GetName())
+	err = ta.Accessor.InsertUser(&spi.UserInfo{Name: "metaUser", Pass: "123456", Affiliation: "org1"})
+	assert.NoError(t, err, "Failed to insert user")
+	attrs, err := ta.Accessor.GetEffectiveAttributes("metaUser")
+	assert.NoError(t, err, "Failed to get effective attributes")
+	assert.Empty(t, attrs, "Metadata should not be inherited as identity attributes")
+
+	err = ta.Accessor.SetAffiliationMetadata("org2", expected)
+	assert.Error(t, err, "Setting metadata of a non-existent affiliation should have failed")
+	_, err = ta.Accessor.GetAffiliationMetadata("org2")
+	assert.Error(t, err, "Getting metadata of a non-existent affiliation should have failed")
+}
+
+func testGetRecentEnrollments(ta TestAccessor, t *testing.T) {
+	t.Log("TestGetRecentEnrollments")
+	ta.Truncate()
+
+	now := time.Now()
+	for _, name := range []string{"justNow", "minutesAgo", "daysAgo", "never"} {
+		err := ta.Accessor.InsertUser(&spi.UserInfo{Name: name, Pass: "123456", Affiliation: "org1", MaxEnrollments: -1})
+		assert.NoError(t, err, "Failed to insert user %s", name)
+	}
+	for name, enrolled := range map[string]time.Time{
+		"minutesAgo": now.Add(-10 * time.Minute),
+		"daysAgo":    now.Add(-48 * time.Hour),
+	} {
+		_, err := ta.DB.Exec("UPDATE users SET state = 1, last_enrolled_at = ? WHERE (id = ?)", enrolled.UTC(), name)
+		assert.NoError(t, err, "Failed to set enrollment time of %s", name)
+	}
+	user, err := ta.Accessor.GetUser("justNow", nil)
+	assert.NoError(t, err, "Failed to get user")
+	err = user.LoginComplete()
+	assert.NoError(t, err, "Failed to complete enrollment")
+
+	users, err := ta.Accessor.GetRecentEnrollments(now.Add(-time.Hour))
+	assert.NoError(t, err, "Failed to get recent enrollments")
+	names := []string{}
+	for _, user := range users {
+		names = append(names, user.Name)
+	}
+	assert.Equal(t, []string{"justNow", "minutesAgo"}, names, "Recent enrollments should be most recent first")
+
+	detail, err := ta.Accessor.GetUserDetail("justNow")
+	assert.NoError(t, err, "Failed to get user detail")
+	assert.True(t, detail.LastEnrolledAt.After(now.Add(-time.Minute)), "Incorrect enrollment time: %s", detail.LastEnrolledAt)
+
+	users, err = ta.Accessor.GetRecentEnrollments(now.Add(time.Hour))
+	assert.NoError(t, err, "Failed to get recent enrollments")
+	assert.Empty(t, users)
+}
+
+func testUpdateUserIfExists(ta TestAccessor, t *testing.T) {
+	t.Log("TestUpdateUserIfExists")
+	ta.Truncate()
+
+	user := spi.UserInfo{Name: "presentUser", Pass: "123456", Type: "client", Affiliation: "org1"}
+	err := ta.Accessor.InsertUser(&user)
+	assert.NoError(t, err, "Failed to insert user")
+
+	user.Type = "peer"
+	err = ta.Accessor.UpdateUser(&user, true)
+	assert.NoError(t, err, "Failed to update present user")
+	user.Type = "orderer"
+	err = ta.Accessor.UpdateUserIfExists(&user, true)
+	assert.NoError(t, err, "Failed to update present user if it exists")
+	fields, err := ta.Accessor.GetUserFields("presentUser", FieldType)
+	assert.NoError(t, err, "Failed to get user fields")
+	assert.Equal(t, "orderer", fields[FieldType])
+
+	absent := spi.UserInfo{Name: "absentUser", Pass: "123456", Type: "client", Affiliation: "org1"}
+	err = ta.Accessor.UpdateUser(&absent, true)
+	assert.Error(t, err, "Updating an absent user should have failed")
+	err = ta.Accessor.UpdateUserIfExists(&absent, true)
+	assert.NoError(t, err, "Updating an absent user if it exists should not fail")
+	_, err = ta.Accessor.GetUser("absentUser", nil)
+	assert.Error(t, err, "Updating an absent user should not have inserted it")
+
+	err = ta.Accessor.UpdateUserIfExists(nil, true)
+	assert.Error(t, err, "Updating an undefined user should have failed")
+}
+
+func testEnrollmentHistory(ta TestAccessor, t *testing.T) {
+	t.Log("TestEnrollmentHistory")
+	ta.Truncate()
+
+	history, err := ta.Accessor.GetEnrollmentHistory("historyUser")
+	assert.NoError(t, err, "Failed to get empty enrollment history")
+	assert.Empty(t, history)
+
+	first := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	second := first.Add(30 * time.Minute)
+	err = ta.Accessor.RecordEnrollment("historyUser", "CN=historyUser,OU=client", "10.0.0.2:51234", second)
+	assert.NoError(t, err, "Failed to record enrollment")
+	err = ta.Accessor.RecordEnrollment("historyUser", "CN=historyUser", "10.0.0.1:40000", first)
+	assert.NoError(t, err, "Failed to record enrollment")
+	err = ta.Accessor.RecordEnrollment("otherUser", "CN=otherUser", "10.0.0.3:40000", first)
+	assert.NoError(t, err, "Failed to record enrollment")
+
+	history, err = ta.Accessor.GetEnrollmentHistory("historyUser")
+	assert.NoError(t, err, "Failed to get enrollment history")
+	if assert.Len(t, history, 2) {
+		assert.Equal(t, "CN=historyUser", history[0].CSRSubject, "History should be oldest first")
+		assert.Equal(t, "10.0.0.1:40000", history[0].RemoteAddr)
+		assert.True(t, first.Equal(history[0].At), "Incorrect enrollment time %s", history[0].At)
+		assert.Equal(t, "CN=historyUser,OU=client", history[1].CSRSubject)
+		assert.True(t, second.Equal(history[1].At), "Incorrect enrollment time %s", history[1].At)
+	}
+}
+
+func testHasInitialSecret(ta TestAccessor, t *testing.T) {
+	t.Log("TestHasInitialSecret")
+	ta.Truncate()
+
+	for _, name := range []string{"freshUser", "changedUser"} {
+		err := ta.Accessor.InsertUser(&spi.UserInfo{
+			Name:        name,
+			Pass:        "123456",
+			Type:        "client",
+			Affiliation: "org1",
+		})
+		assert.NoError(t, err, "Failed to insert user %s", name)
+	}
+
+	initial, err := ta.Accessor.HasInitialSecret("freshUser")
+	assert.NoError(t, err, "Failed to check initial secret")
+	assert.True(t, initial, "A newly registered user should have its initial secret")
+
+	// Updating an identity without changing its password keeps the initial secret
+	user := spi.UserInfo{Name: "changedUser", Type: "peer", Affiliation: "org1"}
+	err = ta.Accessor.UpdateUser(&user, false)
+	assert.NoError(t, err, "Failed to update user")
+	initial, err = ta.Accessor.HasInitialSecret("changedUser")
+	assert.NoError(t, err, "Failed to check initial secret")
+	assert.True(t, initial, "Updating a user without a password should keep its initial secret")
+
+	user.Pass = "654321"
+	err = ta.Accessor.UpdateUser(&user, true)
+	assert.NoError(t, err, "Failed to change password")
+	initial, err = ta.Accessor.HasInitialSecret("changedUser")
+	assert.NoError(t, err, "Failed to check initial secret")
+	assert.False(t, initial, "A user that changed its password should not have its initial secret")
+
+	initial, err = ta.Accessor.HasInitialSecret("freshUser")
+	assert.NoError(t, err, "Failed to check initial secret")
+	assert.True(t, initial, "Changing another user's password should not affect this user")
+
+	_, err = ta.Accessor.HasInitialSecret("missingUser")
+	assert.Error(t, err, "Checking the initial secret of a non-existent user should have failed")
+}
+
+func testRevokeAffiliationMembers(ta TestAccessor, t *testing.T) {
+	t.Log("TestRevokeAffiliationMembers")
+	ta.Truncate()
+
+	for _, aff := range []struct{ name, prekey string }{{"org1", ""}, {"org1.dept1", "org1"}, {"org2", ""}} {
+		err := ta.Accessor.InsertAffiliation(aff.name, aff.prekey, 0)
+		assert.NoError(t, err, "Failed to insert affiliation %s", aff.name)
+	}
+	members := map[string]string{
+		"org1User":     "org1",
+		"dept1User":    "org1.dept1",
+		"revokedUser":  "org1.dept1",
+		"org2User":     "org2",
+		"org10User":    "org10",
+		"unaffiliated": "",
+	}
+	for name, aff := range members {
+		err := ta.Accessor.InsertUser(&spi.UserInfo{Name: name, Pass: "123456", Type: "client", Affiliation: aff})
+		assert.NoError(t, err, "Failed to insert user %s", name)
+	}
+	user, err := ta.Accessor.GetUser("revokedUser", nil)
+	assert.NoError(t, err, "Failed to get user")
+	err = user.(*DBUser).RevokeWithReason(ocsp.Superseded)
+	assert.NoError(t, err, "Failed to revoke user")
+
+	revoked, err := ta.Accessor.RevokeAffiliationMembers("org1", ocsp.KeyCompromise)
+	assert.NoError(t, err, "Failed to revoke affiliation members")
+	assert.Equal(t, 2, revoked, "Only members that were not already revoked should be counted")
+
+	for _, name := range []string{"org1User", "dept1User"} {
+		detail, err := ta.Accessor.GetUserDetail(name)
+		assert.NoError(t, err, "Failed to get user %s", name)
+		assert.Equal(t, -1, detail.State, "%s should be revoked", name)
+		assert.Equal(t, ocsp.KeyCompromise, detail.RevocationReason, "Incorrect revocation reason of %s", name)
+		assert.False(t, detail.RevokedAt.IsZero(), "Revocation time of %s should be recorded", name)
+	}
+	detail, err := ta.Accessor.GetUserDetail("revokedUser")
+	assert.NoError(t, err, "Failed to get user")
+	assert.Equal(t, ocsp.Superseded, detail.RevocationReason, "An identity that was already revoked should keep its reason")
+	for _, name := range []string{"org2User", "org10User", "unaffiliated"} {
+		detail, err := ta.Accessor.GetUserDetail(name)
+		assert.NoError(t, err, "Failed to get user %s", name)
+		assert.NotEqual(t, -1, detail.State, "%s is not a member of org1 and should not be revoked", name)
+	}
+
+	revoked, err = ta.Accessor.RevokeAffiliationMembers("org1", ocsp.KeyCompromise)
+	assert.NoError(t, err, "Failed to revoke affiliation members again")
+	assert.Equal(t, 0, revoked)
+
+	_, err = ta.Accessor.RevokeAffiliationMembers("org3", ocsp.KeyCompromise)
+	assert.Error(t, err, "Revoking members of a non-existent affiliation should have failed")
+}
+
+func testCaseInsensitiveAffiliations(ta TestAccessor, t *testing.T) {
+	t.Log("TestCaseInsensitiveAffiliations")
+	ta.Truncate()
+
+	// By default names that differ only in case are different affiliations
+	err := ta.Accessor.InsertAffiliation("Org1", "", 0)
+	assert.NoError(t, err, "Failed to insert affiliation")
+	err = ta.Accessor.InsertAffiliation("org1", "", 0)
+	assert.NoError(t, err, "Affiliations differing in case should be allowed by default")
+	_, err = ta.Accessor.GetAffiliation("ORG1")
+	assert.Error(t, err, "Affiliation names should be case sensitive by default")
+
+	ta.Truncate()
+	ta.Accessor.CaseInsensitiveAffiliations = true
+	defer func() { ta.Accessor.CaseInsensitiveAffiliations = false }()
+
+	err = ta.Accessor.InsertAffiliation("Org1", "", 0)
+	assert.NoError(t, err, "Failed to insert affiliation")
+	err = ta.Accessor.InsertAffiliation("org1", "", 0)
+	if assert.Error(t, err, "Inserting an affiliation differing only in case should have failed") {
+		assert.Contains(t, err.Error(), fmt.Sprintf("code: %d", ErrAffiliationExists))
+	}
+
+	for _, cache := range []bool{false, true} {
+		ta.Accessor.CacheAffiliations = cache
+		aff, err := ta.Accessor.GetAffiliation("ORG1")
+		if assert.NoError(t, err, "Failed to get affiliation ignoring case (cache %t)", cache) {
+			assert.Equal(t, "Org1", aff.GetName(), "The name should keep the casing it was inserted with")
+		}
+	}
+	ta.Accessor.CacheAffiliations = false
+
+	exist, err := ta.Accessor.AffiliationsExist([]string{"org1", "ORG1", "org2"})
+	assert.NoError(t, err, "Failed to check if affiliations exist")
+	assert.Equal(t, map[string]bool{"org1": true, "ORG1": true, "org2": false}, exist)
+}
+
+func testListOrdering(ta TestAccessor, t *testing.T) {
+	t.Log("TestListOrdering")
+	ta.Truncate()
+
+	err := ta.Accessor.InsertAffiliation("org1", "", 0)
+	assert.NoError(t, err, "Failed to insert affiliation")
+	insert := func(names ...string) {
+		for _, name := range names {
+			err := ta.Accessor.InsertUser(&spi.UserInfo{Name: name, Pass: "123456", Type: "client", Affiliation: "org1"})
+			assert.NoError(t, err, "Failed to insert user %s", name)
+			err = ta.Accessor.InsertAffiliation("org1."+name, "org1", 0)
+			assert.NoError(t, err, "Failed to insert affiliation")
+		}
+	}
+	streamIDs := func() []string {
+		ids := []string{}
+		err := ta.Accessor.StreamUsers(func(user spi.UserInfo) error {
+			ids = append(ids, user.Name)
+			return nil
+		})
+		assert.NoError(t, err, "Failed to stream users")
+		return ids
+	}
+	filteredIDs := func() []string {
+		rows, err := ta.Accessor.GetFilteredUsers("org1", "*")
+		if !assert.NoError(t, err, "Failed to get filtered users") {
+			return nil
+		}
+		defer rows.Close()
+		ids := []string{}
+		for rows.Next() {
+			var userRec UserRecord
+			assert.NoError(t, rows.StructScan(&userRec), "Failed to scan user")
+			ids = append(ids, userRec.Name)
+		}
+		return ids
+	}
+	affiliationNames := func() []string {
+		rows, err := ta.Accessor.GetAllAffiliations("org1")
+		if !assert.NoError(t, err, "Failed to get affiliations") {
+			return nil
+		}
+		defer rows.Close()
+		names := []string{}
+		for rows.Next() {
+			var affRec AffiliationRecord
+			assert.NoError(t, rows.StructScan(&affRec), "Failed to scan affiliation")
+			names = append(names, affRec.Name)
+		}
+		return names
+	}
+
+	insert("carol", "alice", "erin")
+	assert.Equal(t, []string{"alice", "carol", "erin"}, streamIDs())
+	assert.Equal(t, []string{"alice", "carol", "erin"}, filteredIDs())
+	assert.Equal(t, []string{"org1", "org1.alice", "org1.carol", "org1.erin"}, affiliationNames())
+
+	// Rows inserted between calls take their place in the order without
+	// moving the rows that were returned before
+	insert("dave", "bob")
+	assert.Equal(t, []string{"alice", "bob", "carol", "dave", "erin"}, streamIDs())
+	assert.Equal(t, []string{"alice", "bob", "carol", "dave", "erin"}, filteredIDs())
+	assert.Equal(t, []string{"org1", "org1.alice", "org1.bob", "org1.carol", "org1.dave", "org1.erin"}, affiliationNames())
+}
+
+// stubSecretResolver serves the tokens in secrets, failing for ids in failing
+type stubSecretResolver struct {
+	secrets map[string][]byte
+	failing map[string]bool
+}
+
+func (r stubSecretResolver) ResolveSecret(id string) ([]byte, bool, error) {
+	if r.failing[id] {
+		return nil, false, errors.New("Secret store is unavailable")
+	}
+	token, found := r.secrets[id]
+	return token, found, nil
+}
+
+func testSecretResolver(ta TestAccessor, t *testing.T) {
+	t.Log("TestSecretResolver")
+	ta.Truncate()
+
+	for _, name := range []string{"vaultUser", "dbUser", "failingUser"} {
+		err := ta.Accessor.InsertUser(&spi.UserInfo{Name: name, Pass: "dbsecret", Affiliation: "org1", MaxEnrollments: -1})
+		assert.NoError(t, err, "Failed to insert user %s", name)
+	}
+
+	vaultToken, err := bcrypt.GenerateFromPassword([]byte("vaultsecret"), bcrypt.MinCost)
+	assert.NoError(t, err, "Failed to hash password")
+	accessor := ta.Accessor
+	defer func() { accessor.SecretResolver = nil }()
+	accessor.SecretResolver = stubSecretResolver{
+		secrets: map[string][]byte{"vaultUser": vaultToken},
+		failing: map[string]bool{"failingUser": true},
+	}
+
+	// The external secret overrides the token in the database
+	user, err := accessor.GetUser("vaultUser", nil)
+	assert.NoError(t, err, "Failed to get user")
+	err = user.Login("vaultsecret", -1)
+	assert.NoError(t, err, "Failed to login with the external secret")
+	err = user.Login("dbsecret", -1)
+	assert.Error(t, err, "Login with the database secret should fail when an external secret exists")
+
+	// The database token is used when the store has no secret for the identity
+	user, err = accessor.GetUser("dbUser", nil)
+	assert.NoError(t, err, "Failed to get user")
+	err = user.Login("dbsecret", -1)
+	assert.NoError(t, err, "Failed to login with the database secret")
+
+	user, err = accessor.GetUser("failingUser", nil)
+	assert.NoError(t, err, "Failed to get user")
+	err = user.Login("dbsecret", -1)
+	if assert.Error(t, err, "Login should fail when the secret store fails") {
+		assert.Contains(t, err.Error(), "Failed to resolve secret")
+	}
+}
+
+func testAddAttributeToType(ta TestAccessor, t *testing.T) {
+	t.Log("TestAddAttributeToType")
+	ta.Truncate()
+
+	users := []spi.UserInfo{
+		{Name: "peer1", Type: "peer", Attributes: []api.Attribute{{Name: "hf.Revoker", Value: "false"}}},
+		{Name: "peer2", Type: "peer", Attributes: []api.Attribute{{Name: "role", Value: "old"}}},
+		{Name: "client1", Type: "client"},
+	}
+	for i := range users {
+		users[i].Pass = "123456"
+		users[i].Affiliation = "org1"
+		err := ta.Accessor.InsertUser(&users[i])
+		assert.NoError(t, err, "Failed to insert user %s", users[i].Name)
+	}
+	_, err := ta.DB.Exec("INSERT INTO users (id, token, type, affiliation, attributes, state, max_enrollments, level) VALUES ('peer3', 'token', 'peer', 'org1', '{\"dept\": \"sales\"}', 0, -1, 0)")
+	assert.NoError(t, err, "Failed to insert user with legacy attributes")
+
+	role := api.Attribute{Name: "role", Value: "endorser", ECert: true}
+	updated, err := ta.Accessor.AddAttributeToType("peer", role)
+	assert.NoError(t, err, "Failed to add attribute to peers")
+	assert.Equal(t, 3, updated, "Every peer should be updated")
+
+	getAttrs := func(id string) []api.Attribute {
+		user, err := ta.Accessor.GetUser(id, nil)
+		assert.NoError(t, err, "Failed to get user %s", id)
+		attrs, err := user.GetAttributes(nil)
+		assert.NoError(t, err, "Failed to get attributes of %s", id)
+		sort.Slice(attrs, func(i, j int) bool { return attrs[i].Name < attrs[j].Name })
+		return attrs
+	}
+	assert.Equal(t, []api.Attribute{{Name: "hf.Revoker", Value: "false"}, role}, getAttrs("peer1"))
+	assert.Equal(t, []api.Attribute{role}, getAttrs("peer2"), "An existing attribute should be replaced")
+	assert.Equal(t, []api.Attribute{{Name: "dept", Value: "sales"}, role}, getAttrs("peer3"))
+	assert.Empty(t, getAttrs("client1"), "Identities of other types should not be updated")
+
+	updated, err = ta.Accessor.AddAttributeToType("orderer", role)
+	assert.NoError(t, err, "Failed to add attribute to orderers")
+	assert.Equal(t, 0, updated)
+
+	_, err = ta.Accessor.AddAttributeToType("peer", api.Attribute{Value: "noname"})
+	assert.Error(t, err, "Adding an attribute without a name should have failed")
+}
+
+func testFindDuplicateSerials(ta TestAccessor, t *testing.T) {
+	t.Log("TestFindDuplicateSerials")
+	ta.Truncate()
+
+	certDBAcc := NewCertDBAccessor(ta.DB, 0)
+	insertCert := func(id, serial, aki string) {
+		_, err := ta.DB.Exec("INSERT INTO certificates (id, serial_number, authority_key_identifier, status, pem) VALUES (?, ?, ?, 'good', 'pem')", id, serial, aki)
+		assert.NoError(t, err, "Failed to insert certificate %s of %s", serial, id)
+	}
+	insertCert("user1", "01", "aki1")
+	insertCert("user1", "02", "aki1")
+	insertCert("user2", "03", "aki1")
+
+	duplicates, err := certDBAcc.FindDuplicateSerials()
+	assert.NoError(t, err, "Failed to find duplicate serials")
+	assert.Empty(t, duplicates, "A store without collisions should have no duplicate serials")
+
+	// The same identity holding a serial from two CAs is not a collision
+	insertCert("user2", "03", "aki2")
+	insertCert("user3", "01", "aki2")
+	insertCert("user2", "01", "aki3")
+	duplicates, err = certDBAcc.FindDuplicateSerials()
+	assert.NoError(t, err, "Failed to find duplicate serials")
+	assert.Equal(t, map[string][]string{"01": {"user1", "user2", "user3"}}, duplicates)
+}
+
+func testGetAttributesAs(ta TestAccessor, t *testing.T) {
+	t.Log("TestGetAttributesAs")
+	ta.Truncate()
+
+	err := ta.Accessor.InsertUser(&spi.UserInfo{
+		Name:        "typedUser",
+		Pass:        "123456",
+		Affiliation: "org1",
+		Attributes: []api.Attribute{
+			{Name: "role", Value: "auditor", ECert: true},
+			{Name: "dept", Value: "sales"},
+		},
+	})
+	assert.NoError(t, err, "Failed to insert user")
+
+	type namedValue struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	var attrs []namedValue
+	err = ta.Accessor.GetAttributesAs("typedUser", &attrs)
+	assert.NoError(t, err, "Failed to get attributes into custom type")
+	assert.Equal(t, []namedValue{{"role", "auditor"}, {"dept", "sales"}}, attrs)
+
+	// Attributes stored as a JSON object can be decoded into a struct
+	_, err = ta.DB.Exec("INSERT INTO users (id, token, type, affiliation, attributes, state, max_enrollments, level) VALUES ('legacyUser', 'token', 'client', 'org1', '{\"dept\": \"sales\", \"clearance\": 3}', 0, -1, 0)")
+	assert.NoError(t, err, "Failed to insert user with legacy attributes")
+	var profile struct {
+		Dept      string `json:"dept"`
+		Clearance int    `json:"clearance"`
+	}
+	err = ta.Accessor.GetAttributesAs("legacyUser", &profile)
+	assert.NoError(t, err, "Failed to get attributes into struct")
+	assert.Equal(t, "sales", profile.Dept)
+	assert.Equal(t, 3, profile.Clearance)
+
+	err = ta.Accessor.GetAttributesAs("typedUser", &profile)
+	assert.Error(t, err, "Unmarshaling a list of attributes into a struct should have failed")
+	err = ta.Accessor.GetAttributesAs("unknownUser", &attrs)
+	assert.Error(t, err, "Getting attributes of a non-existent user should have failed")
+}
+
+func testAuditDB(ta TestAccessor, t *testing.T) {
+	t.Log("TestAuditDB")
+	ta.Truncate()
+
+	os.Remove(dbPath + "/audit.db")
+	defer os.Remove(dbPath + "/audit.db")
+	auditDB, err := sqlx.Open("sqlite3", dbPath+"/audit.db")
+	if !assert.NoError(t, err, "Failed to open audit DB") {
+		return
+	}
+	defer auditDB.Close()
+	accessor := ta.Accessor
+	defer func() {
+		accessor.SetAuditDB(nil)
+		accessor.StrictAudit = false
+	}()
+	err = accessor.SetAuditDB(&dbutil.DB{DB: auditDB, IsDBInitialized: true})
+	assert.NoError(t, err, "Failed to set audit DB")
+
+	getEvents := func() []string {
+		var events []string
+		err := auditDB.Select(&events, "SELECT action || ':' || id FROM audit_events ORDER BY rowid")
+		assert.NoError(t, err, "Failed to get audit events")
+		return events
+	}
+	getUserType := func(id string) string {
+		user, err := accessor.GetUser(id, nil)
+		if err != nil {
+			return ""
+		}
+		return user.GetType()
+	}
+
+	// Best effort mode records each mutation
+	user := spi.UserInfo{Name: "auditUser", Pass: "123456", Type: "client", Affiliation: "org1"}
+	err = accessor.InsertUser(&user)
+	assert.NoError(t, err, "Failed to insert user")
+	user.Type = "peer"
+	err = accessor.UpdateUser(&user, false)
+	assert.NoError(t, err, "Failed to update user")
+	_, err = accessor.DeleteUser("auditUser")
+	assert.NoError(t, err, "Failed to delete user")
+	assert.Equal(t, []string{"insert_user:auditUser", "update_user:auditUser", "delete_user:auditUser"}, getEvents())
+
+	// Every way of inserting an identity is recorded
+	_, err = accessor.RegisterWithSecret(spi.UserInfo{Name: "auditSecretUser", Affiliation: "org1"})
+	assert.NoError(t, err, "Failed to register user with secret")
+	for i := 0; i < 2; i++ {
+		_, err = accessor.InsertUserIdempotent(spi.UserInfo{Name: "auditIdempotentUser", Pass: "123456", Affiliation: "org1"}, "auditKey")
+		assert.NoError(t, err, "Failed to insert user idempotently")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte("123456"), bcrypt.MinCost)
+	assert.NoError(t, err, "Failed to hash password")
+	err = accessor.InsertUserPreHashed(spi.UserInfo{Name: "auditPreHashedUser", Affiliation: "org1"}, string(hash))
+	assert.NoError(t, err, "Failed to insert user with pre-hashed password")
+	assert.Equal(t, []string{"insert_user:auditSecretUser", "insert_user:auditIdempotentUser", "insert_user:auditPreHashedUser"}, getEvents()[3:],
+		"Each inserted identity should have been recorded once")
+
+	// Failed mutations are not recorded
+	_, err = accessor.DeleteUser("auditUser")
+	assert.Error(t, err, "Deleting a non-existent user should have failed")
+	assert.Len(t, getEvents(), 6)
+
+	// Failures to write events do not block mutations in best effort mode
+	_, err = auditDB.Exec("DROP TABLE audit_events")
+	assert.NoError(t, err, "Failed to drop audit table")
+	user.Type = "client"
+	err = accessor.InsertUser(&user)
+	assert.NoError(t, err, "Insert should succeed when the audit DB fails in best effort mode")
+	assert.Equal(t, "client", getUserType("auditUser"))
+
+	// Failures to write events roll back mutations in strict mode
+	accessor.StrictAudit = true
+	user.Name = "strictUser"
+	err = accessor.InsertUser(&user)
+	if assert.Error(t, err, "Insert should fail when the audit DB fails in strict mode") {
+		assert.Contains(t, err.Error(), fmt.Sprintf("code: %d", ErrAuditEvent))
+	}
+	assert.Equal(t, "", getUserType("strictUser"), "The failed insert should have been rolled back")
+	_, err = accessor.RegisterWithSecret(spi.UserInfo{Name: "strictSecretUser", Affiliation: "org1"})
+	assert.Error(t, err, "Register with secret should fail when the audit DB fails in strict mode")
+	assert.Equal(t, "", getUserType("strictSecretUser"), "The failed register should have been rolled back")
+	user.Name = "auditUser"
+	user.Type = "peer"
+	err = accessor.UpdateUser(&user, false)
+	assert.Error(t, err, "Update should fail when the audit DB fails in strict mode")
+	assert.Equal(t, "client", getUserType("auditUser"), "The failed update should have been rolled back")
+	_, err = accessor.DeleteUser("auditUser")
+	assert.Error(t, err, "Delete should fail when the audit DB fails in strict mode")
+	assert.Equal(t, "client", getUserType("auditUser"), "The failed delete should have been rolled back")
+
+	err = accessor.SetAuditDB(&dbutil.DB{DB: auditDB, IsDBInitialized: true})
+	assert.NoError(t, err, "Failed to set audit DB")
+	err = accessor.UpdateUser(&user, false)
+	assert.NoError(t, err, "Failed to update user in strict mode")
+	assert.Equal(t, "peer", getUserType("auditUser"))
+	assert.Equal(t, []string{"update_user:auditUser"}, getEvents())
+}
+
+// newTestCertPEM returns a self-signed certificate for enrollment ID id
+func newTestCertPEM(t *testing.T, id string, serial int64) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err, "Failed to generate key")
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: id},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err, "Failed to create certificate")
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func testSerialHistory(ta TestAccessor, t *testing.T) {
+	t.Log("TestSerialHistory")
+	ta.Truncate()
+
+	err := ta.Accessor.InsertUser(&spi.UserInfo{Name: "rotUser", Pass: "123456", Affiliation: "org1"})
+	assert.NoError(t, err, "Failed to insert user")
+
+	current, previous, err := ta.Accessor.GetSerialHistory("rotUser")
+	assert.NoError(t, err, "Failed to get serial history")
+	assert.Empty(t, current, "A user that was never enrolled should have no serial")
+	assert.Empty(t, previous)
+
+	certDBAcc := NewCertDBAccessor(ta.DB, 0)
+	serial := func(n int64) string {
+		return util.GetSerialAsHex(big.NewInt(n))
+	}
+	for _, n := range []int64{1001, 1002, 1003} {
+		err = certDBAcc.InsertCertificate(certdb.CertificateRecord{
+			Serial: big.NewInt(n).String(),
+			AKI:    "0aki",
+			Status: "good",
+			Expiry: time.Now().Add(time.Hour),
+			PEM:    newTestCertPEM(t, "rotUser", n),
+		})
+		assert.NoError(t, err, "Failed to insert certificate %d", n)
+		current, previous, err = ta.Accessor.GetSerialHistory("rotUser")
+		assert.NoError(t, err, "Failed to get serial history")
+		assert.Equal(t, serial(n), current, "The new certificate should be current")
+		if n == 1001 {
+			assert.Empty(t, previous, "There is no previous certificate after the first enrollment")
+		} else {
+			assert.Equal(t, serial(n-1), previous, "The current certificate should have become previous")
+		}
+	}
+
+	// Certificates of subjects that are not identities are still stored
+	err = certDBAcc.InsertCertificate(certdb.CertificateRecord{
+		Serial: "2001",
+		AKI:    "aki",
+		Status: "good",
+		Expiry: time.Now().Add(time.Hour),
+		PEM:    newTestCertPEM(t, "notAnIdentity", 2001),
+	})
+	assert.NoError(t, err, "Failed to insert certificate of a subject that is not an identity")
+
+	_, _, err = ta.Accessor.GetSerialHistory("unknownUser")
+	assert.Error(t, err, "Getting serial history of a non-existent user should have failed")
+}
+
+func testReconcileCertificates(ta TestAccessor, t *testing.T) {
+	t.Log("TestReconcileCertificates")
+	ta.Truncate()
+
+	for _, name := range []string{"syncedUser", "driftedUser", "missingUser", "revokedUser"} {
+		err := ta.Accessor.InsertUser(&spi.UserInfo{Name: name, Pass: "123456", Affiliation: "org1"})
+		assert.NoError(t, err, "Failed to insert user %s", name)
+	}
+	insertCert := func(id, serial, status string, expiry time.Time) {
+		_, err := ta.DB.Exec(ta.DB.Rebind("INSERT INTO certificates (id, serial_number, authority_key_identifier, status, expiry, pem) VALUES (?, ?, 'aki', ?, ?, 'pem')"), id, serial, status, expiry)
+		assert.NoError(t, err, "Failed to insert certificate %s of %s", serial, id)
+	}
+	setSerial := func(id, serial string) {
+		_, err := ta.DB.Exec(ta.DB.Rebind("UPDATE users SET serial_number = ?, aki = 'aki' WHERE (id = ?)"), serial, id)
+		assert.NoError(t, err, "Failed to set serial of %s", id)
+	}
+	now := time.Now().UTC()
+
+	insertCert("syncedUser", "11", "good", now.Add(time.Hour))
+	setSerial("syncedUser", "11")
+	// The serial of driftedUser is that of an older certificate
+	insertCert("driftedUser", "21", "good", now.Add(time.Hour))
+	insertCert("driftedUser", "22", "good", now.Add(2*time.Hour))
+	insertCert("driftedUser", "23", "revoked", now.Add(3*time.Hour))
+	setSerial("driftedUser", "21")
+	insertCert("missingUser", "31", "good", now.Add(time.Hour))
+	insertCert("revokedUser", "41", "revoked", now.Add(time.Hour))
+	setSerial("revokedUser", "41")
+	insertCert("notAnIdentity", "51", "good", now.Add(time.Hour))
+
+	fixed, err := ta.Accessor.ReconcileCertificates()
+	assert.NoError(t, err, "Failed to reconcile certificates")
+	assert.Equal(t, 2, fixed, "The drifted and missing serials should have been corrected")
+
+	expected := map[string]string{"syncedUser": "11", "driftedUser": "22", "missingUser": "31", "revokedUser": "41"}
+	for name, serial := range expected {
+		current, _, err := ta.Accessor.GetSerialHistory(name)
+		assert.NoError(t, err, "Failed to get serial history of %s", name)
+		assert.Equal(t, serial, current, "Incorrect serial of %s", name)
+	}
+
+	fixed, err = ta.Accessor.ReconcileCertificates()
+	assert.NoError(t, err, "Failed to reconcile certificates again")
+	assert.Equal(t, 0, fixed, "Nothing should need correcting after reconciling")
+}
+
+func testGetDisplayName(ta TestAccessor, t *testing.T) {
+	t.Log("TestGetDisplayName")
+	ta.Truncate()
+
+	users := []spi.UserInfo{
+		{Name: "jdoe", Attributes: []api.Attribute{{Name: "displayName", Value: "Jane Doe"}, {Name: "dept", Value: "sales"}}},
+		{Name: "plainUser", Attributes: []api.Attribute{{Name: "dept", Value: "sales"}}},
+		{Name: "emptyName", Attributes: []api.Attribute{{Name: "displayName", Value: ""}}},
+	}
+	for i := range users {
+		users[i].Pass = "123456"
+		users[i].Affiliation = "org1"
+		err := ta.Accessor.InsertUser(&users[i])
+		assert.NoError(t, err, "Failed to insert user %s", users[i].Name)
+	}
+
+	name, err := ta.Accessor.GetDisplayName("jdoe")
+	assert.NoError(t, err, "Failed to get display name")
+	assert.Equal(t, "Jane Doe", name)
+
+	name, err = ta.Accessor.GetDisplayName("plainUser")
+	assert.NoError(t, err, "Failed to get display name")
+	assert.Equal(t, "plainUser", name, "The id should be used when there is no display name")
+
+	name, err = ta.Accessor.GetDisplayName("emptyName")
+	assert.NoError(t, err, "Failed to get display name")
+	assert.Equal(t, "emptyName", name, "The id should be used when the display name is empty")
+
+	_, err = ta.Accessor.GetDisplayName("unknownUser")
+	assert.Error(t, err, "Getting the display name of a non-existent user should have failed")
+}
+
+func testResolveAffiliationPathPrefix(ta TestAccessor, t *testing.T) {
+	t.Log("TestResolveAffiliationPathPrefix")
+	ta.Truncate()
+
+	for _, aff := range []struct{ name, prekey string }{{"org1", ""}, {"org1.dept1", "org1"}, {"org1.dept1.team1", "org1.dept1"}} {
+		err := ta.Accessor.InsertAffiliation(aff.name, aff.prekey, 0)
+		assert.NoError(t, err, "Failed to insert affiliation %s", aff.name)
+	}
+
+	name, err := ta.Accessor.ResolveAffiliationPathPrefix("org1.dept1.team1")
+	assert.NoError(t, err, "Failed to resolve existing path")
+	assert.Equal(t, "org1.dept1.team1", name, "A path that exists should resolve to itself")
+
+	name, err = ta.Accessor.ResolveAffiliationPathPrefix("org1.dept1.team2.squad1")
+	assert.NoError(t, err, "Failed to resolve partially existing path")
+	assert.Equal(t, "org1.dept1", name, "The longest existing prefix should be returned")
+
+	name, err = ta.Accessor.ResolveAffiliationPathPrefix("org1.dept2")
+	assert.NoError(t, err, "Failed to resolve partially existing path")
+	assert.Equal(t, "org1", name)
+
+	_, err = ta.Accessor.ResolveAffiliationPathPrefix("org2.dept1")
+	assert.Error(t, err, "Resolving a path without any existing prefix should have failed")
+	_, err = ta.Accessor.ResolveAffiliationPathPrefix("")
+	assert.Error(t, err, "Resolving an empty path should have failed")
+}
+
+func testCountEnrollmentsBetween(ta TestAccessor, t *testing.T) {
+	t.Log("TestCountEnrollmentsBetween")
+	ta.Truncate()
+
+	month := func(m time.Month) time.Time {
+		return time.Date(2018, m, 1, 0, 0, 0, 0, time.UTC)
+	}
+	enrollments := []time.Time{
+		month(time.January).Add(12 * time.Hour),
+		month(time.February),
+		month(time.February).Add(10 * 24 * time.Hour),
+		month(time.March).Add(-time.Second),
+		month(time.March),
+		month(time.April).Add(time.Hour),
+	}
+	for i, at := range enrollments {
+		err := ta.Accessor.RecordEnrollment(fmt.Sprintf("user%d", i%2), "CN=user", "10.0.0.1:40000", at)
+		assert.NoError(t, err, "Failed to record enrollment")
+	}
+
+	count, err := ta.Accessor.CountEnrollmentsBetween(month(time.February), month(time.March))
+	assert.NoError(t, err, "Failed to count enrollments")
+	assert.Equal(t, 3, count, "February should include its first instant and exclude March's")
+
+	total := 0
+	for m := time.January; m <= time.April; m++ {
+		count, err = ta.Accessor.CountEnrollmentsBetween(month(m), month(m+1))
+		assert.NoError(t, err, "Failed to count enrollments")
+		total += count
+	}
+	assert.Equal(t, len(enrollments), total, "Consecutive months should count each enrollment once")
+
+	count, err = ta.Accessor.CountEnrollmentsBetween(month(time.March), month(time.March))
+	assert.NoError(t, err, "Failed to count enrollments in an empty range")
+	assert.Equal(t, 0, count)
+	count, err = ta.Accessor.CountEnrollmentsBetween(month(time.April), month(time.January))
+	assert.NoError(t, err, "Failed to count enrollments in a reversed range")
+	assert.Equal(t, 0, count)
+}
+
+func testCompressAttributes(ta TestAccessor, t *testing.T) {
+	t.Log("TestCompressAttributes")
+	ta.Truncate()
+
+	ta.Accessor.CompressAttributes = true
+	defer func() { ta.Accessor.CompressAttributes = false }()
+
+	attrs := []api.Attribute{}
+	for i := 0; i < 200; i++ {
+		attrs = append(attrs, api.Attribute{Name: fmt.Sprintf("attr%d", i), Value: strings.Repeat("value", 20), ECert: i%2 == 0})
+	}
+	err := ta.Accessor.InsertUser(&spi.UserInfo{
+		Name:        "compressedUser",
+		Pass:        "123456",
+		Affiliation: "org1",
+		Attributes:  attrs,
+	})
+	assert.NoError(t, err, "Failed to insert user")
+
+	var stored string
+	err = ta.DB.Get(&stored, "SELECT attributes FROM users WHERE (id = 'compressedUser')")
+	assert.NoError(t, err, "Failed to get stored attributes")
+	attrBytes, err := json.Marshal(attrs)
+	assert.NoError(t, err, "Failed to marshal attributes")
+	assert.True(t, strings.HasPrefix(stored, "\x1f"), "Attributes should have been stored compressed")
+	assert.True(t, len(stored) < len(attrBytes), "Compressed attributes should be smaller than %d bytes, were %d", len(attrBytes), len(stored))
+
+	user, err := ta.Accessor.GetUser("compressedUser", nil)
+	assert.NoError(t, err, "Failed to get user")
+	userAttrs, err := user.GetAttributes(nil)
+	assert.NoError(t, err, "Failed to get attributes of user")
+	sort.Slice(userAttrs, func(i, j int) bool { return userAttrs[i].Name < userAttrs[j].Name })
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].Name < attrs[j].Name })
+	assert.Equal(t, attrs, userAttrs)
+
+	err = user.ModifyAttributes([]api.Attribute{{Name: "attr0", Value: "changed"}})
+	assert.NoError(t, err, "Failed to modify attributes")
+	err = ta.DB.Get(&stored, "SELECT attributes FROM users WHERE (id = 'compressedUser')")
+	assert.NoError(t, err, "Failed to get stored attributes")
+	assert.True(t, strings.HasPrefix(stored, "\x1f"), "Modified attributes should have been stored compressed")
+
+	// Rows stored uncompressed are still read
+	_, err = ta.DB.Exec("INSERT INTO users (id, token, type, affiliation, attributes, state, max_enrollments, level) VALUES ('plainUser', 'token', 'client', 'org1', '[{\"name\": \"dept\", \"value\": \"sales\"}]', 0, -1, 0)")
+	assert.NoError(t, err, "Failed to insert user with uncompressed attributes")
+	user, err = ta.Accessor.GetUser("plainUser", nil)
+	assert.NoError(t, err, "Failed to get user")
+	attr, err := user.GetAttribute("dept")
+	assert.NoError(t, err, "Failed to get uncompressed attribute")
+	assert.Equal(t, "sales", attr.Value)
+
+	// Compressed rows are still read once compression is turned off
+	ta.Accessor.CompressAttributes = false
+	user, err = ta.Accessor.GetUser("compressedUser", nil)
+	assert.NoError(t, err, "Failed to get user")
+	attr, err = user.GetAttribute("attr0")
+	assert.NoError(t, err, "Failed to get compressed attribute")
+	assert.Equal(t, "changed", attr.Value)
+	attr, err = user.GetAttribute("attr199")
+	assert.NoError(t, err, "Failed to get compressed attribute")
+	assert.Equal(t, strings.Repeat("value", 20), attr.Value)
+}
+
+func testGetRegistrarRoles(ta TestAccessor, t *testing.T) {
+	t.Log("TestGetRegistrarRoles")
+	ta.Truncate()
+
+	users := []spi.UserInfo{
+		{Name: "registrar", Attributes: []api.Attribute{{Name: "hf.Registrar.Roles", Value: "client, peer,orderer"}}},
+		{Name: "plainUser", Attributes: []api.Attribute{{Name: "dept", Value: "sales"}}},
+	}
+	for i := range users {
+		users[i].Pass = "123456"
+		users[i].Affiliation = "org1"
+		err := ta.Accessor.InsertUser(&users[i])
+		assert.NoError(t, err, "Failed to insert user %s", users[i].Name)
+	}
+
+	roles, err := ta.Accessor.GetRegistrarRoles("registrar")
+	assert.NoError(t, err, "Failed to get registrar roles")
+	assert.Equal(t, []string{"client", "peer", "orderer"}, roles)
+
+	roles, err = ta.Accessor.GetRegistrarRoles("plainUser")
+	assert.NoError(t, err, "Failed to get registrar roles")
+	assert.Empty(t, roles, "A user that is not a registrar should have no registrar roles")
+
+	_, err = ta.Accessor.GetRegistrarRoles("unknownUser")
+	assert.Error(t, err, "Getting the registrar roles of a non-existent user should have failed")
+}
+
+func testCanRegisterType(ta TestAccessor, t *testing.T) {
+	t.Log("TestCanRegisterType")
+	ta.Truncate()
+
+	users := []spi.UserInfo{
+		{Name: "registrar", Attributes: []api.Attribute{{Name: "hf.Registrar.Roles", Value: "client,peer"}}},
+		{Name: "superRegistrar", Attributes: []api.Attribute{{Name: "hf.Registrar.Roles", Value: "*"}}},
+		{Name: "plainUser"},
+	}
+	for i := range users {
+		users[i].Pass = "123456"
+		users[i].Affiliation = "org1"
+		err := ta.Accessor.InsertUser(&users[i])
+		assert.NoError(t, err, "Failed to insert user %s", users[i].Name)
+	}
+
+	tests := []struct {
+		registrar, targetType string
+		allowed               bool
+	}{
+		{"registrar", "peer", true},
+		{"registrar", "", true},
+		{"registrar", "orderer", false},
+		{"superRegistrar", "orderer", true},
+		{"plainUser", "client", false},
+	}
+	for _, test := range tests {
+		allowed, err := ta.Accessor.CanRegisterType(test.registrar, test.targetType)
+		assert.NoError(t, err, "Failed to check if %s can register type '%s'", test.registrar, test.targetType)
+		assert.Equal(t, test.allowed, allowed, "Incorrect result for %s registering type '%s'", test.registrar, test.targetType)
+	}
+
+	_, err := ta.Accessor.CanRegisterType("unknownUser", "client")
+	assert.Error(t, err, "Checking a non-existent registrar should have failed")
+}
+
+func testCanRegisterInAffiliation(ta TestAccessor, t *testing.T) {
+	t.Log("TestCanRegisterInAffiliation")
+	ta.Truncate()
+
+	for _, aff := range []struct{ name, prekey string }{{"org1", ""}, {"org1.dept1", "org1"}, {"org1.dept1.team1", "org1.dept1"}, {"org1.dept2", "org1"}, {"org2", ""}} {
+		err := ta.Accessor.InsertAffiliation(aff.name, aff.prekey, 0)
+		assert.NoError(t, err, "Failed to insert affiliation %s", aff.name)
+	}
+	users := []spi.UserInfo{
+		{Name: "deptRegistrar", Affiliation: "org1.dept1"},
+		{Name: "rootRegistrar", Affiliation: ""},
+	}
+	for i := range users {
+		users[i].Pass = "123456"
+		users[i].Attributes = []api.Attribute{{Name: "hf.Registrar.Roles", Value: "client"}}
+		err := ta.Accessor.InsertUser(&users[i])
+		assert.NoError(t, err, "Failed to insert user %s", users[i].Name)
+	}
+
+	tests := []struct {
+		registrar, targetAffiliation string
+		allowed                      bool
+	}{
+		{"deptRegistrar", "org1.dept1", true},
+		{"deptRegistrar", "org1.dept1.team1", true},
+		{"deptRegistrar", "org1", false},
+		{"deptRegistrar", "org1.dept2", false},
+		{"deptRegistrar", "org2", false},
+		{"rootRegistrar", "org2", true},
+	}
+	for _, test := range tests {
+		allowed, err := ta.Accessor.CanRegisterInAffiliation(test.registrar, test.targetAffiliation)
+		assert.NoError(t, err, "Failed to check if %s can register in '%s'", test.registrar, test.targetAffiliation)
+		assert.Equal(t, test.allowed, allowed, "Incorrect result for %s registering in '%s'", test.registrar, test.targetAffiliation)
+	}
+
+	_, err := ta.Accessor.CanRegisterInAffiliation("deptRegistrar", "org3")
+	assert.Error(t, err, "Checking a non-existent affiliation should have failed")
+	_, err = ta.Accessor.CanRegisterInAffiliation("unknownUser", "org1")
+	assert.Error(t, err, "Checking a non-existent registrar should have failed")
+}
+
+func testCertNotification(ta TestAccessor, t *testing.T) {
+	t.Log("TestCertNotification")
+	ta.Truncate()
+
+	certDBAcc := NewCertDBAccessor(ta.DB, 0)
+	now := time.Now().UTC()
+	insertCert := func(serial, status string, expiry time.Time) {
+		_, err := ta.DB.Exec("INSERT INTO certificates (id, serial_number, authority_key_identifier, ca_label, status, reason, expiry, revoked_at, pem) VALUES ('user1', ?, 'aki1', '', ?, 0, ?, ?, 'pem')", serial, status, expiry, time.Time{})
+		assert.NoError(t, err, "Failed to insert certificate %s", serial)
+	}
+	insertCert("01", "good", now.Add(time.Hour))
+	insertCert("02", "good", now.Add(2*time.Hour))
+	insertCert("03", "good", now.Add(48*time.Hour))
+	insertCert("04", "revoked", now.Add(time.Hour))
+	insertCert("05", "good", now.Add(-time.Hour))
+
+	serials := func(crs []CertRecord) []string {
+		result := []string{}
+		for _, cr := range crs {
+			result = append(result, cr.Serial)
+		}
+		return result
+	}
+
+	crs, err := certDBAcc.GetCertsNeedingNotification(24 * time.Hour)
+	assert.NoError(t, err, "Failed to get certificates needing notification")
+	assert.Equal(t, []string{"01", "02"}, serials(crs))
+
+	err = certDBAcc.MarkNotified("01", "aki1")
+	assert.NoError(t, err, "Failed to mark certificate notified")
+	crs, err = certDBAcc.GetCertsNeedingNotification(24 * time.Hour)
+	assert.NoError(t, err, "Failed to get certificates needing notification")
+	assert.Equal(t, []string{"02"}, serials(crs), "A notified certificate should not need notification again")
+
+	crs, err = certDBAcc.GetCertsNeedingNotification(72 * time.Hour)
+	assert.NoError(t, err, "Failed to get certificates needing notification")
+	assert.Equal(t, []string{"02", "03"}, serials(crs))
+
+	err = certDBAcc.MarkNotified("99", "aki1")
+	assert.Error(t, err, "Marking a non-existent certificate notified should have failed")
+}
+
+func testGetUserRecord(ta TestAccessor, t *testing.T) {
+	t.Log("TestGetUserRecord")
+	ta.Truncate()
+
+	ta.Accessor.CAName = "ca1"
+	defer func() { ta.Accessor.CAName = "" }()
+
+	err := ta.Accessor.InsertUser(&spi.UserInfo{
+		Name:           "recordUser",
+		Pass:           "123456",
+		Type:           "client",
+		Affiliation:    "org1",
+		Attributes:     []api.Attribute{{Name: "dept", Value: "sales"}},
+		State:          1,
+		MaxEnrollments: 5,
+		Level:          2,
+	})
+	assert.NoError(t, err, "Failed to insert user")
+	now := time.Now().UTC()
+	_, err = ta.DB.Exec("UPDATE users SET incorrect_password_attempts = 1, locked_until = ?, created_by = 'admin', revocation_reason = 1, revoked_at = ?, expires_at = ?, idempotency_key = 'key', last_enrolled_at = ?, serial_number = '02', aki = 'aki1', previous_serial_number = '01', previous_aki = 'aki1', secret_expires_at = ?, is_bootstrap = 1 WHERE (id = 'recordUser')", now, now, now, now, now)
+	assert.NoError(t, err, "Failed to set the remaining columns of user")
+
+	userRec, err := ta.Accessor.GetUserRecord("recordUser")
+	if !assert.NoError(t, err, "Failed to get user record") {
+		return
+	}
+	v := reflect.ValueOf(*userRec)
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		assert.False(t, reflect.DeepEqual(field.Interface(), reflect.Zero(field.Type()).Interface()), "Field %s of user record is not populated", v.Type().Field(i).Name)
+	}
+	assert.Equal(t, "recordUser", userRec.Name)
+	assert.Equal(t, 1, userRec.State)
+	assert.Equal(t, "02", userRec.SerialNumber.String)
+	assert.Equal(t, "aki1", userRec.AKI.String)
+
+	_, err = ta.Accessor.GetUserRecord("unknownUser")
+	assert.Error(t, err, "Getting the record of a non-existent user should have failed")
+}
+
+func testSetStates(ta TestAccessor, t *testing.T) {
+	t.Log("TestSetStates")
+	ta.Truncate()
+
+	for _, id := range []string{"user1", "user2", "user3"} {
+		err := ta.Accessor.InsertUser(&spi.UserInfo{Name: id, Pass: "123456", Affiliation: "org1", State: 1})
+		assert.NoError(t, err, "Failed to insert user %s", id)
+	}
+
+	states := map[string]int{"user1": 3, "user2": 1, "user3": -1, "unknownUser": 2}
+	updated, err := ta.Accessor.SetStates(states)
+	assert.NoError(t, err, "Failed to set states")
+	assert.Equal(t, 2, updated, "Only the users whose state changed should be counted")
+
+	for id, state := range map[string]int{"user1": 3, "user2": 1, "user3": -1} {
+		user, err := ta.Accessor.GetUser(id, nil)
+		if assert.NoError(t, err, "Failed to get user %s", id) {
+			assert.Equal(t, state, user.(*DBUser).State, "Incorrect state of %s", id)
+		}
+	}
+
+	updated, err = ta.Accessor.SetStates(states)
+	assert.NoError(t, err, "Failed to set states")
+	assert.Equal(t, 0, updated, "Setting the same states again should change nothing")
+}
+
+func testCAName(ta TestAccessor, t *testing.T) {
+	t.Log("TestCAName")
+	ta.Truncate()
+
+	ca1 := ta.Accessor
+	ca1.CAName = "ca1"
+	defer func() { ca1.CAName = "" }()
+	ca2 := NewDBAccessor(ta.DB)
+	ca2.CAName = "ca2"
+
+	err := ca1.InsertUser(&spi.UserInfo{Name: "shared", Pass: "123456", Type: "client", Affiliation: "org1", MaxEnrollments: -1})
+	assert.NoError(t, err, "Failed to insert user into ca1")
+	err = ca2.InsertUser(&spi.UserInfo{Name: "shared", Pass: "123456", Type: "peer", Affiliation: "org2", MaxEnrollments: -1})
+	assert.NoError(t, err, "Failed to insert user with the same id into ca2")
+	err = ca1.InsertUser(&spi.UserInfo{Name: "shared", Pass: "123456", Affiliation: "org1"})
+	assert.Error(t, err, "Inserting a duplicate user into the same CA should have failed")
+	err = ca1.InsertUser(&spi.UserInfo{Name: "onlyCA1", Pass: "123456", Affiliation: "org1"})
+	assert.NoError(t, err, "Failed to insert user into ca1")
+
+	user, err := ca1.GetUser("shared", nil)
+	if assert.NoError(t, err, "Failed to get user from ca1") {
+		assert.Equal(t, "org1", GetUserAffiliation(user))
+		assert.Equal(t, "client", user.(*DBUser).Type)
+	}
+	user, err = ca2.GetUser("shared", nil)
+	if assert.NoError(t, err, "Failed to get user from ca2") {
+		assert.Equal(t, "org2", GetUserAffiliation(user))
+		assert.Equal(t, "peer", user.(*DBUser).Type)
+	}
+	_, err = ca2.GetUser("onlyCA1", nil)
+	assert.Error(t, err, "A user of ca1 should not be found in ca2")
+
+	// Enrollments are recorded for the identity of the CA
+	now := time.Now()
+	err = ca1.RecordEnrollment("shared", "CN=shared,O=ca1", "127.0.0.1", now)
+	assert.NoError(t, err, "Failed to record enrollment in ca1")
+	for i := 0; i < 2; i++ {
+		err = ca2.RecordEnrollment("shared", "CN=shared,O=ca2", "127.0.0.2", now)
+		assert.NoError(t, err, "Failed to record enrollment in ca2")
+	}
+	history, err := ca1.GetEnrollmentHistory("shared")
+	if assert.NoError(t, err, "Failed to get enrollment history from ca1") && assert.Len(t, history, 1) {
+		assert.Equal(t, "CN=shared,O=ca1", history[0].CSRSubject)
+	}
+	count, err := ca2.CountEnrollmentsBetween(now.Add(-time.Minute), now.Add(time.Minute))
+	assert.NoError(t, err, "Failed to count enrollments of ca2")
+	assert.Equal(t, 2, count, "Only the enrollments of ca2 should have been counted")
+	_, err = NewDBAccessor(ta.DB).GetUser("shared", nil)
+	assert.Error(t, err, "A user of ca1 should not be found without a CA name")
+
+	// Updates only affect the identity of the CA
+	err = ca1.UpdateUser(&spi.UserInfo{Name: "shared", Type: "admin", Affiliation: "org1", MaxEnrollments: -1}, false)
+	assert.NoError(t, err, "Failed to update user of ca1")
+	user, err = ca1.GetUser("shared", nil)
+	if assert.NoError(t, err, "Failed to get user from ca1") {
+		assert.Equal(t, "admin", user.(*DBUser).Type)
+		err = user.LoginComplete()
+		assert.NoError(t, err, "Failed to complete login of user of ca1")
+	}
+	user, err = ca2.GetUser("shared", nil)
+	if assert.NoError(t, err, "Failed to get user from ca2") {
+		assert.Equal(t, "peer", user.(*DBUser).Type)
+		assert.Equal(t, 0, user.(*DBUser).State, "Logging in to ca1 should not change the state of the user of ca2")
+	}
+
+	users, cursor, err := ca1.ListUsersAfter("", 10)
+	assert.NoError(t, err, "Failed to list users of ca1")
+	assert.Empty(t, cursor)
+	if assert.Len(t, users, 2) {
+		assert.Equal(t, "onlyCA1", users[0].Name)
+		assert.Equal(t, "shared", users[1].Name)
+	}
+
+	_, err = ca2.DeleteUser("shared")
+	assert.NoError(t, err, "Failed to delete user of ca2")
+	_, err = ca2.GetUser("shared", nil)
+	assert.Error(t, err, "The deleted user of ca2 should not be found")
+	_, err = ca1.GetUser("shared", nil)
+	assert.NoError(t, err, "Deleting the user of ca2 should not delete the user of ca1")
+
+	// Renaming and deleting affiliations only affect the identities of the CA
+	for _, name := range []string{"org1", "org2"} {
+		err = ca1.InsertAffiliation(name, "", 0)
+		assert.NoError(t, err, "Failed to insert affiliation '%s'", name)
+	}
+	err = ca2.InsertUser(&spi.UserInfo{Name: "shared", Pass: "123456", Affiliation: "org2", MaxEnrollments: -1})
+	assert.NoError(t, err, "Failed to insert user into ca2")
+	result, err := ca1.ModifyAffiliation("org1", "org3", true, true)
+	if assert.NoError(t, err, "Failed to rename affiliation of ca1") && assert.Len(t, result.Identities, 2) {
+		for _, user := range result.Identities {
+			assert.Equal(t, "org3", user.(*DBUser).Affiliation, "Renamed identity should be of ca1")
+		}
+	}
+	result, err = ca1.DeleteAffiliation("org3", true, true, true)
+	if assert.NoError(t, err, "Failed to delete affiliation of ca1") {
+		assert.Len(t, result.Identities, 2)
+	}
+	_, err = ca1.GetUser("shared", nil)
+	assert.Error(t, err, "Identity of ca1 in the deleted affiliation should have been deleted")
+	user, err = ca2.GetUser("shared", nil)
+	if assert.NoError(t, err, "Deleting an affiliation of ca1 should not delete the identity of ca2") {
+		assert.Equal(t, "org2", GetUserAffiliation(user))
+	}
+
+	// Affiliations of identities of other CAs can not be removed
+	_, err = ca1.DeleteAffiliation("org2", true, true, true)
+	if assert.Error(t, err, "Deleting an affiliation with identities of another CA should have failed") {
+		assert.Contains(t, err.Error(), fmt.Sprintf("code: %d", ErrUpdateConfigRemoveAff))
+	}
+	_, err = ca1.ModifyAffiliation("org2", "org4", true, true)
+	if assert.Error(t, err, "Renaming an affiliation with identities of another CA should have failed") {
+		assert.Contains(t, err.Error(), fmt.Sprintf("code: %d", ErrUpdateConfigModifyAff))
+	}
+}
+
+func testGetUserWithAffiliationCheck(ta TestAccessor, t *testing.T) {
+	t.Log("TestGetUserWithAffiliationCheck")
+	ta.Truncate()
+
+	err := ta.Accessor.InsertAffiliation("org1", "", 0)
+	assert.NoError(t, err, "Failed to insert affiliation")
+	users := []spi.UserInfo{
+		{Name: "validUser", Affiliation: "org1"},
+		{Name: "rootUser", Affiliation: ""},
+		{Name: "danglingUser", Affiliation: "org2"},
+	}
+	for i := range users {
+		users[i].Pass = "123456"
+		err = ta.Accessor.InsertUser(&users[i])
+		assert.NoError(t, err, "Failed to insert user %s", users[i].Name)
+	}
+
+	user, err := ta.Accessor.GetUserWithAffiliationCheck("validUser")
+	if assert.NoError(t, err, "Failed to get user with an existing affiliation") {
+		assert.Equal(t, "validUser", user.GetName())
+	}
+	_, err = ta.Accessor.GetUserWithAffiliationCheck("rootUser")
+	assert.NoError(t, err, "Failed to get user with the root affiliation")
+
+	_, err = ta.Accessor.GetUserWithAffiliationCheck("danglingUser")
+	if assert.Error(t, err, "Getting a user whose affiliation does not exist should have failed") {
+		assert.Contains(t, err.Error(), fmt.Sprintf("code: %d", ErrInvalidRequest))
+	}
+
+	_, err = ta.Accessor.GetUserWithAffiliationCheck("unknownUser")
+	assert.Error(t, err, "Getting a non-existent user should have failed")
+}
+
+func testExportImportAffiliations(ta TestAccessor, t *testing.T) {
+	t.Log("TestExportImportAffiliations")
+	ta.Truncate()
+
+	affiliations := []struct {
+		name, prekey string
+		level        int
+	}{
+		{"org1", "", 0},
+		{"org1.dept1", "org1", 1},
+		{"org1.dept1.team1", "org1.dept1", 2},
+		{"org2", "", 0},
+	}
+	for _, aff := range affiliations {
+		err := ta.Accessor.InsertAffiliation(aff.name, aff.prekey, aff.level)
+		assert.NoError(t, err, "Failed to insert affiliation %s", aff.name)
+	}
+
+	var buf bytes.Buffer
+	err := ta.Accessor.ExportAffiliations(&buf)
+	if !assert.NoError(t, err, "Failed to export affiliations") {
+		return
+	}
+	exported := buf.String()
+
+	// Reverse the export so that children precede their parents
+	var affs []ExportedAffiliation
+	err = json.Unmarshal(buf.Bytes(), &affs)
+	if !assert.NoError(t, err, "Failed to parse exported affiliations") {
+		return
+	}
+	assert.Equal(t, len(affiliations), len(affs))
+	for i, j := 0, len(affs)-1; i < j; i, j = i+1, j-1 {
+		affs[i], affs[j] = affs[j], affs[i]
+	}
+	reversed, err := json.Marshal(affs)
+	assert.NoError(t, err, "Failed to marshal affiliations")
+
+	ta.Truncate()
+	count, err := ta.Accessor.ImportAffiliations(bytes.NewReader(reversed))
+	assert.NoError(t, err, "Failed to import affiliations")
+	assert.Equal(t, len(affiliations), count)
+	for _, aff := range affiliations {
+		imported, err := ta.Accessor.GetAffiliation(aff.name)
+		if assert.NoError(t, err, "Failed to get imported affiliation %s", aff.name) {
+			assert.Equal(t, aff.prekey, imported.GetPrekey())
+			assert.Equal(t, aff.level, imported.GetLevel())
+		}
+	}
+
+	buf.Reset()
+	err = ta.Accessor.ExportAffiliations(&buf)
+	assert.NoError(t, err, "Failed to export imported affiliations")
+	assert.Equal(t, exported, buf.String())
+
+	count, err = ta.Accessor.ImportAffiliations(strings.NewReader(exported))
+	assert.NoError(t, err, "Failed to import existing affiliations")
+	assert.Equal(t, 0, count, "Existing affiliations should not have been imported again")
+
+	ta.Truncate()
+	_, err = ta.Accessor.ImportAffiliations(strings.NewReader(`[{"name":"org3.dept1","parent":"org3","level":1}]`))
+	if assert.Error(t, err, "Importing an affiliation whose parent does not exist should have failed") {
+		assert.Contains(t, err.Error(), fmt.Sprintf("code: %d", ErrInvalidRequest))
+	}
+	_, err = ta.Accessor.GetAffiliation("org3.dept1")
+	assert.Error(t, err, "A failed import should not have added any affiliations")
+}
+
+func testLockUser(ta TestAccessor, t *testing.T) {
+	t.Log("TestLockUser")
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	holders, maxHolders := 0, 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := ta.Accessor.LockUser("testLockUser")
+			defer unlock()
+
+			mutex.Lock()
+			holders++
+			if holders > maxHolders {
+				maxHolders = holders
+			}
+			mutex.Unlock()
+
+			time.Sleep(time.Millisecond)
+
+			mutex.Lock()
+			holders--
+			mutex.Unlock()
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, maxHolders, "More than one caller held the lock of the same identity")
+
+	// The lock of one identity does not block callers locking another
+	unlock := ta.Accessor.LockUser("testLockUser1")
+	locked := make(chan func())
+	go func() {
+		locked <- ta.Accessor.LockUser("testLockUser2")
+	}()
+	select {
+	case unlock2 := <-locked:
+		unlock2()
+	case <-time.After(5 * time.Second):
+		t.Error("Locking an identity was blocked by the lock of another identity")
+	}
+
+	// Releasing twice has no effect, and the identity can be locked again
+	unlock()
+	unlock()
+	go func() {
+		locked <- ta.Accessor.LockUser("testLockUser1")
+	}()
+	select {
+	case unlock = <-locked:
+		unlock()
+	case <-time.After(5 * time.Second):
+		t.Error("Locking a released identity was blocked")
+	}
+}
+
+func testFindUsers(ta TestAccessor, t *testing.T) {
+	t.Log("TestFindUsers")
+	ta.Truncate()
+
+	users := []spi.UserInfo{
+		{Name: "peer1", Type: "peer", Attributes: []api.Attribute{{Name: "hf.Revoker", Value: "true"}, {Name: "role", Value: "admin"}}},
+		{Name: "peer2", Type: "peer", Attributes: []api.Attribute{{Name: "hf.Revoker", Value: "false"}}},
+		{Name: "client1", Type: "client", Attributes: []api.Attribute{{Name: "hf.Revoker", Value: "true"}}},
+		{Name: "client2", Type: "client"},
+	}
+	for i := range users {
+		users[i].Pass = "123456"
+		err := ta.Accessor.InsertUser(&users[i])
+		assert.NoError(t, err, "Failed to insert user %s", users[i].Name)
+	}
+
+	tests := []struct {
+		predicates map[string]string
+		expected   []string
+	}{
+		{map[string]string{"type": "peer"}, []string{"peer1", "peer2"}},
+		{map[string]string{"hf.Revoker": "true"}, []string{"client1", "peer1"}},
+		{map[string]string{"type": "peer", "hf.Revoker": "true"}, []string{"peer1"}},
+		{map[string]string{"hf.Revoker": "true", "role": "admin"}, []string{"peer1"}},
+		{map[string]string{"type": "client", "role": "admin"}, []string{}},
+		{map[string]string{"hf.Revoker": "maybe"}, []string{}},
+		{map[string]string{}, []string{"client1", "client2", "peer1", "peer2"}},
+	}
+	for _, test := range tests {
+		found, err := ta.Accessor.FindUsers(test.predicates)
+		if !assert.NoError(t, err, "Failed to find users matching %v", test.predicates) {
+			continue
+		}
+		names := []string{}
+		for _, user := range found {
+			names = append(names, user.Name)
+		}
+		assert.Equal(t, test.expected, names, "Incorrect users matching %v", test.predicates)
+	}
+}
+
+func testTruncateTables(ta TestAccessor, t *testing.T) {
+	t.Log("TestTruncateTables")
+	ta.Truncate()
+
+	err := ta.Accessor.InsertAffiliation("org1", "", 0)
+	assert.NoError(t, err, "Failed to insert affiliation")
+	err = ta.Accessor.InsertUser(&spi.UserInfo{Name: "testTruncateUser", Pass: "123456", Affiliation: "org1"})
+	assert.NoError(t, err, "Failed to insert user")
+	err = ta.Accessor.RecordEnrollment("testTruncateUser", "CN=testTruncateUser", "127.0.0.1", time.Now())
+	assert.NoError(t, err, "Failed to record enrollment")
+	_, err = ta.DB.Exec("INSERT INTO certificates (id, serial_number, authority_key_identifier, ca_label, status, reason, expiry, revoked_at, pem) VALUES ('testTruncateUser', 'serial1', 'aki1', '', 'good', 0, ?, ?, 'pem')", time.Now(), time.Time{})
+	assert.NoError(t, err, "Failed to insert certificate")
+
+	err = ta.Accessor.Truncate()
+	if assert.Error(t, err, "Truncating tables without AllowTruncate should have failed") {
+		assert.Contains(t, err.Error(), fmt.Sprintf("code: %d", ErrTruncateNotAllowed))
+	}
+	_, err = ta.Accessor.GetUser("testTruncateUser", nil)
+	assert.NoError(t, err, "A truncate that was not allowed should not have deleted users")
+
+	ta.Accessor.AllowTruncate = true
+	defer func() { ta.Accessor.AllowTruncate = false }()
+	err = ta.Accessor.Truncate()
+	assert.NoError(t, err, "Failed to truncate tables")
+	for _, table := range []string{"users", "affiliations", "certificates", "enrollment_events"} {
+		var count int
+		err = ta.DB.Get(&count, fmt.Sprintf("SELECT COUNT(*) FROM %s", table))
+		assert.NoError(t, err, "Failed to count rows of table %s", table)
+		assert.Equal(t, 0, count, "Table %s is not empty after truncating", table)
+	}
+
+	// The truncated affiliation can be added again, and its rowid starts over
+	err = ta.Accessor.InsertAffiliation("org1", "", 0)
+	assert.NoError(t, err, "Failed to insert affiliation after truncating")
+	var rowid int
+	err = ta.DB.Get(&rowid, "SELECT rowid FROM affiliations WHERE (name = 'org1')")
+	assert.NoError(t, err, "Failed to get rowid of affiliation")
+	assert.Equal(t, 1, rowid, "Rowids of affiliations should restart after truncating")
+}
+
+func testSortAttributes(ta TestAccessor, t *testing.T) {
+	t.Log("TestSortAttributes")
+	ta.Truncate()
+
+	err := ta.Accessor.InsertUser(&spi.UserInfo{
+		Name: "testSortAttributes",
+		Pass: "123456",
+		Attributes: []api.Attribute{
+			{Name: "zeta", Value: "1"},
+			{Name: "alpha", Value: "2"},
+			{Name: "mu", Value: "3", ECert: true},
+			{Name: "beta", Value: "4", ECert: true},
+		},
+	})
+	assert.NoError(t, err, "Failed to insert user")
+
+	user, err := ta.Accessor.GetUser("testSortAttributes", nil)
+	if assert.NoError(t, err, "Failed to get user") {
+		assert.Equal(t, "zeta", user.(*DBUser).Attributes[0].Name, "Attributes should be in stored order by default")
+	}
+
+	ta.Accessor.SortAttributes = true
+	defer func() { ta.Accessor.SortAttributes = false }()
+	attrNames := func(attrs []api.Attribute) []string {
+		names := []string{}
+		for _, attr := range attrs {
+			names = append(names, attr.Name)
+		}
+		return names
+	}
+	for i := 0; i < 10; i++ {
+		user, err = ta.Accessor.GetUser("testSortAttributes", nil)
+		if !assert.NoError(t, err, "Failed to get user") {
+			return
+		}
+		assert.Equal(t, []string{"alpha", "beta", "mu", "zeta"}, attrNames(user.(*DBUser).Attributes))
+		attrs, err := user.GetAttributes(nil)
+		assert.NoError(t, err, "Failed to get attributes")
+		assert.Equal(t, []string{"alpha", "beta", "mu", "zeta"}, attrNames(attrs))
+	}
+
+	user, err = ta.Accessor.GetUserECert("testSortAttributes")
+	if assert.NoError(t, err, "Failed to get user with ECert attributes") {
+		assert.Equal(t, []string{"beta", "mu"}, attrNames(user.(*DBUser).Attributes))
+	}
+}
+
+// recordingEventSink is an EventSink that keeps the events it is sent
+type recordingEventSink struct {
+	events []ChangeEvent
+}
+
+func (s *recordingEventSink) Emit(event ChangeEvent) {
+	s.events = append(s.events, event)
+}
+
+func testEventSink(ta TestAccessor, t *testing.T) {
+	t.Log("TestEventSink")
+	ta.Truncate()
+
+	sink := &recordingEventSink{}
+	ta.Accessor.EventSink = sink
+	defer func() { ta.Accessor.EventSink = nil }()
+
+	user := spi.UserInfo{Name: "testEventSink", Pass: "123456", Type: "client", MaxEnrollments: 1}
+	err := ta.Accessor.InsertUser(&user)
+	assert.NoError(t, err, "Failed to insert user")
+	if assert.Len(t, sink.events, 1, "Inserting a user should have emitted one event") {
+		event := sink.events[0]
+		assert.Equal(t, ChangeInsert, event.Op)
+		assert.Equal(t, "testEventSink", event.ID)
+		if assert.NotNil(t, event.Record, "Insert event is missing the record") {
+			assert.Equal(t, "client", event.Record.Type)
+		}
+	}
+
+	err = ta.Accessor.InsertUser(&user)
+	assert.Error(t, err, "Inserting a duplicate user should have failed")
+	assert.Len(t, sink.events, 1, "A failed insert should not have emitted an event")
+
+	user.Type = "peer"
+	err = ta.Accessor.UpdateUser(&user, false)
+	assert.NoError(t, err, "Failed to update user")
+	if assert.Len(t, sink.events, 2, "Updating a user should have emitted one event") {
+		event := sink.events[1]
+		assert.Equal(t, ChangeUpdate, event.Op)
+		assert.Equal(t, "testEventSink", event.ID)
+		if assert.NotNil(t, event.Record, "Update event is missing the record") {
+			assert.Equal(t, "peer", event.Record.Type)
+		}
+	}
+
+	_, err = ta.Accessor.DeleteUser("testEventSink")
+	assert.NoError(t, err, "Failed to delete user")
+	if assert.Len(t, sink.events, 3, "Deleting a user should have emitted one event") {
+		event := sink.events[2]
+		assert.Equal(t, ChangeDelete, event.Op)
+		assert.Equal(t, "testEventSink", event.ID)
+		assert.Nil(t, event.Record, "Delete event should not have a record")
+	}
+
+	_, err = ta.Accessor.DeleteUser("testEventSink")
+	assert.Error(t, err, "Deleting a non-existent user should have failed")
+	assert.Len(t, sink.events, 3, "A failed delete should not have emitted an event")
+
+	err = ta.Accessor.InsertAffiliation("eventOrg", "", 0)
+	assert.NoError(t, err, "Failed to insert affiliation")
+	for _, name := range []string{"testEvent1", "testEvent2"} {
+		err = ta.Accessor.InsertUser(&spi.UserInfo{Name: name, Pass: "123456", Type: "client", Affiliation: "eventOrg", MaxEnrollments: -1})
+		assert.NoError(t, err, "Failed to insert user %s", name)
+	}
+
+	sink.events = nil
+	err = ta.Accessor.UpdateField("testEvent1", FieldLevel, 3)
+	assert.NoError(t, err, "Failed to update field")
+	if assert.Len(t, sink.events, 1, "Updating a field should have emitted one event") {
+		assert.Equal(t, ChangeUpdate, sink.events[0].Op)
+		if assert.NotNil(t, sink.events[0].Record, "Update event is missing the record") {
+			assert.Equal(t, 3, sink.events[0].Record.Level)
+		}
+	}
+
+	// A batch write emits one event for each identity it changed
+	sink.events = nil
+	updated, err := ta.Accessor.UpdateFieldBatch([]string{"testEvent1", "testEvent2", "testUnknown"}, FieldType, "peer")
+	assert.NoError(t, err, "Failed to update field of multiple users")
+	assert.Equal(t, 2, updated)
+	assert.Equal(t, []string{"testEvent1", "testEvent2"}, eventIDs(sink.events))
+	sink.events = nil
+	revoked, err := ta.Accessor.RevokeAffiliationMembers("eventOrg", ocsp.KeyCompromise)
+	assert.NoError(t, err, "Failed to revoke affiliation members")
+	assert.Equal(t, 2, revoked)
+	assert.Equal(t, []string{"testEvent1", "testEvent2"}, eventIDs(sink.events))
+
+	// Writes through a user returned by the accessor emit events too
+	sink.events = nil
+	dbUser, err := ta.Accessor.GetUser("testEvent1", nil)
+	if assert.NoError(t, err, "Failed to get user") {
+		err = dbUser.ModifyAttributes([]api.Attribute{{Name: "attr1", Value: "value1"}})
+		assert.NoError(t, err, "Failed to modify attributes")
+		if assert.Len(t, sink.events, 1, "Modifying attributes of a user should have emitted one event") {
+			assert.Equal(t, ChangeUpdate, sink.events[0].Op)
+			if assert.NotNil(t, sink.events[0].Record, "Update event is missing the record") {
+				assert.Contains(t, sink.events[0].Record.Attributes, "value1")
+			}
+		}
+	}
+
+	sink.events = nil
+	_, err = ta.Accessor.DeleteAffiliation("eventOrg", true, true, true)
+	assert.NoError(t, err, "Failed to delete affiliation with its identities")
+	assert.Equal(t, []string{"testEvent1", "testEvent2"}, eventIDs(sink.events))
+	for _, event := range sink.events {
+		assert.Equal(t, ChangeDelete, event.Op)
+	}
+}
+
+// eventIDs returns the sorted ids of events
+func eventIDs(events []ChangeEvent) []string {
+	ids := []string{}
+	for _, event := range events {
+		ids = append(ids, event.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func testGetExpiringCertsInAffiliation(ta TestAccessor, t *testing.T) {
+	t.Log("TestGetExpiringCertsInAffiliation")
+	ta.Truncate()
+
+	for _, aff := range []struct{ name, prekey string }{{"org1", ""}, {"org1.dept1", "org1"}, {"org10", ""}, {"org2", ""}} {
+		err := ta.Accessor.InsertAffiliation(aff.name, aff.prekey, 0)
+		assert.NoError(t, err, "Failed to insert affiliation %s", aff.name)
+	}
+	for _, user := range []struct{ name, affiliation string }{{"user1", "org1"}, {"user2", "org1.dept1"}, {"user3", "org2"}, {"user4", "org10"}} {
+		err := ta.Accessor.InsertUser(&spi.UserInfo{Name: user.name, Pass: "123456", Affiliation: user.affiliation})
+		assert.NoError(t, err, "Failed to insert user %s", user.name)
+	}
+
+	day := 24 * time.Hour
+	now := time.Now().UTC()
+	certs := []struct {
+		id, serial, status string
+		expiry             time.Time
+	}{
+		{"user1", "user1-soon", "good", now.Add(day)},
+		{"user1", "user1-later", "good", now.Add(100 * day)},
+		{"user1", "user1-expired", "good", now.Add(-day)},
+		{"user2", "user2-soon", "good", now.Add(2 * day)},
+		{"user2", "user2-revoked", "revoked", now.Add(day)},
+		{"user3", "user3-soon", "good", now.Add(3 * day)},
+		{"user4", "user4-soon", "good", now.Add(4 * day)},
+	}
+	for _, cert := range certs {
+		_, err := ta.DB.Exec("INSERT INTO certificates (id, serial_number, authority_key_identifier, ca_label, status, reason, expiry, revoked_at, pem) VALUES (?, ?, 'aki1', '', ?, 0, ?, ?, 'pem')", cert.id, cert.serial, cert.status, cert.expiry, time.Time{})
+		assert.NoError(t, err, "Failed to insert certificate %s", cert.serial)
+	}
+
+	tests := []struct {
+		affiliation string
+		expected    []string
+	}{
+		{"org1", []string{"user1-soon", "user2-soon"}},
+		{"org1.dept1", []string{"user2-soon"}},
+		{"org2", []string{"user3-soon"}},
+		{"", []string{"user1-soon", "user2-soon", "user3-soon", "user4-soon"}},
+	}
+	for _, test := range tests {
+		expiring, err := ta.Accessor.GetExpiringCertsInAffiliation(test.affiliation, now.Add(10*day))
+		if !assert.NoError(t, err, "Failed to get expiring certificates in affiliation '%s'", test.affiliation) {
+			continue
+		}
+		serials := []string{}
+		for _, cert := range expiring {
+			serials = append(serials, cert.Serial)
+		}
+		assert.Equal(t, test.expected, serials, "Incorrect expiring certificates in affiliation '%s'", test.affiliation)
+	}
+
+	_, err := ta.Accessor.GetExpiringCertsInAffiliation("org3", now.Add(10*day))
+	assert.Error(t, err, "Getting expiring certificates in a non-existent affiliation should have failed")
+}
+
+func testIDValidator(ta TestAccessor, t *testing.T) {
+	t.Log("TestIDValidator")
+	ta.Truncate()
+
+	ta.Accessor.IDValidator = NewIDValidator(16)
+	defer func() { ta.Accessor.IDValidator = nil }()
+
+	for _, id := range []string{"user1", "User.Name-1_a", "0123456789abcdef", " padded.user "} {
+		err := ta.Accessor.InsertUser(&spi.UserInfo{Name: id, Pass: "123456"})
+		assert.NoError(t, err, "Failed to insert user with valid id '%s'", id)
+	}
+
+	for _, id := range []string{"", "user@org1", "user name", "user/1", "0123456789abcdefg", "usér"} {
+		err := ta.Accessor.InsertUser(&spi.UserInfo{Name: id, Pass: "123456"})
+		if assert.Error(t, err, "Inserting user with invalid id '%s' should have failed", id) {
+			assert.Contains(t, err.Error(), fmt.Sprintf("code: %d", ErrInvalidRequest))
+		}
+		_, err = ta.Accessor.GetUser(id, nil)
+		assert.Error(t, err, "User with invalid id '%s' should not have been inserted", id)
+	}
+
+	// Identities are validated on every path that inserts them
+	_, err := ta.Accessor.RegisterWithSecret(spi.UserInfo{Name: "user@org1"})
+	assert.Error(t, err, "Registering user with an invalid id should have failed")
+
+	assert.NoError(t, DefaultIDValidator(strings.Repeat("a", MaxIDLength)))
+	assert.Error(t, DefaultIDValidator(strings.Repeat("a", MaxIDLength+1)))
+}
+
+func testNeedsReenrollment(ta TestAccessor, t *testing.T) {
+	t.Log("TestNeedsReenrollment")
+	ta.Truncate()
+
+	day := 24 * time.Hour
+	now := time.Now().UTC()
+	tests := []struct {
+		id       string
+		state    int
+		certs    map[string]time.Time
+		expected bool
+	}{
+		{"freshUser", 1, map[string]time.Time{"good": now.Add(100 * day)}, false},
+		{"nearExpiryUser", 1, map[string]time.Time{"good": now.Add(2 * day)}, true},
+		{"expiredUser", 2, map[string]time.Time{"good": now.Add(-day)}, true},
+		{"revokedCertUser", 1, map[string]time.Time{"revoked": now.Add(100 * day)}, true},
+		{"noCertUser", 1, nil, true},
+		{"unenrolledUser", 0, nil, false},
+		{"revokedUser", -1, map[string]time.Time{"good": now.Add(2 * day)}, false},
+	}
+	for _, test := range tests {
+		err := ta.Accessor.InsertUser(&spi.UserInfo{Name: test.id, Pass: "123456", State: test.state})
+		assert.NoError(t, err, "Failed to insert user %s", test.id)
+		for status, expiry := range test.certs {
+			_, err = ta.DB.Exec("INSERT INTO certificates (id, serial_number, authority_key_identifier, ca_label, status, reason, expiry, revoked_at, pem) VALUES (?, ?, 'aki1', '', ?, 0, ?, ?, 'pem')", test.id, test.id+"-"+status, status, expiry, time.Time{})
+			assert.NoError(t, err, "Failed to insert certificate of %s", test.id)
+		}
+	}
+
+	for _, test := range tests {
+		needs, err := ta.Accessor.NeedsReenrollment(test.id, 30*day)
+		if assert.NoError(t, err, "Failed to check if %s needs reenrollment", test.id) {
+			assert.Equal(t, test.expected, needs, "Incorrect reenrollment need of %s", test.id)
+		}
+	}
+
+	// A certificate that expires later makes a near expiry one irrelevant
+	_, err := ta.DB.Exec("INSERT INTO certificates (id, serial_number, authority_key_identifier, ca_label, status, reason, expiry, revoked_at, pem) VALUES ('nearExpiryUser', 'nearExpiryUser-renewed', 'aki1', '', 'good', 0, ?, ?, 'pem')", now.Add(365*day), time.Time{})
+	assert.NoError(t, err, "Failed to insert renewed certificate")
+	needs, err := ta.Accessor.NeedsReenrollment("nearExpiryUser", 30*day)
+	assert.NoError(t, err, "Failed to check if nearExpiryUser needs reenrollment")
+	assert.False(t, needs, "An identity with a renewed certificate should not need reenrollment")
+
+	_, err = ta.Accessor.NeedsReenrollment("unknownUser", 30*day)
+	assert.Error(t, err, "Checking a non-existent user should have failed")
+}
+
+func testSwapToken(ta TestAccessor, t *testing.T) {
+	t.Log("TestSwapToken")
+	ta.Truncate()
+
+	err := ta.Accessor.InsertUser(&spi.UserInfo{Name: "testSwapToken", Pass: "oldpass", MaxEnrollments: -1})
+	assert.NoError(t, err, "Failed to insert user")
+	userRec, err := ta.Accessor.GetUserRecord("testSwapToken")
+	if !assert.NoError(t, err, "Failed to get user record") {
+		return
+	}
+	oldHash := string(userRec.Pass)
+	newHash, err := bcrypt.GenerateFromPassword([]byte("newpass"), bcrypt.DefaultCost)
+	assert.NoError(t, err, "Failed to hash password")
+
+	err = ta.Accessor.SwapToken("testSwapToken", oldHash, string(newHash))
+	assert.NoError(t, err, "Failed to swap token with matching old hash")
+	user, err := ta.Accessor.GetUser("testSwapToken", nil)
+	if assert.NoError(t, err, "Failed to get user") {
+		assert.NoError(t, user.Login("newpass", -1), "Failed to login with the swapped password")
+	}
+
+	// The old hash no longer matches, so swapping with it again conflicts
+	err = ta.Accessor.SwapToken("testSwapToken", oldHash, "otherhash")
+	if assert.Error(t, err, "Swapping token with a mismatching old hash should have failed") {
+		assert.Contains(t, err.Error(), fmt.Sprintf("code: %d", ErrTokenConflict))
+	}
+	userRec, err = ta.Accessor.GetUserRecord("testSwapToken")
+	if assert.NoError(t, err, "Failed to get user record") {
+		assert.Equal(t, newHash, userRec.Pass, "A conflicting swap should not have changed the token")
+	}
+
+	err = ta.Accessor.SwapToken("unknownUser", oldHash, string(newHash))
+	if assert.Error(t, err, "Swapping token of a non-existent user should have failed") {
+		assert.Contains(t, err.Error(), fmt.Sprintf("code: %d", ErrDBGet))
+	}
+}
+
+func testGetMergedAttributes(ta TestAccessor, t *testing.T) {
+	t.Log("TestGetMergedAttributes")
+	ta.Truncate()
+
+	affiliations := []struct{ name, prekey, attributes string }{
+		{"org1", "", `[{"name":"policy","value":"strict"},{"name":"region","value":"us"},{"name":"tier","value":"gold"}]`},
+		{"org1.dept1", "org1", `[{"name":"region","value":"eu"},{"name":"team","value":"a"}]`},
+		{"org1.dept1.team1", "org1.dept1", `[{"name":"team","value":"b"}]`},
+	}
+	for _, aff := range affiliations {
+		err := ta.Accessor.InsertAffiliation(aff.name, aff.prekey, 0)
+		assert.NoError(t, err, "Failed to insert affiliation %s", aff.name)
+		_, err = ta.DB.Exec(ta.DB.Rebind("UPDATE affiliations SET attributes = ? WHERE (name = ?)"), aff.attributes, aff.name)
+		assert.NoError(t, err, "Failed to set attributes of affiliation %s", aff.name)
+	}
+
+	users := []spi.UserInfo{
+		{Name: "teamUser", Affiliation: "org1.dept1.team1", Attributes: []api.Attribute{{Name: "tier", Value: "silver"}}},
+		{Name: "deptUser", Affiliation: "org1.dept1"},
+		{Name: "rootUser", Affiliation: "", Attributes: []api.Attribute{{Name: "tier", Value: "bronze"}}},
+	}
+	for i := range users {
+		users[i].Pass = "123456"
+		err := ta.Accessor.InsertUser(&users[i])
+		assert.NoError(t, err, "Failed to insert user %s", users[i].Name)
+	}
+
+	expected := map[string]map[string]string{
+		"teamUser": {"policy": "strict", "region": "eu", "team": "b", "tier": "silver"},
+		"deptUser": {"policy": "strict", "region": "eu", "team": "a", "tier": "gold"},
+		"rootUser": {"tier": "bronze"},
+	}
+	for id, values := range expected {
+		attrs, err := ta.Accessor.GetMergedAttributes(id)
+		if !assert.NoError(t, err, "Failed to get merged attributes of %s", id) {
+			continue
+		}
+		merged := map[string]string{}
+		for _, attr := range attrs {
+			merged[attr.Name] = attr.Value
+		}
+		assert.Equal(t, values, merged, "Incorrect merged attributes of %s", id)
+	}
+
+	_, err := ta.Accessor.GetMergedAttributes("unknownUser")
+	assert.Error(t, err, "Getting merged attributes of an unknown user should have failed")
+}
+
+func testGetCRLEntries(ta TestAccessor, t *testing.T) {
+	t.Log("TestGetCRLEntries")
+	ta.Truncate()
+
+	day := 24 * time.Hour
+	now := time.Now().UTC().Truncate(time.Second)
+	thisUpdate := now.Add(day)
+	certs := []struct {
+		serial, status string
+		reason         int
+		expiry         time.Time
+	}{
+		{"a", "revoked", 1, now.Add(30 * day)},
+		{"10", "revoked", 4, now.Add(30 * day)},
+		{"2", "revoked", 0, now.Add(30 * day)},
+		{"ff", "revoked", 1, now.Add(-day)},
+		{"fe", "revoked", 1, now.Add(day / 2)},
+		{"3", "good", 0, now.Add(30 * day)},
+	}
+	for i, cert := range certs {
+		revokedAt := time.Time{}
+		if cert.status == "revoked" {
+			revokedAt = now.Add(-time.Duration(i) * time.Hour)
+		}
+		_, err := ta.DB.Exec("INSERT INTO certificates (id, serial_number, authority_key_identifier, ca_label, status, reason, expiry, revoked_at, pem) VALUES ('user1', ?, 'aki1', '', ?, ?, ?, ?, 'pem')", cert.serial, cert.status, cert.reason, cert.expiry, revokedAt)
+		assert.NoError(t, err, "Failed to insert certificate %s", cert.serial)
+	}
+
+	entries, err := NewCertDBAccessor(ta.DB, 0).GetCRLEntries(thisUpdate)
+	if !assert.NoError(t, err, "Failed to get CRL entries") {
+		return
+	}
+	serials := []string{}
+	for _, entry := range entries {
+		serials = append(serials, entry.Serial)
+	}
+	// Only revoked certificates that have not expired by thisUpdate, in numeric order of serial
+	assert.Equal(t, []string{"2", "a", "10"}, serials)
+	if assert.Len(t, entries, 3) {
+		assert.Equal(t, 0, entries[0].Reason)
+		assert.Equal(t, 1, entries[1].Reason)
+		assert.Equal(t, 4, entries[2].Reason)
+		assert.Equal(t, "aki1", entries[1].AKI)
+		assert.True(t, now.Equal(entries[1].RevokedAt), "Incorrect revocation time %s", entries[1].RevokedAt)
+	}
+}
+
+func testInsertUserWithWarnings(ta TestAccessor, t *testing.T) {
+	t.Log("TestInsertUserWithWarnings")
+	ta.Truncate()
+
+	ta.Accessor.RecommendedAttributes = []string{"email", "hf.Revoker"}
+	defer func() { ta.Accessor.RecommendedAttributes = nil }()
+	err := ta.Accessor.InsertAffiliation("org1", "", 0)
+	assert.NoError(t, err, "Failed to insert affiliation")
+
+	warnings, err := ta.Accessor.InsertUserWithWarnings(&spi.UserInfo{
+		Name:        "completeUser",
+		Pass:        "123456",
+		Affiliation: "org1",
+		Attributes:  []api.Attribute{{Name: "email", Value: "user@org1"}, {Name: "hf.Revoker", Value: "false"}},
+	})
+	assert.NoError(t, err, "Failed to insert user")
+	assert.Empty(t, warnings, "A complete user should not have warnings")
+
+	warnings, err = ta.Accessor.InsertUserWithWarnings(&spi.UserInfo{
+		Name:        "incompleteUser",
+		Pass:        "123456",
+		Affiliation: "org2",
+		Attributes:  []api.Attribute{{Name: "email", Value: "user@org2"}},
+	})
+	assert.NoError(t, err, "Warnings should not have failed the insert")
+	assert.Equal(t, []Warning{
+		{Field: "attributes", Message: "Recommended attribute 'hf.Revoker' is missing"},
+		{Field: "affiliation", Message: "Affiliation 'org2' does not exist"},
+	}, warnings)
+	_, err = ta.Accessor.GetUser("incompleteUser", nil)
+	assert.NoError(t, err, "User with warnings should have been inserted")
+
+	warnings, err = ta.Accessor.InsertUserWithWarnings(&spi.UserInfo{Name: "incompleteUser", Pass: "123456"})
+	assert.Error(t, err, "Inserting a duplicate user should have failed")
+	assert.Nil(t, warnings, "A failed insert should not return warnings")
+}
+
+func testGetEmptyAffiliations(ta TestAccessor, t *testing.T) {
+	t.Log("TestGetEmptyAffiliations")
+	ta.Truncate()
+
+	affiliations := []struct{ name, prekey string }{
+		{"org1", ""},
+		{"org1.dept1", "org1"},
+		{"org1.dept2", "org1"},
+		{"org2", ""},
+		{"org3", ""},
+		{"org3.dept1", "org3"},
+		{"org4", ""},
+	}
+	for _, aff := range affiliations {
+		err := ta.Accessor.InsertAffiliation(aff.name, aff.prekey, 0)
+		assert.NoError(t, err, "Failed to insert affiliation %s", aff.name)
+	}
+	err := ta.Accessor.InsertUser(&spi.UserInfo{Name: "testUser1", Pass: "123456", Affiliation: "org1.dept1"})
+	assert.NoError(t, err, "Failed to insert user")
+	err = ta.Accessor.InsertUser(&spi.UserInfo{Name: "testUser2", Pass: "123456", Affiliation: "org2"})
+	assert.NoError(t, err, "Failed to insert user")
+	// Deleted affiliations are not listed, and do not keep their parent from being empty
+	err = ta.Accessor.SoftDeleteAffiliation("org3.dept1")
+	assert.NoError(t, err, "Failed to soft delete affiliation")
+
+	empty, err := ta.Accessor.GetEmptyAffiliations()
+	if !assert.NoError(t, err, "Failed to get empty affiliations") {
+		return
+	}
+	names := []string{}
+	for _, aff := range empty {
+		names = append(names, aff.GetName())
+	}
+	assert.Equal(t, []string{"org1.dept2", "org3", "org4"}, names)
+
+	// Identities of other CAs keep an affiliation from being empty
+	other := NewDBAccessor(ta.DB)
+	other.CAName = "otherCA"
+	err = other.InsertUser(&spi.UserInfo{Name: "testUser3", Pass: "123456", Affiliation: "org4"})
+	assert.NoError(t, err, "Failed to insert user of another CA")
+	empty, err = ta.Accessor.GetEmptyAffiliations()
+	assert.NoError(t, err, "Failed to get empty affiliations")
+	assert.Len(t, empty, 2)
+}
+
+func testMaxAttributeLengths(ta TestAccessor, t *testing.T) {
+	t.Log("TestMaxAttributeLengths")
+	ta.Truncate()
+
+	ta.Accessor.MaxAttributeLengths = map[string]int{"role": 8}
+	defer func() { ta.Accessor.MaxAttributeLengths = nil }()
+
+	user := spi.UserInfo{
+		Name:       "testAttrLength",
+		Pass:       "123456",
+		Attributes: []api.Attribute{{Name: "role", Value: "12345678"}, {Name: "unlimited", Value: strings.Repeat("x", 100)}},
+	}
+	err := ta.Accessor.InsertUser(&user)
+	assert.NoError(t, err, "Failed to insert user with attribute values within the limits")
+
+	tooLong := spi.UserInfo{Name: "testAttrTooLong", Pass: "123456", Attributes: []api.Attribute{{Name: "role", Value: "123456789"}}}
+	err = ta.Accessor.InsertUser(&tooLong)
+	if assert.Error(t, err, "Inserting a user with an attribute value over the limit should have failed") {
+		assert.Contains(t, err.Error(), fmt.Sprintf("code: %d", ErrInvalidRequest))
+	}
+	_, err = ta.Accessor.GetUser("testAttrTooLong", nil)
+	assert.Error(t, err, "User with an attribute value over the limit should not have been inserted")
+
+	dbUser, err := ta.Accessor.GetUser("testAttrLength", nil)
+	if !assert.NoError(t, err, "Failed to get user") {
+		return
+	}
+	err = dbUser.ModifyAttributes([]api.Attribute{{Name: "role", Value: "123456789"}})
+	if assert.Error(t, err, "Updating an attribute to a value over the limit should have failed") {
+		assert.Contains(t, err.Error(), fmt.Sprintf("code: %d", ErrInvalidRequest))
+	}
+	err = dbUser.ModifyAttributes([]api.Attribute{{Name: "role", Value: "admin"}})
+	assert.NoError(t, err, "Failed to update an attribute to a value within the limit")
+
+	user.Attributes = []api.Attribute{{Name: "role", Value: "administrator"}}
+	err = ta.Accessor.UpdateUser(&user, false)
+	assert.Error(t, err, "Updating a user with an attribute value over the limit should have failed")
+
+	attr, err := ta.Accessor.GetTypedAttribute("testAttrLength", "role")
+	assert.NoError(t, err, "Failed to get attribute")
+	assert.Equal(t, "admin", attr, "Rejected updates should not have changed the attribute")
+}
+
+func testIsSecretExpired(ta TestAccessor, t *testing.T) {
+	t.Log("TestIsSecretExpired")
+	ta.Truncate()
+
+	users := []struct {
+		name            string
+		secretExpiresAt time.Time
+		expired         bool
+	}{
+		{"testSecretUnexpired", time.Now().Add(time.Hour), false},
+		{"testSecretExpired", time.Now().Add(-time.Hour), true},
+		{"testSecretNoExpiry", time.Time{}, false},
+	}
+	for _, u := range users {
+		err := ta.Accessor.InsertUser(&spi.UserInfo{Name: u.name, Pass: "123456", MaxEnrollments: -1, SecretExpiresAt: u.secretExpiresAt})
+		if !assert.NoError(t, err, "Failed to insert user %s", u.name) {
+			return
+		}
+
+		expired, err := ta.Accessor.IsSecretExpired(u.name)
+		assert.NoError(t, err, "Failed to check if secret of %s is expired", u.name)
+		assert.Equal(t, u.expired, expired, "Incorrect secret expiry for %s", u.name)
+
+		user, err := ta.Accessor.GetUser(u.name, nil)
+		if !assert.NoError(t, err, "Failed to get user %s", u.name) {
+			return
+		}
+		err = user.Login("123456", -1)
+		if u.expired {
+			assert.Error(t, err, "Login of %s with an expired secret should have failed", u.name)
+		} else {
+			assert.NoError(t, err, "Failed to login %s", u.name)
+		}
+	}
+
+	_, err := ta.Accessor.IsSecretExpired("testSecretUnknown")
+	assert.Error(t, err, "Checking the secret of a non-existent user should have failed")
+}
+
+func testUpgradeTokensToBcrypt(ta TestAccessor, t *testing.T) {
+	t.Log("TestUpgradeTokensToBcrypt")
+	ta.Truncate()
+
+	for _, name := range []string{"testHashed", "testPlain1", "testPlain2"} {
+		err := ta.Accessor.InsertUser(&spi.UserInfo{Name: name, Pass: name + "pass", MaxEnrollments: -1})
+		if !assert.NoError(t, err, "Failed to insert user %s", name) {
+			return
+		}
+	}
+	for _, name := range []string{"testPlain1", "testPlain2"} {
+		_, err := ta.DB.Exec(ta.DB.Rebind("UPDATE users SET token = ? WHERE (id = ?)"), []byte(name+"pass"), name)
+		assert.NoError(t, err, "Failed to store plaintext token of %s", name)
+	}
+
+	upgraded, err := ta.Accessor.UpgradeTokensToBcrypt()
+	assert.NoError(t, err, "Failed to upgrade tokens")
+	assert.Equal(t, 2, upgraded, "Only the plaintext tokens should have been upgraded")
+
+	for _, name := range []string{"testHashed", "testPlain1", "testPlain2"} {
+		user, err := ta.Accessor.GetUser(name, nil)
+		if !assert.NoError(t, err, "Failed to get user %s", name) {
+			return
+		}
+		err = user.Login(name+"pass", -1)
+		assert.NoError(t, err, "Failed to login %s after upgrading tokens", name)
+	}
+
+	upgraded, err = ta.Accessor.UpgradeTokensToBcrypt()
+	assert.NoError(t, err, "Failed to upgrade tokens again")
+	assert.Equal(t, 0, upgraded, "Upgrading tokens again should not have changed any tokens")
+}
+
+func testBootstrapAdmin(ta TestAccessor, t *testing.T) {
+	t.Log("TestBootstrapAdmin")
+	ta.Truncate()
+
+	err := ta.Accessor.InsertUser(&spi.UserInfo{Name: "testBootstrap", Pass: "123456", IsBootstrap: true})
+	assert.NoError(t, err, "Failed to insert bootstrap admin")
+	err = ta.Accessor.InsertUser(&spi.UserInfo{Name: "testNotBootstrap", Pass: "123456"})
+	assert.NoError(t, err, "Failed to insert user")
+
+	isBootstrap, err := ta.Accessor.IsBootstrapAdmin("testBootstrap")
+	assert.NoError(t, err, "Failed to check if user is the bootstrap admin")
+	assert.True(t, isBootstrap, "testBootstrap should be the bootstrap admin")
+	isBootstrap, err = ta.Accessor.IsBootstrapAdmin("testNotBootstrap")
+	assert.NoError(t, err, "Failed to check if user is the bootstrap admin")
+	assert.False(t, isBootstrap, "testNotBootstrap should not be the bootstrap admin")
+	_, err = ta.Accessor.IsBootstrapAdmin("testUnknown")
+	assert.Error(t, err, "Checking a non-existent user should have failed")
+
+	user, err := ta.Accessor.GetUser("testBootstrap", nil)
+	if assert.NoError(t, err, "Failed to get bootstrap admin") {
+		assert.True(t, user.(*DBUser).IsBootstrap, "GetUser should return the bootstrap admin as such")
+	}
+
+	_, err = ta.Accessor.DeleteUser("testBootstrap")
+	if assert.Error(t, err, "Deleting the bootstrap admin should have failed") {
+		assert.Contains(t, err.Error(), fmt.Sprintf("code: %d", ErrInvalidRequest))
+	}
+	_, err = ta.Accessor.GetUser("testBootstrap", nil)
+	assert.NoError(t, err, "Bootstrap admin should not have been deleted")
+
+	// Deleting the affiliation of the bootstrap admin must not delete it either
+	err = ta.Accessor.InsertAffiliation("bootstrapOrg", "", 0)
+	assert.NoError(t, err, "Failed to insert affiliation")
+	err = ta.Accessor.InsertUser(&spi.UserInfo{Name: "testBootstrapMember", Pass: "123456", Affiliation: "bootstrapOrg.dept1", IsBootstrap: true})
+	assert.NoError(t, err, "Failed to insert bootstrap admin")
+	_, err = ta.Accessor.DeleteAffiliation("bootstrapOrg", true, true, true)
+	if assert.Error(t, err, "Deleting the affiliation of the bootstrap admin should have failed") {
+		assert.Contains(t, err.Error(), fmt.Sprintf("code: %d", ErrInvalidRequest))
+	}
+	_, err = ta.Accessor.GetUser("testBootstrapMember", nil)
+	assert.NoError(t, err, "Bootstrap admin should not have been deleted with its affiliation")
+	_, err = ta.Accessor.GetAffiliation("bootstrapOrg")
+	assert.NoError(t, err, "Affiliation of the bootstrap admin should not have been deleted")
+
+	_, err = ta.Accessor.DeleteUser("testNotBootstrap")
+	assert.NoError(t, err, "Failed to delete user")
+	_, err = ta.Accessor.GetUser("testNotBootstrap", nil)
+	assert.Error(t, err, "User should have been deleted")
+}
+
+func testPurgeDeletedBefore(ta TestAccessor, t *testing.T) {
+	t.Log("TestPurgeDeletedBefore")
+	ta.Truncate()
+
+	for _, name := range []string{"testOld", "testRecent", "testLive"} {
+		err := ta.Accessor.InsertUser(&spi.UserInfo{Name: name, Pass: "123456", Type: "client", Attributes: []api.Attribute{{Name: "attr1", Value: name}}})
+		assert.NoError(t, err, "Failed to insert user %s", name)
+	}
+	for _, name := range []string{"testOld", "testRecent"} {
+		_, err := ta.Accessor.SoftDeleteUser(name)
+		assert.NoError(t, err, "Failed to soft delete user %s", name)
+		_, err = ta.Accessor.GetUser(name, nil)
+		assert.Error(t, err, "Soft deleted user %s should not be returned", name)
+	}
+	_, err := ta.Accessor.SoftDeleteUser("testUnknown")
+	if assert.Error(t, err, "Soft deleting an unknown user should have failed") {
+		assert.Contains(t, err.Error(), fmt.Sprintf("code: %d", ErrDBGet))
+	}
+	err = ta.Accessor.InsertUser(&spi.UserInfo{Name: "testBootstrap", Pass: "123456", IsBootstrap: true})
+	assert.NoError(t, err, "Failed to insert bootstrap admin")
+	_, err = ta.Accessor.SoftDeleteUser("testBootstrap")
+	assert.Error(t, err, "Soft deleting the bootstrap admin should have failed")
+
+	var deleted []UserRecord
+	err = ta.DB.Select(&deleted, "SELECT id, attributes FROM deleted_users ORDER BY id")
+	if assert.NoError(t, err, "Failed to get deleted users") && assert.Len(t, deleted, 2) {
+		assert.Equal(t, "testOld", deleted[0].Name)
+		assert.Contains(t, deleted[0].Attributes, "testOld", "Record of the deleted user was not kept")
+	}
+	var deletedAt []time.Time
+	err = ta.DB.Select(&deletedAt, "SELECT deleted_at FROM deleted_users WHERE (id = 'testRecent')")
+	if assert.NoError(t, err, "Failed to get deletion time") && assert.Len(t, deletedAt, 1) {
+		assert.WithinDuration(t, time.Now(), deletedAt[0], time.Minute, "Deletion time of a soft deleted user was not recorded")
+	}
+
+	// The id of a soft deleted user can be registered again
+	err = ta.Accessor.InsertUser(&spi.UserInfo{Name: "testRecent", Pass: "123456", Type: "client"})
+	assert.NoError(t, err, "Failed to register the id of a soft deleted user")
+
+	_, err = ta.DB.Exec("UPDATE deleted_users SET deleted_at = ? WHERE (id = 'testOld')", time.Now().UTC().Add(-30*24*time.Hour))
+	assert.NoError(t, err, "Failed to backdate tombstone")
+
+	purged, err := ta.Accessor.PurgeDeletedBefore(time.Now().Add(-7 * 24 * time.Hour))
+	assert.NoError(t, err, "Failed to purge deleted users")
+	assert.Equal(t, 1, purged)
+
+	var remaining []string
+	err = ta.DB.Select(&remaining, "SELECT id FROM deleted_users ORDER BY id")
+	assert.NoError(t, err, "Failed to get remaining deleted users")
+	assert.Equal(t, []string{"testRecent"}, remaining)
+
+	purged, err = ta.Accessor.PurgeDeletedBefore(time.Now().Add(time.Hour))
+	assert.NoError(t, err, "Failed to purge deleted users")
+	assert.Equal(t, 1, purged)
+	for _, name := range []string{"testRecent", "testLive"} {
+		_, err = ta.Accessor.GetUser(name, nil)
+		assert.NoError(t, err, "Purging deleted users should not remove user %s", name)
+	}
+}
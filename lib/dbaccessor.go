@@ -17,8 +17,22 @@ limitations under the License.
 package lib
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/hyperledger/fabric-ca/lib/attr"
 	"github.com/hyperledger/fabric-ca/util"
@@ -43,21 +57,32 @@ func init() {
 
 const (
 	insertUser = `
-INSERT INTO users (id, token, type, affiliation, attributes, state, max_enrollments, level)
-	VALUES (:id, :token, :type, :affiliation, :attributes, :state, :max_enrollments, :level);`
+INSERT INTO users (id, token, type, affiliation, attributes, attr_count, state, max_enrollments, level, created_at, created_by, expires_at, initial_secret, ca_name, secret_expires_at, is_bootstrap)
+	VALUES (:id, :token, :type, :affiliation, :attributes, :attr_count, :state, :max_enrollments, :level, :created_at, :created_by, :expires_at, :initial_secret, :ca_name, :secret_expires_at, :is_bootstrap);`
 
 	deleteUser = `
 DELETE FROM users
-	WHERE (id = ?);`
+	WHERE (id = ?) AND (ca_name = ?);`
+
+	softDeleteUser = `
+INSERT INTO deleted_users (id, token, type, affiliation, attributes, state, max_enrollments, level, incorrect_password_attempts, locked_until, created_at, created_by, revocation_reason, revoked_at, attr_count, expires_at, idempotency_key, last_enrolled_at, initial_secret, serial_number, aki, previous_serial_number, previous_aki, ca_name, secret_expires_at, is_bootstrap, deleted_at)
+	SELECT id, token, type, affiliation, attributes, state, max_enrollments, level, incorrect_password_attempts, locked_until, created_at, created_by, revocation_reason, revoked_at, attr_count, expires_at, idempotency_key, last_enrolled_at, initial_secret, serial_number, aki, previous_serial_number, previous_aki, ca_name, secret_expires_at, is_bootstrap, ?
+	FROM users
+	WHERE (id = ?) AND (ca_name = ?);`
 
 	updateUser = `
 UPDATE users
-	SET token = :token, type = :type, affiliation = :affiliation, attributes = :attributes, state = :state, max_enrollments = :max_enrollments, level = :level
-	WHERE (id = :id);`
+	SET token = :token, type = :type, affiliation = :affiliation, attributes = :attributes, attr_count = :attr_count, state = :state, max_enrollments = :max_enrollments, level = :level
+	WHERE (id = :id) AND (ca_name = :ca_name);`
+
+	updateUserPass = `
+UPDATE users
+	SET token = :token, type = :type, affiliation = :affiliation, attributes = :attributes, attr_count = :attr_count, state = :state, max_enrollments = :max_enrollments, level = :level, initial_secret = 0, secret_expires_at = :secret_expires_at
+	WHERE (id = :id) AND (ca_name = :ca_name);`
 
 	getUser = `
 SELECT * FROM users
-	WHERE (id = ?)`
+	WHERE (id = ?) AND (ca_name = ?)`
 
 	insertAffiliation = `
 INSERT INTO affiliations (name, prekey, level)
@@ -69,641 +94,4719 @@ DELETE FROM affiliations
 
 	getAffiliationQuery = `
 SELECT * FROM affiliations
-	WHERE (name = ?)`
+	WHERE (name = ?) AND (deleted = 0)`
 
 	getAllAffiliationsQuery = `
 SELECT * FROM affiliations
-	WHERE ((name = ?) OR (name LIKE ?))`
+	WHERE ((name = ?) OR (name LIKE ?)) AND (deleted = 0)
+	ORDER BY name`
 )
 
-// UserRecord defines the properties of a user
+// UserRecord defines the properties of a user. Attributes contains the
+// identity's attributes encoded as a JSON array; the column is of type JSONB
+// on Postgres and TEXT on the other databases.
 type UserRecord struct {
-	Name           string `db:"id"`
-	Pass           []byte `db:"token"`
-	Type           string `db:"type"`
-	Affiliation    string `db:"affiliation"`
-	Attributes     string `db:"attributes"`
-	State          int    `db:"state"`
-	MaxEnrollments int    `db:"max_enrollments"`
-	Level          int    `db:"level"`
+	Name                      string         `db:"id"`
+	Pass                      []byte         `db:"token"`
+	Type                      string         `db:"type"`
+	Affiliation               string         `db:"affiliation"`
+	Attributes                string         `db:"attributes"`
+	State                     int            `db:"state"`
+	MaxEnrollments            int            `db:"max_enrollments"`
+	Level                     int            `db:"level"`
+	IncorrectPasswordAttempts int            `db:"incorrect_password_attempts"`
+	LockedUntil               sql.NullTime   `db:"locked_until"`
+	CreatedAt                 sql.NullTime   `db:"created_at"`
+	CreatedBy                 sql.NullString `db:"created_by"`
+	RevocationReason          sql.NullInt64  `db:"revocation_reason"`
+	RevokedAt                 sql.NullTime   `db:"revoked_at"`
+	// AttrCount is the number of attributes, maintained whenever the
+	// attributes are written so they need not be decoded to be counted
+	AttrCount sql.NullInt64 `db:"attr_count"`
+	ExpiresAt sql.NullTime  `db:"expires_at"`
+	// IdempotencyKey is the key of the request that inserted the user with
+	// InsertUserIdempotent, which expires IdempotencyKeyTTL after CreatedAt
+	IdempotencyKey sql.NullString `db:"idempotency_key"`
+	LastEnrolledAt sql.NullTime   `db:"last_enrolled_at"`
+	// InitialSecret is 1 while the identity still has the secret it was
+	// registered with, and 0 once its password has been changed
+	InitialSecret int `db:"initial_secret"`
+	// SerialNumber and AKI identify the certificate most recently issued to
+	// the identity, and PreviousSerialNumber and PreviousAKI the one before it
+	SerialNumber         sql.NullString `db:"serial_number"`
+	AKI                  sql.NullString `db:"aki"`
+	PreviousSerialNumber sql.NullString `db:"previous_serial_number"`
+	PreviousAKI          sql.NullString `db:"previous_aki"`
+	// CAName is the name of the CA the identity belongs to
+	CAName string `db:"ca_name"`
+	// SecretExpiresAt is when the secret of the identity expires
+	SecretExpiresAt sql.NullTime `db:"secret_expires_at"`
+	// IsBootstrap is 1 for the bootstrap admin, which can not be deleted
+	IsBootstrap int `db:"is_bootstrap"`
+}
+
+// UserDetail is a user along with the times recorded for it. Times that were
+// never recorded, such as the revocation time of an identity that is not
+// revoked, are zero.
+type UserDetail struct {
+	spi.UserInfo
+	CreatedAt        time.Time
+	LockedUntil      time.Time
+	RevokedAt        time.Time
+	RevocationReason int
+	LastEnrolledAt   time.Time
 }
 
 // AffiliationRecord defines the properties of an affiliation
 type AffiliationRecord struct {
-	ID     int    `db:"id"`
-	Name   string `db:"name"`
-	Prekey string `db:"prekey"`
-	Level  int    `db:"level"`
+	ID         int            `db:"id"`
+	Name       string         `db:"name"`
+	Prekey     string         `db:"prekey"`
+	Level      int            `db:"level"`
+	Attributes sql.NullString `db:"attributes"`
+	Deleted    int            `db:"deleted"`
+	// Metadata describes the affiliation itself, such as its display name,
+	// as a JSON object. Unlike Attributes, it is not inherited by identities.
+	Metadata sql.NullString `db:"metadata"`
+}
+
+// EnrollmentEvent records the request of an enrollment of an identity
+type EnrollmentEvent struct {
+	ID         string    `db:"id"`
+	CSRSubject string    `db:"csr_subject"`
+	RemoteAddr string    `db:"remote_addr"`
+	At         time.Time `db:"enrolled_at"`
+}
+
+// AccessorStats is a summary of the contents of the identity registry
+type AccessorStats struct {
+	Users        int    `db:"users" json:"users"`
+	Affiliations int    `db:"affiliations" json:"affiliations"`
+	Enrolled     int    `db:"enrolled" json:"enrolled"`
+	Driver       string `db:"-" json:"driver"`
+}
+
+// AffiliationDTO is a JSON serializable representation of an affiliation
+type AffiliationDTO struct {
+	// Name is the last element of the affiliation's path
+	Name string `json:"name"`
+	// Path is the dotted path of the affiliation, which is how it is named
+	// everywhere else
+	Path       string `json:"path"`
+	Parent     string `json:"parent,omitempty"`
+	ChildCount int    `json:"childCount"`
+}
+
+// EnrollmentState is the state of an identity, which is the number of times it
+// has enrolled, or EnrollmentStateRevoked if it has been revoked
+type EnrollmentState int
+
+const (
+	// EnrollmentStateRevoked is the state of a revoked identity
+	EnrollmentStateRevoked EnrollmentState = -1
+	// EnrollmentStateNotEnrolled is the state of an identity that has not enrolled
+	EnrollmentStateNotEnrolled EnrollmentState = 0
+)
+
+// AttributeType is the declared type of the value of an attribute
+type AttributeType int
+
+const (
+	// AttributeTypeString is the type of attributes whose values are strings
+	AttributeTypeString AttributeType = iota
+	// AttributeTypeBool is the type of attributes whose values are booleans
+	AttributeTypeBool
+	// AttributeTypeInt is the type of attributes whose values are integers
+	AttributeTypeInt
+	// AttributeTypeFloat is the type of attributes whose values are floating point numbers
+	AttributeTypeFloat
+)
+
+// Field is a column of the users table that can be updated directly
+type Field int
+
+const (
+	// FieldType is the type of an identity
+	FieldType Field = iota
+	// FieldAffiliation is the affiliation of an identity
+	FieldAffiliation
+	// FieldState is the number of times an identity has enrolled
+	FieldState
+	// FieldMaxEnrollments is the maximum number of enrollments of an identity
+	FieldMaxEnrollments
+	// FieldLevel is the level of an identity
+	FieldLevel
+)
+
+// fieldColumns maps each field to its column in the users table
+var fieldColumns = map[Field]string{
+	FieldType:           "type",
+	FieldAffiliation:    "affiliation",
+	FieldState:          "state",
+	FieldMaxEnrollments: "max_enrollments",
+	FieldLevel:          "level",
 }
 
 // Accessor implements db.Accessor interface.
 type Accessor struct {
 	db *dbutil.DB
+	// readDB is an optional read replica of db
+	readDB *dbutil.DB
+	// MaxAffiliationDepth is the maximum number of levels allowed in the
+	// affiliation tree; zero means unlimited
+	MaxAffiliationDepth int
+	// MaxIncorrectPasswordAttempts is the number of consecutive incorrect
+	// passwords after which an identity is locked; zero disables locking
+	MaxIncorrectPasswordAttempts int
+	// LockoutDuration is how long an identity remains locked
+	LockoutDuration time.Duration
+	// CAMaxEnrollments is the maximum number of enrollments allowed by the CA
+	// that CanEnroll applies, like the caMaxEnrollments argument of Login;
+	// -1 means the CA does not limit enrollments
+	CAMaxEnrollments int
+	// CacheAffiliations enables an in-memory cache of the affiliation tree
+	// that backs GetAffiliation and IsAncestorAffiliation. The cache is
+	// reloaded after affiliations are changed through this accessor; changes
+	// made by other servers sharing the database require RefreshAffiliationCache
+	CacheAffiliations bool
+	affCache          map[string]AffiliationRecord
+	affCacheMutex     sync.RWMutex
+	// IDNormalizer canonicalizes identity names before they are stored or
+	// looked up, so that equivalent names refer to the same identity. It is
+	// applied by InsertUser, GetUser, and DeleteUser, and therefore also to
+	// the identity being authenticated. If nil, names are used as is.
+	IDNormalizer func(string) string
+	// IDValidator, if set, is applied to the normalized names of identities
+	// being inserted, which are rejected if it returns an error. The default
+	// is not to validate names; DefaultIDValidator may be used instead.
+	IDValidator func(string) error
+	// RecommendedAttributes are the names of attributes identities should
+	// have. InsertUserWithWarnings warns about identities missing any of them.
+	RecommendedAttributes []string
+	// MaxAttributeLengths limits the length in bytes of the values of
+	// attributes, by attribute name, such as of attributes that are embedded
+	// in certificates. Identities with longer values can not be inserted, and
+	// attributes can not be updated to longer values.
+	MaxAttributeLengths map[string]int
+	// DefaultUserType is the type given by InsertUser to identities that are
+	// inserted without a type
+	DefaultUserType string
+	// AttributeTypes declares the types of attribute values, by attribute
+	// name, that GetTypedAttribute converts the stored strings to
+	AttributeTypes map[string]AttributeType
+	// IdempotencyKeyTTL is how long InsertUserIdempotent remembers the key
+	// of a request; zero means keys never expire
+	IdempotencyKeyTTL time.Duration
+	// SQLiteBusyRetries is the number of times a statement or transaction that
+	// fails because the SQLite database is locked by another connection is
+	// retried
+	SQLiteBusyRetries int
+	// Authenticator verifies the credentials of identities that log in; if
+	// nil, credentials are verified as passwords
+	Authenticator Authenticator
+	// RepairDuplicateAttributes enables rewriting the attributes of identities
+	// that are stored with duplicate attribute names when they are loaded.
+	// Duplicates are always collapsed on read, keeping the last value.
+	RepairDuplicateAttributes bool
+	// CaseInsensitiveAffiliations makes GetAffiliation, InsertAffiliation, and
+	// AffiliationsExist compare affiliation names ignoring case, so that an
+	// affiliation can not be added twice with different casing. Names are
+	// stored with the casing they were first inserted with.
+	CaseInsensitiveAffiliations bool
+	// StrictAudit makes a mutation fail, and rolls it back, if its event can
+	// not be written to the audit database set with SetAuditDB. Otherwise
+	// failures to write audit events are only logged.
+	StrictAudit bool
+	auditDB     *dbutil.DB
+	// CompressAttributes makes attributes be stored gzip compressed. Rows
+	// stored uncompressed remain readable. It has no effect on Postgres, where
+	// attributes are stored as JSONB, which the database compresses itself.
+	CompressAttributes bool
+	// EnforceForeignKeys makes SetDB enable enforcement of foreign key
+	// constraints on SQLite databases, which SQLite does not enforce by
+	// default. The registry tables declare no foreign keys: an affiliation
+	// refers to its parent by name, with an empty prekey for the root
+	// affiliations, which a foreign key can not exempt.
+	EnforceForeignKeys bool
+	// SecretResolver looks up the tokens of identities whose secrets are kept
+	// outside of the database; if nil, the token column is always used
+	SecretResolver SecretResolver
+	// CAName scopes the identities read and written to those of the named CA,
+	// so that several CAs can share one users table. Identities of each CA are
+	// unique by id, but different CAs may have identities with the same id.
+	// The affiliation tree is shared by all CAs. The default, empty name is
+	// that of the identities stored before identities were scoped.
+	CAName string
+	// AllowTruncate enables Truncate, which deletes all identities,
+	// affiliations, and certificates. It is meant for test setup only.
+	AllowTruncate bool
+	// SortAttributes makes GetUser, and the other methods that get a single
+	// identity, return its attributes ordered by name, both in its Attributes
+	// and from GetAttributes, instead of in the order they are stored
+	SortAttributes bool
+	// EventSink, if set, is sent a ChangeEvent for each identity inserted,
+	// updated, or deleted through this accessor, after the change is committed
+	EventSink EventSink
+	// ConsistentReads makes GetUser, and the other methods that get a single
+	// identity, read an identity from the primary database instead of the
+	// read replica for ConsistentReadWindow after it is written through this
+	// accessor, so that a write is seen by the reads that follow it even if
+	// the replica lags behind. Writes are tracked in this process only.
+	ConsistentReads bool
+	// ConsistentReadWindow is how long reads of an identity go to the primary
+	// database after it is written; zero means DefaultConsistentReadWindow
+	ConsistentReadWindow time.Duration
+	userLocks            map[string]*userLock
+	userLocksMutex       sync.Mutex
+	recentWrites         map[string]time.Time
+	recentWritesMutex    sync.Mutex
+}
+
+// DefaultConsistentReadWindow is the default ConsistentReadWindow
+const DefaultConsistentReadWindow = 5 * time.Second
+
+// userLock is the lock held by LockUser on an identity, with the number of
+// callers holding or waiting for it
+type userLock struct {
+	sync.Mutex
+	refs int
+}
+
+// ChangeOp is the kind of change to an identity reported in a ChangeEvent
+type ChangeOp string
+
+// Kinds of changes to identities
+const (
+	ChangeInsert ChangeOp = "insert"
+	ChangeUpdate ChangeOp = "update"
+	ChangeDelete ChangeOp = "delete"
+)
+
+// ChangeEvent is a committed change to an identity
+type ChangeEvent struct {
+	Op ChangeOp
+	// ID is the name of the identity that changed
+	ID string
+	// Record is the identity as stored after the change; it is nil for
+	// deletions, and if the identity could not be read after the change
+	Record *UserRecord
+}
+
+// EventSink receives every change to identities made through the accessor or
+// the users it returns, such as to stream them to a change data capture
+// pipeline. Changes to several identities are reported as one event for each
+// identity changed.
+type EventSink interface {
+	// Emit is called after the change in event is committed
+	Emit(event ChangeEvent)
+}
+
+// SecretResolver fetches the token of an identity from an external secret
+// store, such as Vault
+type SecretResolver interface {
+	// ResolveSecret returns the token of identity id, in the same form as the
+	// token column of the users table. found is false if the store has no
+	// secret for the identity, in which case the token in the database is used.
+	ResolveSecret(id string) (token []byte, found bool, err error)
+}
+
+// Authenticator verifies the credential presented by an identity logging in
+type Authenticator interface {
+	// Authenticate returns an error if credential is not valid for user,
+	// whose stored token is token
+	Authenticate(user *spi.UserInfo, token []byte, credential string) error
+}
+
+// PasswordAuthenticator verifies credentials as passwords whose bcrypt hashes
+// are stored as the tokens of identities
+type PasswordAuthenticator struct{}
+
+// Authenticate compares the password to the stored hash
+func (PasswordAuthenticator) Authenticate(user *spi.UserInfo, token []byte, credential string) error {
+	return bcrypt.CompareHashAndPassword(token, []byte(credential))
 }
 
 // NewDBAccessor is a constructor for the database API
 func NewDBAccessor(db *dbutil.DB) *Accessor {
 	return &Accessor{
-		db: db,
+		db:                db,
+		IDNormalizer:      TrimIDNormalizer,
+		DefaultUserType:   "client",
+		IdempotencyKeyTTL: 24 * time.Hour,
+		Authenticator:     PasswordAuthenticator{},
+		CAMaxEnrollments:  -1,
+	}
+}
+
+// TrimIDNormalizer is the default IDNormalizer, which removes leading and
+// trailing whitespace from identity names
+func TrimIDNormalizer(id string) string {
+	return strings.TrimSpace(id)
+}
+
+// MaxIDLength is the length of the longest identity name accepted by
+// DefaultIDValidator, which is the size of the id column
+const MaxIDLength = 255
+
+// DefaultIDValidator accepts identity names of at most MaxIDLength characters
+// that contain only the characters allowed by NewIDValidator
+var DefaultIDValidator = NewIDValidator(MaxIDLength)
+
+// NewIDValidator returns an IDValidator that accepts non-empty identity names
+// of at most maxLength characters consisting of letters, digits, dots,
+// dashes, and underscores
+func NewIDValidator(maxLength int) func(string) error {
+	return func(id string) error {
+		if id == "" {
+			return errors.New("Identity name is empty")
+		}
+		if len(id) > maxLength {
+			return errors.Errorf("Identity name is longer than %d characters", maxLength)
+		}
+		for _, c := range id {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_') {
+				return errors.Errorf("Identity name contains the character '%c', but only letters, digits, '.', '-', and '_' are allowed", c)
+			}
+		}
+		return nil
+	}
+}
+
+// checkAttributeLengths returns an error if the value of any of attrs is
+// longer than the maximum length in maxLengths for its name
+func checkAttributeLengths(attrs []api.Attribute, maxLengths map[string]int) error {
+	for _, attr := range attrs {
+		maxLength, ok := maxLengths[attr.Name]
+		if ok && len(attr.Value) > maxLength {
+			return newHTTPErr(400, ErrInvalidRequest, "Value of attribute '%s' is %d bytes long, which exceeds the maximum of %d bytes", attr.Name, len(attr.Value), maxLength)
+		}
+	}
+	return nil
+}
+
+// rebind replaces the '?' placeholders of query with those of the dialect of
+// the database
+func (d *Accessor) rebind(query string) string {
+	return dbutil.Rebind(d.db.Dialect(), query)
+}
+
+// affiliationNameMatch returns the condition that matches an affiliation
+// name against a query parameter
+func (d *Accessor) affiliationNameMatch() string {
+	if d.CaseInsensitiveAffiliations {
+		return "(LOWER(name) = LOWER(?))"
+	}
+	return "(name = ?)"
+}
+
+// affiliationCacheKey returns the key of an affiliation in the cache
+func (d *Accessor) affiliationCacheKey(name string) string {
+	if d.CaseInsensitiveAffiliations {
+		return strings.ToLower(name)
+	}
+	return name
+}
+
+// normalizeID applies IDNormalizer to an identity name
+func (d *Accessor) normalizeID(id string) string {
+	if d.IDNormalizer == nil {
+		return id
 	}
+	return d.IDNormalizer(id)
 }
 
 func (d *Accessor) checkDB() error {
 	if d.db == nil {
-		return errors.New("Failed to correctly setup database connection")
+		return newHTTPErr(500, ErrConnectingDB, "Failed to correctly setup database connection")
 	}
 	return nil
 }
 
 // SetDB changes the underlying sql.DB object Accessor is manipulating.
 func (d *Accessor) SetDB(db *dbutil.DB) {
+	if d.EnforceForeignKeys && db != nil && db.DriverName() == "sqlite3" {
+		err := db.EnableSQLiteForeignKeys()
+		if err != nil {
+			log.Errorf("Failed to enable foreign key enforcement: %s", err)
+		}
+	}
 	d.db = db
 }
 
-// InsertUser inserts user into database
-func (d *Accessor) InsertUser(user *spi.UserInfo) error {
-	if user == nil {
-		return errors.New("User is not defined")
+// SetReadDB sets a read replica of the database. When set, GetUser,
+// GetAllAffiliations, and GetFilteredUsers read from the replica while all
+// writes continue to go to the primary database. Passing nil reverts to using
+// the primary database for reads.
+//
+// Reads from a replica may return stale data while replication is lagging.
+// In particular, the user returned by GetUser is used to login, so a login
+// may be checked against a password or enrollment state that has since been
+// changed on the primary.
+func (d *Accessor) SetReadDB(db *dbutil.DB) {
+	d.readDB = db
+}
+
+// Actions recorded in the audit database
+const (
+	auditInsertUser = "insert_user"
+	auditUpdateUser = "update_user"
+	auditDeleteUser = "delete_user"
+)
+
+// SetAuditDB sets a separate database to which an event is appended for each
+// identity inserted, updated, or deleted by InsertUser, UpdateUser, and
+// DeleteUser. The audit_events table is created in it if it does not exist.
+// Passing nil stops auditing.
+func (d *Accessor) SetAuditDB(db *dbutil.DB) error {
+	if db != nil {
+		timestamp := "timestamp"
+		if db.DriverName() == "mysql" {
+			timestamp = "timestamp NULL"
+		}
+		_, err := db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS audit_events (action VARCHAR(64) NOT NULL, id VARCHAR(255) NOT NULL, at %s)", timestamp))
+		if err != nil {
+			return errors.Wrap(err, "Failed to create audit_events table")
+		}
 	}
-	log.Debugf("DB: Add identity %s", user.Name)
+	d.auditDB = db
+	return nil
+}
 
-	err := d.checkDB()
+// writeAuditEvent appends an event for action on identity id to the audit database
+func (d *Accessor) writeAuditEvent(action, id string) error {
+	_, err := d.auditDB.Exec(dbutil.Rebind(d.auditDB.Dialect(), "INSERT INTO audit_events (action, id, at) VALUES (?, ?, ?)"), action, id, time.Now().UTC())
 	if err != nil {
-		return err
+		return errors.Wrapf(err, "Failed to write %s audit event for identity '%s'", action, id)
 	}
+	return nil
+}
 
-	attrBytes, err := json.Marshal(user.Attributes)
-	if err != nil {
-		return err
+// doAuditedTransaction runs doit in a transaction like doTransaction and
+// records action on identity id in the audit database, if one is set. In
+// strict mode the event is written before the transaction is committed, and
+// the transaction is rolled back if the event can not be written. Otherwise
+// the event is written after the commit and failures are logged. No event is
+// recorded if doit returns false, meaning that it made no change.
+func (d *Accessor) doAuditedTransaction(action, id string, doit func(tx *sqlx.Tx, args ...interface{}) (interface{}, error), args ...interface{}) (interface{}, error) {
+	if d.auditDB == nil {
+		return d.doTransaction(doit, args...)
 	}
 
-	// Hash the password before storing it
-	pwd := []byte(user.Pass)
-	pwd, err = bcrypt.GenerateFromPassword(pwd, bcrypt.DefaultCost)
+	strict := d.StrictAudit
+	result, err := d.doTransaction(func(tx *sqlx.Tx, args ...interface{}) (interface{}, error) {
+		result, err := doit(tx, args...)
+		if err != nil || !strict || result == false {
+			return result, err
+		}
+		err = d.writeAuditEvent(action, id)
+		if err != nil {
+			return nil, newHTTPErr(500, ErrAuditEvent, "%s", err)
+		}
+		return result, nil
+	}, args...)
 	if err != nil {
-		return errors.Wrap(err, "Failed to hash password")
+		return nil, err
 	}
 
-	// Store the user record in the DB
-	res, err := d.db.NamedExec(insertUser, &UserRecord{
-		Name:           user.Name,
-		Pass:           pwd,
-		Type:           user.Type,
-		Affiliation:    user.Affiliation,
-		Attributes:     string(attrBytes),
-		State:          user.State,
-		MaxEnrollments: user.MaxEnrollments,
-		Level:          user.Level,
-	})
+	if !strict && result != false {
+		err = d.writeAuditEvent(action, id)
+		if err != nil {
+			log.Errorf("%s", err)
+		}
+	}
 
-	if err != nil {
-		return errors.Wrapf(err, "Error adding identity '%s' to the database", user.Name)
+	return result, nil
+}
+
+// emitChange sends a ChangeEvent for op on identity id to the event sink, if
+// one is set, reading the record of the identity unless it was deleted
+func (d *Accessor) emitChange(op ChangeOp, id string) {
+	if d.EventSink == nil {
+		return
+	}
+	event := ChangeEvent{Op: op, ID: id}
+	if op != ChangeDelete {
+		var userRec UserRecord
+		err := d.db.Get(&userRec, d.rebind(getUser), id, d.CAName)
+		if err != nil {
+			log.Warningf("Failed to read identity '%s' for %s change event: %s", id, op, err)
+		} else {
+			event.Record = &userRec
+		}
 	}
+	d.EventSink.Emit(event)
+}
 
-	numRowsAffected, err := res.RowsAffected()
-	if err != nil {
-		return err
+// emitChanges sends a ChangeEvent for op on each of the identities ids
+func (d *Accessor) emitChanges(op ChangeOp, ids []string) {
+	for _, id := range ids {
+		d.emitChange(op, id)
 	}
+}
 
-	if numRowsAffected == 0 {
-		return errors.Errorf("Failed to add identity %s to the database", user.Name)
+// getReadDB returns the database to use for reads
+func (d *Accessor) getReadDB() *dbutil.DB {
+	if d.readDB != nil {
+		return d.readDB
 	}
+	return d.db
+}
 
-	if numRowsAffected != 1 {
-		return errors.Errorf("Expected to add one record to the database, but %d records were added", numRowsAffected)
+// getUserReadDB returns the database to use for reads of identity id, which
+// is the primary database if ConsistentReads is set and the identity was
+// written recently
+func (d *Accessor) getUserReadDB(id string) *dbutil.DB {
+	if d.ConsistentReads && d.readDB != nil {
+		d.recentWritesMutex.Lock()
+		until, ok := d.recentWrites[id]
+		d.recentWritesMutex.Unlock()
+		if ok && time.Now().Before(until) {
+			log.Debugf("Reading identity %s from the primary database because it was written recently", id)
+			return d.db
+		}
 	}
+	return d.getReadDB()
+}
 
-	log.Debugf("Successfully added identity %s to the database", user.Name)
+// recordUserWrite records that identity id was written, so that
+// getUserReadDB reads it from the primary database for a while
+func (d *Accessor) recordUserWrite(id string) {
+	d.recordUserWrites([]string{id})
+}
 
-	return nil
+// recordUserWrites records that the identities ids were written, like
+// recordUserWrite
+func (d *Accessor) recordUserWrites(ids []string) {
+	if !d.ConsistentReads || d.readDB == nil {
+		return
+	}
+	window := d.ConsistentReadWindow
+	if window == 0 {
+		window = DefaultConsistentReadWindow
+	}
 
+	now := time.Now()
+	d.recentWritesMutex.Lock()
+	defer d.recentWritesMutex.Unlock()
+	if d.recentWrites == nil {
+		d.recentWrites = map[string]time.Time{}
+	}
+	// Forget the writes whose window has passed
+	for writtenID, until := range d.recentWrites {
+		if !now.Before(until) {
+			delete(d.recentWrites, writtenID)
+		}
+	}
+	for _, id := range ids {
+		d.recentWrites[id] = now.Add(window)
+	}
 }
 
-// DeleteUser deletes user from database
-func (d *Accessor) DeleteUser(id string) (spi.User, error) {
-	log.Debugf("DB: Delete identity %s", id)
+// sqliteBusyBackoff is the delay before the first retry of a statement that
+// failed because the SQLite database is locked; it doubles with each retry
+const sqliteBusyBackoff = 10 * time.Millisecond
 
-	result, err := d.doTransaction(d.deleteUserTx, id, ocsp.CessationOfOperation) // 5 (cessationofoperation) reason for certificate revocation
-	if err != nil {
-		return nil, err
-	}
+// exec executes a statement, retrying it if the SQLite database is locked
+func (d *Accessor) exec(query string, args ...interface{}) (sql.Result, error) {
+	var res sql.Result
+	err := d.retryBusy(func() error {
+		var err error
+		res, err = d.db.Exec(query, args...)
+		return err
+	})
+	return res, err
+}
 
-	userRec := result.(*UserRecord)
-	user := newDBUser(userRec, d.db)
+// namedExec executes a named statement, retrying it if the SQLite database is locked
+func (d *Accessor) namedExec(query string, arg interface{}) (sql.Result, error) {
+	var res sql.Result
+	err := d.retryBusy(func() error {
+		var err error
+		res, err = d.db.NamedExec(query, arg)
+		return err
+	})
+	return res, err
+}
 
-	return user, nil
+// retryBusy calls op, and calls it again up to SQLiteBusyRetries times with
+// an increasing delay for as long as it fails because the SQLite database is
+// locked
+func (d *Accessor) retryBusy(op func() error) error {
+	backoff := sqliteBusyBackoff
+	for i := 0; ; i++ {
+		err := op()
+		if err == nil || i >= d.SQLiteBusyRetries || d.db.DriverName() != "sqlite3" || !isSQLiteBusyError(err) {
+			return err
+		}
+		log.Debugf("SQLite database is locked, retrying in %s: %s", backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
 }
 
-func (d *Accessor) deleteUserTx(tx *sqlx.Tx, args ...interface{}) (interface{}, error) {
-	id := args[0].(string)
-	reason := args[1].(int)
+// isSQLiteBusyError returns true if err is the SQLITE_BUSY or SQLITE_LOCKED
+// error returned while another connection holds a lock on the database
+func isSQLiteBusyError(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "database is locked") || strings.Contains(msg, "database table is locked")
+}
 
-	var userRec UserRecord
-	err := tx.Get(&userRec, tx.Rebind(getUser), id)
-	if err != nil {
-		return nil, getError(err, "User")
+// InsertUser inserts user into database
+func (d *Accessor) InsertUser(user *spi.UserInfo) error {
+	if user == nil {
+		return newHTTPErr(400, ErrInvalidRequest, "User is not defined")
 	}
+	name := d.normalizeID(user.Name)
+	log.Debugf("DB: Add identity %s", name)
 
-	_, err = tx.Exec(tx.Rebind(deleteUser), id)
+	err := d.checkDB()
 	if err != nil {
-		return nil, newHTTPErr(500, ErrDBDeleteUser, "Error deleting identity '%s': %s", id, err)
+		return err
 	}
 
-	record := &CertRecord{
-		ID: id,
+	if d.auditDB != nil {
+		_, err = d.doAuditedTransaction(auditInsertUser, name, d.insertUserTx, user, name)
+	} else {
+		err = d.insertUserRecord(d.namedExec, user, name)
 	}
-	record.Reason = reason
-
-	_, err = tx.NamedExec(tx.Rebind(updateRevokeSQL), record)
 	if err != nil {
-		return nil, newHTTPErr(500, ErrDBDeleteUser, "Error encountered while revoking certificates for identity '%s' that is being deleted: %s", id, err)
+		return err
 	}
+	d.recordUserWrite(name)
+	d.emitChange(ChangeInsert, name)
 
-	return &userRec, nil
+	return nil
 }
 
-// UpdateUser updates user in database
-func (d *Accessor) UpdateUser(user *spi.UserInfo, updatePass bool) error {
+// Warning is a problem with an identity that does not prevent it from being
+// inserted
+type Warning struct {
+	// Field is the field of the identity the warning is about
+	Field   string
+	Message string
+}
+
+// String returns the field and message of the warning
+func (w Warning) String() string {
+	return fmt.Sprintf("%s: %s", w.Field, w.Message)
+}
+
+// InsertUserWithWarnings inserts user into database like InsertUser, and
+// returns warnings about issues that do not prevent the insert, such as a
+// missing recommended attribute or an affiliation that does not exist
+func (d *Accessor) InsertUserWithWarnings(user *spi.UserInfo) ([]Warning, error) {
 	if user == nil {
-		return errors.New("User is not defined")
+		return nil, newHTTPErr(400, ErrInvalidRequest, "User is not defined")
 	}
-
-	log.Debugf("DB: Update identity %s", user.Name)
 	err := d.checkDB()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	attributes, err := json.Marshal(user.Attributes)
-	if err != nil {
-		return errors.Wrap(err, "Failed to marshal user attributes")
+	warnings := []Warning{}
+	for _, name := range d.RecommendedAttributes {
+		found := false
+		for _, attr := range user.Attributes {
+			if attr.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			warnings = append(warnings, Warning{Field: "attributes", Message: fmt.Sprintf("Recommended attribute '%s' is missing", name)})
+		}
 	}
-
-	// Hash the password before storing it
-	pwd := []byte(user.Pass)
-	if updatePass {
-		pwd, err = bcrypt.GenerateFromPassword(pwd, bcrypt.DefaultCost)
+	if user.Affiliation != "" {
+		_, err = d.getAffiliationRecord(user.Affiliation)
 		if err != nil {
-			return errors.Wrap(err, "Failed to hash password")
+			if getHTTPErr(err).lcode != ErrDBGet {
+				return nil, err
+			}
+			warnings = append(warnings, Warning{Field: "affiliation", Message: fmt.Sprintf("Affiliation '%s' does not exist", user.Affiliation)})
 		}
 	}
 
-	// Store the updated user entry
-	res, err := d.db.NamedExec(updateUser, &UserRecord{
-		Name:           user.Name,
-		Pass:           pwd,
-		Type:           user.Type,
-		Affiliation:    user.Affiliation,
-		Attributes:     string(attributes),
-		State:          user.State,
-		MaxEnrollments: user.MaxEnrollments,
-		Level:          user.Level,
-	})
-
+	err = d.InsertUser(user)
 	if err != nil {
-		return errors.Wrap(err, "Failed to update identity record")
+		return nil, err
+	}
+	for _, warning := range warnings {
+		log.Debugf("Identity %s was added with warning: %s", d.normalizeID(user.Name), warning)
 	}
 
-	numRowsAffected, err := res.RowsAffected()
+	return warnings, nil
+}
 
-	if numRowsAffected == 0 {
-		return errors.New("No identity records were updated")
+// RegisterWithSecret inserts user into database with a randomly generated
+// secret, which is returned. Only the hash of the secret is stored, so the
+// returned value is the only copy of it.
+func (d *Accessor) RegisterWithSecret(user spi.UserInfo) (string, error) {
+	name := d.normalizeID(user.Name)
+	log.Debugf("DB: Register identity %s with a generated secret", name)
+
+	err := d.checkDB()
+	if err != nil {
+		return "", err
 	}
 
-	if numRowsAffected != 1 {
-		return errors.Errorf("Expected one identity record to be updated, but %d records were updated", numRowsAffected)
+	secret := util.RandomString(12)
+	user.Pass = secret
+	_, err = d.doAuditedTransaction(auditInsertUser, name, d.insertUserTx, &user, name)
+	if err != nil {
+		return "", err
 	}
+	d.recordUserWrite(name)
+	d.emitChange(ChangeInsert, name)
 
-	return err
+	return secret, nil
+}
 
+func (d *Accessor) insertUserTx(tx *sqlx.Tx, args ...interface{}) (interface{}, error) {
+	user := args[0].(*spi.UserInfo)
+	name := args[1].(string)
+
+	return nil, d.insertUserRecord(tx.NamedExec, user, name)
 }
 
-// GetUser gets user from database
-func (d *Accessor) GetUser(id string, attrs []string) (spi.User, error) {
-	log.Debugf("DB: Getting identity %s", id)
+// InsertUserIdempotent inserts user into database unless a user was already
+// inserted with the same key, in which case nothing is inserted and false is
+// returned. Retried requests with the same key therefore insert the user once.
+func (d *Accessor) InsertUserIdempotent(user spi.UserInfo, key string) (bool, error) {
+	if key == "" {
+		return false, newHTTPErr(400, ErrInvalidRequest, "Idempotency key is not defined")
+	}
+	name := d.normalizeID(user.Name)
+	log.Debugf("DB: Add identity %s with idempotency key %s", name, key)
 
 	err := d.checkDB()
 	if err != nil {
-		return nil, err
+		return false, err
 	}
 
-	var userRec UserRecord
-	err = d.db.Get(&userRec, d.db.Rebind(getUser), id)
+	created, err := d.doAuditedTransaction(auditInsertUser, name, d.insertUserIdempotentTx, &user, name, key)
 	if err != nil {
-		return nil, getError(err, "User")
+		return false, err
+	}
+	if created.(bool) {
+		d.recordUserWrite(name)
+		d.emitChange(ChangeInsert, name)
 	}
 
-	return newDBUser(&userRec, d.db), nil
+	return created.(bool), nil
 }
 
-// InsertAffiliation inserts affiliation into database
-func (d *Accessor) InsertAffiliation(name string, prekey string, level int) error {
-	log.Debugf("DB: Add affiliation %s", name)
-	err := d.checkDB()
+func (d *Accessor) insertUserIdempotentTx(tx *sqlx.Tx, args ...interface{}) (interface{}, error) {
+	user := args[0].(*spi.UserInfo)
+	name := args[1].(string)
+	key := args[2].(string)
+
+	var seen []UserRecord
+	err := tx.Select(&seen, d.rebind("SELECT * FROM users WHERE (idempotency_key = ?) AND (ca_name = ?)"), key, d.CAName)
 	if err != nil {
-		return err
+		return nil, errors.Wrap(err, "Failed to look up idempotency key")
 	}
-	dbType := d.db.DriverName()
-	// InnoDB store engine for MySQL does not allow more than 767 bytes
-	// in a 'UNIQUE' column. To work around this, the UNIQUE constraint was removed
-	// from the 'name' column in the affiliations table for MySQL to allow for up to 1024
-	// characters to be stored. In doing this, a check is needed on MySQL to check
-	// if the affiliation exists before adding it to prevent duplicate entries.
-	if dbType == "mysql" {
-		aff, _ := d.GetAffiliation(name)
-		if aff != nil {
-			log.Debugf("Affiliation '%s' already exists", name)
-			return nil
+	for _, userRec := range seen {
+		if d.IdempotencyKeyTTL == 0 || (userRec.CreatedAt.Valid && time.Since(userRec.CreatedAt.Time) < d.IdempotencyKeyTTL) {
+			log.Debugf("Identity %s was already added with idempotency key %s", userRec.Name, key)
+			return false, nil
+		}
+		// The key has expired, so it no longer identifies a request
+		_, err = tx.Exec(d.rebind("UPDATE users SET idempotency_key = NULL WHERE (id = ?) AND (ca_name = ?)"), userRec.Name, d.CAName)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to clear expired idempotency key")
 		}
 	}
-	_, err = d.db.Exec(d.db.Rebind(insertAffiliation), name, prekey, level)
+
+	err = d.insertUserRecord(tx.NamedExec, user, name)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(d.rebind("UPDATE users SET idempotency_key = ? WHERE (id = ?) AND (ca_name = ?)"), key, name, d.CAName)
 	if err != nil {
-		if (!strings.Contains(err.Error(), "UNIQUE constraint failed") && dbType == "sqlite3") || (!strings.Contains(err.Error(), "duplicate key value") && dbType == "postgres") {
-			return err
-		}
-		log.Debugf("Affiliation '%s' already exists", name)
-		return nil
+		return nil, errors.Wrap(err, "Failed to store idempotency key")
 	}
-	log.Debugf("Affiliation '%s' added", name)
 
-	return nil
+	return true, nil
 }
 
-// DeleteAffiliation deletes affiliation from database. Using the force option with identity removal allowed
-// this will also delete the identities associated with removed affiliations, and also delete the certificates
-// for the identities removed
-func (d *Accessor) DeleteAffiliation(name string, force, identityRemoval, isRegistrar bool) (*spi.DbTxResult, error) {
-	log.Debugf("DB: Delete affiliation %s", name)
+// InsertUserPreHashed inserts user into database with a bcrypt hash of its
+// password that was computed elsewhere, such as by another CA the user is
+// being migrated from. The hash is stored as is, and user.Pass is ignored.
+func (d *Accessor) InsertUserPreHashed(user spi.UserInfo, tokenHash string) error {
+	name := d.normalizeID(user.Name)
+	log.Debugf("DB: Add identity %s with a pre-hashed password", name)
 
-	_, err := d.GetAffiliation(name)
+	err := d.checkDB()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	result, err := d.doTransaction(d.deleteAffiliationTx, name, force, identityRemoval, isRegistrar)
+	// Make sure the hash can be verified at login
+	_, err = bcrypt.Cost([]byte(tokenHash))
 	if err != nil {
-		return nil, err
+		return newHTTPErr(400, ErrInvalidRequest, "Password hash of identity '%s' is not a valid bcrypt hash: %s", name, err)
 	}
 
-	deletedInfo := result.(*spi.DbTxResult)
+	if d.auditDB != nil {
+		_, err = d.doAuditedTransaction(auditInsertUser, name, d.insertUserPreHashedTx, &user, name, tokenHash)
+	} else {
+		err = d.insertUserToken(d.namedExec, &user, name, []byte(tokenHash))
+	}
+	if err != nil {
+		return err
+	}
+
+	d.recordUserWrite(name)
+	d.emitChange(ChangeInsert, name)
+
+	return nil
+}
+
+func (d *Accessor) insertUserPreHashedTx(tx *sqlx.Tx, args ...interface{}) (interface{}, error) {
+	user := args[0].(*spi.UserInfo)
+	name := args[1].(string)
+	tokenHash := args[2].(string)
+
+	return nil, d.insertUserToken(tx.NamedExec, user, name, []byte(tokenHash))
+}
+
+// insertUserRecord hashes the password of user and stores it as name using namedExec
+func (d *Accessor) insertUserRecord(namedExec func(string, interface{}) (sql.Result, error), user *spi.UserInfo, name string) error {
+	// Hash the password before storing it
+	pwd, err := bcrypt.GenerateFromPassword([]byte(user.Pass), bcrypt.DefaultCost)
+	if err != nil {
+		return errors.Wrap(err, "Failed to hash password")
+	}
+
+	return d.insertUserToken(namedExec, user, name, pwd)
+}
+
+// insertUserToken stores user as name with the password hash pwd using namedExec
+func (d *Accessor) insertUserToken(namedExec func(string, interface{}) (sql.Result, error), user *spi.UserInfo, name string, pwd []byte) error {
+	if d.IDValidator != nil {
+		err := d.IDValidator(name)
+		if err != nil {
+			return newHTTPErr(400, ErrInvalidRequest, "Identity name '%s' is not valid: %s", name, err)
+		}
+	}
+	err := checkAttributeLengths(user.Attributes, d.MaxAttributeLengths)
+	if err != nil {
+		return err
+	}
+
+	attrBytes, err := json.Marshal(user.Attributes)
+	if err != nil {
+		return err
+	}
+	attributes, err := d.encodeAttributes(attrBytes)
+	if err != nil {
+		return err
+	}
+
+	userType := user.Type
+	if userType == "" {
+		userType = d.DefaultUserType
+	}
+
+	isBootstrap := 0
+	if user.IsBootstrap {
+		isBootstrap = 1
+	}
+
+	// Store the user record in the DB
+	res, err := namedExec(insertUser, &UserRecord{
+		Name:            name,
+		Pass:            pwd,
+		Type:            userType,
+		Affiliation:     user.Affiliation,
+		Attributes:      attributes,
+		AttrCount:       sql.NullInt64{Int64: int64(len(user.Attributes)), Valid: true},
+		State:           user.State,
+		MaxEnrollments:  user.MaxEnrollments,
+		Level:           user.Level,
+		CreatedAt:       sql.NullTime{Time: time.Now().UTC(), Valid: true},
+		CreatedBy:       sql.NullString{String: user.CreatedBy, Valid: user.CreatedBy != ""},
+		ExpiresAt:       sql.NullTime{Time: user.ExpiresAt.UTC(), Valid: !user.ExpiresAt.IsZero()},
+		InitialSecret:   1,
+		CAName:          d.CAName,
+		SecretExpiresAt: sql.NullTime{Time: user.SecretExpiresAt.UTC(), Valid: !user.SecretExpiresAt.IsZero()},
+		IsBootstrap:     isBootstrap,
+	})
+
+	if err != nil {
+		return getInsertUserError(err, name)
+	}
+
+	numRowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if numRowsAffected == 0 {
+		return newHTTPErr(500, ErrAddIdentity, "Failed to add identity %s to the database", name)
+	}
+
+	if numRowsAffected != 1 {
+		return newHTTPErr(500, ErrAddIdentity, "Expected to add one record to the database, but %d records were added", numRowsAffected)
+	}
+
+	log.Debugf("Successfully added identity %s to the database", name)
+
+	return nil
+}
+
+// DeleteUser deletes user from database
+func (d *Accessor) DeleteUser(id string) (spi.User, error) {
+	id = d.normalizeID(id)
+	log.Debugf("DB: Delete identity %s", id)
+
+	result, err := d.doAuditedTransaction(auditDeleteUser, id, d.deleteUserTx, id, ocsp.CessationOfOperation) // 5 (cessationofoperation) reason for certificate revocation
+	if err != nil {
+		return nil, err
+	}
+
+	d.recordUserWrite(id)
+	d.emitChange(ChangeDelete, id)
+
+	userRec := result.(*UserRecord)
+	user := newDBUser(userRec, d.db)
+
+	return user, nil
+}
+
+func (d *Accessor) deleteUserTx(tx *sqlx.Tx, args ...interface{}) (interface{}, error) {
+	id := args[0].(string)
+	reason := args[1].(int)
+
+	var userRec UserRecord
+	err := tx.Get(&userRec, d.rebind(getUser), id, d.CAName)
+	if err != nil {
+		return nil, getError(err, "User")
+	}
+	if userRec.IsBootstrap == 1 {
+		return nil, newHTTPErr(400, ErrInvalidRequest, "Identity '%s' is the bootstrap admin and can not be deleted", id)
+	}
+
+	_, err = tx.Exec(d.rebind(deleteUser), id, d.CAName)
+	if err != nil {
+		return nil, newHTTPErr(500, ErrDBDeleteUser, "Error deleting identity '%s': %s", id, err)
+	}
+
+	record := &CertRecord{
+		ID: id,
+	}
+	record.Reason = reason
+
+	_, err = tx.NamedExec(d.rebind(updateRevokeSQL), record)
+	if err != nil {
+		return nil, newHTTPErr(500, ErrDBDeleteUser, "Error encountered while revoking certificates for identity '%s' that is being deleted: %s", id, err)
+	}
+
+	return &userRec, nil
+}
+
+// SoftDeleteUser deletes an identity like DeleteUser, revoking its
+// certificates, but keeps a copy of its record in the deleted_users table,
+// along with the time it was deleted, until PurgeDeletedBefore removes it.
+// The id can be registered again while the deleted identity is kept.
+func (d *Accessor) SoftDeleteUser(id string) (spi.User, error) {
+	id = d.normalizeID(id)
+	log.Debugf("DB: Soft delete identity %s", id)
+
+	result, err := d.doAuditedTransaction(auditDeleteUser, id, d.softDeleteUserTx, id, ocsp.CessationOfOperation) // 5 (cessationofoperation) reason for certificate revocation
+	if err != nil {
+		return nil, err
+	}
+
+	d.recordUserWrite(id)
+	d.emitChange(ChangeDelete, id)
+
+	userRec := result.(*UserRecord)
+	user := newDBUser(userRec, d.db)
+
+	return user, nil
+}
+
+func (d *Accessor) softDeleteUserTx(tx *sqlx.Tx, args ...interface{}) (interface{}, error) {
+	id := args[0].(string)
+
+	_, err := tx.Exec(d.rebind(softDeleteUser), time.Now().UTC(), id, d.CAName)
+	if err != nil {
+		return nil, newHTTPErr(500, ErrDBDeleteUser, "Error keeping deleted identity '%s': %s", id, err)
+	}
+
+	return d.deleteUserTx(tx, args...)
+}
+
+// PurgeDeletedBefore removes the identities that were soft deleted before the
+// given time from the deleted_users table, and returns the number removed
+func (d *Accessor) PurgeDeletedBefore(before time.Time) (int, error) {
+	log.Debugf("DB: Purge identities deleted before %s", before)
+	err := d.checkDB()
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := d.exec(d.rebind("DELETE FROM deleted_users WHERE (deleted_at < ?) AND (ca_name = ?)"), before.UTC(), d.CAName)
+	if err != nil {
+		return 0, newHTTPErr(500, ErrDBDeleteUser, "Failed to purge deleted identities: %s", err)
+	}
+	numRowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to get number of rows affected")
+	}
+
+	return int(numRowsAffected), nil
+}
+
+// UpdateUser updates user in database
+func (d *Accessor) UpdateUser(user *spi.UserInfo, updatePass bool) error {
+	if user == nil {
+		return newHTTPErr(400, ErrInvalidRequest, "User is not defined")
+	}
+	name := d.normalizeID(user.Name)
+	log.Debugf("DB: Update identity %s", name)
+	err := d.checkDB()
+	if err != nil {
+		return err
+	}
+	err = checkAttributeLengths(user.Attributes, d.MaxAttributeLengths)
+	if err != nil {
+		return err
+	}
+
+	attrBytes, err := json.Marshal(user.Attributes)
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal user attributes")
+	}
+	attributes, err := d.encodeAttributes(attrBytes)
+	if err != nil {
+		return err
+	}
+
+	// Hash the password before storing it
+	pwd := []byte(user.Pass)
+	query := updateUser
+	if updatePass {
+		pwd, err = bcrypt.GenerateFromPassword(pwd, bcrypt.DefaultCost)
+		if err != nil {
+			return errors.Wrap(err, "Failed to hash password")
+		}
+		// Changing the password replaces the secret the identity was registered with
+		query = updateUserPass
+	}
+
+	userRec := &UserRecord{
+		Name:            name,
+		Pass:            pwd,
+		Type:            user.Type,
+		Affiliation:     user.Affiliation,
+		Attributes:      attributes,
+		AttrCount:       sql.NullInt64{Int64: int64(len(user.Attributes)), Valid: true},
+		State:           user.State,
+		MaxEnrollments:  user.MaxEnrollments,
+		Level:           user.Level,
+		CAName:          d.CAName,
+		SecretExpiresAt: sql.NullTime{Time: user.SecretExpiresAt.UTC(), Valid: !user.SecretExpiresAt.IsZero()},
+	}
+
+	if d.auditDB != nil {
+		_, err = d.doAuditedTransaction(auditUpdateUser, name, d.updateUserTx, query, userRec)
+	} else {
+		err = updateUserRecord(d.namedExec, query, userRec)
+	}
+	if err != nil {
+		return err
+	}
+	d.recordUserWrite(name)
+	d.emitChange(ChangeUpdate, name)
+
+	return nil
+}
+
+func (d *Accessor) updateUserTx(tx *sqlx.Tx, args ...interface{}) (interface{}, error) {
+	query := args[0].(string)
+	userRec := args[1].(*UserRecord)
+
+	return nil, updateUserRecord(tx.NamedExec, query, userRec)
+}
+
+// updateUserRecord stores the updated user entry with query using namedExec
+func updateUserRecord(namedExec func(string, interface{}) (sql.Result, error), query string, userRec *UserRecord) error {
+	res, err := namedExec(query, userRec)
+	if err != nil {
+		return errors.Wrap(err, "Failed to update identity record")
+	}
+
+	numRowsAffected, err := res.RowsAffected()
+
+	if numRowsAffected == 0 {
+		return newHTTPErr(404, ErrModifyingIdentity, "No identity records were updated")
+	}
+
+	if numRowsAffected != 1 {
+		return newHTTPErr(500, ErrModifyingIdentity, "Expected one identity record to be updated, but %d records were updated", numRowsAffected)
+	}
+
+	return err
+}
+
+// HasInitialSecret returns true if the identity still has the secret it was
+// registered with, that is, if its password has never been changed
+func (d *Accessor) HasInitialSecret(id string) (bool, error) {
+	id = d.normalizeID(id)
+	log.Debugf("DB: Check whether identity %s has its initial secret", id)
+	err := d.checkDB()
+	if err != nil {
+		return false, err
+	}
+
+	var initialSecret int
+	rdb := d.getUserReadDB(id)
+	err = rdb.Get(&initialSecret, d.rebind("SELECT initial_secret FROM users WHERE (id = ?) AND (ca_name = ?)"), id, d.CAName)
+	if err != nil {
+		return false, getError(err, "User")
+	}
+
+	return initialSecret == 1, nil
+}
+
+// IsBootstrapAdmin returns true if the identity is the bootstrap admin
+// registered when the CA was initialized
+func (d *Accessor) IsBootstrapAdmin(id string) (bool, error) {
+	id = d.normalizeID(id)
+	log.Debugf("DB: Check whether identity %s is the bootstrap admin", id)
+	err := d.checkDB()
+	if err != nil {
+		return false, err
+	}
+
+	var isBootstrap int
+	rdb := d.getUserReadDB(id)
+	err = rdb.Get(&isBootstrap, d.rebind("SELECT is_bootstrap FROM users WHERE (id = ?) AND (ca_name = ?)"), id, d.CAName)
+	if err != nil {
+		return false, getError(err, "User")
+	}
+
+	return isBootstrap == 1, nil
+}
+
+// IsSecretExpired returns true if the secret of an identity has an expiry time
+// that has passed, after which the identity can not login with the secret
+func (d *Accessor) IsSecretExpired(id string) (bool, error) {
+	id = d.normalizeID(id)
+	log.Debugf("DB: Check if secret of identity %s is expired", id)
+	err := d.checkDB()
+	if err != nil {
+		return false, err
+	}
+
+	var secretExpiresAt sql.NullTime
+	rdb := d.getUserReadDB(id)
+	err = rdb.Get(&secretExpiresAt, d.rebind("SELECT secret_expires_at FROM users WHERE (id = ?) AND (ca_name = ?)"), id, d.CAName)
+	if err != nil {
+		return false, getError(err, "User")
+	}
+
+	return secretExpiresAt.Valid && isSecretExpired(secretExpiresAt.Time), nil
+}
+
+// GetSerialHistory returns the serial numbers of the certificate most recently
+// issued to an identity and of the one issued before it. Either is empty if
+// the identity has not been issued that many certificates.
+func (d *Accessor) GetSerialHistory(id string) (current, previous string, err error) {
+	id = d.normalizeID(id)
+	log.Debugf("DB: Get serial history of identity %s", id)
+	err = d.checkDB()
+	if err != nil {
+		return "", "", err
+	}
+
+	var serials struct {
+		Current  sql.NullString `db:"serial_number"`
+		Previous sql.NullString `db:"previous_serial_number"`
+	}
+	rdb := d.getUserReadDB(id)
+	err = rdb.Get(&serials, d.rebind("SELECT serial_number, previous_serial_number FROM users WHERE (id = ?) AND (ca_name = ?)"), id, d.CAName)
+	if err != nil {
+		return "", "", getError(err, "User")
+	}
+
+	return serials.Current.String, serials.Previous.String, nil
+}
+
+// NeedsReenrollment returns true if an identity has enrolled and its
+// unrevoked certificate that expires last expires within the given duration
+// from now, or if it has enrolled but has no unrevoked, unexpired
+// certificate. Identities that have not enrolled, and revoked identities,
+// which can not reenroll, do not need reenrollment.
+func (d *Accessor) NeedsReenrollment(id string, within time.Duration) (bool, error) {
+	id = d.normalizeID(id)
+	log.Debugf("DB: Check if identity %s needs reenrollment within %s", id, within)
+	err := d.checkDB()
+	if err != nil {
+		return false, err
+	}
+
+	var state int
+	rdb := d.getUserReadDB(id)
+	err = rdb.Get(&state, d.rebind("SELECT state FROM users WHERE (id = ?) AND (ca_name = ?)"), id, d.CAName)
+	if err != nil {
+		return false, getError(err, "User")
+	}
+	if state <= 0 {
+		return false, nil
+	}
+
+	var expiries []time.Time
+	err = rdb.Select(&expiries, d.rebind("SELECT expiry FROM certificates WHERE (id = ?) AND (status != 'revoked') ORDER BY expiry DESC LIMIT 1"), id)
+	if err != nil {
+		return false, errors.Wrapf(err, "Failed to get certificates of identity '%s'", id)
+	}
+	if len(expiries) == 0 {
+		return true, nil
+	}
+
+	return expiries[0].Before(time.Now().Add(within)), nil
+}
+
+// ReconcileCertificates makes the current serial of each identity that of its
+// latest unrevoked certificate, that is the one that expires last, correcting
+// identities whose serial has drifted from the certificates table. Identities
+// without an unrevoked certificate are left unchanged. It returns the number
+// of identities corrected.
+func (d *Accessor) ReconcileCertificates() (int, error) {
+	log.Debug("DB: Reconcile identities with the certificates table")
+	err := d.checkDB()
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := d.doTransaction(d.reconcileCertificatesTx)
+	if err != nil {
+		return 0, err
+	}
+
+	ids := result.([]string)
+	d.recordUserWrites(ids)
+	d.emitChanges(ChangeUpdate, ids)
+
+	fixed := len(ids)
+	if fixed > 0 {
+		log.Infof("Corrected the current certificate of %d identities", fixed)
+	}
+	return fixed, nil
+}
+
+func (d *Accessor) reconcileCertificatesTx(tx *sqlx.Tx, args ...interface{}) (interface{}, error) {
+	var certs []struct {
+		ID     string `db:"id"`
+		Serial string `db:"serial_number"`
+		AKI    string `db:"authority_key_identifier"`
+	}
+	err := tx.Select(&certs, "SELECT id, serial_number, authority_key_identifier FROM certificates WHERE (status != 'revoked') ORDER BY id, expiry DESC")
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get unrevoked certificates")
+	}
+
+	var users []struct {
+		Name   string         `db:"id"`
+		Serial sql.NullString `db:"serial_number"`
+		AKI    sql.NullString `db:"aki"`
+	}
+	err = tx.Select(&users, d.rebind("SELECT id, serial_number, aki FROM users WHERE (ca_name = ?)"), d.CAName)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get serials of identities")
+	}
+	current := make(map[string][2]string, len(users))
+	for _, user := range users {
+		current[user.Name] = [2]string{user.Serial.String, user.AKI.String}
+	}
+
+	fixed := []string{}
+	for i, cert := range certs {
+		// Only the first certificate of each identity is its latest
+		if i > 0 && certs[i-1].ID == cert.ID {
+			continue
+		}
+		serial, ok := current[cert.ID]
+		if !ok || serial == [2]string{cert.Serial, cert.AKI} {
+			continue
+		}
+		log.Debugf("Current certificate of identity '%s' is %s, but its latest unrevoked certificate is %s", cert.ID, serial[0], cert.Serial)
+		_, err = tx.Exec(d.rebind("UPDATE users SET serial_number = ?, aki = ? WHERE (id = ?) AND (ca_name = ?)"), cert.Serial, cert.AKI, cert.ID, d.CAName)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to correct current certificate of identity '%s'", cert.ID)
+		}
+		fixed = append(fixed, cert.ID)
+	}
+
+	return fixed, nil
+}
+
+// UpdateUserIfExists updates user in database like UpdateUser, except that it
+// is not an error if the user does not exist or no record needed updating
+func (d *Accessor) UpdateUserIfExists(user *spi.UserInfo, updatePass bool) error {
+	err := d.UpdateUser(user, updatePass)
+	if err != nil {
+		httpErr := getHTTPErr(err)
+		if httpErr.lcode == ErrModifyingIdentity && httpErr.scode == 404 {
+			log.Debugf("Identity %s was not updated: %s", user.Name, err)
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// UpdateField sets a single field of an identity
+func (d *Accessor) UpdateField(id string, field Field, value interface{}) error {
+	id = d.normalizeID(id)
+	log.Debugf("DB: Update field %d of identity %s", field, id)
+	err := d.checkDB()
+	if err != nil {
+		return err
+	}
+
+	column, err := getFieldColumn(field, value)
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf("UPDATE users SET %s = ? WHERE (id = ?) AND (ca_name = ?)", column)
+	res, err := d.exec(d.rebind(query), value, id, d.CAName)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to update field %d of identity '%s'", field, id)
+	}
+
+	numRowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "Failed to get number of rows affected")
+	}
+
+	if numRowsAffected == 0 {
+		return newHTTPErr(404, ErrModifyingIdentity, "No identity records were updated")
+	}
+
+	d.recordUserWrite(id)
+	d.emitChange(ChangeUpdate, id)
+
+	return nil
+}
+
+// getFieldColumn returns the column of the users table for field after
+// checking that value has the type stored in that column
+func getFieldColumn(field Field, value interface{}) (string, error) {
+	column, ok := fieldColumns[field]
+	if !ok {
+		return "", newHTTPErr(400, ErrInvalidFieldValue, "Unknown identity field %d", field)
+	}
+
+	switch field {
+	case FieldType, FieldAffiliation:
+		if _, ok := value.(string); !ok {
+			return "", newHTTPErr(400, ErrInvalidFieldValue, "Field %d expects type string, but received type %T", field, value)
+		}
+	case FieldState, FieldMaxEnrollments, FieldLevel:
+		if _, ok := value.(int); !ok {
+			return "", newHTTPErr(400, ErrInvalidFieldValue, "Field %d expects type int, but received type %T", field, value)
+		}
+	}
+
+	return column, nil
+}
+
+// UpdateFieldBatch sets a field to the same value for all of the identities
+// specified with one update statement, and returns the number of identities updated
+func (d *Accessor) UpdateFieldBatch(ids []string, field Field, value interface{}) (int, error) {
+	log.Debugf("DB: Update field %d of identities %s", field, ids)
+	err := d.checkDB()
+	if err != nil {
+		return 0, err
+	}
+
+	column, err := getFieldColumn(field, value)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	normalizedIDs := make([]string, len(ids))
+	for i, id := range ids {
+		normalizedIDs[i] = d.normalizeID(id)
+	}
+
+	result, err := d.doTransaction(d.updateFieldBatchTx, normalizedIDs, column, value)
+	if err != nil {
+		return 0, err
+	}
+
+	updated := result.([]string)
+	d.recordUserWrites(updated)
+	d.emitChanges(ChangeUpdate, updated)
+
+	return len(updated), nil
+}
+
+func (d *Accessor) updateFieldBatchTx(tx *sqlx.Tx, args ...interface{}) (interface{}, error) {
+	ids := args[0].([]string)
+	column := args[1].(string)
+	value := args[2]
+
+	// Get the identities that exist, which are the ones that are updated
+	query := "SELECT id FROM users WHERE (id IN (?)) AND (ca_name = ?)"
+	inQuery, inArgs, err := sqlx.In(query, ids, d.CAName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to construct query '%s'", query)
+	}
+	updated := []string{}
+	err = tx.Select(&updated, d.rebind(inQuery), inArgs...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to execute query '%s' for multiple identity update", query)
+	}
+
+	query = fmt.Sprintf("UPDATE users SET %s = ? WHERE (id IN (?)) AND (ca_name = ?)", column)
+	inQuery, inArgs, err = sqlx.In(query, value, ids, d.CAName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to construct query '%s'", query)
+	}
+	_, err = tx.Exec(d.rebind(inQuery), inArgs...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to execute query '%s' for multiple identity update", query)
+	}
+
+	return updated, nil
+}
+
+// TransitionState changes the enrollment state of an identity, allowing only
+// transitions that can happen through normal use: one more enrollment, within
+// the identity's maximum enrollments, or revocation. A revoked identity can not
+// change state, and the state can not go backwards; use ResetAllEnrollments to
+// allow identities to enroll again.
+func (d *Accessor) TransitionState(id string, to EnrollmentState) error {
+	id = d.normalizeID(id)
+	log.Debugf("DB: Transition state of identity %s to %d", id, to)
+	user, err := d.getUser(id, false)
+	if err != nil {
+		return err
+	}
+
+	from := EnrollmentState(user.State)
+	switch {
+	case from == EnrollmentStateRevoked:
+		return newHTTPErr(400, ErrInvalidStateTransition, "Identity '%s' is revoked and its state can not be changed", user.Name)
+	case to == EnrollmentStateRevoked:
+		// Any identity that is not revoked may be revoked
+	case to != from+1:
+		return newHTTPErr(400, ErrInvalidStateTransition, "Identity '%s' can not transition from state %d to state %d", user.Name, from, to)
+	case user.MaxEnrollments != -1 && int(to) > user.MaxEnrollments:
+		return newHTTPErr(400, ErrInvalidStateTransition, "Identity '%s' can not transition to state %d, which exceeds its maximum enrollments of %d", user.Name, to, user.MaxEnrollments)
+	}
+
+	// Only update the state if it has not changed since it was read
+	res, err := d.exec(d.rebind("UPDATE users SET state = ? WHERE (id = ?) AND (ca_name = ?) AND (state = ?)"), int(to), user.Name, d.CAName, int(from))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to update state of identity '%s'", user.Name)
+	}
+
+	numRowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "Failed to get number of rows affected")
+	}
+
+	if numRowsAffected == 0 {
+		return newHTTPErr(500, ErrModifyingIdentity, "State of identity '%s' was changed concurrently", user.Name)
+	}
+
+	d.recordUserWrite(user.Name)
+	d.emitChange(ChangeUpdate, user.Name)
+
+	return nil
+}
+
+// ResetAllEnrollments sets the state of every identity back to 0 so that each
+// identity may enroll again, returning the number of identities that were reset.
+// Since this affects all identities, confirm must be true or no change is made.
+func (d *Accessor) ResetAllEnrollments(confirm bool) (int, error) {
+	log.Debug("DB: Reset enrollment state of all identities")
+	if !confirm {
+		return 0, newHTTPErr(400, ErrInvalidRequest, "Resetting the enrollment state of all identities requires confirmation")
+	}
+
+	result, err := d.doTransaction(d.resetAllEnrollmentsTx)
+	if err != nil {
+		return 0, err
+	}
+
+	reset := result.([]string)
+	d.recordUserWrites(reset)
+	d.emitChanges(ChangeUpdate, reset)
+
+	return len(reset), nil
+}
+
+func (d *Accessor) resetAllEnrollmentsTx(tx *sqlx.Tx, args ...interface{}) (interface{}, error) {
+	reset := []string{}
+	err := tx.Select(&reset, d.rebind("SELECT id FROM users WHERE (ca_name = ?)"), d.CAName)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get identities to reset")
+	}
+
+	_, err = tx.Exec(d.rebind("UPDATE users SET state = 0 WHERE (ca_name = ?)"), d.CAName)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to reset enrollment state of identities")
+	}
+
+	return reset, nil
+}
+
+// SetStates sets the enrollment state of each identity in states to the
+// state it maps to, in a single transaction. It returns the number of
+// identities whose state changed; ids that do not exist are ignored.
+func (d *Accessor) SetStates(states map[string]int) (int, error) {
+	log.Debugf("DB: Set enrollment state of %d identities", len(states))
+	if len(states) == 0 {
+		return 0, nil
+	}
+
+	result, err := d.doTransaction(d.setStatesTx, states)
+	if err != nil {
+		return 0, err
+	}
+
+	updated := result.([]string)
+	d.recordUserWrites(updated)
+	d.emitChanges(ChangeUpdate, updated)
+
+	return len(updated), nil
+}
+
+func (d *Accessor) setStatesTx(tx *sqlx.Tx, args ...interface{}) (interface{}, error) {
+	states := args[0].(map[string]int)
+
+	// Update in a fixed order so concurrent calls lock rows in the same order
+	ids := make([]string, 0, len(states))
+	for id := range states {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	updated := []string{}
+	for _, id := range ids {
+		name := d.normalizeID(id)
+		res, err := tx.Exec(d.rebind("UPDATE users SET state = ? WHERE (id = ? AND ca_name = ? AND state != ?)"), states[id], name, d.CAName, states[id])
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to set enrollment state of identity '%s'", id)
+		}
+		numRowsAffected, err := res.RowsAffected()
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to get number of rows affected")
+		}
+		if numRowsAffected > 0 {
+			updated = append(updated, name)
+		}
+	}
+
+	return updated, nil
+}
+
+// GetUser gets user from database
+func (d *Accessor) GetUser(id string, attrs []string) (spi.User, error) {
+	log.Debugf("DB: Getting identity %s", id)
+	user, err := d.getUser(id, false)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// GetUserECert gets user from database with only the attributes that are
+// added to an enrollment certificate by default, i.e. those with ECert set.
+// The attributes of the returned user can not be modified.
+func (d *Accessor) GetUserECert(id string) (spi.User, error) {
+	log.Debugf("DB: Getting identity %s with ECert attributes", id)
+	user, err := d.getUser(id, true)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// GetUserWithAffiliationCheck gets user from database like GetUser, and
+// returns an error if the user's affiliation no longer exists. Identities
+// with the root affiliation always pass the check.
+func (d *Accessor) GetUserWithAffiliationCheck(id string) (spi.User, error) {
+	log.Debugf("DB: Getting identity %s and checking its affiliation", id)
+	user, err := d.getUser(id, false)
+	if err != nil {
+		return nil, err
+	}
+	if user.Affiliation == "" {
+		return user, nil
+	}
+	_, err = d.getAffiliationRecord(user.Affiliation)
+	if err != nil {
+		if getHTTPErr(err).lcode == ErrDBGet {
+			return nil, newHTTPErr(400, ErrInvalidRequest, "Affiliation '%s' of identity '%s' does not exist", user.Affiliation, user.Name)
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+func (d *Accessor) getUser(id string, ecertOnly bool) (*DBUser, error) {
+	id = d.normalizeID(id)
+	err := d.checkDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var userRec UserRecord
+	rdb := d.getUserReadDB(id)
+	err = rdb.Get(&userRec, d.rebind(getUser), id, d.CAName)
+	if err != nil {
+		return nil, getError(err, "User")
+	}
+
+	if d.RepairDuplicateAttributes {
+		d.repairDuplicateAttributes(&userRec)
+	}
+
+	user := convertUserRecord(&userRec, d.db, ecertOnly)
+	user.maxIncorrectPasswordAttempts = d.MaxIncorrectPasswordAttempts
+	user.lockoutDuration = d.LockoutDuration
+	user.authenticator = d.Authenticator
+	user.secretResolver = d.SecretResolver
+	user.compressAttributes = d.compressesAttributes()
+	user.sortAttributes = d.SortAttributes
+	user.maxAttributeLengths = d.MaxAttributeLengths
+	user.recordWrite = d.recordUserWrite
+	user.emitWrite = func(id string) { d.emitChange(ChangeUpdate, id) }
+	if d.SortAttributes {
+		sort.SliceStable(user.Attributes, func(i, j int) bool { return user.Attributes[i].Name < user.Attributes[j].Name })
+	}
+
+	return user, nil
+}
+
+// repairDuplicateAttributes rewrites the attributes of a user record if they
+// contain duplicate attribute names. Failures are logged, since the duplicates
+// are collapsed when the record is converted anyway.
+func (d *Accessor) repairDuplicateAttributes(userRec *UserRecord) {
+	decoded, err := decodeAttributes(userRec.Attributes)
+	if err != nil {
+		return
+	}
+	var attrs []api.Attribute
+	err = json.Unmarshal([]byte(decoded), &attrs)
+	if err != nil {
+		return
+	}
+	attrs, duplicates := dedupeAttributes(attrs)
+	if !duplicates {
+		return
+	}
+
+	log.Infof("Removing duplicate attributes of identity '%s'", userRec.Name)
+	attrBytes, err := json.Marshal(attrs)
+	if err != nil {
+		log.Warningf("Failed to encode attributes of identity '%s': %s", userRec.Name, err)
+		return
+	}
+	attributes, err := d.encodeAttributes(attrBytes)
+	if err != nil {
+		log.Warningf("Failed to encode attributes of identity '%s': %s", userRec.Name, err)
+		return
+	}
+	_, err = d.exec(d.rebind("UPDATE users SET attributes = ?, attr_count = ? WHERE (id = ?) AND (ca_name = ?)"), attributes, len(attrs), userRec.Name, userRec.CAName)
+	if err != nil {
+		log.Warningf("Failed to remove duplicate attributes of identity '%s': %s", userRec.Name, err)
+		return
+	}
+	userRec.Attributes = attributes
+	userRec.AttrCount = sql.NullInt64{Int64: int64(len(attrs)), Valid: true}
+	d.recordUserWrite(userRec.Name)
+	d.emitChange(ChangeUpdate, userRec.Name)
+}
+
+// dedupeAttributes collapses attributes with the same name into one, at the
+// position of the first and with the value of the last. It returns true if
+// there were any duplicates.
+func dedupeAttributes(attrs []api.Attribute) ([]api.Attribute, bool) {
+	deduped := make([]api.Attribute, 0, len(attrs))
+	index := make(map[string]int, len(attrs))
+	for _, attr := range attrs {
+		if i, ok := index[attr.Name]; ok {
+			deduped[i] = attr
+			continue
+		}
+		index[attr.Name] = len(deduped)
+		deduped = append(deduped, attr)
+	}
+	return deduped, len(deduped) != len(attrs)
+}
+
+// compressedAttributesMarker starts the attributes of identities that are
+// stored compressed; it is gzip's first magic byte, which can not start JSON
+const compressedAttributesMarker = "\x1f"
+
+// compressesAttributes returns true if attributes are stored compressed
+func (d *Accessor) compressesAttributes() bool {
+	return d.CompressAttributes && d.db.DriverName() != "postgres"
+}
+
+// encodeAttributes returns the JSON encoded attributes as they are to be
+// stored
+func (d *Accessor) encodeAttributes(attrBytes []byte) (string, error) {
+	return encodeAttributes(attrBytes, d.compressesAttributes())
+}
+
+// encodeAttributes returns the JSON encoded attributes as they are to be
+// stored, gzip compressed and base64 encoded after a marker if compress is true
+func encodeAttributes(attrBytes []byte, compress bool) (string, error) {
+	if !compress {
+		return string(attrBytes), nil
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(attrBytes)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to compress attributes")
+	}
+	err = zw.Close()
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to compress attributes")
+	}
+	return compressedAttributesMarker + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// decodeAttributes returns the JSON encoded attributes from their stored form,
+// decompressing them if they were stored compressed
+func decodeAttributes(attributes string) (string, error) {
+	if !strings.HasPrefix(attributes, compressedAttributesMarker) {
+		return attributes, nil
+	}
+	compressed, err := base64.StdEncoding.DecodeString(attributes[len(compressedAttributesMarker):])
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to decode compressed attributes")
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to decompress attributes")
+	}
+	defer zr.Close()
+	attrBytes, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to decompress attributes")
+	}
+	return string(attrBytes), nil
+}
+
+// CanEnroll returns whether the identity is currently allowed to enroll and,
+// if not, a human-readable reason why. It applies the same checks as Login,
+// except for the password, using CAMaxEnrollments as the maximum enrollments
+// of the CA, without changing the identity. An error is returned only if the
+// database fails.
+func (d *Accessor) CanEnroll(id string) (bool, string, error) {
+	log.Debugf("DB: Check if identity %s can enroll", id)
+	user, err := d.getUser(id, false)
+	if err != nil {
+		if getHTTPErr(err).lcode == ErrDBGet {
+			return false, fmt.Sprintf("Identity '%s' does not exist", id), nil
+		}
+		return false, "", err
+	}
+
+	err = user.checkLoginAllowed()
+	if err != nil {
+		return false, err.Error(), nil
+	}
+
+	err = user.checkEnrollmentAllowed(d.CAMaxEnrollments)
+	if err != nil {
+		return false, err.Error(), nil
+	}
+
+	return true, "", nil
+}
+
+// IsUserLocked returns true if the identity is currently locked because of too
+// many incorrect password attempts, along with the time at which the lock expires
+func (d *Accessor) IsUserLocked(id string) (bool, time.Time, error) {
+	id = d.normalizeID(id)
+	log.Debugf("DB: Check if identity %s is locked", id)
+	err := d.checkDB()
+	if err != nil {
+		return false, time.Time{}, err
+	}
+
+	var lockedUntil sql.NullTime
+	err = d.getUserReadDB(id).Get(&lockedUntil, d.rebind("SELECT locked_until FROM users WHERE (id = ?) AND (ca_name = ?)"), id, d.CAName)
+	if err != nil {
+		return false, time.Time{}, getError(err, "User")
+	}
+
+	if !lockedUntil.Valid || !time.Now().Before(lockedUntil.Time) {
+		return false, time.Time{}, nil
+	}
+
+	return true, lockedUntil.Time, nil
+}
+
+// GetUserProvenance returns when and by whom the identity was created. Identities
+// created before this information was recorded return a zero time and an empty
+// creator, as do identities that were not registered by another identity.
+func (d *Accessor) GetUserProvenance(id string) (time.Time, string, error) {
+	id = d.normalizeID(id)
+	log.Debugf("DB: Getting provenance of identity %s", id)
+	err := d.checkDB()
+	if err != nil {
+		return time.Time{}, "", err
+	}
+
+	var prov struct {
+		CreatedAt sql.NullTime   `db:"created_at"`
+		CreatedBy sql.NullString `db:"created_by"`
+	}
+	err = d.getUserReadDB(id).Get(&prov, d.rebind("SELECT created_at, created_by FROM users WHERE (id = ?) AND (ca_name = ?)"), id, d.CAName)
+	if err != nil {
+		return time.Time{}, "", getError(err, "User")
+	}
+
+	return prov.CreatedAt.Time, prov.CreatedBy.String, nil
+}
+
+// GetRevocationInfo returns the RFC 5280 reason code and time of the revocation
+// of an identity. If the identity is not revoked, or was revoked before this
+// information was recorded, the returned time is zero.
+func (d *Accessor) GetRevocationInfo(id string) (int, time.Time, error) {
+	id = d.normalizeID(id)
+	log.Debugf("DB: Getting revocation information of identity %s", id)
+	err := d.checkDB()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	var info struct {
+		State            int           `db:"state"`
+		RevocationReason sql.NullInt64 `db:"revocation_reason"`
+		RevokedAt        sql.NullTime  `db:"revoked_at"`
+	}
+	err = d.getUserReadDB(id).Get(&info, d.rebind("SELECT state, revocation_reason, revoked_at FROM users WHERE (id = ?) AND (ca_name = ?)"), id, d.CAName)
+	if err != nil {
+		return 0, time.Time{}, getError(err, "User")
+	}
+
+	if info.State != -1 || !info.RevokedAt.Valid {
+		return 0, time.Time{}, nil
+	}
+
+	return int(info.RevocationReason.Int64), info.RevokedAt.Time, nil
+}
+
+// GetAttributeCount returns the number of attributes of an identity without
+// decoding them, unless the count was not recorded when the attributes were
+// last written
+func (d *Accessor) GetAttributeCount(id string) (int, error) {
+	log.Debugf("DB: Getting attribute count of identity %s", id)
+	err := d.checkDB()
+	if err != nil {
+		return 0, err
+	}
+
+	id = d.normalizeID(id)
+	rdb := d.getUserReadDB(id)
+	var count sql.NullInt64
+	err = rdb.Get(&count, d.rebind("SELECT attr_count FROM users WHERE (id = ?) AND (ca_name = ?)"), id, d.CAName)
+	if err != nil {
+		return 0, getError(err, "User")
+	}
+	if count.Valid {
+		return int(count.Int64), nil
+	}
+
+	// Identities last written before the count was maintained
+	var attributes sql.NullString
+	err = rdb.Get(&attributes, d.rebind("SELECT attributes FROM users WHERE (id = ?) AND (ca_name = ?)"), id, d.CAName)
+	if err != nil {
+		return 0, getError(err, "User")
+	}
+	var attrs []api.Attribute
+	if attributes.Valid && attributes.String != "" {
+		decoded, err := decodeAttributes(attributes.String)
+		if err != nil {
+			return 0, errors.WithMessage(err, fmt.Sprintf("Failed to read attributes of identity '%s'", id))
+		}
+		err = json.Unmarshal([]byte(decoded), &attrs)
+		if err != nil {
+			return 0, errors.Wrapf(err, "Failed to unmarshal attributes of identity '%s'", id)
+		}
+	}
+
+	return len(attrs), nil
+}
+
+// GetUserRecord gets the record of a user as it is stored in the database,
+// including the password hash and the attributes in their stored encoding
+func (d *Accessor) GetUserRecord(id string) (*UserRecord, error) {
+	id = d.normalizeID(id)
+	log.Debugf("DB: Getting record of identity %s", id)
+	err := d.checkDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var userRec UserRecord
+	rdb := d.getUserReadDB(id)
+	err = rdb.Get(&userRec, d.rebind(getUser), id, d.CAName)
+	if err != nil {
+		return nil, getError(err, "User")
+	}
+
+	return &userRec, nil
+}
+
+// GetUserDetail gets user from database along with the times recorded for it.
+// The password hash is not returned.
+func (d *Accessor) GetUserDetail(id string) (*UserDetail, error) {
+	id = d.normalizeID(id)
+	log.Debugf("DB: Getting details of identity %s", id)
+	err := d.checkDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var userRec UserRecord
+	rdb := d.getUserReadDB(id)
+	err = rdb.Get(&userRec, d.rebind(getUser), id, d.CAName)
+	if err != nil {
+		return nil, getError(err, "User")
+	}
+
+	detail := &UserDetail{
+		UserInfo:         newDBUser(&userRec, d.db).UserInfo,
+		CreatedAt:        nullTimeValue(userRec.CreatedAt),
+		LockedUntil:      nullTimeValue(userRec.LockedUntil),
+		RevokedAt:        nullTimeValue(userRec.RevokedAt),
+		RevocationReason: int(userRec.RevocationReason.Int64),
+		LastEnrolledAt:   nullTimeValue(userRec.LastEnrolledAt),
+	}
+	detail.CreatedBy = userRec.CreatedBy.String
+
+	return detail, nil
+}
+
+// nullTimeValue returns the time, or the zero time if it is NULL
+func nullTimeValue(t sql.NullTime) time.Time {
+	if !t.Valid {
+		return time.Time{}
+	}
+	return t.Time
+}
+
+// PatchUserAttributes applies an RFC 6902 JSON Patch to the attributes of a
+// user. The patch is applied to the JSON array of attributes stored for the
+// user, and the result must still be a valid list of attributes.
+func (d *Accessor) PatchUserAttributes(id string, patch []byte) error {
+	id = d.normalizeID(id)
+	log.Debugf("DB: Patch attributes of identity %s", id)
+	_, err := d.doTransaction(d.patchUserAttributesTx, id, patch)
+	if err != nil {
+		return err
+	}
+
+	d.recordUserWrite(id)
+	d.emitChange(ChangeUpdate, id)
+
+	return nil
+}
+
+func (d *Accessor) patchUserAttributesTx(tx *sqlx.Tx, args ...interface{}) (interface{}, error) {
+	id := args[0].(string)
+	patch := args[1].([]byte)
+
+	var attributes string
+	err := tx.Get(&attributes, d.rebind("SELECT attributes FROM users WHERE (id = ?) AND (ca_name = ?)"), id, d.CAName)
+	if err != nil {
+		return nil, getError(err, "User")
+	}
+	attributes, err = decodeAttributes(attributes)
+	if err != nil {
+		return nil, errors.WithMessage(err, fmt.Sprintf("Failed to read attributes of identity '%s'", id))
+	}
+	if attributes == "" {
+		attributes = "[]"
+	}
+
+	attrBytes, err := applyJSONPatch([]byte(attributes), patch)
+	if err != nil {
+		return nil, newHTTPErr(400, ErrInvalidRequest, "Failed to patch attributes of identity '%s': %s", id, err)
+	}
+
+	var attrs []api.Attribute
+	err = json.Unmarshal(attrBytes, &attrs)
+	if err != nil {
+		return nil, newHTTPErr(400, ErrInvalidRequest, "Patched attributes of identity '%s' are not a list of attributes: %s", id, err)
+	}
+	names := map[string]bool{}
+	for _, attr := range attrs {
+		if attr.Name == "" {
+			return nil, newHTTPErr(400, ErrInvalidRequest, "Patched attributes of identity '%s' contain an attribute without a name", id)
+		}
+		if names[attr.Name] {
+			return nil, newHTTPErr(400, ErrInvalidRequest, "Patched attributes of identity '%s' contain attribute '%s' more than once", id, attr.Name)
+		}
+		names[attr.Name] = true
+	}
+	err = checkAttributeLengths(attrs, d.MaxAttributeLengths)
+	if err != nil {
+		return nil, err
+	}
+
+	attrBytes, err = json.Marshal(attrs)
+	if err != nil {
+		return nil, err
+	}
+	attributes, err = d.encodeAttributes(attrBytes)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(d.rebind("UPDATE users SET attributes = ?, attr_count = ? WHERE (id = ?) AND (ca_name = ?)"), attributes, len(attrs), id, d.CAName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to update attributes of identity '%s'", id)
+	}
+
+	return nil, nil
+}
+
+// AddAttributeToType adds attr to every identity of type userType in a single
+// transaction, replacing the value of any attribute of the same name. It
+// returns the number of identities updated.
+func (d *Accessor) AddAttributeToType(userType string, attr api.Attribute) (int, error) {
+	log.Debugf("DB: Add attribute '%s' to identities of type '%s'", attr.Name, userType)
+	err := d.checkDB()
+	if err != nil {
+		return 0, err
+	}
+	if attr.Name == "" {
+		return 0, newHTTPErr(400, ErrInvalidRequest, "Attribute name is not specified")
+	}
+	err = checkAttributeLengths([]api.Attribute{attr}, d.MaxAttributeLengths)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := d.doTransaction(d.addAttributeToTypeTx, userType, attr)
+	if err != nil {
+		return 0, err
+	}
+
+	updated := result.([]string)
+	d.recordUserWrites(updated)
+	d.emitChanges(ChangeUpdate, updated)
+
+	log.Debugf("Added attribute '%s' to %d identities of type '%s'", attr.Name, len(updated), userType)
+	return len(updated), nil
+}
+
+func (d *Accessor) addAttributeToTypeTx(tx *sqlx.Tx, args ...interface{}) (interface{}, error) {
+	userType := args[0].(string)
+	attr := args[1].(api.Attribute)
+
+	var rows []struct {
+		Name       string         `db:"id"`
+		Attributes sql.NullString `db:"attributes"`
+	}
+	err := tx.Select(&rows, d.rebind("SELECT id, attributes FROM users WHERE (type = ?) AND (ca_name = ?) ORDER BY id"), userType, d.CAName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to get identities of type '%s'", userType)
+	}
+
+	updated := make([]string, 0, len(rows))
+	for _, row := range rows {
+		var attrs []api.Attribute
+		stored, err := decodeAttributes(row.Attributes.String)
+		if err != nil {
+			return nil, errors.WithMessage(err, fmt.Sprintf("Failed to read attributes of identity '%s'", row.Name))
+		}
+		if stored != "" {
+			err = json.Unmarshal([]byte(stored), &attrs)
+			if err != nil {
+				var legacy bool
+				attrs, legacy = convertLegacyAttributes(stored)
+				if !legacy {
+					return nil, errors.Wrapf(err, "Failed to unmarshal attributes of identity '%s'", row.Name)
+				}
+			}
+		}
+		attrs, _ = dedupeAttributes(append(attrs, attr))
+
+		attrBytes, err := json.Marshal(attrs)
+		if err != nil {
+			return nil, err
+		}
+		attributes, err := d.encodeAttributes(attrBytes)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec(d.rebind("UPDATE users SET attributes = ?, attr_count = ? WHERE (id = ?) AND (ca_name = ?)"), attributes, len(attrs), row.Name, d.CAName)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to update attributes of identity '%s'", row.Name)
+		}
+		updated = append(updated, row.Name)
+	}
+
+	return updated, nil
+}
+
+// GetTypedAttribute gets the value of an attribute of a user, converted to the
+// type declared for it in AttributeTypes: bool, int64, or float64. The value
+// is returned as a string if no type is declared or it can not be converted.
+func (d *Accessor) GetTypedAttribute(id, name string) (interface{}, error) {
+	log.Debugf("DB: Get typed attribute '%s' of identity %s", name, id)
+	user, err := d.GetUser(id, []string{name})
+	if err != nil {
+		return nil, err
+	}
+	attr, err := user.GetAttribute(name)
+	if err != nil {
+		return nil, newHTTPErr(404, ErrDBGet, "Failed to get attribute '%s' of identity '%s': %s", name, id, err)
+	}
+
+	var value interface{}
+	switch d.AttributeTypes[name] {
+	case AttributeTypeBool:
+		value, err = strconv.ParseBool(attr.Value)
+	case AttributeTypeInt:
+		value, err = strconv.ParseInt(attr.Value, 10, 64)
+	case AttributeTypeFloat:
+		value, err = strconv.ParseFloat(attr.Value, 64)
+	default:
+		return attr.Value, nil
+	}
+	if err != nil {
+		log.Debugf("Value of attribute '%s' of identity %s does not have its declared type: %s", name, id, err)
+		return attr.Value, nil
+	}
+
+	return value, nil
+}
+
+// UserHasAttribute returns true if a user has the named attribute and its
+// value is one of allowedValues
+func (d *Accessor) UserHasAttribute(id, name string, allowedValues []string) (bool, error) {
+	log.Debugf("DB: Check if identity %s has attribute '%s' with a value in %v", id, name, allowedValues)
+	user, err := d.GetUser(id, []string{name})
+	if err != nil {
+		return false, err
+	}
+	attr, err := user.GetAttribute(name)
+	if err != nil {
+		// The user does not have the attribute
+		return false, nil
+	}
+
+	for _, value := range allowedValues {
+		if attr.Value == value {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// GetAttributesAs unmarshals the attributes of a user, as stored, into out with
+// json.Unmarshal. It is for callers that know the shape of the stored
+// attributes and want them in their own types rather than as []api.Attribute.
+func (d *Accessor) GetAttributesAs(id string, out interface{}) error {
+	id = d.normalizeID(id)
+	log.Debugf("DB: Get attributes of identity %s as %T", id, out)
+	err := d.checkDB()
+	if err != nil {
+		return err
+	}
+
+	var attributes sql.NullString
+	rdb := d.getUserReadDB(id)
+	err = rdb.Get(&attributes, d.rebind("SELECT attributes FROM users WHERE (id = ?) AND (ca_name = ?)"), id, d.CAName)
+	if err != nil {
+		return getError(err, "User")
+	}
+	attributes.String, err = decodeAttributes(attributes.String)
+	if err != nil {
+		return errors.WithMessage(err, fmt.Sprintf("Failed to read attributes of identity '%s'", id))
+	}
+	if attributes.String == "" {
+		// Leave out unchanged, as json.Unmarshal does for null
+		attributes.String = "null"
+	}
+
+	err = json.Unmarshal([]byte(attributes.String), out)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to unmarshal attributes of identity '%s' into %T", id, out)
+	}
+
+	return nil
+}
+
+// displayNameAttribute is the attribute holding the friendly name of an identity
+const displayNameAttribute = "displayName"
+
+// GetDisplayName returns the value of the displayName attribute of a user,
+// or the user's id if it has no display name
+func (d *Accessor) GetDisplayName(id string) (string, error) {
+	log.Debugf("DB: Get display name of identity %s", id)
+	user, err := d.GetUser(id, []string{displayNameAttribute})
+	if err != nil {
+		return "", err
+	}
+	attr, err := user.GetAttribute(displayNameAttribute)
+	if err != nil || attr.Value == "" {
+		return user.GetName(), nil
+	}
+	return attr.Value, nil
+}
+
+// GetRegistrarRoles returns the types of identities a user may register, as
+// listed in its hf.Registrar.Roles attribute. It returns an empty list if the
+// user is not a registrar.
+func (d *Accessor) GetRegistrarRoles(id string) ([]string, error) {
+	log.Debugf("DB: Get registrar roles of identity %s", id)
+	user, err := d.GetUser(id, []string{attr.Roles})
+	if err != nil {
+		return nil, err
+	}
+	rolesAttr, err := user.GetAttribute(attr.Roles)
+	if err != nil || rolesAttr.Value == "" {
+		return []string{}, nil
+	}
+	roles := []string{}
+	for _, role := range util.GetSliceFromList(rolesAttr.Value, ",") {
+		if role != "" {
+			roles = append(roles, role)
+		}
+	}
+	return roles, nil
+}
+
+// CanRegisterType returns true if a registrar may register identities of the
+// target type, which is the case if its hf.Registrar.Roles attribute lists the
+// type or '*'. An empty target type is the default type, client.
+func (d *Accessor) CanRegisterType(registrarID, targetType string) (bool, error) {
+	roles, err := d.GetRegistrarRoles(registrarID)
+	if err != nil {
+		return false, err
+	}
+	if targetType == "" {
+		targetType = "client"
+	}
+	for _, role := range roles {
+		if role == "*" || role == targetType {
+			return true, nil
+		}
+	}
+	log.Debugf("Registrar '%s' with types %v is not authorized to register type '%s'", registrarID, roles, targetType)
+	return false, nil
+}
+
+// CanRegisterInAffiliation returns true if a registrar may register identities
+// in the target affiliation, which must be the registrar's own affiliation or
+// one of its descendants. A registrar with the root affiliation may register
+// identities in any affiliation.
+func (d *Accessor) CanRegisterInAffiliation(registrarID, targetAffiliation string) (bool, error) {
+	user, err := d.GetUser(registrarID, nil)
+	if err != nil {
+		return false, err
+	}
+	registrarAffiliation := GetUserAffiliation(user)
+	if registrarAffiliation == "" || registrarAffiliation == targetAffiliation {
+		return true, nil
+	}
+	return d.IsAncestorAffiliation(registrarAffiliation, targetAffiliation)
+}
+
+// GetUserFields gets only the requested fields of a user from database.
+// Fields of type string are returned as strings and the others as ints.
+func (d *Accessor) GetUserFields(id string, fields ...Field) (map[Field]interface{}, error) {
+	id = d.normalizeID(id)
+	log.Debugf("DB: Getting fields %v of identity %s", fields, id)
+	err := d.checkDB()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, newHTTPErr(400, ErrInvalidRequest, "No fields of identity '%s' were requested", id)
+	}
+
+	columns := []string{}
+	values := []interface{}{}
+	for _, field := range fields {
+		column, ok := fieldColumns[field]
+		if !ok {
+			return nil, newHTTPErr(400, ErrInvalidRequest, "Unknown identity field %d", field)
+		}
+		columns = append(columns, column)
+		switch field {
+		case FieldType, FieldAffiliation:
+			values = append(values, new(sql.NullString))
+		default:
+			values = append(values, new(sql.NullInt64))
+		}
+	}
+
+	rdb := d.getUserReadDB(id)
+	query := fmt.Sprintf("SELECT %s FROM users WHERE (id = ?) AND (ca_name = ?)", strings.Join(columns, ", "))
+	err = rdb.QueryRowx(d.rebind(query), id, d.CAName).Scan(values...)
+	if err != nil {
+		return nil, getError(err, "User")
+	}
+
+	result := make(map[Field]interface{}, len(fields))
+	for i, field := range fields {
+		switch value := values[i].(type) {
+		case *sql.NullString:
+			result[field] = value.String
+		case *sql.NullInt64:
+			result[field] = int(value.Int64)
+		}
+	}
+
+	return result, nil
+}
+
+// SwapToken replaces the token of an identity with newHash if, and only if,
+// its current token is expectedOldHash, checking and replacing it in a single
+// statement so that concurrent rotations can not both succeed. It returns an
+// error with ErrTokenConflict if the current token is a different one.
+func (d *Accessor) SwapToken(id, expectedOldHash, newHash string) error {
+	id = d.normalizeID(id)
+	log.Debugf("DB: Swap token of identity %s", id)
+	err := d.checkDB()
+	if err != nil {
+		return err
+	}
+
+	res, err := d.exec(d.rebind("UPDATE users SET token = ? WHERE (id = ?) AND (ca_name = ?) AND (token = ?)"), []byte(newHash), id, d.CAName, []byte(expectedOldHash))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to swap token of identity '%s'", id)
+	}
+	numRowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "Failed to get number of rows affected")
+	}
+	if numRowsAffected > 0 {
+		d.recordUserWrite(id)
+		d.emitChange(ChangeUpdate, id)
+		return nil
+	}
+
+	var count int
+	err = d.db.Get(&count, d.rebind("SELECT COUNT(*) FROM users WHERE (id = ?) AND (ca_name = ?)"), id, d.CAName)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to check if identity '%s' exists", id)
+	}
+	if count == 0 {
+		return getError(sql.ErrNoRows, "User")
+	}
+	return newHTTPErr(409, ErrTokenConflict, "Token of identity '%s' is not the expected one", id)
+}
+
+// GetUserETag returns an entity tag for a user, which is a hash of its
+// stored record. The tag changes whenever the record is updated, so it can be
+// used to validate cached copies of the user.
+func (d *Accessor) GetUserETag(id string) (string, error) {
+	id = d.normalizeID(id)
+	log.Debugf("DB: Getting ETag of identity %s", id)
+	err := d.checkDB()
+	if err != nil {
+		return "", err
+	}
+
+	var userRec UserRecord
+	rdb := d.getUserReadDB(id)
+	err = rdb.Get(&userRec, d.rebind(getUser), id, d.CAName)
+	if err != nil {
+		return "", getError(err, "User")
+	}
+
+	recBytes, err := json.Marshal(&userRec)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to encode identity '%s'", id)
+	}
+	hash := sha256.Sum256(recBytes)
+
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// GetUserSafe gets user from database with the password hash removed. The
+// returned user is meant for display purposes only and can not be used to
+// login; use GetUser for authentication.
+func (d *Accessor) GetUserSafe(id string) (spi.User, error) {
+	user, err := d.GetUser(id, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	dbUser := user.(*DBUser)
+	dbUser.Pass = ""
+	dbUser.pass = nil
+
+	return dbUser, nil
+}
+
+// GetEffectiveAttributes returns the attributes of the identity merged with the
+// attributes of the identity's affiliation. If an attribute is defined on both
+// the identity and the affiliation, the identity's value takes precedence.
+func (d *Accessor) GetEffectiveAttributes(id string) ([]api.Attribute, error) {
+	log.Debugf("DB: Get effective attributes of identity %s", id)
+
+	user, err := d.GetUser(id, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs, err := d.getAffiliationAttributes(GetUserAffiliation(user))
+	if err != nil {
+		return nil, err
+	}
+
+	userAttrs, err := user.GetAttributes(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return getNewAttributes(attrs, userAttrs), nil
+}
+
+// GetMergedAttributes returns the attributes of the identity merged with the
+// attributes of its affiliation and of every ancestor of the affiliation. The
+// levels are merged from the top of the tree down to the identity, so that
+// an attribute of an affiliation overrides the same attribute of its
+// ancestors, and the identity's value takes precedence over all of them.
+// Affiliations that do not exist contribute no attributes.
+func (d *Accessor) GetMergedAttributes(id string) ([]api.Attribute, error) {
+	log.Debugf("DB: Get merged attributes of identity %s", id)
+
+	user, err := d.GetUser(id, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Collect the attributes of each level, from the affiliation of the
+	// identity up to the top of the tree
+	levels := [][]api.Attribute{}
+	visited := map[string]bool{}
+	for name := GetUserAffiliation(user); name != "" && !visited[name]; {
+		visited[name] = true
+		affiliationRecord, err := d.getAffiliationRecord(name)
+		if err != nil {
+			if getHTTPErr(err).lcode == ErrDBGet {
+				break
+			}
+			return nil, err
+		}
+		attrs, err := decodeAffiliationAttributes(affiliationRecord)
+		if err != nil {
+			return nil, err
+		}
+		levels = append(levels, attrs)
+		name = affiliationRecord.Prekey
+	}
+
+	attrs := []api.Attribute{}
+	for i := len(levels) - 1; i >= 0; i-- {
+		attrs = getNewAttributes(attrs, levels[i])
+	}
+
+	userAttrs, err := user.GetAttributes(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return getNewAttributes(attrs, userAttrs), nil
+}
+
+// getAffiliationAttributes returns the attributes stored on an affiliation. No
+// attributes are returned for the root affiliation or for an unknown or
+// soft deleted affiliation.
+func (d *Accessor) getAffiliationAttributes(name string) ([]api.Attribute, error) {
+	err := d.checkDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var attrs []api.Attribute
+	if name == "" {
+		return attrs, nil
+	}
+
+	affiliationRecord, err := d.getAffiliationRecord(name)
+	if err != nil {
+		if getHTTPErr(err).lcode == ErrDBGet {
+			return attrs, nil
+		}
+		return nil, err
+	}
+
+	return decodeAffiliationAttributes(affiliationRecord)
+}
+
+// decodeAffiliationAttributes returns the attributes stored on the record of
+// an affiliation
+func decodeAffiliationAttributes(affiliationRecord *AffiliationRecord) ([]api.Attribute, error) {
+	var attrs []api.Attribute
+	if affiliationRecord.Attributes.Valid && affiliationRecord.Attributes.String != "" {
+		err := json.Unmarshal([]byte(affiliationRecord.Attributes.String), &attrs)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to unmarshal attributes of affiliation '%s'", affiliationRecord.Name)
+		}
+	}
+	return attrs, nil
+}
+
+// InsertAffiliation inserts affiliation into database
+func (d *Accessor) InsertAffiliation(name string, prekey string, level int) error {
+	log.Debugf("DB: Add affiliation %s", name)
+	err := d.checkDB()
+	if err != nil {
+		return err
+	}
+	if d.MaxAffiliationDepth > 0 {
+		depth, err := d.getAffiliationDepth(prekey)
+		if err != nil {
+			return err
+		}
+		if depth > d.MaxAffiliationDepth {
+			return newHTTPErr(400, ErrAffiliationDepth, "Affiliation '%s' has a depth of %d, which exceeds the maximum depth of %d", name, depth, d.MaxAffiliationDepth)
+		}
+	}
+	_, err = d.doTransaction(d.insertAffiliationTx, name, prekey, level)
+	if err != nil {
+		return err
+	}
+	d.invalidateAffiliationCache()
+	log.Debugf("Affiliation '%s' added", name)
+
+	return nil
+}
+
+func (d *Accessor) insertAffiliationTx(tx *sqlx.Tx, args ...interface{}) (interface{}, error) {
+	name := args[0].(string)
+	prekey := args[1].(string)
+	level := args[2].(int)
+
+	// InnoDB store engine for MySQL does not allow more than 767 bytes
+	// in a 'UNIQUE' column. To work around this, the UNIQUE constraint was removed
+	// from the 'name' column in the affiliations table for MySQL to allow for up to 1024
+	// characters to be stored. Since the constraint may not exist, a check is needed
+	// to see if the affiliation exists before adding it to prevent duplicate entries.
+	var count int
+	// Soft deleted affiliations still exist, so they are not excluded here
+	err := tx.Get(&count, d.rebind("SELECT COUNT(*) FROM affiliations WHERE "+d.affiliationNameMatch()), name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to check if affiliation '%s' exists", name)
+	}
+	if count > 0 {
+		return nil, newHTTPErr(400, ErrAffiliationExists, "Affiliation '%s' already exists", name)
+	}
+
+	_, err = tx.Exec(d.rebind(insertAffiliation), name, prekey, level)
+	if err != nil {
+		msg := err.Error()
+		// Another server added the affiliation since it was checked
+		if strings.Contains(msg, "UNIQUE constraint failed") || strings.Contains(msg, "duplicate key value") {
+			return nil, newHTTPErr(400, ErrAffiliationExists, "Affiliation '%s' already exists", name)
+		}
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// isAffiliationExistsError returns true if err is the error returned by
+// InsertAffiliation when the affiliation already exists
+func isAffiliationExistsError(err error) bool {
+	return err != nil && getHTTPErr(err).lcode == ErrAffiliationExists
+}
+
+// ExportedAffiliation is an affiliation as written by ExportAffiliations
+type ExportedAffiliation struct {
+	Name       string `json:"name"`
+	Parent     string `json:"parent"`
+	Level      int    `json:"level"`
+	Attributes string `json:"attributes,omitempty"`
+	Metadata   string `json:"metadata,omitempty"`
+}
+
+// ExportAffiliations writes all affiliations to w as a JSON array of
+// ExportedAffiliation, one affiliation at a time
+func (d *Accessor) ExportAffiliations(w io.Writer) error {
+	log.Debug("DB: Export affiliations")
+	err := d.checkDB()
+	if err != nil {
+		return err
+	}
+
+	rdb := d.getReadDB()
+	rows, err := rdb.Queryx("SELECT * FROM affiliations WHERE (deleted = 0) ORDER BY name")
+	if err != nil {
+		return errors.Wrap(err, "Failed to get affiliations")
+	}
+	defer rows.Close()
+
+	_, err = w.Write([]byte("["))
+	if err != nil {
+		return errors.Wrap(err, "Failed to write affiliations")
+	}
+	for count := 0; rows.Next(); count++ {
+		var aff AffiliationRecord
+		err = rows.StructScan(&aff)
+		if err != nil {
+			return errors.Wrap(err, "Failed to read affiliation")
+		}
+		affBytes, err := json.Marshal(&ExportedAffiliation{
+			Name:       aff.Name,
+			Parent:     aff.Prekey,
+			Level:      aff.Level,
+			Attributes: aff.Attributes.String,
+			Metadata:   aff.Metadata.String,
+		})
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			affBytes = append([]byte(","), affBytes...)
+		}
+		_, err = w.Write(affBytes)
+		if err != nil {
+			return errors.Wrap(err, "Failed to write affiliations")
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return errors.Wrap(err, "Failed to get affiliations")
+	}
+	_, err = w.Write([]byte("]"))
+	if err != nil {
+		return errors.Wrap(err, "Failed to write affiliations")
+	}
+
+	return nil
+}
+
+// ImportAffiliations adds the affiliations written by ExportAffiliations, in
+// a single transaction, inserting each parent before its children. Affiliations
+// that already exist are left unchanged. It returns the number of affiliations
+// added.
+func (d *Accessor) ImportAffiliations(r io.Reader) (int, error) {
+	log.Debug("DB: Import affiliations")
+	err := d.checkDB()
+	if err != nil {
+		return 0, err
+	}
+
+	var affs []ExportedAffiliation
+	err = json.NewDecoder(r).Decode(&affs)
+	if err != nil {
+		return 0, newHTTPErr(400, ErrInvalidRequest, "Failed to decode affiliations: %s", err)
+	}
+
+	result, err := d.doTransaction(d.importAffiliationsTx, affs)
+	if err != nil {
+		return 0, err
+	}
+	d.invalidateAffiliationCache()
+
+	return result.(int), nil
+}
+
+func (d *Accessor) importAffiliationsTx(tx *sqlx.Tx, args ...interface{}) (interface{}, error) {
+	pending := args[0].([]ExportedAffiliation)
+
+	imported := 0
+	added := map[string]bool{}
+	for len(pending) > 0 {
+		// Add the affiliations whose parent is a root, an already added
+		// affiliation, or is not part of the import and so must already exist
+		inImport := map[string]bool{}
+		for _, aff := range pending {
+			inImport[aff.Name] = true
+		}
+		remaining := []ExportedAffiliation{}
+		for _, aff := range pending {
+			if aff.Parent != "" && !added[aff.Parent] && inImport[aff.Parent] {
+				remaining = append(remaining, aff)
+				continue
+			}
+			if aff.Parent != "" && !added[aff.Parent] {
+				var count int
+				err := tx.Get(&count, d.rebind("SELECT COUNT(*) FROM affiliations WHERE "+d.affiliationNameMatch()+" AND (deleted = 0)"), aff.Parent)
+				if err != nil {
+					return nil, errors.Wrapf(err, "Failed to check if affiliation '%s' exists", aff.Parent)
+				}
+				if count == 0 {
+					return nil, newHTTPErr(400, ErrInvalidRequest, "Parent affiliation '%s' of affiliation '%s' does not exist", aff.Parent, aff.Name)
+				}
+			}
+
+			_, err := d.insertAffiliationTx(tx, aff.Name, aff.Parent, aff.Level)
+			if isAffiliationExistsError(err) {
+				log.Debugf("Affiliation '%s' already exists and was not imported", aff.Name)
+				added[aff.Name] = true
+				continue
+			}
+			if err != nil {
+				return nil, errors.WithMessage(err, fmt.Sprintf("Failed to import affiliation '%s'", aff.Name))
+			}
+			if aff.Attributes != "" || aff.Metadata != "" {
+				_, err = tx.Exec(d.rebind("UPDATE affiliations SET attributes = ?, metadata = ? WHERE (name = ?)"),
+					sql.NullString{String: aff.Attributes, Valid: aff.Attributes != ""}, sql.NullString{String: aff.Metadata, Valid: aff.Metadata != ""}, aff.Name)
+				if err != nil {
+					return nil, errors.Wrapf(err, "Failed to import attributes of affiliation '%s'", aff.Name)
+				}
+			}
+			added[aff.Name] = true
+			imported++
+		}
+		if len(remaining) == len(pending) {
+			// Every remaining affiliation waits for another, so they form a cycle
+			return nil, newHTTPErr(400, ErrAffiliationCycle, "Affiliation '%s' is part of a cycle of parent affiliations", remaining[0].Name)
+		}
+		pending = remaining
+	}
+
+	return imported, nil
+}
+
+// getAffiliationDepth returns the depth that a new affiliation would have if
+// added below the affiliation named by prekey. The depth is computed by walking
+// up the parent affiliations until the root is reached.
+func (d *Accessor) getAffiliationDepth(prekey string) (int, error) {
+	depth := 1
+	for prekey != "" {
+		var affiliationRecord AffiliationRecord
+		err := d.db.Get(&affiliationRecord, d.rebind(getAffiliationQuery), prekey)
+		if err == sql.ErrNoRows {
+			// Parent is not in the database, treat it as a root affiliation
+			return depth + 1, nil
+		}
+		if err != nil {
+			return 0, getError(err, "Affiliation")
+		}
+		depth++
+		// Stop walking a corrupted tree that loops back on itself
+		if depth > d.MaxAffiliationDepth {
+			break
+		}
+		prekey = affiliationRecord.Prekey
+	}
+	return depth, nil
+}
+
+// DeleteAffiliation deletes affiliation from database. Using the force option with identity removal allowed
+// this will also delete the identities associated with removed affiliations, and also delete the certificates
+// for the identities removed. Affiliations that identities of other CAs belong to can not be deleted.
+func (d *Accessor) DeleteAffiliation(name string, force, identityRemoval, isRegistrar bool) (*spi.DbTxResult, error) {
+	log.Debugf("DB: Delete affiliation %s", name)
+
+	_, err := d.GetAffiliation(name)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := d.doTransaction(d.deleteAffiliationTx, name, force, identityRemoval, isRegistrar)
+	if err != nil {
+		return nil, err
+	}
+	d.invalidateAffiliationCache()
+
+	deletedInfo := result.(*spi.DbTxResult)
+	deletedIDs := identityNames(deletedInfo)
+	d.recordUserWrites(deletedIDs)
+	d.emitChanges(ChangeDelete, deletedIDs)
 
 	return deletedInfo, nil
 }
 
-func (d *Accessor) deleteAffiliationTx(tx *sqlx.Tx, args ...interface{}) (interface{}, error) {
-	var err error
+// DeleteAffiliationWithMembers deletes an affiliation, the affiliations below
+// it, and all identities that belong to any of them in one transaction, so that
+// either all or none of them are removed. The certificates of the deleted
+// identities are revoked. It returns the number of identities and affiliations
+// that were deleted.
+func (d *Accessor) DeleteAffiliationWithMembers(name string) (int, int, error) {
+	log.Debugf("DB: Delete affiliation %s with its identities", name)
+	result, err := d.DeleteAffiliation(name, true, true, true)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return len(result.Identities), len(result.Affiliations), nil
+}
+
+// SoftDeleteAffiliation marks an affiliation and the affiliations below it as
+// deleted without removing them from the database. Soft deleted affiliations
+// are not returned by GetAffiliation, GetAffiliationTree, or GetAllAffiliations,
+// and can be brought back with RestoreAffiliation. Identities in the affiliation
+// are not changed.
+func (d *Accessor) SoftDeleteAffiliation(name string) error {
+	log.Debugf("DB: Soft delete affiliation %s", name)
+
+	_, err := d.GetAffiliation(name)
+	if err != nil {
+		return err
+	}
+
+	err = d.setAffiliationDeleted(name, 1)
+	if err != nil {
+		return newHTTPErr(500, ErrRemoveAffDB, "Failed to delete affiliation '%s': %s", name, err)
+	}
+
+	return nil
+}
+
+// RestoreAffiliation clears the deleted flag of a soft deleted affiliation and
+// the affiliations below it
+func (d *Accessor) RestoreAffiliation(name string) error {
+	log.Debugf("DB: Restore affiliation %s", name)
+	err := d.checkDB()
+	if err != nil {
+		return err
+	}
+
+	var affiliationRecord AffiliationRecord
+	err = d.db.Get(&affiliationRecord, d.rebind("SELECT * FROM affiliations WHERE (name = ?)"), name)
+	if err != nil {
+		return getError(err, "Affiliation")
+	}
+	if affiliationRecord.Deleted == 0 {
+		return newHTTPErr(400, ErrInvalidStateTransition, "Affiliation '%s' is not deleted", name)
+	}
+
+	err = d.setAffiliationDeleted(name, 0)
+	if err != nil {
+		return newHTTPErr(500, ErrConnectingDB, "Failed to restore affiliation '%s': %s", name, err)
+	}
+
+	return nil
+}
+
+// setAffiliationDeleted sets the deleted flag of an affiliation and the
+// affiliations below it
+func (d *Accessor) setAffiliationDeleted(name string, deleted int) error {
+	_, err := d.exec(d.rebind("UPDATE affiliations SET deleted = ? WHERE ((name = ?) OR (name LIKE ?))"), deleted, name, name+".%")
+	if err != nil {
+		return err
+	}
+	d.invalidateAffiliationCache()
+
+	return nil
+}
+
+func (d *Accessor) deleteAffiliationTx(tx *sqlx.Tx, args ...interface{}) (interface{}, error) {
+	var err error
+
+	name := args[0].(string)
+	force := args[1].(bool)
+	identityRemoval := args[2].(bool)
+	isRegistar := args[3].(bool)
+
+	query := "SELECT * FROM users WHERE (affiliation = ?) AND (ca_name = ?)"
+	ids := []UserRecord{}
+	err = tx.Select(&ids, d.rebind(query), name, d.CAName)
+	if err != nil {
+		return nil, newHTTPErr(500, ErrRemoveAffDB, "Failed to select users with affiliation '%s': %s", name, err)
+	}
+
+	subAffName := name + ".%"
+	query = "SELECT * FROM users WHERE (affiliation LIKE ?) AND (ca_name = ?)"
+	subAffIds := []UserRecord{}
+	err = tx.Select(&subAffIds, d.rebind(query), subAffName, d.CAName)
+	if err != nil {
+		return nil, newHTTPErr(500, ErrRemoveAffDB, "Failed to select users with sub-affiliation of '%s': %s", name, err)
+	}
+
+	ids = append(ids, subAffIds...)
+	idNames := []string{}
+	for _, id := range ids {
+		idNames = append(idNames, id.Name)
+	}
+	idNamesStr := strings.Join(idNames, ",")
+
+	// First check that all settings are correct
+	if len(ids) > 0 {
+		if !isRegistar {
+			return nil, newAuthErr(ErrUpdateConfigRemoveAff, "Removing affiliation affects identities, but caller is not a registrar")
+		}
+		if !identityRemoval {
+			return nil, newAuthErr(ErrUpdateConfigRemoveAff, "Identity removal is not allowed on server")
+		}
+		if !force {
+			// If force option is not specified, only delete affiliation if there are no identities that have that affiliation
+			return nil, newAuthErr(ErrUpdateConfigRemoveAff, "Cannot delete affiliation '%s'. The affiliation has the following identities associated: %s. Need to use 'force' to remove identities and affiliation", name, idNamesStr)
+		}
+		for _, id := range ids {
+			if id.IsBootstrap == 1 {
+				return nil, newHTTPErr(400, ErrInvalidRequest, "Identity '%s' is the bootstrap admin and can not be deleted", id.Name)
+			}
+		}
+	}
+	otherCAMembers, err := d.countOtherCAMembersTx(tx, name)
+	if err != nil {
+		return nil, newHTTPErr(500, ErrRemoveAffDB, "%s", err)
+	}
+	if otherCAMembers > 0 {
+		return nil, newHTTPErr(400, ErrUpdateConfigRemoveAff, "Cannot delete affiliation '%s'. The affiliation has %d identities of other CAs", name, otherCAMembers)
+	}
+
+	aff := AffiliationRecord{}
+	err = tx.Get(&aff, d.rebind(getAffiliationQuery), name)
+	if err != nil {
+		return nil, getError(err, "Affiliation")
+	}
+	// Getting all the sub-affiliations that are going to be deleted
+	allAffs := []AffiliationRecord{}
+	err = tx.Select(&allAffs, d.rebind("Select * FROM affiliations where (name LIKE ?)"), subAffName)
+	if err != nil {
+		return nil, newHTTPErr(500, ErrRemoveAffDB, "Failed to select sub-affiliations of '%s': %s", allAffs, err)
+	}
+
+	if len(allAffs) > 0 {
+		if !force {
+			// If force option is not specified, only delete affiliation if there are no sub-affiliations
+			return nil, newAuthErr(ErrUpdateConfigRemoveAff, "Cannot delete affiliation '%s'. The affiliation has the following sub-affiliations: %s. Need to use 'force' to remove affiliation and sub-affiliations", name, allAffs)
+		}
+	}
+	allAffs = append(allAffs, aff)
+
+	// Now proceed with deletion
+
+	// delete any associated identities and certificates
+	if len(ids) > 0 {
+		log.Debugf("IDs '%s' to be removed based on affiliation '%s' removal", idNamesStr, name)
+
+		// Delete all the identities in one database request
+		query := "DELETE FROM users WHERE ((affiliation = ?) OR (affiliation LIKE ?)) AND (ca_name = ?)"
+		_, err = tx.Exec(d.rebind(query), name, subAffName, d.CAName)
+		if err != nil {
+			return nil, newHTTPErr(500, ErrRemoveAffDB, "Failed to execute query '%s' for multiple identity removal: %s", query, err)
+		}
+
+		// Revoke all the certificates associated with the removed identities above with reason of "affiliationchange" (3)
+		query = "UPDATE certificates SET status='revoked', revoked_at=CURRENT_TIMESTAMP, reason = ? WHERE (id IN (?) AND status != 'revoked')"
+		inQuery, args, err := sqlx.In(query, ocsp.AffiliationChanged, idNames)
+		if err != nil {
+			return nil, newHTTPErr(500, ErrRemoveAffDB, "Failed to construct query '%s': %s", query, err)
+		}
+		_, err = tx.Exec(d.rebind(inQuery), args...)
+		if err != nil {
+			return nil, newHTTPErr(500, ErrRemoveAffDB, "Failed to execute query '%s' for multiple certificate removal: %s", query, err)
+		}
+	}
+
+	log.Debugf("All affiliations to be removed: %s", allAffs)
+
+	// Delete the requested affiliation
+	_, err = tx.Exec(d.rebind(deleteAffiliation), name)
+	if err != nil {
+		return nil, newHTTPErr(500, ErrRemoveAffDB, "Failed to delete affiliation '%s': %s", name, err)
+	}
+
+	if len(allAffs) > 1 {
+		// Delete all the sub-affiliations
+		_, err = tx.Exec(d.rebind("DELETE FROM affiliations where (name LIKE ?)"), subAffName)
+		if err != nil {
+			return nil, newHTTPErr(500, ErrRemoveAffDB, "Failed to delete affiliations: %s", err)
+		}
+	}
+	// Return the identities and affiliations that were removed
+	result := d.getResult(ids, allAffs)
+
+	return result, nil
+}
+
+// GetAffiliation gets affiliation from database
+func (d *Accessor) GetAffiliation(name string) (spi.Affiliation, error) {
+	log.Debugf("DB: Get affiliation %s", name)
+	err := d.checkDB()
+	if err != nil {
+		return nil, err
+	}
+
+	affiliationRecord, err := d.getAffiliationRecord(name)
+	if err != nil {
+		return nil, err
+	}
+
+	affiliation := spi.NewAffiliation(affiliationRecord.Name, affiliationRecord.Prekey, affiliationRecord.Level)
+
+	return affiliation, nil
+}
+
+// AffiliationsExist returns whether each of the named affiliations exists,
+// using a single query
+func (d *Accessor) AffiliationsExist(names []string) (map[string]bool, error) {
+	log.Debugf("DB: Check if affiliations %v exist", names)
+	err := d.checkDB()
+	if err != nil {
+		return nil, err
+	}
+
+	exist := make(map[string]bool, len(names))
+	if len(names) == 0 {
+		return exist, nil
+	}
+	column := "name"
+	keys := make([]string, len(names))
+	for i, name := range names {
+		exist[name] = false
+		keys[i] = d.affiliationCacheKey(name)
+	}
+	if d.CaseInsensitiveAffiliations {
+		column = "LOWER(name)"
+	}
+
+	query, args, err := sqlx.In(fmt.Sprintf("SELECT %s FROM affiliations WHERE (%s IN (?)) AND (deleted = 0)", column, column), keys)
+	if err != nil {
+		return nil, err
+	}
+	var found []string
+	rdb := d.getReadDB()
+	err = rdb.Select(&found, d.rebind(query), args...)
+	if err != nil {
+		return nil, newHTTPErr(500, ErrGettingAffiliation, "Failed to check if affiliations exist: %s", err)
+	}
+	foundKeys := make(map[string]bool, len(found))
+	for _, key := range found {
+		foundKeys[key] = true
+	}
+	for i, name := range names {
+		if foundKeys[keys[i]] {
+			exist[name] = true
+		}
+	}
+
+	return exist, nil
+}
+
+// ResolveAffiliationPathPrefix returns the name of the longest affiliation
+// that is a prefix of the dotted affiliation path, such as org1.dept1 for
+// org1.dept1.team1 if team1 does not exist. It returns an error if no
+// affiliation along the path exists.
+func (d *Accessor) ResolveAffiliationPathPrefix(path string) (string, error) {
+	log.Debugf("DB: Resolve longest existing prefix of affiliation path '%s'", path)
+	if path == "" {
+		return "", newHTTPErr(400, ErrInvalidRequest, "Affiliation path is not specified")
+	}
+
+	segments := strings.Split(path, ".")
+	prefixes := make([]string, len(segments))
+	for i := range segments {
+		prefixes[i] = strings.Join(segments[:i+1], ".")
+	}
+	exist, err := d.AffiliationsExist(prefixes)
+	if err != nil {
+		return "", err
+	}
+
+	for i := len(prefixes) - 1; i >= 0; i-- {
+		if exist[prefixes[i]] {
+			// Get the name as it is stored, which may differ in case
+			aff, err := d.GetAffiliation(prefixes[i])
+			if err != nil {
+				return "", err
+			}
+			return aff.GetName(), nil
+		}
+	}
+
+	return "", newHTTPErr(404, ErrGettingAffiliation, "No affiliation along the path '%s' exists", path)
+}
+
+// SetAffiliationMetadata replaces the metadata of an affiliation, which
+// describes the affiliation itself and is not inherited by its identities
+func (d *Accessor) SetAffiliationMetadata(name string, metadata map[string]string) error {
+	log.Debugf("DB: Set metadata of affiliation '%s'", name)
+	err := d.checkDB()
+	if err != nil {
+		return err
+	}
+
+	_, err = d.GetAffiliation(name)
+	if err != nil {
+		return err
+	}
+
+	metadataBytes, err := json.Marshal(metadata)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to encode metadata of affiliation '%s'", name)
+	}
+	_, err = d.exec(d.rebind("UPDATE affiliations SET metadata = ? WHERE (name = ?)"), string(metadataBytes), name)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to set metadata of affiliation '%s'", name)
+	}
+	d.invalidateAffiliationCache()
+
+	return nil
+}
+
+// GetAffiliationMetadata returns the metadata of an affiliation, which is
+// empty if none was set
+func (d *Accessor) GetAffiliationMetadata(name string) (map[string]string, error) {
+	log.Debugf("DB: Get metadata of affiliation '%s'", name)
+	err := d.checkDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var metadata sql.NullString
+	rdb := d.getReadDB()
+	err = rdb.Get(&metadata, d.rebind("SELECT metadata FROM affiliations WHERE (name = ?) AND (deleted = 0)"), name)
+	if err != nil {
+		return nil, getError(err, "Affiliation")
+	}
+
+	result := map[string]string{}
+	if metadata.Valid && metadata.String != "" {
+		err = json.Unmarshal([]byte(metadata.String), &result)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to decode metadata of affiliation '%s'", name)
+		}
+	}
+
+	return result, nil
+}
+
+// GetAffiliationDTO gets an affiliation from the database along with the number
+// of affiliations directly below it
+func (d *Accessor) GetAffiliationDTO(name string) (*AffiliationDTO, error) {
+	log.Debugf("DB: Get affiliation DTO %s", name)
+	aff, err := d.GetAffiliation(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var childCount int
+	err = d.db.Get(&childCount, d.rebind("SELECT COUNT(*) FROM affiliations WHERE (prekey = ?) AND (deleted = 0)"), name)
+	if err != nil {
+		return nil, newHTTPErr(500, ErrGettingAffiliation, "Failed to count affiliations below '%s': %s", name, err)
+	}
+
+	path := aff.GetName()
+	return &AffiliationDTO{
+		Name:       path[strings.LastIndex(path, ".")+1:],
+		Path:       path,
+		Parent:     aff.GetPrekey(),
+		ChildCount: childCount,
+	}, nil
+}
+
+// IsAncestorAffiliation returns true if ancestor is a parent, grandparent, etc.
+// of the affiliation named name
+func (d *Accessor) IsAncestorAffiliation(ancestor, name string) (bool, error) {
+	log.Debugf("DB: Check if affiliation '%s' is an ancestor of '%s'", ancestor, name)
+	err := d.checkDB()
+	if err != nil {
+		return false, err
+	}
+
+	affiliationRecord, err := d.getAffiliationRecord(name)
+	if err != nil {
+		return false, err
+	}
+
+	visited := map[string]bool{name: true}
+	for prekey := affiliationRecord.Prekey; prekey != ""; prekey = affiliationRecord.Prekey {
+		if prekey == ancestor {
+			return true, nil
+		}
+		// Stop walking a corrupted tree that loops back on itself
+		if visited[prekey] {
+			break
+		}
+		visited[prekey] = true
+		affiliationRecord, err = d.getAffiliationRecord(prekey)
+		if err != nil {
+			if getHTTPErr(err).lcode == ErrDBGet {
+				// Parent is not in the database, treat it as a root affiliation
+				break
+			}
+			return false, err
+		}
+	}
+
+	return false, nil
+}
+
+// LockUser blocks until no other caller holds the lock on identity id, then
+// takes it and returns the function that releases it. It serializes critical
+// sections, such as deciding whether an identity may enroll and recording the
+// enrollment, that must not interleave for the same identity.
+// The lock is local to this process: servers sharing the database do not
+// see each other's locks.
+func (d *Accessor) LockUser(id string) func() {
+	id = d.normalizeID(id)
+
+	d.userLocksMutex.Lock()
+	if d.userLocks == nil {
+		d.userLocks = map[string]*userLock{}
+	}
+	lock, ok := d.userLocks[id]
+	if !ok {
+		lock = &userLock{}
+		d.userLocks[id] = lock
+	}
+	lock.refs++
+	d.userLocksMutex.Unlock()
+
+	lock.Lock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			lock.Unlock()
+			d.userLocksMutex.Lock()
+			defer d.userLocksMutex.Unlock()
+			// Forget the lock once nobody uses it, so the map does not grow
+			// with every identity ever locked
+			lock.refs--
+			if lock.refs == 0 {
+				delete(d.userLocks, id)
+			}
+		})
+	}
+}
+
+// RefreshAffiliationCache discards the cached affiliation tree and reloads
+// it from the database
+func (d *Accessor) RefreshAffiliationCache() error {
+	log.Debug("DB: Refresh affiliation cache")
+	err := d.checkDB()
+	if err != nil {
+		return err
+	}
+
+	d.affCacheMutex.Lock()
+	defer d.affCacheMutex.Unlock()
+	return d.loadAffiliationCache()
+}
+
+// getAffiliationRecord returns the affiliation from the cache if caching is
+// enabled, or otherwise from the database
+func (d *Accessor) getAffiliationRecord(name string) (*AffiliationRecord, error) {
+	if !d.CacheAffiliations {
+		var affiliationRecord AffiliationRecord
+		query := "SELECT * FROM affiliations WHERE " + d.affiliationNameMatch() + " AND (deleted = 0)"
+		err := d.db.Get(&affiliationRecord, d.rebind(query), name)
+		if err != nil {
+			return nil, getError(err, "Affiliation")
+		}
+		return &affiliationRecord, nil
+	}
+
+	d.affCacheMutex.RLock()
+	if d.affCache == nil {
+		// Build the cache on first use
+		d.affCacheMutex.RUnlock()
+		d.affCacheMutex.Lock()
+		if d.affCache == nil {
+			err := d.loadAffiliationCache()
+			if err != nil {
+				d.affCacheMutex.Unlock()
+				return nil, err
+			}
+		}
+		d.affCacheMutex.Unlock()
+		d.affCacheMutex.RLock()
+	}
+	affiliationRecord, ok := d.affCache[d.affiliationCacheKey(name)]
+	d.affCacheMutex.RUnlock()
+	if !ok {
+		return nil, getError(sql.ErrNoRows, "Affiliation")
+	}
+
+	return &affiliationRecord, nil
+}
+
+// loadAffiliationCache reads all affiliations into the cache; the caller must
+// hold the write lock on the cache
+func (d *Accessor) loadAffiliationCache() error {
+	allAffs := []AffiliationRecord{}
+	err := d.db.Select(&allAffs, "SELECT * FROM affiliations WHERE (deleted = 0)")
+	if err != nil {
+		return newHTTPErr(500, ErrGettingAffiliation, "Failed to load affiliation tree: %s", err)
+	}
+
+	cache := make(map[string]AffiliationRecord, len(allAffs))
+	for _, aff := range allAffs {
+		cache[d.affiliationCacheKey(aff.Name)] = aff
+	}
+	d.affCache = cache
+	log.Debugf("Loaded %d affiliations into the affiliation cache", len(cache))
+
+	return nil
+}
+
+// invalidateAffiliationCache discards the cached affiliation tree so that it
+// is reloaded on next use
+func (d *Accessor) invalidateAffiliationCache() {
+	d.affCacheMutex.Lock()
+	d.affCache = nil
+	d.affCacheMutex.Unlock()
+}
+
+// GetAffiliationTree returns the requested affiliation and affiliations below
+func (d *Accessor) GetAffiliationTree(name string) (*spi.DbTxResult, error) {
+	log.Debugf("DB: Get affiliation tree for '%s'", name)
+
+	if name != "" {
+		_, err := d.GetAffiliation(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := d.doTransaction(d.getAffiliationTreeTx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	getResult := result.(*spi.DbTxResult)
+
+	return getResult, nil
+}
+
+// GetAffiliation gets affiliation from database
+func (d *Accessor) getAffiliationTreeTx(tx *sqlx.Tx, args ...interface{}) (interface{}, error) {
+	name := args[0].(string)
+
+	log.Debugf("DB: Get affiliation tree for %s", name)
+	err := d.checkDB()
+	if err != nil {
+		return nil, err
+	}
+
+	// Getting affiliations
+	allAffs := []AffiliationRecord{}
+	if name == "" { // Requesting all affiliations
+		err = tx.Select(&allAffs, d.rebind("SELECT * FROM affiliations WHERE (deleted = 0) ORDER BY name"))
+		if err != nil {
+			return nil, newHTTPErr(500, ErrGettingAffiliation, "Failed to get affiliation tree for '%s': %s", name, err)
+		}
+	} else {
+		err = tx.Select(&allAffs, d.rebind("Select * FROM affiliations where ((name LIKE ?) OR (name = ?)) AND (deleted = 0) ORDER BY name"), name+".%", name)
+		if err != nil {
+			return nil, newHTTPErr(500, ErrGettingAffiliation, "Failed to get affiliation tree for '%s': %s", name, err)
+		}
+	}
+
+	ids := []UserRecord{} // TODO: Return identities associated with these affiliations
+	result := d.getResult(ids, allAffs)
+	return result, nil
+}
+
+// GetProperties returns the properties from the database
+func (d *Accessor) GetProperties(names []string) (map[string]string, error) {
+	log.Debugf("DB: Get properties %s", names)
+	err := d.checkDB()
+	if err != nil {
+		return nil, err
+	}
+
+	type property struct {
+		Name  string `db:"property"`
+		Value string `db:"value"`
+	}
+
+	properties := []property{}
+
+	query := "SELECT * FROM properties WHERE (property IN (?))"
+	inQuery, args, err := sqlx.In(query, names)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to construct query '%s' for properties '%s'", query, names)
+	}
+	err = d.db.Select(&properties, d.rebind(inQuery), args...)
+	if err != nil {
+		return nil, getError(err, "Properties")
+	}
+
+	propertiesMap := make(map[string]string)
+	for _, prop := range properties {
+		propertiesMap[prop.Name] = prop.Value
+	}
+
+	return propertiesMap, nil
+}
+
+// GetUserLessThanLevel returns all identities that are less than the level specified
+// Otherwise, returns no users if requested level is zero
+func (d *Accessor) GetUserLessThanLevel(level int) ([]spi.User, error) {
+	if level == 0 {
+		return []spi.User{}, nil
+	}
+
+	rows, err := d.db.Queryx(d.rebind("SELECT * FROM users WHERE ((level < ?) OR (level IS NULL)) AND (ca_name = ?) ORDER BY id"), level, d.CAName)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get identities that need to be updated")
+	}
+
+	allUsers := []spi.User{}
+
+	for rows.Next() {
+		var user UserRecord
+		rows.StructScan(&user)
+		dbUser := newDBUser(&user, d.db)
+		allUsers = append(allUsers, dbUser)
+	}
+
+	return allUsers, nil
+}
+
+// StreamUsers invokes fn for each identity in the database, one row at a time,
+// so that all identities are never held in memory at once. Identities are
+// visited in order of id. Iteration stops at the first error returned by fn,
+// and that error is returned.
+func (d *Accessor) StreamUsers(fn func(spi.UserInfo) error) error {
+	log.Debug("DB: Stream all identities")
+	err := d.checkDB()
+	if err != nil {
+		return err
+	}
+
+	rdb := d.getReadDB()
+	rows, err := rdb.Queryx(d.rebind("SELECT * FROM users WHERE (ca_name = ?) ORDER BY id"), d.CAName)
+	if err != nil {
+		return errors.Wrap(err, "Failed to get identities")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userRec UserRecord
+		err = rows.StructScan(&userRec)
+		if err != nil {
+			return errors.Wrap(err, "Failed to read identity")
+		}
+		err = fn(newDBUser(&userRec, d.db).UserInfo)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// ListUsersAfter returns up to limit identities, ordered by name, whose names
+// come after afterID; an empty afterID starts from the first identity. The
+// returned cursor is passed as afterID to get the next page, and is empty when
+// there are no more identities.
+func (d *Accessor) ListUsersAfter(afterID string, limit int) ([]spi.UserInfo, string, error) {
+	log.Debugf("DB: List %d identities after '%s'", limit, afterID)
+	err := d.checkDB()
+	if err != nil {
+		return nil, "", err
+	}
+	if limit <= 0 {
+		return nil, "", newHTTPErr(400, ErrInvalidRequest, "Limit must be greater than zero, but is %d", limit)
+	}
+
+	// Get one more identity than requested to find out if this is the last page
+	userRecs := []UserRecord{}
+	rdb := d.getReadDB()
+	err = rdb.Select(&userRecs, d.rebind("SELECT * FROM users WHERE (id > ?) AND (ca_name = ?) ORDER BY id LIMIT ?"), afterID, d.CAName, limit+1)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "Failed to list identities")
+	}
+
+	cursor := ""
+	if len(userRecs) > limit {
+		userRecs = userRecs[:limit]
+		cursor = userRecs[limit-1].Name
+	}
+
+	users := []spi.UserInfo{}
+	for i := range userRecs {
+		users = append(users, newDBUser(&userRecs[i], d.db).UserInfo)
+	}
+
+	return users, cursor, nil
+}
+
+// FindUsers returns the identities, ordered by name, that match all of the
+// predicates, each of which maps a name to the value it must have. The
+// predicate "type" matches the type of the identity, and any other predicate
+// matches the value of the attribute of that name.
+func (d *Accessor) FindUsers(predicates map[string]string) ([]spi.UserInfo, error) {
+	log.Debugf("DB: Find identities matching %v", predicates)
+	err := d.checkDB()
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for name := range predicates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	query := "SELECT * FROM users WHERE (ca_name = ?)"
+	args := []interface{}{d.CAName}
+	attrs := map[string]string{}
+	for _, name := range names {
+		if name == "type" {
+			query += " AND (type = ?)"
+			args = append(args, predicates[name])
+			continue
+		}
+		attrs[name] = predicates[name]
+		// Postgres can match attributes in the JSONB column; other databases
+		// store them as text, possibly compressed, so they are matched below
+		if d.db.DriverName() == "postgres" {
+			attrBytes, err := json.Marshal([]api.Attribute{{Name: name, Value: predicates[name]}})
+			if err != nil {
+				return nil, err
+			}
+			query += " AND (attributes @> ?::jsonb)"
+			args = append(args, string(attrBytes))
+		}
+	}
+	query += " ORDER BY id"
+
+	rdb := d.getReadDB()
+	rows, err := rdb.Queryx(d.rebind(query), args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to find identities")
+	}
+	defer rows.Close()
+
+	users := []spi.UserInfo{}
+	for rows.Next() {
+		var userRec UserRecord
+		err = rows.StructScan(&userRec)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to read identity")
+		}
+		// Match attributes here on Postgres too, where the query may match
+		// a duplicate attribute that is collapsed when the identity is read
+		user := newDBUser(&userRec, d.db).UserInfo
+		if userHasAttributeValues(&user, attrs) {
+			users = append(users, user)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "Failed to find identities")
+	}
+
+	return users, nil
+}
+
+// userHasAttributeValues returns true if the attributes of user have all of
+// the values in attrs, by attribute name
+func userHasAttributeValues(user *spi.UserInfo, attrs map[string]string) bool {
+	for name, value := range attrs {
+		found := false
+		for _, attr := range user.Attributes {
+			if attr.Name == name && attr.Value == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// RecordEnrollment records the subject of the CSR and the address of the
+// client of an enrollment of an identity
+func (d *Accessor) RecordEnrollment(id, csrSubject, remoteAddr string, at time.Time) error {
+	id = d.normalizeID(id)
+	log.Debugf("DB: Record enrollment of identity %s from %s", id, remoteAddr)
+	err := d.checkDB()
+	if err != nil {
+		return err
+	}
+
+	_, err = d.exec(d.rebind("INSERT INTO enrollment_events (id, csr_subject, remote_addr, enrolled_at, ca_name) VALUES (?, ?, ?, ?, ?)"), id, csrSubject, remoteAddr, at.UTC(), d.CAName)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to record enrollment of identity '%s'", id)
+	}
+
+	return nil
+}
+
+// GetEnrollmentHistory returns the recorded enrollments of an identity,
+// oldest first
+func (d *Accessor) GetEnrollmentHistory(id string) ([]EnrollmentEvent, error) {
+	id = d.normalizeID(id)
+	log.Debugf("DB: Get enrollment history of identity %s", id)
+	err := d.checkDB()
+	if err != nil {
+		return nil, err
+	}
+
+	events := []EnrollmentEvent{}
+	rdb := d.getUserReadDB(id)
+	err = rdb.Select(&events, d.rebind("SELECT id, csr_subject, remote_addr, enrolled_at FROM enrollment_events WHERE (id = ?) AND (ca_name = ?) ORDER BY enrolled_at"), id, d.CAName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to get enrollment history of identity '%s'", id)
+	}
+
+	return events, nil
+}
+
+// CountEnrollmentsBetween returns the number of recorded enrollments of
+// identities of the CA at or after from and before to, so that consecutive
+// ranges, such as months, do not count an enrollment twice
+func (d *Accessor) CountEnrollmentsBetween(from, to time.Time) (int, error) {
+	log.Debugf("DB: Count enrollments between %s and %s", from, to)
+	err := d.checkDB()
+	if err != nil {
+		return 0, err
+	}
+	if !from.Before(to) {
+		return 0, nil
+	}
+
+	var count int
+	rdb := d.getReadDB()
+	err = rdb.Get(&count, d.rebind("SELECT COUNT(*) FROM enrollment_events WHERE (enrolled_at >= ?) AND (enrolled_at < ?) AND (ca_name = ?)"), from.UTC(), to.UTC(), d.CAName)
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to count enrollments")
+	}
+
+	return count, nil
+}
+
+// GetRecentEnrollments returns the identities that last enrolled after since,
+// most recent first
+func (d *Accessor) GetRecentEnrollments(since time.Time) ([]spi.UserInfo, error) {
+	log.Debugf("DB: Get identities enrolled since %s", since)
+	err := d.checkDB()
+	if err != nil {
+		return nil, err
+	}
+
+	userRecs := []UserRecord{}
+	rdb := d.getReadDB()
+	err = rdb.Select(&userRecs, d.rebind("SELECT * FROM users WHERE (last_enrolled_at > ?) AND (ca_name = ?) ORDER BY last_enrolled_at DESC"), since.UTC(), d.CAName)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get recently enrolled identities")
+	}
+
+	users := []spi.UserInfo{}
+	for i := range userRecs {
+		users = append(users, newDBUser(&userRecs[i], d.db).UserInfo)
+	}
+
+	return users, nil
+}
+
+// SearchUsers returns at most limit identities, ordered by id, whose ids
+// contain pattern. Characters in pattern that are wildcards in SQL LIKE
+// patterns match only themselves.
+func (d *Accessor) SearchUsers(pattern string, limit int) ([]spi.UserInfo, error) {
+	log.Debugf("DB: Search for at most %d identities matching '%s'", limit, pattern)
+	err := d.checkDB()
+	if err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		return nil, newHTTPErr(400, ErrInvalidRequest, "Limit must be greater than zero, but is %d", limit)
+	}
+
+	// '!' is used as the escape character because backslashes in string
+	// literals are treated differently by MySQL and Postgres
+	escaped := strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(pattern)
+	userRecs := []UserRecord{}
+	rdb := d.getReadDB()
+	err = rdb.Select(&userRecs, d.rebind("SELECT * FROM users WHERE (id LIKE ? ESCAPE '!') AND (ca_name = ?) ORDER BY id LIMIT ?"), "%"+escaped+"%", d.CAName, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to search identities")
+	}
+
+	users := []spi.UserInfo{}
+	for i := range userRecs {
+		users = append(users, newDBUser(&userRecs[i], d.db).UserInfo)
+	}
+
+	return users, nil
+}
+
+// GetExpiredUsers returns the identities whose expiry time has passed, so that
+// they can be cleaned up
+func (d *Accessor) GetExpiredUsers() ([]spi.UserInfo, error) {
+	log.Debug("DB: Get expired identities")
+	err := d.checkDB()
+	if err != nil {
+		return nil, err
+	}
+
+	userRecs := []UserRecord{}
+	rdb := d.getReadDB()
+	err = rdb.Select(&userRecs, d.rebind("SELECT * FROM users WHERE (expires_at IS NOT NULL) AND (expires_at <= ?) AND (ca_name = ?) ORDER BY id"), time.Now().UTC(), d.CAName)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get expired identities")
+	}
+
+	users := []spi.UserInfo{}
+	for i := range userRecs {
+		users = append(users, newDBUser(&userRecs[i], d.db).UserInfo)
+	}
+
+	return users, nil
+}
+
+// CountUsersByType returns the number of identities of each type
+func (d *Accessor) CountUsersByType() (map[string]int, error) {
+	log.Debug("DB: Count identities by type")
+	err := d.checkDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var counts []struct {
+		Type  sql.NullString `db:"type"`
+		Count int            `db:"count"`
+	}
+	rdb := d.getReadDB()
+	err = rdb.Select(&counts, d.rebind("SELECT type, COUNT(*) AS count FROM users WHERE (ca_name = ?) GROUP BY type"), d.CAName)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to count identities by type")
+	}
+
+	countsByType := make(map[string]int, len(counts))
+	for _, c := range counts {
+		countsByType[c.Type.String] += c.Count
+	}
+
+	return countsByType, nil
+}
+
+// Stats returns the number of identities, affiliations, and enrolled
+// identities, and the name of the database driver
+func (d *Accessor) Stats() (*AccessorStats, error) {
+	log.Debug("DB: Get identity registry stats")
+	err := d.checkDB()
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+SELECT
+	(SELECT COUNT(*) FROM users WHERE (ca_name = ?)) AS users,
+	(SELECT COUNT(*) FROM affiliations WHERE (deleted = 0)) AS affiliations,
+	(SELECT COUNT(*) FROM users WHERE (state > 0) AND (ca_name = ?)) AS enrolled`
+	stats := &AccessorStats{}
+	rdb := d.getReadDB()
+	err = rdb.Get(stats, d.rebind(query), d.CAName, d.CAName)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get identity registry stats")
+	}
+	stats.Driver = rdb.DriverName()
+
+	return stats, nil
+}
+
+// schemaColumns are the columns the accessor expects of each table, mapped to
+// the kind of type they should have. The attributes of identities have
+// kind "json" on Postgres and "text" on the other databases.
+var schemaColumns = map[string]map[string]string{
+	"users": {
+		"id": "text", "token": "binary", "type": "text", "affiliation": "text", "attributes": "text",
+		"state": "integer", "max_enrollments": "integer", "level": "integer", "incorrect_password_attempts": "integer",
+		"locked_until": "timestamp", "created_at": "timestamp", "created_by": "text", "revocation_reason": "integer",
+		"revoked_at": "timestamp", "attr_count": "integer", "expires_at": "timestamp", "idempotency_key": "text",
+		"last_enrolled_at": "timestamp", "initial_secret": "integer", "serial_number": "text", "aki": "text",
+		"previous_serial_number": "text", "previous_aki": "text", "ca_name": "text",
+		"secret_expires_at": "timestamp", "is_bootstrap": "integer",
+	},
+	"affiliations": {
+		"name": "text", "prekey": "text", "level": "integer", "attributes": "text", "deleted": "integer", "metadata": "text",
+	},
+}
+
+// ValidateSchema checks that the users and affiliations tables have the
+// columns the accessor uses, with types of the expected kind, and returns an
+// error listing every column that is missing or has an unexpected type.
+// Columns that the accessor does not use are ignored.
+func (d *Accessor) ValidateSchema() error {
+	log.Debug("DB: Validate schema")
+	err := d.checkDB()
+	if err != nil {
+		return err
+	}
+
+	tables := []string{"affiliations", "users"}
+	problems := []string{}
+	for _, table := range tables {
+		columnTypes, err := d.getColumnTypes(table)
+		if err != nil {
+			return err
+		}
+		if len(columnTypes) == 0 {
+			problems = append(problems, fmt.Sprintf("table '%s' is missing", table))
+			continue
+		}
+
+		columns := make([]string, 0, len(schemaColumns[table]))
+		for column := range schemaColumns[table] {
+			columns = append(columns, column)
+		}
+		sort.Strings(columns)
+		for _, column := range columns {
+			expected := schemaColumns[table][column]
+			if table == "users" && column == "attributes" && d.db.DriverName() == "postgres" {
+				expected = "json"
+			}
+			columnType, ok := columnTypes[column]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("column '%s' of table '%s' is missing", column, table))
+				continue
+			}
+			if kind := columnTypeKind(columnType); kind != expected {
+				problems = append(problems, fmt.Sprintf("column '%s' of table '%s' has type '%s', but a %s type is expected", column, table, columnType, expected))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return newHTTPErr(500, ErrInvalidSchema, "Database schema does not match the expected schema: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// getColumnTypes returns the types of the columns of a table, keyed by column
+// name, as reported by the database
+func (d *Accessor) getColumnTypes(table string) (map[string]string, error) {
+	type columnInfo struct {
+		Name string `db:"column_name"`
+		Type string `db:"data_type"`
+	}
+	var columns []columnInfo
+	var err error
+	switch d.db.DriverName() {
+	case "postgres":
+		err = d.db.Select(&columns, "SELECT column_name, data_type FROM information_schema.columns WHERE (table_schema = current_schema()) AND (table_name = $1)", table)
+	case "mysql":
+		err = d.db.Select(&columns, "SELECT column_name AS column_name, data_type AS data_type FROM information_schema.columns WHERE (table_schema = DATABASE()) AND (table_name = ?)", table)
+	default:
+		var infos []struct {
+			CID     int            `db:"cid"`
+			Name    string         `db:"name"`
+			Type    string         `db:"type"`
+			NotNull int            `db:"notnull"`
+			Default sql.NullString `db:"dflt_value"`
+			PK      int            `db:"pk"`
+		}
+		err = d.db.Select(&infos, fmt.Sprintf("PRAGMA table_info(%s)", table))
+		for _, info := range infos {
+			columns = append(columns, columnInfo{info.Name, info.Type})
+		}
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to get columns of table '%s'", table)
+	}
+
+	columnTypes := make(map[string]string, len(columns))
+	for _, column := range columns {
+		columnTypes[strings.ToLower(column.Name)] = column.Type
+	}
+	return columnTypes, nil
+}
+
+// columnTypeKind returns the kind of a column type as named by any of the
+// supported databases, e.g. "text" for VARCHAR(255) and character varying
+func columnTypeKind(columnType string) string {
+	columnType = strings.ToLower(strings.TrimSpace(columnType))
+	if i := strings.Index(columnType, "("); i >= 0 {
+		columnType = strings.TrimSpace(columnType[:i])
+	}
+	switch {
+	case strings.HasPrefix(columnType, "json"):
+		return "json"
+	case strings.Contains(columnType, "char"), strings.HasSuffix(columnType, "text"):
+		return "text"
+	case strings.Contains(columnType, "int"):
+		return "integer"
+	case strings.HasPrefix(columnType, "timestamp"), columnType == "datetime":
+		return "timestamp"
+	case strings.Contains(columnType, "blob"), strings.Contains(columnType, "binary"), columnType == "bytea":
+		return "binary"
+	}
+	return columnType
+}
+
+// attributeMigrationBatchSize is the number of identities read and rewritten
+// at a time by MigrateAttributeFormat
+const attributeMigrationBatchSize = 100
+
+// MigrateAttributeFormat rewrites attributes stored in the legacy format, a
+// JSON object mapping attribute names to values, as the current JSON array of
+// attributes. It returns the number of identities that were rewritten.
+func (d *Accessor) MigrateAttributeFormat() (int, error) {
+	log.Debug("DB: Migrate legacy attribute format")
+	err := d.checkDB()
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	lastID := ""
+	for {
+		var rows []struct {
+			Name       string         `db:"id"`
+			Attributes sql.NullString `db:"attributes"`
+		}
+		err = d.db.Select(&rows, d.rebind("SELECT id, attributes FROM users WHERE (id > ?) AND (ca_name = ?) ORDER BY id LIMIT ?"), lastID, d.CAName, attributeMigrationBatchSize)
+		if err != nil {
+			return migrated, errors.Wrap(err, "Failed to get identity attributes")
+		}
+		if len(rows) == 0 {
+			return migrated, nil
+		}
+		lastID = rows[len(rows)-1].Name
+
+		updates := map[string][]api.Attribute{}
+		for _, row := range rows {
+			attrs, legacy := convertLegacyAttributes(row.Attributes.String)
+			if legacy {
+				updates[row.Name] = attrs
+			}
+		}
+		if len(updates) == 0 {
+			continue
+		}
+		_, err = d.doTransaction(d.migrateAttributeFormatTx, updates)
+		if err != nil {
+			return migrated, err
+		}
+		for id := range updates {
+			d.recordUserWrite(id)
+			d.emitChange(ChangeUpdate, id)
+		}
+		migrated += len(updates)
+	}
+}
+
+func (d *Accessor) migrateAttributeFormatTx(tx *sqlx.Tx, args ...interface{}) (interface{}, error) {
+	updates := args[0].(map[string][]api.Attribute)
+
+	for id, attrs := range updates {
+		attrBytes, err := json.Marshal(attrs)
+		if err != nil {
+			return nil, err
+		}
+		attributes, err := d.encodeAttributes(attrBytes)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec(d.rebind("UPDATE users SET attributes = ?, attr_count = ? WHERE (id = ?) AND (ca_name = ?)"), attributes, len(attrs), id, d.CAName)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to migrate attributes of identity '%s'", id)
+		}
+	}
+
+	return nil, nil
+}
+
+// tokenUpgradeBatchSize is the number of identities read and rehashed at a
+// time by UpgradeTokensToBcrypt
+const tokenUpgradeBatchSize = 100
+
+// UpgradeTokensToBcrypt replaces tokens stored in plaintext by a legacy store
+// with bcrypt hashes of them. Tokens that are already bcrypt hashes are left
+// as they are, so running it again is harmless. It returns the number of
+// identities whose tokens were rehashed.
+func (d *Accessor) UpgradeTokensToBcrypt() (int, error) {
+	log.Debug("DB: Upgrade plaintext tokens to bcrypt")
+	err := d.checkDB()
+	if err != nil {
+		return 0, err
+	}
+
+	upgraded := 0
+	lastID := ""
+	for {
+		var rows []struct {
+			Name  string `db:"id"`
+			Token []byte `db:"token"`
+		}
+		err = d.db.Select(&rows, d.rebind("SELECT id, token FROM users WHERE (id > ?) AND (ca_name = ?) ORDER BY id LIMIT ?"), lastID, d.CAName, tokenUpgradeBatchSize)
+		if err != nil {
+			return upgraded, errors.Wrap(err, "Failed to get identity tokens")
+		}
+		if len(rows) == 0 {
+			return upgraded, nil
+		}
+		lastID = rows[len(rows)-1].Name
+
+		updates := map[string][]byte{}
+		for _, row := range rows {
+			if len(row.Token) == 0 || isBcryptHash(row.Token) {
+				continue
+			}
+			pwd, err := bcrypt.GenerateFromPassword(row.Token, bcrypt.DefaultCost)
+			if err != nil {
+				return upgraded, errors.Wrapf(err, "Failed to hash token of identity '%s'", row.Name)
+			}
+			updates[row.Name] = pwd
+		}
+		if len(updates) == 0 {
+			continue
+		}
+		_, err = d.doTransaction(d.upgradeTokensToBcryptTx, updates)
+		if err != nil {
+			return upgraded, err
+		}
+		for id := range updates {
+			d.recordUserWrite(id)
+			d.emitChange(ChangeUpdate, id)
+		}
+		upgraded += len(updates)
+	}
+}
+
+func (d *Accessor) upgradeTokensToBcryptTx(tx *sqlx.Tx, args ...interface{}) (interface{}, error) {
+	updates := args[0].(map[string][]byte)
 
-	name := args[0].(string)
-	force := args[1].(bool)
-	identityRemoval := args[2].(bool)
-	isRegistar := args[3].(bool)
+	for id, pwd := range updates {
+		_, err := tx.Exec(d.rebind("UPDATE users SET token = ? WHERE (id = ?) AND (ca_name = ?)"), pwd, id, d.CAName)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to upgrade token of identity '%s'", id)
+		}
+	}
 
-	query := "SELECT * FROM users WHERE (affiliation = ?)"
-	ids := []UserRecord{}
-	err = tx.Select(&ids, tx.Rebind(query), name)
+	return nil, nil
+}
+
+// isBcryptHash returns true if token is a bcrypt hash rather than a plaintext
+// secret
+func isBcryptHash(token []byte) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+		if bytes.HasPrefix(token, []byte(prefix)) {
+			_, err := bcrypt.Cost(token)
+			return err == nil
+		}
+	}
+	return false
+}
+
+// convertLegacyAttributes converts attributes stored as a JSON object mapping
+// names to values to a list of attributes sorted by name. It returns false if
+// the attributes are not in the legacy format.
+func convertLegacyAttributes(attributes string) ([]api.Attribute, bool) {
+	var legacy map[string]interface{}
+	err := json.Unmarshal([]byte(attributes), &legacy)
+	if err != nil || legacy == nil {
+		return nil, false
+	}
+
+	attrs := []api.Attribute{}
+	for name, value := range legacy {
+		strValue, ok := value.(string)
+		if !ok {
+			valueBytes, _ := json.Marshal(value)
+			strValue = string(valueBytes)
+		}
+		attrs = append(attrs, api.Attribute{Name: name, Value: strValue})
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].Name < attrs[j].Name })
+
+	return attrs, true
+}
+
+// Vacuum reclaims the space left by deleted rows and updates the statistics
+// used by the query planner. It runs VACUUM on SQLite and VACUUM ANALYZE on
+// Postgres, and does nothing on MySQL.
+func (d *Accessor) Vacuum() error {
+	log.Debug("DB: Vacuum database")
+	err := d.checkDB()
 	if err != nil {
-		return nil, newHTTPErr(500, ErrRemoveAffDB, "Failed to select users with affiliation '%s': %s", name, err)
+		return err
 	}
 
-	subAffName := name + ".%"
-	query = "SELECT * FROM users WHERE (affiliation LIKE ?)"
-	subAffIds := []UserRecord{}
-	err = tx.Select(&subAffIds, tx.Rebind(query), subAffName)
+	var query string
+	switch d.db.DriverName() {
+	case "sqlite3":
+		query = "VACUUM"
+	case "postgres":
+		query = "VACUUM ANALYZE"
+	default:
+		log.Debugf("Vacuum is not supported for database type '%s'", d.db.DriverName())
+		return nil
+	}
+
+	_, err = d.exec(query)
 	if err != nil {
-		return nil, newHTTPErr(500, ErrRemoveAffDB, "Failed to select users with sub-affiliation of '%s': %s", name, err)
+		return errors.Wrap(err, "Failed to vacuum database")
 	}
 
-	ids = append(ids, subAffIds...)
-	idNames := []string{}
-	for _, id := range ids {
-		idNames = append(idNames, id.Name)
+	return nil
+}
+
+// truncatedTables are the tables emptied by Truncate
+var truncatedTables = []string{"users", "affiliations", "certificates", "enrollment_events"}
+
+// Truncate deletes all identities, affiliations, certificates, and recorded
+// enrollments, including those of other CAs sharing the tables, in a single
+// transaction. On MySQL it also resets the auto-increment id of the
+// affiliations table, the only auto-increment column of the schema; the
+// SQLite and Postgres tables have no id counters, and the SQLite rowids
+// restart once a table is empty. It fails unless AllowTruncate is set.
+func (d *Accessor) Truncate() error {
+	log.Debug("DB: Truncate tables")
+	err := d.checkDB()
+	if err != nil {
+		return err
+	}
+	if !d.AllowTruncate {
+		return newHTTPErr(403, ErrTruncateNotAllowed, "Truncating tables is not allowed")
 	}
-	idNamesStr := strings.Join(idNames, ",")
 
-	// First check that all settings are correct
-	if len(ids) > 0 {
-		if !isRegistar {
-			return nil, newAuthErr(ErrUpdateConfigRemoveAff, "Removing affiliation affects identities, but caller is not a registrar")
-		}
-		if !identityRemoval {
-			return nil, newAuthErr(ErrUpdateConfigRemoveAff, "Identity removal is not allowed on server")
+	_, err = d.doTransaction(d.truncateTx)
+	if err != nil {
+		return err
+	}
+	d.invalidateAffiliationCache()
+
+	// ALTER TABLE commits the current transaction on MySQL, so the counter
+	// is reset after the rows are deleted
+	if d.db.DriverName() == "mysql" {
+		_, err = d.exec("ALTER TABLE affiliations AUTO_INCREMENT = 1")
+		if err != nil {
+			return errors.Wrap(err, "Failed to reset auto-increment of table 'affiliations'")
 		}
-		if !force {
-			// If force option is not specified, only delete affiliation if there are no identities that have that affiliation
-			return nil, newAuthErr(ErrUpdateConfigRemoveAff, "Cannot delete affiliation '%s'. The affiliation has the following identities associated: %s. Need to use 'force' to remove identities and affiliation", name, idNamesStr)
+	}
+
+	return nil
+}
+
+func (d *Accessor) truncateTx(tx *sqlx.Tx, args ...interface{}) (interface{}, error) {
+	for _, table := range truncatedTables {
+		_, err := tx.Exec(fmt.Sprintf("DELETE FROM %s", table))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to truncate table '%s'", table)
 		}
 	}
+	return nil, nil
+}
 
-	aff := AffiliationRecord{}
-	err = tx.Get(&aff, tx.Rebind(getAffiliationQuery), name)
+// GetAllAffiliations gets the requested affiliation and any sub affiliations from the database,
+// in order of name
+func (d *Accessor) GetAllAffiliations(name string) (*sqlx.Rows, error) {
+	log.Debugf("DB: Get affiliation %s", name)
+	err := d.checkDB()
 	if err != nil {
-		return nil, getError(err, "Affiliation")
+		return nil, err
 	}
-	// Getting all the sub-affiliations that are going to be deleted
-	allAffs := []AffiliationRecord{}
-	err = tx.Select(&allAffs, tx.Rebind("Select * FROM affiliations where (name LIKE ?)"), subAffName)
+
+	rdb := d.getReadDB()
+	if name == "" { // Requesting all affiliations
+		rows, err := rdb.Queryx(d.rebind("SELECT * FROM affiliations WHERE (deleted = 0) ORDER BY name"))
+		if err != nil {
+			return nil, err
+		}
+		return rows, nil
+	}
+
+	rows, err := rdb.Queryx(d.rebind(getAllAffiliationsQuery), name, name+".%")
 	if err != nil {
-		return nil, newHTTPErr(500, ErrRemoveAffDB, "Failed to select sub-affiliations of '%s': %s", allAffs, err)
+		return nil, err
 	}
 
-	if len(allAffs) > 0 {
-		if !force {
-			// If force option is not specified, only delete affiliation if there are no sub-affiliations
-			return nil, newAuthErr(ErrUpdateConfigRemoveAff, "Cannot delete affiliation '%s'. The affiliation has the following sub-affiliations: %s. Need to use 'force' to remove affiliation and sub-affiliations", name, allAffs)
-		}
+	return rows, nil
+}
+
+// GetFilteredUsers returns all identities that fall under the affiliation and types,
+// in order of id
+func (d *Accessor) GetFilteredUsers(affiliation, types string) (*sqlx.Rows, error) {
+	log.Debugf("DB: Get all identities per affiliation '%s' and types '%s'", affiliation, types)
+	err := d.checkDB()
+	if err != nil {
+		return nil, err
 	}
-	allAffs = append(allAffs, aff)
 
-	// Now proceed with deletion
+	rdb := d.getReadDB()
+	typesArray := strings.Split(types, ",")
+	for i := range typesArray {
+		typesArray[i] = strings.TrimSpace(typesArray[i])
+	}
 
-	// delete any associated identities and certificates
-	if len(ids) > 0 {
-		log.Debugf("IDs '%s' to be removed based on affiliation '%s' removal", idNamesStr, name)
+	// If root affiliation, allowed to get back users of all affiliations
+	if affiliation == "" {
+		if util.ListContains(types, "*") { // If type is '*', allowed to get back of all types
+			query := "SELECT * FROM users WHERE (ca_name = ?) ORDER BY id"
+			rows, err := rdb.Queryx(d.rebind(query), d.CAName)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Failed to execute query '%s' for affiliation '%s' and types '%s'", query, affiliation, types)
+			}
+			return rows, nil
+		}
 
-		// Delete all the identities in one database request
-		query := "DELETE FROM users WHERE (id IN (?))"
-		inQuery, args, err := sqlx.In(query, idNames)
+		query := "SELECT * FROM users WHERE (type IN (?)) AND (ca_name = ?) ORDER BY id"
+		query, args, err := sqlx.In(query, typesArray, d.CAName)
 		if err != nil {
-			return nil, newHTTPErr(500, ErrRemoveAffDB, "Failed to construct query '%s': %s", query, err)
+			return nil, errors.Wrapf(err, "Failed to construct query '%s' for affiliation '%s' and types '%s'", query, affiliation, types)
 		}
-		_, err = tx.Exec(tx.Rebind(inQuery), args...)
+		rows, err := rdb.Queryx(d.rebind(query), args...)
 		if err != nil {
-			return nil, newHTTPErr(500, ErrRemoveAffDB, "Failed to execute query '%s' for multiple identity removal: %s", query, err)
+			return nil, errors.Wrapf(err, "Failed to execute query '%s' for affiliation '%s' and types '%s'", query, affiliation, types)
 		}
+		return rows, nil
+	}
 
-		// Revoke all the certificates associated with the removed identities above with reason of "affiliationchange" (3)
-		query = "UPDATE certificates SET status='revoked', revoked_at=CURRENT_TIMESTAMP, reason = ? WHERE (id IN (?) AND status != 'revoked')"
-		inQuery, args, err = sqlx.In(query, ocsp.AffiliationChanged, idNames)
-		if err != nil {
-			return nil, newHTTPErr(500, ErrRemoveAffDB, "Failed to construct query '%s': %s", query, err)
-		}
-		_, err = tx.Exec(tx.Rebind(inQuery), args...)
+	subAffiliation := affiliation + ".%"
+	if util.ListContains(types, "*") { // If type is '*', allowed to get back of all types for requested affiliation
+		query := "SELECT * FROM users WHERE ((affiliation = ?) OR (affiliation LIKE ?)) AND (ca_name = ?) ORDER BY id"
+		rows, err := rdb.Queryx(d.rebind(query), affiliation, subAffiliation, d.CAName)
 		if err != nil {
-			return nil, newHTTPErr(500, ErrRemoveAffDB, "Failed to execute query '%s' for multiple certificate removal: %s", query, err)
+			return nil, errors.Wrapf(err, "Failed to execute query '%s' for affiliation '%s' and types '%s'", query, affiliation, types)
 		}
+		return rows, nil
 	}
 
-	log.Debugf("All affiliations to be removed: %s", allAffs)
+	query := "SELECT * FROM users WHERE ((affiliation = ?) OR (affiliation LIKE ?)) AND (type IN (?)) AND (ca_name = ?) ORDER BY id"
+	inQuery, args, err := sqlx.In(query, affiliation, subAffiliation, typesArray, d.CAName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to construct query '%s' for affiliation '%s' and types '%s'", query, affiliation, types)
+	}
+	rows, err := rdb.Queryx(d.rebind(inQuery), args...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to execute query '%s' for affiliation '%s' and types '%s'", query, affiliation, types)
+	}
 
-	// Delete the requested affiliation
-	_, err = tx.Exec(tx.Rebind(deleteAffiliation), name)
+	return rows, nil
+
+}
+
+// ModifyAffiliation renames the affiliation and updates all identities to use the new affiliation depending on
+// the value of the "force" parameter. Affiliations that identities of other CAs belong to can not be renamed.
+func (d *Accessor) ModifyAffiliation(oldAffiliation, newAffiliation string, force, isRegistrar bool) (*spi.DbTxResult, error) {
+	log.Debugf("DB: Modify affiliation from '%s' to '%s'", oldAffiliation, newAffiliation)
+	err := d.checkDB()
 	if err != nil {
-		return nil, newHTTPErr(500, ErrRemoveAffDB, "Failed to delete affiliation '%s': %s", name, err)
+		return nil, err
 	}
 
-	if len(allAffs) > 1 {
-		// Delete all the sub-affiliations
-		_, err = tx.Exec(tx.Rebind("DELETE FROM affiliations where (name LIKE ?)"), subAffName)
+	// Check to see if the affiliation being modifies exists in the affiliation table
+	_, err = d.GetAffiliation(oldAffiliation)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check to see if the new affiliation being requested exists in the affiliation table
+	_, err = d.GetAffiliation(newAffiliation)
+	if err == nil {
+		return nil, newHTTPErr(400, ErrUpdateConfigModifyAff, "Affiliation '%s' already exists", newAffiliation)
+	}
+
+	result, err := d.doTransaction(d.modifyAffiliationTx, oldAffiliation, newAffiliation, force, isRegistrar)
+	if err != nil {
+		return nil, err
+	}
+	d.invalidateAffiliationCache()
+
+	modifiedInfo := result.(*spi.DbTxResult)
+	modifiedIDs := identityNames(modifiedInfo)
+	d.recordUserWrites(modifiedIDs)
+	d.emitChanges(ChangeUpdate, modifiedIDs)
+
+	return modifiedInfo, nil
+}
+
+// MoveAffiliation moves an affiliation and the affiliations below it under a
+// new parent affiliation, or to the root if newParent is empty. Since the name
+// of an affiliation contains its path, the moved affiliations are renamed and
+// identities that belong to them are updated to use the new names.
+func (d *Accessor) MoveAffiliation(name, newParent string) error {
+	log.Debugf("DB: Move affiliation '%s' under '%s'", name, newParent)
+	err := d.checkDB()
+	if err != nil {
+		return err
+	}
+
+	_, err = d.GetAffiliation(name)
+	if err != nil {
+		return err
+	}
+
+	if newParent == name || strings.HasPrefix(newParent, name+".") {
+		return newHTTPErr(400, ErrUpdateConfigModifyAff, "Affiliation '%s' can not be moved under itself or one of its descendants", name)
+	}
+
+	newName := name[strings.LastIndex(name, ".")+1:]
+	if newParent != "" {
+		_, err = d.GetAffiliation(newParent)
 		if err != nil {
-			return nil, newHTTPErr(500, ErrRemoveAffDB, "Failed to delete affiliations: %s", err)
+			return errors.WithMessage(err, fmt.Sprintf("Parent affiliation '%s' not found", newParent))
 		}
+		newName = newParent + "." + newName
 	}
-	// Return the identities and affiliations that were removed
-	result := d.getResult(ids, allAffs)
 
-	return result, nil
+	if newName == name {
+		return nil
+	}
+
+	_, err = d.GetAffiliation(newName)
+	if err == nil {
+		return newHTTPErr(400, ErrUpdateConfigModifyAff, "Affiliation '%s' already exists", newName)
+	}
+
+	_, err = d.doTransaction(d.moveAffiliationTx, name, newName, newParent)
+	if err != nil {
+		return err
+	}
+	d.invalidateAffiliationCache()
+
+	return nil
 }
 
-// GetAffiliation gets affiliation from database
-func (d *Accessor) GetAffiliation(name string) (spi.Affiliation, error) {
-	log.Debugf("DB: Get affiliation %s", name)
+// UpdateAffiliationParent sets the parent of an affiliation to newParent, or
+// makes it a root affiliation if newParent is empty. Only the parent is
+// updated; unlike MoveAffiliation, the names of the affiliation and its
+// descendants are left unchanged.
+func (d *Accessor) UpdateAffiliationParent(name, newParent string) error {
+	log.Debugf("DB: Update parent of affiliation '%s' to '%s'", name, newParent)
 	err := d.checkDB()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	var affiliationRecord AffiliationRecord
+	_, err = d.GetAffiliation(name)
+	if err != nil {
+		return err
+	}
+
+	if newParent != "" {
+		_, err = d.GetAffiliation(newParent)
+		if err != nil {
+			if getHTTPErr(err).lcode == ErrDBGet {
+				return newHTTPErr(400, ErrParentAffiliationNotFound, "Parent affiliation '%s' not found", newParent)
+			}
+			return err
+		}
+
+		cycle := newParent == name
+		if !cycle {
+			cycle, err = d.IsAncestorAffiliation(name, newParent)
+			if err != nil {
+				return err
+			}
+		}
+		if cycle {
+			return newHTTPErr(400, ErrAffiliationCycle, "Affiliation '%s' can not be its own ancestor", name)
+		}
+	}
 
-	err = d.db.Get(&affiliationRecord, d.db.Rebind(getAffiliationQuery), name)
+	_, err = d.exec(d.rebind("UPDATE affiliations SET prekey = ? WHERE (name = ?)"), newParent, name)
 	if err != nil {
-		return nil, getError(err, "Affiliation")
+		return errors.Wrapf(err, "Failed to update parent of affiliation '%s'", name)
 	}
+	d.invalidateAffiliationCache()
 
-	affiliation := spi.NewAffiliation(affiliationRecord.Name, affiliationRecord.Prekey, affiliationRecord.Level)
+	return nil
+}
 
-	return affiliation, nil
+// CountMembersRecursive returns the number of identities of the CA that
+// belong to an affiliation or any of its descendants
+func (d *Accessor) CountMembersRecursive(name string) (int, error) {
+	log.Debugf("DB: Count members of affiliation '%s' and its descendants", name)
+	err := d.checkDB()
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = d.GetAffiliation(name)
+	if err != nil {
+		return 0, err
+	}
+
+	// MySQL 5.7 and older do not support recursive common table expressions
+	if d.db.DriverName() == "postgres" {
+		return d.countMembersCTE(name)
+	}
+	return d.countMembersIterative(name)
 }
 
-// GetAffiliationTree returns the requested affiliation and affiliations below
-func (d *Accessor) GetAffiliationTree(name string) (*spi.DbTxResult, error) {
-	log.Debugf("DB: Get affiliation tree for '%s'", name)
+// countMembersCTE counts the members of the subtree of an affiliation with a
+// single recursive query
+func (d *Accessor) countMembersCTE(name string) (int, error) {
+	query := `
+WITH RECURSIVE subtree(name) AS (
+	SELECT name FROM affiliations WHERE (name = ?) AND (deleted = 0)
+	UNION
+	SELECT a.name FROM affiliations a, subtree s WHERE (a.prekey = s.name) AND (a.deleted = 0)
+)
+SELECT COUNT(*) FROM users WHERE (affiliation IN (SELECT name FROM subtree)) AND (ca_name = ?)`
+	var count int
+	rdb := d.getReadDB()
+	err := rdb.Get(&count, d.rebind(query), name, d.CAName)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Failed to count members of affiliation '%s'", name)
+	}
+	return count, nil
+}
 
-	if name != "" {
-		_, err := d.GetAffiliation(name)
+// countMembersIterative counts the members of the subtree of an affiliation
+// by walking the tree one level at a time
+func (d *Accessor) countMembersIterative(name string) (int, error) {
+	rdb := d.getReadDB()
+	subtree := []string{name}
+	visited := map[string]bool{name: true}
+	for i := 0; i < len(subtree); i++ {
+		var children []string
+		err := rdb.Select(&children, d.rebind("SELECT name FROM affiliations WHERE (prekey = ?) AND (deleted = 0) ORDER BY name"), subtree[i])
 		if err != nil {
-			return nil, err
+			return 0, errors.Wrapf(err, "Failed to get children of affiliation '%s'", subtree[i])
+		}
+		for _, child := range children {
+			if !visited[child] {
+				visited[child] = true
+				subtree = append(subtree, child)
+			}
 		}
 	}
 
-	result, err := d.doTransaction(d.getAffiliationTreeTx, name)
+	query, args, err := sqlx.In("SELECT COUNT(*) FROM users WHERE (affiliation IN (?)) AND (ca_name = ?)", subtree, d.CAName)
+	if err != nil {
+		return 0, err
+	}
+	var count int
+	err = rdb.Get(&count, d.rebind(query), args...)
 	if err != nil {
-		return nil, err
+		return 0, errors.Wrapf(err, "Failed to count members of affiliation '%s'", name)
 	}
-
-	getResult := result.(*spi.DbTxResult)
-
-	return getResult, nil
+	return count, nil
 }
 
-// GetAffiliation gets affiliation from database
-func (d *Accessor) getAffiliationTreeTx(tx *sqlx.Tx, args ...interface{}) (interface{}, error) {
-	name := args[0].(string)
-
-	log.Debugf("DB: Get affiliation tree for %s", name)
+// GetExpiringCertsInAffiliation returns the unrevoked certificates, ordered by
+// expiry, that have not expired but expire before the given time, of the
+// identities that belong to an affiliation or any of its descendants. The
+// root affiliation, "", includes all identities.
+func (d *Accessor) GetExpiringCertsInAffiliation(affiliation string, before time.Time) ([]CertRecord, error) {
+	log.Debugf("DB: Get certificates expiring before %s in affiliation '%s'", before, affiliation)
 	err := d.checkDB()
 	if err != nil {
 		return nil, err
 	}
 
-	// Getting affiliations
-	allAffs := []AffiliationRecord{}
-	if name == "" { // Requesting all affiliations
-		err = tx.Select(&allAffs, tx.Rebind("SELECT * FROM affiliations"))
-		if err != nil {
-			return nil, newHTTPErr(500, ErrGettingAffiliation, "Failed to get affiliation tree for '%s': %s", name, err)
-		}
-	} else {
-		err = tx.Select(&allAffs, tx.Rebind("Select * FROM affiliations where (name LIKE ?) OR (name = ?)"), name+".%", name)
+	if affiliation != "" {
+		_, err = d.GetAffiliation(affiliation)
 		if err != nil {
-			return nil, newHTTPErr(500, ErrGettingAffiliation, "Failed to get affiliation tree for '%s': %s", name, err)
+			return nil, err
 		}
 	}
 
-	ids := []UserRecord{} // TODO: Return identities associated with these affiliations
-	result := d.getResult(ids, allAffs)
-	return result, nil
+	members := "(ca_name = ?)"
+	args := []interface{}{time.Now().UTC(), before.UTC(), d.CAName}
+	if affiliation != "" {
+		members += " AND ((affiliation = ?) OR (affiliation LIKE ?))"
+		args = append(args, affiliation, affiliation+".%")
+	}
+	query := fmt.Sprintf(`
+SELECT %s FROM certificates
+	WHERE (status != 'revoked') AND (expiry >= ?) AND (expiry < ?) AND id IN (SELECT id FROM users WHERE %s)
+	ORDER BY expiry, serial_number`, sqlstruct.Columns(CertRecord{}), members)
+	certs := []CertRecord{}
+	rdb := d.getReadDB()
+	err = rdb.Select(&certs, d.rebind(query), args...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to get expiring certificates in affiliation '%s'", affiliation)
+	}
+
+	return certs, nil
 }
 
-// GetProperties returns the properties from the database
-func (d *Accessor) GetProperties(names []string) (map[string]string, error) {
-	log.Debugf("DB: Get properties %s", names)
+// RevokeAffiliationMembers revokes every identity in the affiliation name and
+// its descendants in a single transaction, recording reason as the RFC 5280
+// reason code of each revocation. Identities that are already revoked keep
+// their original reason and time. It returns the number of identities revoked.
+func (d *Accessor) RevokeAffiliationMembers(name string, reason int) (int, error) {
+	log.Debugf("DB: Revoke members of affiliation '%s' with reason %d", name, reason)
 	err := d.checkDB()
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
-	type property struct {
-		Name  string `db:"property"`
-		Value string `db:"value"`
+	result, err := d.doTransaction(d.revokeAffiliationMembersTx, name, reason)
+	if err != nil {
+		return 0, err
 	}
 
-	properties := []property{}
+	revoked := result.([]string)
+	d.recordUserWrites(revoked)
+	d.emitChanges(ChangeUpdate, revoked)
 
-	query := "SELECT * FROM properties WHERE (property IN (?))"
-	inQuery, args, err := sqlx.In(query, names)
+	log.Debugf("Revoked %d members of affiliation '%s'", len(revoked), name)
+	return len(revoked), nil
+}
+
+func (d *Accessor) revokeAffiliationMembersTx(tx *sqlx.Tx, args ...interface{}) (interface{}, error) {
+	name := args[0].(string)
+	reason := args[1].(int)
+
+	var aff AffiliationRecord
+	err := tx.Get(&aff, d.rebind(getAffiliationQuery), name)
 	if err != nil {
-		return nil, errors.Wrapf(err, "Failed to construct query '%s' for properties '%s'", query, names)
+		return nil, getError(err, "Affiliation")
 	}
-	err = d.db.Select(&properties, d.db.Rebind(inQuery), args...)
+
+	revoked := []string{}
+	query := "SELECT id FROM users WHERE ((affiliation = ?) OR (affiliation LIKE ?)) AND (ca_name = ?) AND (state != -1)"
+	err = tx.Select(&revoked, d.rebind(query), name, name+".%", d.CAName)
 	if err != nil {
-		return nil, getError(err, "Properties")
+		return nil, errors.Wrapf(err, "Failed to get members of affiliation '%s'", name)
 	}
 
-	propertiesMap := make(map[string]string)
-	for _, prop := range properties {
-		propertiesMap[prop.Name] = prop.Value
+	query = "UPDATE users SET state = -1, revocation_reason = ?, revoked_at = ? WHERE ((affiliation = ?) OR (affiliation LIKE ?)) AND (ca_name = ?) AND (state != -1)"
+	_, err = tx.Exec(d.rebind(query), reason, time.Now().UTC(), name, name+".%", d.CAName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to revoke members of affiliation '%s'", name)
 	}
 
-	return propertiesMap, nil
+	return revoked, nil
 }
 
-// GetUserLessThanLevel returns all identities that are less than the level specified
-// Otherwise, returns no users if requested level is zero
-func (d *Accessor) GetUserLessThanLevel(level int) ([]spi.User, error) {
-	if level == 0 {
-		return []spi.User{}, nil
+// ListAffiliations returns at most limit affiliations ordered by name,
+// starting at offset. An empty list is returned past the last affiliation.
+func (d *Accessor) ListAffiliations(offset, limit int) ([]spi.Affiliation, error) {
+	log.Debugf("DB: List %d affiliations at offset %d", limit, offset)
+	err := d.checkDB()
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 {
+		return nil, newHTTPErr(400, ErrInvalidRequest, "Offset must not be negative, but is %d", offset)
+	}
+	if limit <= 0 {
+		return nil, newHTTPErr(400, ErrInvalidRequest, "Limit must be greater than zero, but is %d", limit)
 	}
 
-	rows, err := d.db.Queryx(d.db.Rebind("SELECT * FROM users WHERE (level < ?) OR (level IS NULL)"), level)
+	affRecs := []AffiliationRecord{}
+	rdb := d.getReadDB()
+	err = rdb.Select(&affRecs, d.rebind("SELECT * FROM affiliations WHERE (deleted = 0) ORDER BY name LIMIT ? OFFSET ?"), limit, offset)
 	if err != nil {
-		return nil, errors.Wrap(err, "Failed to get identities that need to be updated")
+		return nil, newHTTPErr(500, ErrGettingAffiliation, "Failed to list affiliations: %s", err)
 	}
 
-	allUsers := []spi.User{}
-
-	for rows.Next() {
-		var user UserRecord
-		rows.StructScan(&user)
-		dbUser := newDBUser(&user, d.db)
-		allUsers = append(allUsers, dbUser)
+	affiliations := []spi.Affiliation{}
+	for _, aff := range affRecs {
+		affiliations = append(affiliations, spi.NewAffiliation(aff.Name, aff.Prekey, aff.Level))
 	}
 
-	return allUsers, nil
+	return affiliations, nil
 }
 
-// GetAllAffiliations gets the requested affiliation and any sub affiliations from the database
-func (d *Accessor) GetAllAffiliations(name string) (*sqlx.Rows, error) {
-	log.Debugf("DB: Get affiliation %s", name)
+// FindOrphanAffiliations returns the affiliations whose parent affiliation does
+// not exist in the database
+func (d *Accessor) FindOrphanAffiliations() ([]spi.Affiliation, error) {
+	log.Debug("DB: Find orphan affiliations")
 	err := d.checkDB()
 	if err != nil {
 		return nil, err
 	}
 
-	if name == "" { // Requesting all affiliations
-		rows, err := d.db.Queryx(d.db.Rebind("SELECT * FROM affiliations"))
-		if err != nil {
-			return nil, err
-		}
-		return rows, nil
+	query := `
+SELECT * FROM affiliations a
+	WHERE (a.prekey <> '') AND (a.deleted = 0)
+	AND NOT EXISTS (SELECT 1 FROM affiliations p WHERE (p.name = a.prekey))
+	ORDER BY a.name`
+	orphans := []AffiliationRecord{}
+	err = d.db.Select(&orphans, query)
+	if err != nil {
+		return nil, newHTTPErr(500, ErrGettingAffiliation, "Failed to find orphan affiliations: %s", err)
 	}
 
-	rows, err := d.db.Queryx(d.db.Rebind(getAllAffiliationsQuery), name, name+".%")
-	if err != nil {
-		return nil, err
+	affiliations := []spi.Affiliation{}
+	for _, aff := range orphans {
+		affiliations = append(affiliations, spi.NewAffiliation(aff.Name, aff.Prekey, aff.Level))
 	}
 
-	return rows, nil
+	return affiliations, nil
 }
 
-// GetFilteredUsers returns all identities that fall under the affiliation and types
-func (d *Accessor) GetFilteredUsers(affiliation, types string) (*sqlx.Rows, error) {
-	log.Debugf("DB: Get all identities per affiliation '%s' and types '%s'", affiliation, types)
+// GetEmptyAffiliations returns the affiliations that have no identities, of
+// any CA, and no child affiliations, which are the candidates for pruning
+// the affiliation tree
+func (d *Accessor) GetEmptyAffiliations() ([]spi.Affiliation, error) {
+	log.Debug("DB: Get empty affiliations")
 	err := d.checkDB()
 	if err != nil {
 		return nil, err
 	}
 
-	typesArray := strings.Split(types, ",")
-	for i := range typesArray {
-		typesArray[i] = strings.TrimSpace(typesArray[i])
+	query := `
+SELECT * FROM affiliations a
+	WHERE (a.deleted = 0)
+	AND NOT EXISTS (SELECT 1 FROM users u WHERE (u.affiliation = a.name))
+	AND NOT EXISTS (SELECT 1 FROM affiliations c WHERE (c.prekey = a.name) AND (c.deleted = 0))
+	ORDER BY a.name`
+	empty := []AffiliationRecord{}
+	rdb := d.getReadDB()
+	err = rdb.Select(&empty, query)
+	if err != nil {
+		return nil, newHTTPErr(500, ErrGettingAffiliation, "Failed to get empty affiliations: %s", err)
 	}
 
-	// If root affiliation, allowed to get back users of all affiliations
-	if affiliation == "" {
-		if util.ListContains(types, "*") { // If type is '*', allowed to get back of all types
-			query := "SELECT * FROM users"
-			rows, err := d.db.Queryx(d.db.Rebind(query))
-			if err != nil {
-				return nil, errors.Wrapf(err, "Failed to execute query '%s' for affiliation '%s' and types '%s'", query, affiliation, types)
-			}
-			return rows, nil
-		}
-
-		query := "SELECT * FROM users WHERE (type IN (?))"
-		query, args, err := sqlx.In(query, typesArray)
-		if err != nil {
-			return nil, errors.Wrapf(err, "Failed to construct query '%s' for affiliation '%s' and types '%s'", query, affiliation, types)
-		}
-		rows, err := d.db.Queryx(d.db.Rebind(query), args...)
-		if err != nil {
-			return nil, errors.Wrapf(err, "Failed to execute query '%s' for affiliation '%s' and types '%s'", query, affiliation, types)
-		}
-		return rows, nil
+	affiliations := []spi.Affiliation{}
+	for _, aff := range empty {
+		affiliations = append(affiliations, spi.NewAffiliation(aff.Name, aff.Prekey, aff.Level))
 	}
 
-	subAffiliation := affiliation + ".%"
-	if util.ListContains(types, "*") { // If type is '*', allowed to get back of all types for requested affiliation
-		query := "SELECT * FROM users WHERE ((affiliation = ?) OR (affiliation LIKE ?))"
-		rows, err := d.db.Queryx(d.db.Rebind(query))
-		if err != nil {
-			return nil, errors.Wrapf(err, "Failed to execute query '%s' for affiliation '%s' and types '%s'", query, affiliation, types)
-		}
-		return rows, nil
-	}
+	return affiliations, nil
+}
 
-	query := "SELECT * FROM users WHERE ((affiliation = ?) OR (affiliation LIKE ?)) AND (type IN (?))"
-	inQuery, args, err := sqlx.In(query, affiliation, subAffiliation, typesArray)
-	if err != nil {
-		return nil, errors.Wrapf(err, "Failed to construct query '%s' for affiliation '%s' and types '%s'", query, affiliation, types)
-	}
-	rows, err := d.db.Queryx(d.db.Rebind(inQuery), args...)
+// ReparentOrphans moves every orphan affiliation, along with the affiliations
+// below it, under the affiliation to, or to the root if to is empty. It returns
+// the number of orphan affiliations that were moved before any error occurred.
+func (d *Accessor) ReparentOrphans(to string) (int, error) {
+	log.Debugf("DB: Reparent orphan affiliations under '%s'", to)
+	orphans, err := d.FindOrphanAffiliations()
 	if err != nil {
-		return nil, errors.Wrapf(err, "Failed to execute query '%s' for affiliation '%s' and types '%s'", query, affiliation, types)
+		return 0, err
 	}
 
-	return rows, nil
+	for i, orphan := range orphans {
+		err = d.MoveAffiliation(orphan.GetName(), to)
+		if err != nil {
+			return i, errors.WithMessage(err, fmt.Sprintf("Failed to reparent orphan affiliation '%s'", orphan.GetName()))
+		}
+	}
 
+	return len(orphans), nil
 }
 
-// ModifyAffiliation renames the affiliation and updates all identities to use the new affiliation depending on
-// the value of the "force" parameter
-func (d *Accessor) ModifyAffiliation(oldAffiliation, newAffiliation string, force, isRegistrar bool) (*spi.DbTxResult, error) {
-	log.Debugf("DB: Modify affiliation from '%s' to '%s'", oldAffiliation, newAffiliation)
-	err := d.checkDB()
+func (d *Accessor) moveAffiliationTx(tx *sqlx.Tx, args ...interface{}) (interface{}, error) {
+	name := args[0].(string)
+	newName := args[1].(string)
+	newParent := args[2].(string)
+
+	// Renaming updates the names and parents of the affiliations below the moved
+	// affiliation, but the parent of the moved affiliation itself must be set
+	result, err := d.modifyAffiliationTx(tx, name, newName, true, true)
 	if err != nil {
 		return nil, err
 	}
 
-	// Check to see if the affiliation being modifies exists in the affiliation table
-	_, err = d.GetAffiliation(oldAffiliation)
+	_, err = tx.Exec(d.rebind("UPDATE affiliations SET prekey = ? WHERE (name = ?)"), newParent, newName)
 	if err != nil {
-		return nil, err
+		return nil, newHTTPErr(500, ErrUpdateConfigModifyAff, "Failed to set parent of affiliation '%s': %s", newName, err)
 	}
 
-	// Check to see if the new affiliation being requested exists in the affiliation table
-	_, err = d.GetAffiliation(newAffiliation)
-	if err == nil {
-		return nil, newHTTPErr(400, ErrUpdateConfigModifyAff, "Affiliation '%s' already exists", newAffiliation)
-	}
+	return result, nil
+}
 
-	result, err := d.doTransaction(d.modifyAffiliationTx, oldAffiliation, newAffiliation, force, isRegistrar)
+// countOtherCAMembersTx returns the number of identities of other CAs sharing
+// the table that belong to an affiliation or its descendants. Deleting or
+// renaming such an affiliation would leave them in an affiliation that no
+// longer exists.
+func (d *Accessor) countOtherCAMembersTx(tx *sqlx.Tx, name string) (int, error) {
+	var count int
+	err := tx.Get(&count, d.rebind("SELECT COUNT(*) FROM users WHERE ((affiliation = ?) OR (affiliation LIKE ?)) AND (ca_name != ?)"), name, name+".%", d.CAName)
 	if err != nil {
-		return nil, err
+		return 0, errors.Wrapf(err, "Failed to count identities of other CAs with affiliation '%s'", name)
 	}
-
-	modifiedInfo := result.(*spi.DbTxResult)
-
-	return modifiedInfo, nil
+	return count, nil
 }
 
 func (d *Accessor) modifyAffiliationTx(tx *sqlx.Tx, args ...interface{}) (interface{}, error) {
@@ -715,7 +4818,7 @@ func (d *Accessor) modifyAffiliationTx(tx *sqlx.Tx, args ...interface{}) (interf
 	// Get the affiliation record
 	query := "SELECT name, prekey FROM affiliations WHERE (name = ?)"
 	var oldAffiliationRecord AffiliationRecord
-	err := tx.Get(&oldAffiliationRecord, tx.Rebind(query), oldAffiliation)
+	err := tx.Get(&oldAffiliationRecord, d.rebind(query), oldAffiliation)
 	if err != nil {
 		return nil, err
 	}
@@ -723,13 +4826,21 @@ func (d *Accessor) modifyAffiliationTx(tx *sqlx.Tx, args ...interface{}) (interf
 	// Get the affiliation records for all sub affiliations
 	query = "SELECT name, prekey FROM affiliations WHERE (name LIKE ?)"
 	var allOldAffiliations []AffiliationRecord
-	err = tx.Select(&allOldAffiliations, tx.Rebind(query), oldAffiliation+".%")
+	err = tx.Select(&allOldAffiliations, d.rebind(query), oldAffiliation+".%")
 	if err != nil {
 		return nil, err
 	}
 
 	allOldAffiliations = append(allOldAffiliations, oldAffiliationRecord)
 
+	otherCAMembers, err := d.countOtherCAMembersTx(tx, oldAffiliation)
+	if err != nil {
+		return nil, err
+	}
+	if otherCAMembers > 0 {
+		return nil, newHTTPErr(400, ErrUpdateConfigModifyAff, "Cannot modify affiliation '%s'. The affiliation has %d identities of other CAs", oldAffiliation, otherCAMembers)
+	}
+
 	log.Debugf("Affiliations to be modified %+v", allOldAffiliations)
 
 	// Iterate through all the affiliations found and update to use new affiliation path
@@ -743,8 +4854,8 @@ func (d *Accessor) modifyAffiliationTx(tx *sqlx.Tx, args ...interface{}) (interf
 		log.Debugf("oldPath: %s, newPath: %s, oldParentPath: %s, newParentPath: %s", oldPath, newPath, oldParentPath, newParentPath)
 
 		// Select all users that are using the old affiliation
-		query = "SELECT * FROM users WHERE (affiliation = ?)"
-		err = tx.Select(&idsWithOldAff, tx.Rebind(query), oldPath)
+		query = "SELECT * FROM users WHERE (affiliation = ?) AND (ca_name = ?)"
+		err = tx.Select(&idsWithOldAff, d.rebind(query), oldPath, d.CAName)
 		if err != nil {
 			return nil, err
 		}
@@ -761,12 +4872,8 @@ func (d *Accessor) modifyAffiliationTx(tx *sqlx.Tx, args ...interface{}) (interf
 			if force {
 				log.Debugf("Identities %s to be updated to use new affiliation of '%s' from '%s'", ids, newPath, oldPath)
 
-				query := "Update users SET affiliation = ? WHERE (id IN (?))"
-				inQuery, args, err := sqlx.In(query, newPath, ids)
-				if err != nil {
-					return nil, errors.Wrapf(err, "Failed to construct query '%s'", query)
-				}
-				_, err = tx.Exec(tx.Rebind(inQuery), args...)
+				query := "Update users SET affiliation = ? WHERE (affiliation = ?) AND (ca_name = ?)"
+				_, err = tx.Exec(d.rebind(query), newPath, oldPath, d.CAName)
 				if err != nil {
 					return nil, errors.Wrapf(err, "Failed to execute query '%s' for multiple certificate removal", query)
 				}
@@ -788,11 +4895,15 @@ func (d *Accessor) modifyAffiliationTx(tx *sqlx.Tx, args ...interface{}) (interf
 					if err != nil {
 						return nil, err
 					}
+					attributes, err := d.encodeAttributes(attrBytes)
+					if err != nil {
+						return nil, err
+					}
 
 					// Update attributes
-					query := "UPDATE users SET attributes = ? where (id = ?)"
+					query := "UPDATE users SET attributes = ?, attr_count = ? where (id = ?) AND (ca_name = ?)"
 					id := user.GetName()
-					res, err := tx.Exec(tx.Rebind(query), string(attrBytes), id)
+					res, err := tx.Exec(d.rebind(query), attributes, len(userAttrs), id, d.CAName)
 					if err != nil {
 						return nil, err
 					}
@@ -821,32 +4932,32 @@ func (d *Accessor) modifyAffiliationTx(tx *sqlx.Tx, args ...interface{}) (interf
 
 		// Update the affiliation record in the database to use new affiliation path
 		query = "Update affiliations SET name = ?, prekey = ? WHERE (name = ?)"
-		res := tx.MustExec(tx.Rebind(query), newPath, newParentPath, oldPath)
+		res := tx.MustExec(d.rebind(query), newPath, newParentPath, oldPath)
 		numRowsAffected, err := res.RowsAffected()
 		if err != nil {
 			return nil, errors.Errorf("Failed to get number of rows affected")
 		}
 		if numRowsAffected == 0 {
-			return nil, errors.Errorf("Failed to update any affiliation records for '%s'", oldPath)
+			return nil, newHTTPErr(500, ErrUpdateConfigModifyAff, "Failed to update any affiliation records for '%s'", oldPath)
 		}
 	}
 
 	// Generate the result set that has all identities with their new affiliation and all renamed affiliations
 	var idsWithNewAff []UserRecord
 	if len(idsUpdated) > 0 {
-		query = "Select * FROM users WHERE (id IN (?))"
-		inQuery, args, err := sqlx.In(query, idsUpdated)
+		query = "Select * FROM users WHERE (id IN (?)) AND (ca_name = ?)"
+		inQuery, args, err := sqlx.In(query, idsUpdated, d.CAName)
 		if err != nil {
 			return nil, errors.Wrapf(err, "Failed to construct query '%s'", query)
 		}
-		err = tx.Select(&idsWithNewAff, tx.Rebind(inQuery), args...)
+		err = tx.Select(&idsWithNewAff, d.rebind(inQuery), args...)
 		if err != nil {
 			return nil, errors.Wrapf(err, "Failed to execute query '%s' for getting users with new affiliation", query)
 		}
 	}
 
 	allNewAffs := []AffiliationRecord{}
-	err = tx.Select(&allNewAffs, tx.Rebind("Select * FROM affiliations where (name LIKE ?) OR (name = ?)"), newAffiliation+".%", newAffiliation)
+	err = tx.Select(&allNewAffs, d.rebind("Select * FROM affiliations where (name LIKE ?) OR (name = ?)"), newAffiliation+".%", newAffiliation)
 	if err != nil {
 		return nil, newHTTPErr(500, ErrGettingAffiliation, "Failed to get affiliation tree for '%s': %s", newAffiliation, err)
 	}
@@ -857,12 +4968,32 @@ func (d *Accessor) modifyAffiliationTx(tx *sqlx.Tx, args ...interface{}) (interf
 	return result, nil
 }
 
+// doTransaction runs doit in a transaction, running the whole transaction
+// again if it fails because the SQLite database is locked
 func (d *Accessor) doTransaction(doit func(tx *sqlx.Tx, args ...interface{}) (interface{}, error), args ...interface{}) (interface{}, error) {
 	err := d.checkDB()
 	if err != nil {
 		return nil, err
 	}
-	tx := d.db.MustBegin()
+
+	var result interface{}
+	err = d.retryBusy(func() error {
+		var err error
+		result, err = d.doTransactionOnce(doit, args...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (d *Accessor) doTransactionOnce(doit func(tx *sqlx.Tx, args ...interface{}) (interface{}, error), args ...interface{}) (interface{}, error) {
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to begin transaction")
+	}
 	result, err := doit(tx, args...)
 	if err != nil {
 		err2 := tx.Rollback()
@@ -902,8 +5033,23 @@ func (d *Accessor) getResult(ids []UserRecord, affs []AffiliationRecord) *spi.Db
 	}
 }
 
+// identityNames returns the names of the identities in result
+func identityNames(result *spi.DbTxResult) []string {
+	names := make([]string, 0, len(result.Identities))
+	for _, id := range result.Identities {
+		names = append(names, id.GetName())
+	}
+	return names
+}
+
 // Creates a DBUser object from the DB user record
 func newDBUser(userRec *UserRecord, db *dbutil.DB) *DBUser {
+	return convertUserRecord(userRec, db, false)
+}
+
+// convertUserRecord converts a user record to a DBUser, keeping only the
+// attributes with ECert set if ecertOnly is true
+func convertUserRecord(userRec *UserRecord, db *dbutil.DB, ecertOnly bool) *DBUser {
 	var user = new(DBUser)
 	user.Name = userRec.Name
 	user.pass = userRec.Pass
@@ -912,9 +5058,36 @@ func newDBUser(userRec *UserRecord, db *dbutil.DB) *DBUser {
 	user.Affiliation = userRec.Affiliation
 	user.Type = userRec.Type
 	user.Level = userRec.Level
+	user.caName = userRec.CAName
+	user.incorrectPasswordAttempts = userRec.IncorrectPasswordAttempts
+	if userRec.LockedUntil.Valid {
+		user.lockedUntil = userRec.LockedUntil.Time
+	}
+	if userRec.ExpiresAt.Valid {
+		user.ExpiresAt = userRec.ExpiresAt.Time
+	}
+	if userRec.SecretExpiresAt.Valid {
+		user.SecretExpiresAt = userRec.SecretExpiresAt.Time
+	}
+	user.IsBootstrap = userRec.IsBootstrap == 1
 
 	var attrs []api.Attribute
-	json.Unmarshal([]byte(userRec.Attributes), &attrs)
+	attributes, err := decodeAttributes(userRec.Attributes)
+	if err != nil {
+		log.Warningf("Failed to read attributes of identity '%s': %s", userRec.Name, err)
+	}
+	json.Unmarshal([]byte(attributes), &attrs)
+	attrs, _ = dedupeAttributes(attrs)
+	if ecertOnly {
+		ecertAttrs := []api.Attribute{}
+		for _, attr := range attrs {
+			if attr.ECert {
+				ecertAttrs = append(ecertAttrs, attr)
+			}
+		}
+		attrs = ecertAttrs
+		user.ecertOnly = true
+	}
 	user.Attributes = attrs
 
 	user.attrs = make(map[string]api.Attribute)
@@ -933,9 +5106,43 @@ func newDBUser(userRec *UserRecord, db *dbutil.DB) *DBUser {
 // DBUser is the databases representation of a user
 type DBUser struct {
 	spi.UserInfo
-	pass  []byte
-	attrs map[string]api.Attribute
-	db    *dbutil.DB
+	pass                         []byte
+	attrs                        map[string]api.Attribute
+	db                           *dbutil.DB
+	incorrectPasswordAttempts    int
+	lockedUntil                  time.Time
+	maxIncorrectPasswordAttempts int
+	lockoutDuration              time.Duration
+	// ecertOnly is set if only the ECert attributes of the user were loaded
+	ecertOnly bool
+	// authenticator verifies the credential passed to Login
+	authenticator Authenticator
+	// secretResolver overrides pass with a token from an external store
+	secretResolver SecretResolver
+	// compressAttributes is set if attributes are stored compressed
+	compressAttributes bool
+	// caName is the name of the CA the identity belongs to
+	caName string
+	// sortAttributes is set if GetAttributes returns attributes by name
+	sortAttributes bool
+	// recordWrite, if set, is called with the name of the user after the
+	// user is written
+	recordWrite func(id string)
+	// emitWrite, if set, is called with the name of the user after the
+	// write of the user is committed, to report it to the event sink
+	emitWrite func(id string)
+	// maxAttributeLengths limits the lengths of attribute values, by name
+	maxAttributeLengths map[string]int
+}
+
+// written reports a write of the user to recordWrite and emitWrite
+func (u *DBUser) written() {
+	if u.recordWrite != nil {
+		u.recordWrite(u.Name)
+	}
+	if u.emitWrite != nil {
+		u.emitWrite(u.Name)
+	}
 }
 
 // GetName returns the enrollment ID of the user
@@ -960,9 +5167,9 @@ func (u *DBUser) GetLevel() int {
 
 // SetLevel sets the level of the user
 func (u *DBUser) SetLevel(level int) error {
-	query := "UPDATE users SET level = ? where (id = ?)"
+	query := "UPDATE users SET level = ? where (id = ?) AND (ca_name = ?)"
 	id := u.GetName()
-	res, err := u.db.Exec(u.db.Rebind(query), level, id)
+	res, err := u.db.Exec(dbutil.Rebind(u.db.Dialect(), query), level, id, u.caName)
 	if err != nil {
 		return err
 	}
@@ -978,19 +5185,108 @@ func (u *DBUser) SetLevel(level int) error {
 	if numRowsAffected != 1 {
 		return errors.Errorf("%d rows were affected when updating the state of identity %s", numRowsAffected, id)
 	}
+	u.written()
 	return nil
 }
 
-// Login the user with a password
+// Login the user with a password, or with the credential expected by the
+// Authenticator of the accessor that loaded the user
 func (u *DBUser) Login(pass string, caMaxEnrollments int) error {
 	log.Debugf("DB: Login user %s with max enrollments of %d and state of %d", u.Name, u.MaxEnrollments, u.State)
 
-	// Check the password by comparing to stored hash
-	err := bcrypt.CompareHashAndPassword(u.pass, []byte(pass))
+	err := u.checkLoginAllowed()
+	if err != nil {
+		return err
+	}
+
+	token, err := u.resolveToken()
+	if err != nil {
+		return err
+	}
+
+	authenticator := u.authenticator
+	if authenticator == nil {
+		authenticator = PasswordAuthenticator{}
+	}
+	err = authenticator.Authenticate(&u.UserInfo, token, pass)
 	if err != nil {
+		err2 := u.recordIncorrectPassword()
+		if err2 != nil {
+			log.Warningf("Failed to record incorrect password attempt for identity '%s': %s", u.Name, err2)
+		}
 		return errors.Wrap(err, "Password mismatch")
 	}
 
+	if u.incorrectPasswordAttempts > 0 {
+		_, err = u.db.Exec(dbutil.Rebind(u.db.Dialect(), "UPDATE users SET incorrect_password_attempts = 0 WHERE (id = ?) AND (ca_name = ?)"), u.Name, u.caName)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to reset incorrect password attempts of identity '%s'", u.Name)
+		}
+		u.incorrectPasswordAttempts = 0
+		u.written()
+	}
+
+	err = u.checkEnrollmentAllowed(caMaxEnrollments)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("DB: identity %s successfully logged in", u.Name)
+
+	return nil
+
+}
+
+// resolveToken returns the token to verify the credential of the user against,
+// which comes from the secret resolver if it has one for the user and from the
+// database otherwise
+func (u *DBUser) resolveToken() ([]byte, error) {
+	if u.secretResolver == nil {
+		return u.pass, nil
+	}
+	token, found, err := u.secretResolver.ResolveSecret(u.Name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to resolve secret of identity '%s'", u.Name)
+	}
+	if !found {
+		log.Debugf("No external secret found for identity '%s', using the stored token", u.Name)
+		return u.pass, nil
+	}
+	return token, nil
+}
+
+// isSecretExpired returns true if secretExpiresAt is a secret expiry time
+// that has passed
+func isSecretExpired(secretExpiresAt time.Time) bool {
+	return !secretExpiresAt.IsZero() && !time.Now().Before(secretExpiresAt)
+}
+
+// isExpired returns true if the user has an expiry time that has passed
+func (u *DBUser) isExpired() bool {
+	return !u.ExpiresAt.IsZero() && !time.Now().Before(u.ExpiresAt)
+}
+
+// checkLoginAllowed returns an error if the user is locked, has expired, or
+// has a secret that has expired
+func (u *DBUser) checkLoginAllowed() error {
+	if time.Now().Before(u.lockedUntil) {
+		return errors.Errorf("Identity '%s' is locked until %s", u.Name, u.lockedUntil.Format(time.RFC3339))
+	}
+
+	if u.isExpired() {
+		return errors.Errorf("Identity '%s' expired at %s", u.Name, u.ExpiresAt.Format(time.RFC3339))
+	}
+
+	if isSecretExpired(u.SecretExpiresAt) {
+		return errors.Errorf("Secret of identity '%s' expired at %s", u.Name, u.SecretExpiresAt.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// checkEnrollmentAllowed returns an error if the state and maximum enrollments
+// of the user do not allow it to enroll again
+func (u *DBUser) checkEnrollmentAllowed(caMaxEnrollments int) error {
 	if u.MaxEnrollments == 0 {
 		return errors.Errorf("Zero is an invalid value for maximum enrollments on identity '%s'", u.Name)
 	}
@@ -1012,10 +5308,36 @@ func (u *DBUser) Login(pass string, caMaxEnrollments int) error {
 		return errors.Errorf("The identity %s has already enrolled %d times, it has reached its maximum enrollment allowance", u.Name, u.MaxEnrollments)
 	}
 
-	log.Debugf("DB: identity %s successfully logged in", u.Name)
-
 	return nil
+}
+
+// recordIncorrectPassword increments the number of incorrect password attempts
+// of the user, and locks the user once the maximum number of attempts is reached
+func (u *DBUser) recordIncorrectPassword() error {
+	if u.maxIncorrectPasswordAttempts <= 0 {
+		return nil
+	}
+
+	u.incorrectPasswordAttempts++
+	if u.incorrectPasswordAttempts < u.maxIncorrectPasswordAttempts {
+		_, err := u.db.Exec(dbutil.Rebind(u.db.Dialect(), "UPDATE users SET incorrect_password_attempts = ? WHERE (id = ?) AND (ca_name = ?)"), u.incorrectPasswordAttempts, u.Name, u.caName)
+		if err != nil {
+			return err
+		}
+		u.written()
+		return nil
+	}
 
+	// Lock the user and reset the attempts so the user starts over once the lock expires
+	u.lockedUntil = time.Now().Add(u.lockoutDuration).UTC()
+	u.incorrectPasswordAttempts = 0
+	log.Infof("Identity '%s' has reached the maximum number of incorrect password attempts, locked until %s", u.Name, u.lockedUntil.Format(time.RFC3339))
+	_, err := u.db.Exec(dbutil.Rebind(u.db.Dialect(), "UPDATE users SET incorrect_password_attempts = 0, locked_until = ? WHERE (id = ?) AND (ca_name = ?)"), u.lockedUntil, u.Name, u.caName)
+	if err != nil {
+		return err
+	}
+	u.written()
+	return nil
 }
 
 // LoginComplete completes the login process by incrementing the state of the user
@@ -1025,16 +5347,16 @@ func (u *DBUser) LoginComplete() error {
 	var err error
 
 	state := u.State + 1
-	args = append(args, u.Name)
+	args = append(args, time.Now().UTC(), u.Name, u.caName)
 	if u.MaxEnrollments == -1 {
 		// unlimited so no state check
-		stateUpdateSQL = "UPDATE users SET state = state + 1 WHERE (id = ?)"
+		stateUpdateSQL = "UPDATE users SET state = state + 1, last_enrolled_at = ? WHERE (id = ? AND ca_name = ?)"
 	} else {
 		// state must be less than max enrollments
-		stateUpdateSQL = "UPDATE users SET state = state + 1 WHERE (id = ? AND state < ?)"
+		stateUpdateSQL = "UPDATE users SET state = state + 1, last_enrolled_at = ? WHERE (id = ? AND ca_name = ? AND state < ?)"
 		args = append(args, u.MaxEnrollments)
 	}
-	res, err := u.db.Exec(u.db.Rebind(stateUpdateSQL), args...)
+	res, err := u.db.Exec(dbutil.Rebind(u.db.Dialect(), stateUpdateSQL), args...)
 	if err != nil {
 		return errors.Wrapf(err, "Failed to update state of identity %s to %d", u.Name, state)
 	}
@@ -1053,6 +5375,7 @@ func (u *DBUser) LoginComplete() error {
 	}
 
 	log.Debugf("Successfully incremented state for identity %s to %d", u.Name, state)
+	u.written()
 	return nil
 
 }
@@ -1080,6 +5403,9 @@ func (u *DBUser) GetAttributes(attrNames []string) ([]api.Attribute, error) {
 		for _, value := range u.attrs {
 			attrs = append(attrs, value)
 		}
+		if u.sortAttributes {
+			sort.Slice(attrs, func(i, j int) bool { return attrs[i].Name < attrs[j].Name })
+		}
 		return attrs, nil
 	}
 
@@ -1095,9 +5421,15 @@ func (u *DBUser) GetAttributes(attrNames []string) ([]api.Attribute, error) {
 
 // Revoke will revoke the user, setting the state of the user to be -1
 func (u *DBUser) Revoke() error {
-	stateUpdateSQL := "UPDATE users SET state = -1 WHERE (id = ?)"
+	return u.RevokeWithReason(ocsp.Unspecified)
+}
+
+// RevokeWithReason revokes the user, setting its state to -1 and recording the
+// RFC 5280 reason code and time of the revocation
+func (u *DBUser) RevokeWithReason(reason int) error {
+	stateUpdateSQL := "UPDATE users SET state = -1, revocation_reason = ?, revoked_at = ? WHERE (id = ?) AND (ca_name = ?)"
 
-	res, err := u.db.Exec(u.db.Rebind(stateUpdateSQL), u.GetName())
+	res, err := u.db.Exec(dbutil.Rebind(u.db.Dialect(), stateUpdateSQL), reason, time.Now().UTC(), u.GetName(), u.caName)
 	if err != nil {
 		return errors.Wrapf(err, "Failed to update state of identity %s to -1", u.Name)
 	}
@@ -1116,6 +5448,7 @@ func (u *DBUser) Revoke() error {
 	}
 
 	log.Debugf("Successfully incremented state for identity %s to -1", u.Name)
+	u.written()
 
 	return nil
 }
@@ -1123,6 +5456,14 @@ func (u *DBUser) Revoke() error {
 // ModifyAttributes adds a new attribute, modifies existing attribute, or delete attribute
 func (u *DBUser) ModifyAttributes(newAttrs []api.Attribute) error {
 	log.Debugf("Modify Attributes: %+v", newAttrs)
+	if u.ecertOnly {
+		// Writing back the filtered attributes would remove all the others
+		return errors.Errorf("Cannot modify attributes of identity '%s' because only its ECert attributes were loaded", u.GetName())
+	}
+	err := checkAttributeLengths(newAttrs, u.maxAttributeLengths)
+	if err != nil {
+		return err
+	}
 	currentAttrs, _ := u.GetAttributes(nil)
 	userAttrs := getNewAttributes(currentAttrs, newAttrs)
 
@@ -1130,10 +5471,14 @@ func (u *DBUser) ModifyAttributes(newAttrs []api.Attribute) error {
 	if err != nil {
 		return err
 	}
+	attributes, err := encodeAttributes(attrBytes, u.compressAttributes)
+	if err != nil {
+		return err
+	}
 
-	query := "UPDATE users SET attributes = ? where (id = ?)"
+	query := "UPDATE users SET attributes = ?, attr_count = ? where (id = ?) AND (ca_name = ?)"
 	id := u.GetName()
-	res, err := u.db.Exec(u.db.Rebind(query), string(attrBytes), id)
+	res, err := u.db.Exec(dbutil.Rebind(u.db.Dialect(), query), attributes, len(userAttrs), id, u.caName)
 	if err != nil {
 		return err
 	}
@@ -1150,9 +5495,37 @@ func (u *DBUser) ModifyAttributes(newAttrs []api.Attribute) error {
 	if numRowsAffected != 1 {
 		return errors.Errorf("%d rows were affected when updating the state of identity %s", numRowsAffected, id)
 	}
+	u.written()
 	return nil
 }
 
+// getInsertUserError classifies a database error returned while adding an
+// identity. The driver error is logged but not returned, to avoid exposing
+// details of the SQL statement to clients.
+func getInsertUserError(err error, id string) error {
+	log.Errorf("Error adding identity '%s' to the database: %s", id, err)
+	msg := err.Error()
+	// Error messages differ between sqlite3, postgres, and mysql drivers
+	switch {
+	case strings.Contains(msg, "UNIQUE constraint failed"),
+		strings.Contains(msg, "duplicate key value"),
+		strings.Contains(msg, "Error 1062"):
+		return newHTTPErr(400, ErrIdentityExists, "Identity '%s' already exists", id)
+	case strings.Contains(msg, "NOT NULL constraint failed"),
+		strings.Contains(msg, "violates not-null constraint"),
+		strings.Contains(msg, "Error 1048"):
+		return newHTTPErr(400, ErrAddIdentity, "Identity '%s' is missing a required value", id)
+	case isSQLiteBusyError(err):
+		// Keep the cause so that the insert is retried
+		return newHTTPErr(503, ErrConnectingDB, "Failed to add identity '%s' while the database is locked: %s", id, err)
+	case err == driver.ErrBadConn, err == sql.ErrConnDone,
+		strings.Contains(msg, "connection refused"),
+		strings.Contains(msg, "database is closed"):
+		return newHTTPErr(504, ErrConnectingDB, "Failed to connect to the database while adding identity '%s'", id)
+	}
+	return newHTTPErr(500, ErrAddIdentity, "Failed to add identity '%s' to the database", id)
+}
+
 func getError(err error, getType string) error {
 	if err.Error() == "sql: no rows in result set" {
 		return newHTTPErr(404, ErrDBGet, "Failed to get %s: %s", getType, err)
@@ -0,0 +1,87 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperledger/fabric-ca/lib/dbutil"
+	"github.com/hyperledger/fabric-ca/lib/spi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountMembersRecursive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "countmembers")
+	assert.NoError(t, err, "Failed to create temporary directory")
+	defer os.RemoveAll(dir)
+
+	db, err := dbutil.NewUserRegistrySQLLite3(filepath.Join(dir, "fabric-ca.db"))
+	if !assert.NoError(t, err, "Failed to open DB") {
+		return
+	}
+	defer db.Close()
+	accessor := NewDBAccessor(db)
+
+	affiliations := []struct {
+		name, prekey string
+		members      int
+	}{
+		{"org1", "", 1},
+		{"org1.dept1", "org1", 2},
+		{"org1.dept1.team1", "org1.dept1", 3},
+		{"org1.dept2", "org1", 0},
+		{"org2", "", 4},
+	}
+	for _, aff := range affiliations {
+		err = accessor.InsertAffiliation(aff.name, aff.prekey, 0)
+		assert.NoError(t, err, "Failed to insert affiliation %s", aff.name)
+		for i := 0; i < aff.members; i++ {
+			err = accessor.InsertUser(&spi.UserInfo{
+				Name:        fmt.Sprintf("%s.user%d", aff.name, i),
+				Pass:        "123456",
+				Affiliation: aff.name,
+			})
+			assert.NoError(t, err, "Failed to insert user")
+		}
+	}
+
+	// Identities of other CAs sharing the table are not counted
+	accessor.CAName = "ca2"
+	err = accessor.InsertUser(&spi.UserInfo{Name: "org2.user0", Pass: "123456", Affiliation: "org2"})
+	assert.NoError(t, err, "Failed to insert user of another CA")
+	ca2Count, err := accessor.CountMembersRecursive("org2")
+	assert.NoError(t, err, "Failed to count members of org2 in another CA")
+	assert.Equal(t, 1, ca2Count, "Incorrect count of members of org2 in another CA")
+	accessor.CAName = ""
+
+	expected := map[string]int{
+		"org1":             6,
+		"org1.dept1":       5,
+		"org1.dept1.team1": 3,
+		"org1.dept2":       0,
+		"org2":             4,
+	}
+	for name, count := range expected {
+		cteCount, err := accessor.countMembersCTE(name)
+		assert.NoError(t, err, "Failed to count members of %s with a recursive query", name)
+		iterativeCount, err := accessor.countMembersIterative(name)
+		assert.NoError(t, err, "Failed to count members of %s iteratively", name)
+		assert.Equal(t, count, cteCount, "Incorrect recursive query count for %s", name)
+		assert.Equal(t, cteCount, iterativeCount, "Implementations disagree on %s", name)
+
+		total, err := accessor.CountMembersRecursive(name)
+		assert.NoError(t, err, "Failed to count members of %s", name)
+		assert.Equal(t, count, total)
+	}
+
+	_, err = accessor.CountMembersRecursive("org3")
+	assert.Error(t, err, "Counting members of a non-existent affiliation should have failed")
+}
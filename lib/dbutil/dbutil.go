@@ -8,6 +8,7 @@ package dbutil
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"path/filepath"
 	"regexp"
@@ -22,6 +23,10 @@ import (
 	"github.com/jmoiron/sqlx"
 )
 
+// sqliteForeignKeysDriver is the name of the SQLite driver that enables
+// foreign key enforcement on each connection
+const sqliteForeignKeysDriver = "sqlite3_fk"
+
 var (
 	dbURLRegex = regexp.MustCompile("(Datasource:\\s*)?(\\S+):(\\S+)@|(Datasource:.*\\s)?(user=\\S+).*\\s(password=\\S+)|(Datasource:.*\\s)?(password=\\S+).*\\s(user=\\S+)")
 )
@@ -54,6 +59,8 @@ type DB struct {
 	*sqlx.DB
 	// Indicates if database was successfully initialized
 	IsDBInitialized bool
+	// dataSourceName is the name the SQLite database was opened with
+	dataSourceName string
 }
 
 // Levels contains the levels of identities, affiliations, and certificates
@@ -85,7 +92,8 @@ func NewUserRegistrySQLLite3(datasource string) (*DB, error) {
 		return nil, errors.WithMessage(err, "Failed to create SQLite3 database")
 	}
 
-	db, err := sqlx.Open("sqlite3", datasource+"?_busy_timeout=5000")
+	dataSourceName := datasource + "?_busy_timeout=5000"
+	db, err := sqlx.Open("sqlite3", dataSourceName)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to open sqlite3 DB")
 	}
@@ -103,7 +111,43 @@ func NewUserRegistrySQLLite3(datasource string) (*DB, error) {
 	db.SetMaxOpenConns(1)
 	log.Debug("Successfully opened sqlite3 DB")
 
-	return &DB{db, false}, nil
+	return &DB{DB: db, dataSourceName: dataSourceName}, nil
+}
+
+// EnableSQLiteForeignKeys reopens the SQLite database so that foreign key
+// constraints, which SQLite does not enforce by default, are enforced. SQLite
+// only enforces them on connections that enable them, so every connection is
+// opened with a hook that does so. The database must have been opened with
+// NewUserRegistrySQLLite3.
+func (db *DB) EnableSQLiteForeignKeys() error {
+	if db.DriverName() != "sqlite3" {
+		return errors.Errorf("Foreign keys can only be enabled on SQLite databases, not on %s", db.DriverName())
+	}
+	if db.dataSourceName == "" {
+		return errors.New("The SQLite database was not opened by name, so it can not be reopened")
+	}
+
+	sqldb, err := sql.Open(sqliteForeignKeysDriver, db.dataSourceName)
+	if err != nil {
+		return errors.Wrap(err, "Failed to open sqlite3 DB")
+	}
+	fkdb := sqlx.NewDb(sqldb, "sqlite3")
+	fkdb.SetMaxOpenConns(1)
+	err = fkdb.Ping()
+	if err != nil {
+		fkdb.Close()
+		return errors.Wrap(err, "Failed to connect to sqlite3 DB with foreign keys enabled")
+	}
+
+	old := db.DB
+	db.DB = fkdb
+	err = old.Close()
+	if err != nil {
+		log.Warningf("Failed to close sqlite3 DB without foreign keys enabled: %s", err)
+	}
+	log.Debug("Enabled foreign key enforcement on sqlite3 DB")
+
+	return nil
 }
 
 func createSQLiteDBTables(datasource string) error {
@@ -112,7 +156,7 @@ func createSQLiteDBTables(datasource string) error {
 	if err != nil {
 		return errors.Wrap(err, "Failed to open SQLite database")
 	}
-	db := &DB{sqldb, false}
+	db := &DB{DB: sqldb}
 	defer db.Close()
 
 	err = doTransaction(db, createAllSQLiteTables)
@@ -158,12 +202,20 @@ func createAllSQLiteTables(tx *sqlx.Tx, args ...interface{}) error {
 	if err != nil {
 		return err
 	}
+	err = createSQLiteEnrollmentEventsTable(tx)
+	if err != nil {
+		return err
+	}
+	err = createSQLiteDeletedIdentityTable(tx)
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
 func createSQLiteIdentityTable(tx *sqlx.Tx) error {
 	log.Debug("Creating users table if it does not exist")
-	if _, err := tx.Exec("CREATE TABLE IF NOT EXISTS users (id VARCHAR(255), token bytea, type VARCHAR(256), affiliation VARCHAR(1024), attributes TEXT, state INTEGER,  max_enrollments INTEGER, level INTEGER DEFAULT 0)"); err != nil {
+	if _, err := tx.Exec("CREATE TABLE IF NOT EXISTS users (id VARCHAR(255) NOT NULL, token bytea, type VARCHAR(256), affiliation VARCHAR(1024), attributes TEXT, state INTEGER,  max_enrollments INTEGER, level INTEGER DEFAULT 0, incorrect_password_attempts INTEGER DEFAULT 0, locked_until timestamp, created_at timestamp, created_by VARCHAR(255), revocation_reason INTEGER, revoked_at timestamp, attr_count INTEGER, expires_at timestamp, idempotency_key VARCHAR(255), last_enrolled_at timestamp, initial_secret INTEGER DEFAULT 0, serial_number VARCHAR(128), aki VARCHAR(128), previous_serial_number VARCHAR(128), previous_aki VARCHAR(128), ca_name VARCHAR(255) NOT NULL DEFAULT '', secret_expires_at timestamp, is_bootstrap INTEGER DEFAULT 0, UNIQUE (id, ca_name))"); err != nil {
 		return errors.Wrap(err, "Error creating users table")
 	}
 	return nil
@@ -171,7 +223,7 @@ func createSQLiteIdentityTable(tx *sqlx.Tx) error {
 
 func createSQLiteAffiliationTable(tx *sqlx.Tx) error {
 	log.Debug("Creating affiliations table if it does not exist")
-	if _, err := tx.Exec("CREATE TABLE IF NOT EXISTS affiliations (name VARCHAR(1024) NOT NULL UNIQUE, prekey VARCHAR(1024), level INTEGER DEFAULT 0)"); err != nil {
+	if _, err := tx.Exec("CREATE TABLE IF NOT EXISTS affiliations (name VARCHAR(1024) NOT NULL UNIQUE, prekey VARCHAR(1024), level INTEGER DEFAULT 0, attributes TEXT, deleted INTEGER DEFAULT 0, metadata TEXT)"); err != nil {
 		return errors.Wrap(err, "Error creating affiliations table")
 	}
 	return nil
@@ -179,7 +231,7 @@ func createSQLiteAffiliationTable(tx *sqlx.Tx) error {
 
 func createSQLiteCertificateTable(tx *sqlx.Tx) error {
 	log.Debug("Creating certificates table if it does not exist")
-	if _, err := tx.Exec("CREATE TABLE IF NOT EXISTS certificates (id VARCHAR(255), serial_number blob NOT NULL, authority_key_identifier blob NOT NULL, ca_label blob, status blob NOT NULL, reason int, expiry timestamp, revoked_at timestamp, pem blob NOT NULL, level INTEGER DEFAULT 0, PRIMARY KEY(serial_number, authority_key_identifier))"); err != nil {
+	if _, err := tx.Exec("CREATE TABLE IF NOT EXISTS certificates (id VARCHAR(255), serial_number blob NOT NULL, authority_key_identifier blob NOT NULL, ca_label blob, status blob NOT NULL, reason int, expiry timestamp, revoked_at timestamp, pem blob NOT NULL, level INTEGER DEFAULT 0, notified_at timestamp, PRIMARY KEY(serial_number, authority_key_identifier))"); err != nil {
 		return errors.Wrap(err, "Error creating certificates table")
 	}
 	return nil
@@ -209,6 +261,22 @@ func createSQLiteNoncesTable(tx *sqlx.Tx) error {
 	return nil
 }
 
+func createSQLiteEnrollmentEventsTable(tx *sqlx.Tx) error {
+	log.Debug("Creating enrollment_events table if it does not exist")
+	if _, err := tx.Exec("CREATE TABLE IF NOT EXISTS enrollment_events (id VARCHAR(255) NOT NULL, csr_subject TEXT, remote_addr VARCHAR(255), enrolled_at timestamp, ca_name VARCHAR(255) NOT NULL DEFAULT '')"); err != nil {
+		return errors.Wrap(err, "Error creating enrollment_events table")
+	}
+	return nil
+}
+
+func createSQLiteDeletedIdentityTable(tx *sqlx.Tx) error {
+	log.Debug("Creating deleted_users table if it does not exist")
+	if _, err := tx.Exec("CREATE TABLE IF NOT EXISTS deleted_users (id VARCHAR(255) NOT NULL, token bytea, type VARCHAR(256), affiliation VARCHAR(1024), attributes TEXT, state INTEGER,  max_enrollments INTEGER, level INTEGER DEFAULT 0, incorrect_password_attempts INTEGER DEFAULT 0, locked_until timestamp, created_at timestamp, created_by VARCHAR(255), revocation_reason INTEGER, revoked_at timestamp, attr_count INTEGER, expires_at timestamp, idempotency_key VARCHAR(255), last_enrolled_at timestamp, initial_secret INTEGER DEFAULT 0, serial_number VARCHAR(128), aki VARCHAR(128), previous_serial_number VARCHAR(128), previous_aki VARCHAR(128), ca_name VARCHAR(255) NOT NULL DEFAULT '', secret_expires_at timestamp, is_bootstrap INTEGER DEFAULT 0, deleted_at timestamp)"); err != nil {
+		return errors.Wrap(err, "Error creating deleted_users table")
+	}
+	return nil
+}
+
 // NewUserRegistryPostgres opens a connection to a postgres database
 func NewUserRegistryPostgres(datasource string, clientTLSConfig *tls.ClientTLSConfig) (*DB, error) {
 	log.Debugf("Using postgres database, connecting to database...")
@@ -271,7 +339,7 @@ func NewUserRegistryPostgres(datasource string, clientTLSConfig *tls.ClientTLSCo
 		return nil, errors.Wrap(err, "Failed to create Postgres tables")
 	}
 
-	return &DB{db, false}, nil
+	return &DB{DB: db}, nil
 }
 
 func createPostgresDatabase(dbName string, db *sqlx.DB) error {
@@ -291,15 +359,19 @@ func createPostgresDatabase(dbName string, db *sqlx.DB) error {
 // createPostgresDB creates postgres database
 func createPostgresTables(dbName string, db *sqlx.DB) error {
 	log.Debug("Creating users table if it does not exist")
-	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS users (id VARCHAR(255), token bytea, type VARCHAR(256), affiliation VARCHAR(1024), attributes TEXT, state INTEGER,  max_enrollments INTEGER, level INTEGER DEFAULT 0)"); err != nil {
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS users (id VARCHAR(255) NOT NULL, token bytea, type VARCHAR(256), affiliation VARCHAR(1024), attributes JSONB, state INTEGER,  max_enrollments INTEGER, level INTEGER DEFAULT 0, incorrect_password_attempts INTEGER DEFAULT 0, locked_until timestamp, created_at timestamp, created_by VARCHAR(255), revocation_reason INTEGER, revoked_at timestamp, attr_count INTEGER, expires_at timestamp, idempotency_key VARCHAR(255), last_enrolled_at timestamp, initial_secret INTEGER DEFAULT 0, serial_number VARCHAR(128), aki VARCHAR(128), previous_serial_number VARCHAR(128), previous_aki VARCHAR(128), ca_name VARCHAR(255) NOT NULL DEFAULT '', secret_expires_at timestamp, is_bootstrap INTEGER DEFAULT 0, UNIQUE (id, ca_name))"); err != nil {
 		return errors.Wrap(err, "Error creating users table")
 	}
+	log.Debug("Creating index on 'attributes' in the users table")
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS users_attributes_index ON users USING GIN (attributes)"); err != nil {
+		return errors.Wrap(err, "Error creating index on users table")
+	}
 	log.Debug("Creating affiliations table if it does not exist")
-	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS affiliations (name VARCHAR(1024) NOT NULL UNIQUE, prekey VARCHAR(1024), level INTEGER DEFAULT 0)"); err != nil {
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS affiliations (name VARCHAR(1024) NOT NULL UNIQUE, prekey VARCHAR(1024), level INTEGER DEFAULT 0, attributes TEXT, deleted INTEGER DEFAULT 0, metadata TEXT)"); err != nil {
 		return errors.Wrap(err, "Error creating affiliations table")
 	}
 	log.Debug("Creating certificates table if it does not exist")
-	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS certificates (id VARCHAR(255), serial_number bytea NOT NULL, authority_key_identifier bytea NOT NULL, ca_label bytea, status bytea NOT NULL, reason int, expiry timestamp, revoked_at timestamp, pem bytea NOT NULL, level INTEGER DEFAULT 0, PRIMARY KEY(serial_number, authority_key_identifier))"); err != nil {
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS certificates (id VARCHAR(255), serial_number bytea NOT NULL, authority_key_identifier bytea NOT NULL, ca_label bytea, status bytea NOT NULL, reason int, expiry timestamp, revoked_at timestamp, pem bytea NOT NULL, level INTEGER DEFAULT 0, notified_at timestamp, PRIMARY KEY(serial_number, authority_key_identifier))"); err != nil {
 		return errors.Wrap(err, "Error creating certificates table")
 	}
 	log.Debug("Creating credentials table if it does not exist")
@@ -314,6 +386,14 @@ func createPostgresTables(dbName string, db *sqlx.DB) error {
 	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS nonces (val VARCHAR(255) NOT NULL UNIQUE, expiry timestamp, level INTEGER DEFAULT 0, PRIMARY KEY (val))"); err != nil {
 		return errors.Wrap(err, "Error creating nonces table")
 	}
+	log.Debug("Creating enrollment_events table if it does not exist")
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS enrollment_events (id VARCHAR(255) NOT NULL, csr_subject TEXT, remote_addr VARCHAR(255), enrolled_at timestamp, ca_name VARCHAR(255) NOT NULL DEFAULT '')"); err != nil {
+		return errors.Wrap(err, "Error creating enrollment_events table")
+	}
+	log.Debug("Creating deleted_users table if it does not exist")
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS deleted_users (id VARCHAR(255) NOT NULL, token bytea, type VARCHAR(256), affiliation VARCHAR(1024), attributes JSONB, state INTEGER,  max_enrollments INTEGER, level INTEGER DEFAULT 0, incorrect_password_attempts INTEGER DEFAULT 0, locked_until timestamp, created_at timestamp, created_by VARCHAR(255), revocation_reason INTEGER, revoked_at timestamp, attr_count INTEGER, expires_at timestamp, idempotency_key VARCHAR(255), last_enrolled_at timestamp, initial_secret INTEGER DEFAULT 0, serial_number VARCHAR(128), aki VARCHAR(128), previous_serial_number VARCHAR(128), previous_aki VARCHAR(128), ca_name VARCHAR(255) NOT NULL DEFAULT '', secret_expires_at timestamp, is_bootstrap INTEGER DEFAULT 0, deleted_at timestamp)"); err != nil {
+		return errors.Wrap(err, "Error creating deleted_users table")
+	}
 	log.Debug("Creating properties table if it does not exist")
 	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS properties (property VARCHAR(255), value VARCHAR(256), PRIMARY KEY(property))"); err != nil {
 		return errors.Wrap(err, "Error creating properties table")
@@ -373,7 +453,7 @@ func NewUserRegistryMySQL(datasource string, clientTLSConfig *tls.ClientTLSConfi
 		return nil, errors.Wrap(err, "Failed to create MySQL tables")
 	}
 
-	return &DB{db, false}, nil
+	return &DB{DB: db}, nil
 }
 
 func createMySQLDatabase(dbName string, db *sqlx.DB) error {
@@ -389,11 +469,11 @@ func createMySQLDatabase(dbName string, db *sqlx.DB) error {
 
 func createMySQLTables(dbName string, db *sqlx.DB) error {
 	log.Debug("Creating users table if it doesn't exist")
-	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS users (id VARCHAR(255) NOT NULL, token blob, type VARCHAR(256), affiliation VARCHAR(1024), attributes TEXT, state INTEGER, max_enrollments INTEGER, level INTEGER DEFAULT 0, PRIMARY KEY (id)) DEFAULT CHARSET=utf8 COLLATE utf8_bin"); err != nil {
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS users (id VARCHAR(255) NOT NULL, token blob, type VARCHAR(256), affiliation VARCHAR(1024), attributes TEXT, state INTEGER, max_enrollments INTEGER, level INTEGER DEFAULT 0, incorrect_password_attempts INTEGER DEFAULT 0, locked_until timestamp NULL, created_at timestamp NULL, created_by VARCHAR(255), revocation_reason INTEGER, revoked_at timestamp NULL, attr_count INTEGER, expires_at timestamp NULL, idempotency_key VARCHAR(255), last_enrolled_at timestamp NULL, initial_secret INTEGER DEFAULT 0, serial_number VARCHAR(128), aki VARCHAR(128), previous_serial_number VARCHAR(128), previous_aki VARCHAR(128), ca_name VARCHAR(255) NOT NULL DEFAULT '', secret_expires_at timestamp NULL, is_bootstrap INTEGER DEFAULT 0, PRIMARY KEY (id, ca_name)) DEFAULT CHARSET=utf8 COLLATE utf8_bin"); err != nil {
 		return errors.Wrap(err, "Error creating users table")
 	}
 	log.Debug("Creating affiliations table if it doesn't exist")
-	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS affiliations (id INT NOT NULL AUTO_INCREMENT, name VARCHAR(1024) NOT NULL, prekey VARCHAR(1024), level INTEGER DEFAULT 0, PRIMARY KEY (id))"); err != nil {
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS affiliations (id INT NOT NULL AUTO_INCREMENT, name VARCHAR(1024) NOT NULL, prekey VARCHAR(1024), level INTEGER DEFAULT 0, attributes TEXT, deleted INTEGER DEFAULT 0, metadata TEXT, PRIMARY KEY (id))"); err != nil {
 		return errors.Wrap(err, "Error creating affiliations table")
 	}
 	log.Debug("Creating index on 'name' in the affiliations table")
@@ -403,7 +483,7 @@ func createMySQLTables(dbName string, db *sqlx.DB) error {
 		}
 	}
 	log.Debug("Creating certificates table if it doesn't exist")
-	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS certificates (id VARCHAR(255), serial_number varbinary(128) NOT NULL, authority_key_identifier varbinary(128) NOT NULL, ca_label varbinary(128), status varbinary(128) NOT NULL, reason int, expiry timestamp DEFAULT 0, revoked_at timestamp DEFAULT 0, pem varbinary(4096) NOT NULL, level INTEGER DEFAULT 0, PRIMARY KEY(serial_number, authority_key_identifier)) DEFAULT CHARSET=utf8 COLLATE utf8_bin"); err != nil {
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS certificates (id VARCHAR(255), serial_number varbinary(128) NOT NULL, authority_key_identifier varbinary(128) NOT NULL, ca_label varbinary(128), status varbinary(128) NOT NULL, reason int, expiry timestamp DEFAULT 0, revoked_at timestamp DEFAULT 0, pem varbinary(4096) NOT NULL, level INTEGER DEFAULT 0, notified_at timestamp NULL, PRIMARY KEY(serial_number, authority_key_identifier)) DEFAULT CHARSET=utf8 COLLATE utf8_bin"); err != nil {
 		return errors.Wrap(err, "Error creating certificates table")
 	}
 	log.Debug("Creating credentials table if it doesn't exist")
@@ -418,6 +498,14 @@ func createMySQLTables(dbName string, db *sqlx.DB) error {
 	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS nonces (val VARCHAR(255) NOT NULL, expiry timestamp, level INTEGER DEFAULT 0, PRIMARY KEY (val))"); err != nil {
 		return errors.Wrap(err, "Error creating nonces table")
 	}
+	log.Debug("Creating enrollment_events table if it does not exist")
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS enrollment_events (id VARCHAR(255) NOT NULL, csr_subject TEXT, remote_addr VARCHAR(255), enrolled_at timestamp NULL, ca_name VARCHAR(255) NOT NULL DEFAULT '') DEFAULT CHARSET=utf8 COLLATE utf8_bin"); err != nil {
+		return errors.Wrap(err, "Error creating enrollment_events table")
+	}
+	log.Debug("Creating deleted_users table if it does not exist")
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS deleted_users (id VARCHAR(255) NOT NULL, token blob, type VARCHAR(256), affiliation VARCHAR(1024), attributes TEXT, state INTEGER, max_enrollments INTEGER, level INTEGER DEFAULT 0, incorrect_password_attempts INTEGER DEFAULT 0, locked_until timestamp NULL, created_at timestamp NULL, created_by VARCHAR(255), revocation_reason INTEGER, revoked_at timestamp NULL, attr_count INTEGER, expires_at timestamp NULL, idempotency_key VARCHAR(255), last_enrolled_at timestamp NULL, initial_secret INTEGER DEFAULT 0, serial_number VARCHAR(128), aki VARCHAR(128), previous_serial_number VARCHAR(128), previous_aki VARCHAR(128), ca_name VARCHAR(255) NOT NULL DEFAULT '', secret_expires_at timestamp NULL, is_bootstrap INTEGER DEFAULT 0, deleted_at timestamp NULL) DEFAULT CHARSET=utf8 COLLATE utf8_bin"); err != nil {
+		return errors.Wrap(err, "Error creating deleted_users table")
+	}
 	log.Debug("Creating properties table if it does not exist")
 	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS properties (property VARCHAR(255), value VARCHAR(256), PRIMARY KEY(property))"); err != nil {
 		return errors.Wrap(err, "Error creating properties table")
@@ -612,9 +700,211 @@ func updateSQLiteSchema(db *DB, serverLevels *Levels) error {
 		}
 	}
 
+	return addSQLiteColumns(db)
+}
+
+// addSQLiteColumns adds any columns that are missing from tables that were
+// created by an earlier version of the server. SQLite supports adding a column
+// to an existing table, so these do not require a table rebuild.
+func addSQLiteColumns(db *DB) error {
+	_, err := db.Exec("ALTER TABLE affiliations ADD COLUMN attributes TEXT")
+	if err != nil {
+		if !strings.Contains(err.Error(), "duplicate column name") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN incorrect_password_attempts INTEGER DEFAULT 0")
+	if err != nil {
+		if !strings.Contains(err.Error(), "duplicate column name") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN locked_until timestamp")
+	if err != nil {
+		if !strings.Contains(err.Error(), "duplicate column name") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN created_at timestamp")
+	if err != nil {
+		if !strings.Contains(err.Error(), "duplicate column name") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN created_by VARCHAR(255)")
+	if err != nil {
+		if !strings.Contains(err.Error(), "duplicate column name") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE affiliations ADD COLUMN deleted INTEGER DEFAULT 0")
+	if err != nil {
+		if !strings.Contains(err.Error(), "duplicate column name") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN revocation_reason INTEGER")
+	if err != nil {
+		if !strings.Contains(err.Error(), "duplicate column name") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN revoked_at timestamp")
+	if err != nil {
+		if !strings.Contains(err.Error(), "duplicate column name") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN attr_count INTEGER")
+	if err != nil {
+		if !strings.Contains(err.Error(), "duplicate column name") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN expires_at timestamp")
+	if err != nil {
+		if !strings.Contains(err.Error(), "duplicate column name") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN idempotency_key VARCHAR(255)")
+	if err != nil {
+		if !strings.Contains(err.Error(), "duplicate column name") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE affiliations ADD COLUMN metadata TEXT")
+	if err != nil {
+		if !strings.Contains(err.Error(), "duplicate column name") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN last_enrolled_at timestamp")
+	if err != nil {
+		if !strings.Contains(err.Error(), "duplicate column name") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN initial_secret INTEGER DEFAULT 0")
+	if err != nil {
+		if !strings.Contains(err.Error(), "duplicate column name") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN serial_number VARCHAR(128)")
+	if err != nil {
+		if !strings.Contains(err.Error(), "duplicate column name") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN aki VARCHAR(128)")
+	if err != nil {
+		if !strings.Contains(err.Error(), "duplicate column name") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN previous_serial_number VARCHAR(128)")
+	if err != nil {
+		if !strings.Contains(err.Error(), "duplicate column name") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN previous_aki VARCHAR(128)")
+	if err != nil {
+		if !strings.Contains(err.Error(), "duplicate column name") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE certificates ADD COLUMN notified_at timestamp")
+	if err != nil {
+		if !strings.Contains(err.Error(), "duplicate column name") { // Already using the latest schema
+			return err
+		}
+	}
+	hasCAName, err := sqliteColumnExists(db, "users", "ca_name")
+	if err != nil {
+		return err
+	}
+	if !hasCAName {
+		// Identities are now unique per CA rather than by id alone
+		err = doTransaction(db, rekeyIdentitiesTable)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE enrollment_events ADD COLUMN ca_name VARCHAR(255) NOT NULL DEFAULT ''")
+	if err != nil {
+		if !strings.Contains(err.Error(), "duplicate column name") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN secret_expires_at timestamp")
+	if err != nil {
+		if !strings.Contains(err.Error(), "duplicate column name") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN is_bootstrap INTEGER DEFAULT 0")
+	if err != nil {
+		if !strings.Contains(err.Error(), "duplicate column name") { // Already using the latest schema
+			return err
+		}
+	}
 	return nil
 }
 
+// sqliteColumnExists returns true if table has a column named column
+func sqliteColumnExists(db *DB, table, column string) (bool, error) {
+	rows, err := db.Queryx(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, errors.Wrapf(err, "Failed to get columns of table '%s'", table)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		info := map[string]interface{}{}
+		err = rows.MapScan(info)
+		if err != nil {
+			return false, errors.Wrapf(err, "Failed to get columns of table '%s'", table)
+		}
+		if name, ok := info["name"].(string); ok && name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// rekeyIdentitiesTable recreates the users table with the ca_name column so
+// that identities are unique by id and CA name, since SQLite can not change
+// the UNIQUE constraint of an existing table. The users table used to allow
+// several identities with the same id, which the new table can not hold, so
+// it fails if there are any.
+func rekeyIdentitiesTable(tx *sqlx.Tx, args ...interface{}) error {
+	var duplicates []string
+	err := tx.Select(&duplicates, "SELECT id FROM users GROUP BY id HAVING COUNT(*) > 1 ORDER BY id")
+	if err != nil {
+		return errors.Wrap(err, "Failed to check for identities with the same id")
+	}
+	if len(duplicates) > 0 {
+		return errors.Errorf("Identities must have unique ids, but the users table has several identities with the ids %s; remove the duplicates to upgrade the database", strings.Join(duplicates, ", "))
+	}
+
+	_, err = tx.Exec("ALTER TABLE users RENAME TO users_old")
+	if err != nil {
+		return err
+	}
+	err = createSQLiteIdentityTable(tx)
+	if err != nil {
+		return err
+	}
+	columns := "id, token, type, affiliation, attributes, state, max_enrollments, level, incorrect_password_attempts, locked_until, created_at, created_by, revocation_reason, revoked_at, attr_count, expires_at, idempotency_key, last_enrolled_at, initial_secret, serial_number, aki, previous_serial_number, previous_aki"
+	_, err = tx.Exec(fmt.Sprintf("INSERT INTO users (%s) SELECT %s FROM users_old", columns, columns))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DROP TABLE users_old")
+	return err
+}
+
 // SQLite has limited support for altering table columns, to upgrade the schema we
 // require renaming the current users table to users_old and then creating a new user table using
 // the new schema definition. Next, we proceed to copy the data from the old table to
@@ -744,6 +1034,12 @@ func updateMySQLSchema(db *DB) error {
 			return err
 		}
 	}
+	_, err = db.Exec("ALTER TABLE affiliations ADD COLUMN attributes TEXT AFTER level")
+	if err != nil {
+		if !strings.Contains(err.Error(), "1060") { // Already using the latest schema
+			return err
+		}
+	}
 	_, err = db.Exec("ALTER TABLE affiliations MODIFY name VARCHAR(1024), MODIFY prekey VARCHAR(1024)")
 	if err != nil {
 		return err
@@ -758,10 +1054,171 @@ func updateMySQLSchema(db *DB) error {
 	if err != nil {
 		return err
 	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN incorrect_password_attempts INTEGER DEFAULT 0")
+	if err != nil {
+		if !strings.Contains(err.Error(), "1060") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN locked_until timestamp NULL")
+	if err != nil {
+		if !strings.Contains(err.Error(), "1060") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN created_at timestamp NULL")
+	if err != nil {
+		if !strings.Contains(err.Error(), "1060") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN created_by VARCHAR(255)")
+	if err != nil {
+		if !strings.Contains(err.Error(), "1060") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE affiliations ADD COLUMN deleted INTEGER DEFAULT 0")
+	if err != nil {
+		if !strings.Contains(err.Error(), "1060") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN revocation_reason INTEGER")
+	if err != nil {
+		if !strings.Contains(err.Error(), "1060") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN revoked_at timestamp NULL")
+	if err != nil {
+		if !strings.Contains(err.Error(), "1060") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN attr_count INTEGER")
+	if err != nil {
+		if !strings.Contains(err.Error(), "1060") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN expires_at timestamp NULL")
+	if err != nil {
+		if !strings.Contains(err.Error(), "1060") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN idempotency_key VARCHAR(255)")
+	if err != nil {
+		if !strings.Contains(err.Error(), "1060") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE affiliations ADD COLUMN metadata TEXT")
+	if err != nil {
+		if !strings.Contains(err.Error(), "1060") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN last_enrolled_at timestamp NULL")
+	if err != nil {
+		if !strings.Contains(err.Error(), "1060") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN initial_secret INTEGER DEFAULT 0")
+	if err != nil {
+		if !strings.Contains(err.Error(), "1060") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN serial_number VARCHAR(128)")
+	if err != nil {
+		if !strings.Contains(err.Error(), "1060") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN aki VARCHAR(128)")
+	if err != nil {
+		if !strings.Contains(err.Error(), "1060") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN previous_serial_number VARCHAR(128)")
+	if err != nil {
+		if !strings.Contains(err.Error(), "1060") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN previous_aki VARCHAR(128)")
+	if err != nil {
+		if !strings.Contains(err.Error(), "1060") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE certificates ADD COLUMN notified_at timestamp NULL")
+	if err != nil {
+		if !strings.Contains(err.Error(), "1060") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN ca_name VARCHAR(255) NOT NULL DEFAULT ''")
+	if err != nil {
+		if !strings.Contains(err.Error(), "1060") { // Already using the latest schema
+			return err
+		}
+	} else {
+		// Identities are now unique per CA rather than by id alone
+		_, err = db.Exec("ALTER TABLE users DROP PRIMARY KEY, ADD PRIMARY KEY (id, ca_name)")
+		if err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN secret_expires_at timestamp NULL")
+	if err != nil {
+		if !strings.Contains(err.Error(), "1060") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN is_bootstrap INTEGER DEFAULT 0")
+	if err != nil {
+		if !strings.Contains(err.Error(), "1060") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE enrollment_events ADD COLUMN ca_name VARCHAR(255) NOT NULL DEFAULT ''")
+	if err != nil {
+		if !strings.Contains(err.Error(), "1060") { // Already using the latest schema
+			return err
+		}
+	}
 
 	return nil
 }
 
+// replaceInvalidAttributes replaces the attributes of identities that are not
+// valid JSON, such as the empty values that could be stored while the column
+// was of type TEXT, with an empty list, so that the column can be converted
+// to JSONB
+func replaceInvalidAttributes(db *DB) error {
+	var values []string
+	err := db.Select(&values, "SELECT DISTINCT attributes FROM users WHERE (attributes IS NOT NULL)")
+	if err != nil {
+		return errors.Wrap(err, "Failed to get attributes of identities")
+	}
+	for _, value := range values {
+		if json.Valid([]byte(value)) {
+			continue
+		}
+		log.Warningf("Replacing attributes of identities that are not valid JSON: '%s'", value)
+		_, err = db.Exec(Rebind(db.Dialect(), "UPDATE users SET attributes = '[]' WHERE (attributes = ?)"), value)
+		if err != nil {
+			return errors.Wrap(err, "Failed to replace attributes that are not valid JSON")
+		}
+	}
+	return nil
+}
+
 func updatePostgresSchema(db *DB) error {
 	log.Debug("Update Postgres schema if using outdated schema")
 	var err error
@@ -770,7 +1227,23 @@ func updatePostgresSchema(db *DB) error {
 	if err != nil {
 		return err
 	}
-	_, err = db.Exec("ALTER TABLE users ALTER COLUMN attributes TYPE TEXT")
+	// Attributes are stored as JSONB so that they can be indexed and queried
+	var attributesType string
+	err = db.Get(&attributesType, "SELECT data_type FROM information_schema.columns WHERE (table_name = 'users') AND (column_name = 'attributes')")
+	if err != nil {
+		return errors.Wrap(err, "Failed to get type of column 'attributes' of table 'users'")
+	}
+	if attributesType != "jsonb" {
+		err = replaceInvalidAttributes(db)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec("ALTER TABLE users ALTER COLUMN attributes TYPE JSONB USING attributes::JSONB")
+		if err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS users_attributes_index ON users USING GIN (attributes)")
 	if err != nil {
 		return err
 	}
@@ -792,6 +1265,12 @@ func updatePostgresSchema(db *DB) error {
 			return err
 		}
 	}
+	_, err = db.Exec("ALTER TABLE affiliations ADD COLUMN attributes TEXT")
+	if err != nil {
+		if !strings.Contains(err.Error(), "already exists") {
+			return err
+		}
+	}
 	_, err = db.Exec("ALTER TABLE affiliations ALTER COLUMN name TYPE VARCHAR(1024), ALTER COLUMN prekey TYPE VARCHAR(1024)")
 	if err != nil {
 		return err
@@ -800,6 +1279,148 @@ func updatePostgresSchema(db *DB) error {
 	if err != nil {
 		return err
 	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN incorrect_password_attempts INTEGER DEFAULT 0")
+	if err != nil {
+		if !strings.Contains(err.Error(), "already exists") {
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN locked_until timestamp")
+	if err != nil {
+		if !strings.Contains(err.Error(), "already exists") {
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN created_at timestamp")
+	if err != nil {
+		if !strings.Contains(err.Error(), "already exists") {
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN created_by VARCHAR(255)")
+	if err != nil {
+		if !strings.Contains(err.Error(), "already exists") {
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE affiliations ADD COLUMN deleted INTEGER DEFAULT 0")
+	if err != nil {
+		if !strings.Contains(err.Error(), "already exists") {
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN revocation_reason INTEGER")
+	if err != nil {
+		if !strings.Contains(err.Error(), "already exists") {
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN revoked_at timestamp")
+	if err != nil {
+		if !strings.Contains(err.Error(), "already exists") {
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN attr_count INTEGER")
+	if err != nil {
+		if !strings.Contains(err.Error(), "already exists") {
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN expires_at timestamp")
+	if err != nil {
+		if !strings.Contains(err.Error(), "already exists") {
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN idempotency_key VARCHAR(255)")
+	if err != nil {
+		if !strings.Contains(err.Error(), "already exists") {
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE affiliations ADD COLUMN metadata TEXT")
+	if err != nil {
+		if !strings.Contains(err.Error(), "already exists") {
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN last_enrolled_at timestamp")
+	if err != nil {
+		if !strings.Contains(err.Error(), "already exists") {
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN initial_secret INTEGER DEFAULT 0")
+	if err != nil {
+		if !strings.Contains(err.Error(), "already exists") {
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN serial_number VARCHAR(128)")
+	if err != nil {
+		if !strings.Contains(err.Error(), "already exists") {
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN aki VARCHAR(128)")
+	if err != nil {
+		if !strings.Contains(err.Error(), "already exists") {
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN previous_serial_number VARCHAR(128)")
+	if err != nil {
+		if !strings.Contains(err.Error(), "already exists") {
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN previous_aki VARCHAR(128)")
+	if err != nil {
+		if !strings.Contains(err.Error(), "already exists") {
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE certificates ADD COLUMN notified_at timestamp")
+	if err != nil {
+		if !strings.Contains(err.Error(), "already exists") {
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN ca_name VARCHAR(255) NOT NULL DEFAULT ''")
+	if err != nil {
+		if !strings.Contains(err.Error(), "already exists") {
+			return err
+		}
+	} else {
+		// Identities are now unique per CA rather than by id alone
+		_, err = db.Exec("ALTER TABLE users DROP CONSTRAINT IF EXISTS users_id_key")
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec("ALTER TABLE users ADD CONSTRAINT users_id_ca_name_key UNIQUE (id, ca_name)")
+		if err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN secret_expires_at timestamp")
+	if err != nil {
+		if !strings.Contains(err.Error(), "already exists") {
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN is_bootstrap INTEGER DEFAULT 0")
+	if err != nil {
+		if !strings.Contains(err.Error(), "already exists") {
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE enrollment_events ADD COLUMN ca_name VARCHAR(255) NOT NULL DEFAULT ''")
+	if err != nil {
+		if !strings.Contains(err.Error(), "already exists") {
+			return err
+		}
+	}
 
 	return nil
 }
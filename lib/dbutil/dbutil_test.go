@@ -0,0 +1,96 @@
+// +build !caclient
+
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dbutil
+
+import (
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplaceInvalidAttributes(t *testing.T) {
+	sqlxDB, err := sqlx.Open("sqlite3", ":memory:")
+	if !assert.NoError(t, err, "Failed to open DB") {
+		return
+	}
+	defer sqlxDB.Close()
+	// Each connection to an in-memory database has its own database
+	sqlxDB.SetMaxOpenConns(1)
+	db := &DB{DB: sqlxDB}
+
+	// Attributes as they could be stored while the column was of type TEXT
+	_, err = db.Exec("CREATE TABLE users (id VARCHAR(255), attributes TEXT)")
+	assert.NoError(t, err, "Failed to create users table")
+	_, err = db.Exec(`INSERT INTO users (id, attributes) VALUES ('empty', ''), ('malformed', '[{"name":'), ('valid', '[{"name":"a","value":"b"}]'), ('none', NULL)`)
+	assert.NoError(t, err, "Failed to insert users")
+
+	err = replaceInvalidAttributes(db)
+	assert.NoError(t, err, "Failed to replace invalid attributes")
+
+	var users []struct {
+		ID         string  `db:"id"`
+		Attributes *string `db:"attributes"`
+	}
+	err = db.Select(&users, "SELECT id, attributes FROM users ORDER BY id")
+	if assert.NoError(t, err, "Failed to get users") && assert.Len(t, users, 4) {
+		assert.Equal(t, "[]", *users[0].Attributes, "Empty attributes should have been replaced")
+		assert.Equal(t, "[]", *users[1].Attributes, "Malformed attributes should have been replaced")
+		assert.Nil(t, users[2].Attributes, "Missing attributes should have been kept")
+		assert.Equal(t, `[{"name":"a","value":"b"}]`, *users[3].Attributes, "Valid attributes should have been kept")
+	}
+}
+
+func TestRekeyIdentitiesTable(t *testing.T) {
+	openOldDB := func(ids ...string) *DB {
+		sqlxDB, err := sqlx.Open("sqlite3", ":memory:")
+		if !assert.NoError(t, err, "Failed to open DB") {
+			return nil
+		}
+		sqlxDB.SetMaxOpenConns(1)
+		db := &DB{DB: sqlxDB}
+		// The users table before identities were scoped by CA, which did
+		// not require ids to be unique
+		_, err = db.Exec("CREATE TABLE users (id VARCHAR(255), token bytea, type VARCHAR(256), affiliation VARCHAR(1024), attributes TEXT, state INTEGER, max_enrollments INTEGER, level INTEGER DEFAULT 0, incorrect_password_attempts INTEGER DEFAULT 0, locked_until timestamp, created_at timestamp, created_by VARCHAR(255), revocation_reason INTEGER, revoked_at timestamp, attr_count INTEGER, expires_at timestamp, idempotency_key VARCHAR(255), last_enrolled_at timestamp, initial_secret INTEGER DEFAULT 0, serial_number VARCHAR(128), aki VARCHAR(128), previous_serial_number VARCHAR(128), previous_aki VARCHAR(128))")
+		assert.NoError(t, err, "Failed to create users table")
+		for _, id := range ids {
+			_, err = db.Exec("INSERT INTO users (id, type) VALUES (?, 'client')", id)
+			assert.NoError(t, err, "Failed to insert user %s", id)
+		}
+		return db
+	}
+
+	db := openOldDB("user1", "user2")
+	if db == nil {
+		return
+	}
+	defer db.Close()
+	err := doTransaction(db, rekeyIdentitiesTable)
+	assert.NoError(t, err, "Failed to rekey users table")
+	var caNames []string
+	err = db.Select(&caNames, "SELECT ca_name FROM users ORDER BY id")
+	assert.NoError(t, err, "Failed to get CA names of users")
+	assert.Equal(t, []string{"", ""}, caNames, "Users should have been copied with the default CA name")
+	_, err = db.Exec("INSERT INTO users (id, ca_name) VALUES ('user1', '')")
+	assert.Error(t, err, "Inserting a duplicate identity of the same CA should have failed")
+
+	dupDB := openOldDB("user1", "dup", "dup")
+	if dupDB == nil {
+		return
+	}
+	defer dupDB.Close()
+	err = doTransaction(dupDB, rekeyIdentitiesTable)
+	if assert.Error(t, err, "Rekeying a users table with duplicate ids should have failed") {
+		assert.Contains(t, err.Error(), "dup")
+	}
+	var count int
+	err = dupDB.Get(&count, "SELECT COUNT(*) FROM users")
+	assert.NoError(t, err, "The users table should have been left as it was")
+	assert.Equal(t, 3, count)
+}
@@ -0,0 +1,127 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dbutil
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Dialect describes the SQL syntax that differs between the supported
+// databases
+type Dialect interface {
+	// Placeholder returns the placeholder of the n'th parameter of a query,
+	// starting from 1
+	Placeholder(n int) string
+	// SupportsReturning returns true if INSERT, UPDATE, and DELETE statements
+	// can return columns of the affected rows with a RETURNING clause
+	SupportsReturning() bool
+	// UpsertClause returns the clause to append to an INSERT statement so
+	// that a row conflicting on conflictColumns is updated with the inserted
+	// values of updateColumns instead. It returns an empty string if the
+	// database has no such clause.
+	UpsertClause(conflictColumns, updateColumns []string) string
+}
+
+// GetDialect returns the dialect of the database driver driverName. Drivers
+// other than postgres and mysql use the SQLite dialect.
+func GetDialect(driverName string) Dialect {
+	switch driverName {
+	case "postgres":
+		return postgresDialect{}
+	case "mysql":
+		return mysqlDialect{}
+	default:
+		return sqliteDialect{}
+	}
+}
+
+// Dialect returns the dialect of the database
+func (db *DB) Dialect() Dialect {
+	return GetDialect(db.DriverName())
+}
+
+// Rebind replaces each '?' in query with the placeholder of dialect for that
+// parameter
+func Rebind(dialect Dialect, query string) string {
+	if !strings.Contains(query, "?") {
+		return query
+	}
+	var rebound strings.Builder
+	n := 0
+	for _, c := range query {
+		if c != '?' {
+			rebound.WriteRune(c)
+			continue
+		}
+		n++
+		rebound.WriteString(dialect.Placeholder(n))
+	}
+	return rebound.String()
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Placeholder(n int) string {
+	return "?"
+}
+
+// SupportsReturning returns false as RETURNING requires SQLite 3.35
+func (sqliteDialect) SupportsReturning() bool {
+	return false
+}
+
+// UpsertClause returns an empty string as ON CONFLICT ... DO UPDATE requires
+// SQLite 3.24
+func (sqliteDialect) UpsertClause(conflictColumns, updateColumns []string) string {
+	return ""
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) Placeholder(n int) string {
+	return fmt.Sprintf("$%d", n)
+}
+
+func (postgresDialect) SupportsReturning() bool {
+	return true
+}
+
+func (postgresDialect) UpsertClause(conflictColumns, updateColumns []string) string {
+	updates := make([]string, len(updateColumns))
+	for i, column := range updateColumns {
+		updates[i] = fmt.Sprintf("%s = EXCLUDED.%s", column, column)
+	}
+	if len(updates) == 0 {
+		return fmt.Sprintf("ON CONFLICT (%s) DO NOTHING", strings.Join(conflictColumns, ", "))
+	}
+	return fmt.Sprintf("ON CONFLICT (%s) DO UPDATE SET %s", strings.Join(conflictColumns, ", "), strings.Join(updates, ", "))
+}
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) Placeholder(n int) string {
+	return "?"
+}
+
+func (mysqlDialect) SupportsReturning() bool {
+	return false
+}
+
+// UpsertClause only uses conflictColumns when there are no columns to
+// update, as MySQL updates the row conflicting on any unique key
+func (mysqlDialect) UpsertClause(conflictColumns, updateColumns []string) string {
+	if len(updateColumns) == 0 && len(conflictColumns) > 0 {
+		// Setting a column to itself leaves the conflicting row unchanged
+		return fmt.Sprintf("ON DUPLICATE KEY UPDATE %s = %s", conflictColumns[0], conflictColumns[0])
+	}
+	updates := make([]string, len(updateColumns))
+	for i, column := range updateColumns {
+		updates[i] = fmt.Sprintf("%s = VALUES(%s)", column, column)
+	}
+	return "ON DUPLICATE KEY UPDATE " + strings.Join(updates, ", ")
+}
@@ -0,0 +1,44 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dbutil
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSQLiteDialect(t *testing.T) {
+	dialect := GetDialect("sqlite3")
+	assert.Equal(t, "?", dialect.Placeholder(1))
+	assert.Equal(t, "?", dialect.Placeholder(2))
+	assert.False(t, dialect.SupportsReturning(), "SQLite dialect should not support RETURNING")
+	assert.Equal(t, "", dialect.UpsertClause([]string{"id"}, []string{"token"}))
+	assert.Equal(t, "SELECT * FROM users WHERE (id = ?) AND (ca_name = ?)", Rebind(dialect, "SELECT * FROM users WHERE (id = ?) AND (ca_name = ?)"))
+
+	assert.Equal(t, dialect, GetDialect("unknown"), "Unknown drivers should use the SQLite dialect")
+}
+
+func TestPostgresDialect(t *testing.T) {
+	dialect := GetDialect("postgres")
+	assert.Equal(t, "$1", dialect.Placeholder(1))
+	assert.Equal(t, "$12", dialect.Placeholder(12))
+	assert.True(t, dialect.SupportsReturning(), "Postgres dialect should support RETURNING")
+	assert.Equal(t, "ON CONFLICT (id, ca_name) DO UPDATE SET token = EXCLUDED.token, state = EXCLUDED.state",
+		dialect.UpsertClause([]string{"id", "ca_name"}, []string{"token", "state"}))
+	assert.Equal(t, "ON CONFLICT (name) DO NOTHING", dialect.UpsertClause([]string{"name"}, nil))
+	assert.Equal(t, "SELECT * FROM users WHERE (id = $1) AND (ca_name = $2)", Rebind(dialect, "SELECT * FROM users WHERE (id = ?) AND (ca_name = ?)"))
+	assert.Equal(t, "SELECT COUNT(*) FROM users", Rebind(dialect, "SELECT COUNT(*) FROM users"))
+}
+
+func TestMySQLDialect(t *testing.T) {
+	dialect := GetDialect("mysql")
+	assert.Equal(t, "?", dialect.Placeholder(3))
+	assert.False(t, dialect.SupportsReturning(), "MySQL dialect should not support RETURNING")
+	assert.Equal(t, "ON DUPLICATE KEY UPDATE token = VALUES(token)", dialect.UpsertClause([]string{"id"}, []string{"token"}))
+	assert.Equal(t, "ON DUPLICATE KEY UPDATE name = name", dialect.UpsertClause([]string{"name"}, nil))
+}
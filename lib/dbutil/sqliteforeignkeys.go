@@ -0,0 +1,24 @@
+// +build !caclient
+
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dbutil
+
+import (
+	"database/sql"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	sql.Register(sqliteForeignKeysDriver, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			_, err := conn.Exec("PRAGMA foreign_keys = ON", nil)
+			return err
+		},
+	})
+}
@@ -0,0 +1,275 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// jsonPatchOp is a single operation of an RFC 6902 JSON Patch
+type jsonPatchOp struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// jsonRoot is the container passed to update functions when the whole
+// document is being updated
+type jsonRoot struct{}
+
+// applyJSONPatch applies the RFC 6902 JSON Patch in patch to the JSON
+// document doc and returns the resulting document
+func applyJSONPatch(doc, patch []byte) ([]byte, error) {
+	var ops []jsonPatchOp
+	err := json.Unmarshal(patch, &ops)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse JSON patch")
+	}
+
+	var node interface{}
+	err = json.Unmarshal(doc, &node)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse JSON document")
+	}
+
+	for i, op := range ops {
+		node, err = applyJSONPatchOp(node, op)
+		if err != nil {
+			return nil, errors.WithMessage(err, fmt.Sprintf("Failed to apply operation %d of JSON patch", i))
+		}
+	}
+
+	return json.Marshal(node)
+}
+
+func applyJSONPatchOp(doc interface{}, op jsonPatchOp) (interface{}, error) {
+	if op.Path == nil {
+		return nil, errors.Errorf("Operation '%s' is missing a path", op.Op)
+	}
+	path, err := parseJSONPointer(*op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var value interface{}
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return nil, errors.Errorf("Operation '%s' is missing a value", op.Op)
+		}
+		err = json.Unmarshal(op.Value, &value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid value for operation '%s'", op.Op)
+		}
+	case "move", "copy":
+		if op.From == nil {
+			return nil, errors.Errorf("Operation '%s' is missing a from location", op.Op)
+		}
+		from, err := parseJSONPointer(*op.From)
+		if err != nil {
+			return nil, err
+		}
+		value, err = getJSONValue(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "copy" {
+			// Copy the value so later operations on either location do not affect the other
+			valueBytes, err := json.Marshal(value)
+			if err != nil {
+				return nil, err
+			}
+			value = nil
+			err = json.Unmarshal(valueBytes, &value)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if op.Op == "move" {
+			if *op.Path != *op.From && strings.HasPrefix(*op.Path, *op.From+"/") {
+				return nil, errors.Errorf("Can not move '%s' into one of its children", *op.From)
+			}
+			doc, err = updateJSONValue(doc, from, removeJSONValue)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	switch op.Op {
+	case "add", "move", "copy":
+		return updateJSONValue(doc, path, addJSONValue(value))
+	case "remove":
+		return updateJSONValue(doc, path, removeJSONValue)
+	case "replace":
+		return updateJSONValue(doc, path, replaceJSONValue(value))
+	case "test":
+		current, err := getJSONValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(current, value) {
+			return nil, errors.Errorf("Test of '%s' failed", *op.Path)
+		}
+		return doc, nil
+	default:
+		return nil, errors.Errorf("Unsupported operation '%s'", op.Op)
+	}
+}
+
+// parseJSONPointer splits an RFC 6901 JSON Pointer into its reference tokens
+func parseJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, errors.Errorf("Invalid JSON pointer '%s'", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// getJSONValue returns the value at path in doc
+func getJSONValue(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, errors.Errorf("Member '%s' not found", token)
+			}
+			doc = value
+		case []interface{}:
+			i, err := jsonArrayIndex(token, len(node)-1)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[i]
+		default:
+			return nil, errors.Errorf("Can not get '%s' of a value that is not an object or array", token)
+		}
+	}
+	return doc, nil
+}
+
+// updateJSONValue calls fn with the container holding the last token of path
+// and returns doc with that container replaced by the one fn returns
+func updateJSONValue(doc interface{}, path []string, fn func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 0 {
+		return fn(jsonRoot{}, "")
+	}
+	if len(path) == 1 {
+		return fn(doc, path[0])
+	}
+
+	child, err := getJSONValue(doc, path[:1])
+	if err != nil {
+		return nil, err
+	}
+	child, err = updateJSONValue(child, path[1:], fn)
+	if err != nil {
+		return nil, err
+	}
+	return replaceJSONValue(child)(doc, path[0])
+}
+
+func addJSONValue(value interface{}) func(interface{}, string) (interface{}, error) {
+	return func(container interface{}, token string) (interface{}, error) {
+		switch node := container.(type) {
+		case jsonRoot:
+			return value, nil
+		case map[string]interface{}:
+			node[token] = value
+			return node, nil
+		case []interface{}:
+			i := len(node)
+			if token != "-" {
+				var err error
+				i, err = jsonArrayIndex(token, len(node))
+				if err != nil {
+					return nil, err
+				}
+			}
+			node = append(node, nil)
+			copy(node[i+1:], node[i:])
+			node[i] = value
+			return node, nil
+		default:
+			return nil, errors.Errorf("Can not add '%s' to a value that is not an object or array", token)
+		}
+	}
+}
+
+func replaceJSONValue(value interface{}) func(interface{}, string) (interface{}, error) {
+	return func(container interface{}, token string) (interface{}, error) {
+		switch node := container.(type) {
+		case jsonRoot:
+			return value, nil
+		case map[string]interface{}:
+			if _, ok := node[token]; !ok {
+				return nil, errors.Errorf("Member '%s' not found", token)
+			}
+			node[token] = value
+			return node, nil
+		case []interface{}:
+			i, err := jsonArrayIndex(token, len(node)-1)
+			if err != nil {
+				return nil, err
+			}
+			node[i] = value
+			return node, nil
+		default:
+			return nil, errors.Errorf("Can not replace '%s' of a value that is not an object or array", token)
+		}
+	}
+}
+
+func removeJSONValue(container interface{}, token string) (interface{}, error) {
+	switch node := container.(type) {
+	case jsonRoot:
+		return nil, errors.New("Can not remove the whole document")
+	case map[string]interface{}:
+		if _, ok := node[token]; !ok {
+			return nil, errors.Errorf("Member '%s' not found", token)
+		}
+		delete(node, token)
+		return node, nil
+	case []interface{}:
+		i, err := jsonArrayIndex(token, len(node)-1)
+		if err != nil {
+			return nil, err
+		}
+		return append(node[:i], node[i+1:]...), nil
+	default:
+		return nil, errors.Errorf("Can not remove '%s' from a value that is not an object or array", token)
+	}
+}
+
+// jsonArrayIndex parses token as an array index no greater than max
+func jsonArrayIndex(token string, max int) (int, error) {
+	if token == "" || strings.Trim(token, "0123456789") != "" || (len(token) > 1 && token[0] == '0') {
+		return 0, errors.Errorf("Invalid array index '%s'", token)
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil {
+		return 0, errors.Errorf("Invalid array index '%s'", token)
+	}
+	if i > max {
+		return 0, errors.Errorf("Array index '%s' is out of range", token)
+	}
+	return i, nil
+}
@@ -309,8 +309,8 @@ func processAffiliationPostRequest(ctx *serverRequestContextImpl, caname string)
 		for _, addAff := range addAffiliationSlice {
 			affiliationPath = affiliationPath + addAff
 			err := registry.InsertAffiliation(affiliationPath, parentAffiliationPath, affLevel)
-			if err != nil {
-				return nil, newHTTPErr(500, ErrUpdateConfigAddAff, "Failed to add affiliations '%s': %s", addAffiliation, err)
+			if err != nil && (!isAffiliationExistsError(err) || affiliationPath == addAffiliation) {
+				return nil, getAddAffiliationError(addAffiliation, err)
 			}
 			parentAffiliationPath = affiliationPath
 			affiliationPath = affiliationPath + "."
@@ -329,12 +329,12 @@ func processAffiliationPostRequest(ctx *serverRequestContextImpl, caname string)
 			}
 			err := registry.InsertAffiliation(addAffiliation, parentAffiliationPath, affLevel)
 			if err != nil {
-				return nil, newHTTPErr(500, ErrUpdateConfigAddAff, "Failed to add affiliation '%s': %s", addAffiliation, err)
+				return nil, getAddAffiliationError(addAffiliation, err)
 			}
 		} else {
 			err := registry.InsertAffiliation(addAffiliation, "", affLevel)
 			if err != nil {
-				return nil, newHTTPErr(500, ErrUpdateConfigAddAff, "Failed to add affiliation '%s': %s", addAffiliation, err)
+				return nil, getAddAffiliationError(addAffiliation, err)
 			}
 		}
 
@@ -346,6 +346,16 @@ func processAffiliationPostRequest(ctx *serverRequestContextImpl, caname string)
 	return resp, nil
 }
 
+// getAddAffiliationError returns the error for a failure to insert the
+// affiliation being added. The affiliation was already checked not to exist,
+// so if the insert found it, it was soft deleted and must be restored instead.
+func getAddAffiliationError(name string, err error) error {
+	if isAffiliationExistsError(err) {
+		return newHTTPErr(400, ErrUpdateConfigAddAff, "Affiliation '%s' was deleted and must be restored rather than added", name)
+	}
+	return newHTTPErr(500, ErrUpdateConfigAddAff, "Failed to add affiliation '%s': %s", name, err)
+}
+
 func processAffiliationPutRequest(ctx *serverRequestContextImpl, caname string) (*api.AffiliationResponse, error) {
 	log.Debug("Processing PUT request")
 
@@ -224,6 +224,17 @@ func TestDynamicAddAffiliation(t *testing.T) {
 	_, err = registry.GetAffiliation("org4.dept1")
 	assert.NoError(t, err, "Failed to add affiliation correctly")
 	assert.Equal(t, "org4.dept1.team2", addAffResp.Name)
+
+	// A soft deleted affiliation is restored rather than added again
+	err = registry.(*Accessor).SoftDeleteAffiliation("org3.dept1")
+	util.FatalError(t, err, "Failed to soft delete affiliation 'org3.dept1'")
+	for _, force := range []bool{false, true} {
+		_, err = admin.AddAffiliation(&api.AddAffiliationRequest{Name: "org3.dept1", Force: force})
+		if assert.Error(t, err, "Adding a soft deleted affiliation should have failed") {
+			assert.Contains(t, err.Error(), "must be restored")
+			assert.Contains(t, err.Error(), fmt.Sprintf("%d", ErrUpdateConfigAddAff))
+		}
+	}
 }
 
 func TestDynamicRemoveAffiliation(t *testing.T) {
@@ -276,6 +287,16 @@ func TestDynamicRemoveAffiliation(t *testing.T) {
 	_, err = registry.GetUser("testuser1", nil)
 	assert.NoError(t, err, "User should exist")
 
+	// Only the first identity of the registry is the bootstrap admin
+	isBootstrap, err := registry.(*Accessor).IsBootstrapAdmin("admin")
+	if assert.NoError(t, err, "Failed to check if 'admin' is the bootstrap admin") {
+		assert.True(t, isBootstrap, "'admin' should be the bootstrap admin")
+	}
+	isBootstrap, err = registry.(*Accessor).IsBootstrapAdmin("admin2")
+	if assert.NoError(t, err, "Failed to check if 'admin2' is the bootstrap admin") {
+		assert.False(t, isBootstrap, "'admin2' should not be the bootstrap admin")
+	}
+
 	certdbregistry := srv.CA.certDBAccessor
 	certs, err := certdbregistry.GetCertificatesByID("testuser1")
 	if len(certs) != 1 {
@@ -78,9 +78,44 @@ func enrollHandler(ctx *serverRequestContextImpl) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
+	recordEnrollment(ctx, id)
 	return resp, nil
 }
 
+// recordEnrollment records the CSR subject and client address of a completed
+// enrollment if the registry keeps an enrollment history. Failures are only
+// logged, since the enrollment has already succeeded.
+func recordEnrollment(ctx *serverRequestContextImpl, id string) {
+	ca, err := ctx.GetCA()
+	if err != nil {
+		return
+	}
+	registry, ok := ca.registry.(*Accessor)
+	if !ok {
+		return
+	}
+
+	var req api.EnrollmentRequestNet
+	err = ctx.ReadBody(&req)
+	if err != nil {
+		log.Warningf("Failed to read enrollment request of identity '%s': %s", id, err)
+		return
+	}
+	var subject string
+	block, _ := pem.Decode([]byte(req.Request))
+	if block != nil {
+		csrReq, err := x509.ParseCertificateRequest(block.Bytes)
+		if err == nil {
+			subject = csrReq.Subject.String()
+		}
+	}
+
+	err = registry.RecordEnrollment(id, subject, ctx.req.RemoteAddr, time.Now())
+	if err != nil {
+		log.Warningf("Failed to record enrollment of identity '%s': %s", id, err)
+	}
+}
+
 // Handle a reenroll request, guarded by token authentication
 func reenrollHandler(ctx *serverRequestContextImpl) (interface{}, error) {
 	// Authenticate the caller
@@ -169,6 +169,30 @@ const (
 	ErrParsingIntEnvVar = 68
 	// CA certificate file is not found warning message
 	ErrCACertFileNotFound = 69
+	// Affiliation being added exceeds the maximum allowed depth
+	ErrAffiliationDepth = 70
+	// Identity being added already exists
+	ErrIdentityExists = 71
+	// ErrInvalidFieldValue is returned when a value of the wrong type is supplied for an identity field
+	ErrInvalidFieldValue = 72
+	// ErrInvalidStateTransition is returned when the enrollment state of an identity can not be changed to the requested state
+	ErrInvalidStateTransition = 73
+	// ErrInvalidRequest is returned when a request to the identity registry is invalid
+	ErrInvalidRequest = 74
+	// ErrParentAffiliationNotFound is returned when the new parent of an affiliation does not exist
+	ErrParentAffiliationNotFound = 75
+	// ErrAffiliationCycle is returned when an affiliation would become its own ancestor
+	ErrAffiliationCycle = 76
+	// ErrAffiliationExists is returned when the affiliation being added already exists
+	ErrAffiliationExists = 77
+	// ErrAuditEvent is returned when an event can not be written to the audit database in strict mode
+	ErrAuditEvent = 78
+	// ErrInvalidSchema is returned when the database tables do not have the expected columns
+	ErrInvalidSchema = 79
+	// ErrTruncateNotAllowed is returned when tables are truncated without AllowTruncate set
+	ErrTruncateNotAllowed = 80
+	// ErrTokenConflict is returned when the token of an identity is not the one expected when swapping it
+	ErrTokenConflict = 81
 )
 
 // Construct a new HTTP error.
@@ -211,6 +235,23 @@ type httpErr struct {
 	rmsg  string // remote error message
 }
 
+// HTTPStatusForError returns the HTTP status code that is returned to clients
+// for err. The codes used by this package, including by the Accessor, are:
+//
+//	400 the request was invalid, e.g. a value of the wrong type or a duplicate
+//	401 authorization of the caller failed
+//	404 the requested identity or affiliation was not found
+//	500 the identity registry failed for any other reason
+//	504 the database could not be reached
+//
+// Errors that were not created with a status code map to 500.
+func HTTPStatusForError(err error) int {
+	if err == nil {
+		return http.StatusOK
+	}
+	return getHTTPErr(err).scode
+}
+
 // Error returns the string representation
 func (he *httpErr) Error() string {
 	return he.String()
@@ -209,7 +209,8 @@ func getIDs(ctx *serverRequestContextImpl, caller spi.User, caname string) error
 		}
 
 		var attrs []api.Attribute
-		json.Unmarshal([]byte(id.Attributes), &attrs)
+		attributes, _ := decodeAttributes(id.Attributes)
+		json.Unmarshal([]byte(attributes), &attrs)
 
 		idInfo := api.IdentityInfo{
 			ID:             id.Name,
@@ -89,7 +89,7 @@ func registerUser(req *api.RegistrationRequest, registrar string, ca *CA, ctx *s
 		return "", err
 	}
 
-	secret, err := registerUserID(req, ca)
+	secret, err := registerUserID(req, registrar, ca)
 
 	if err != nil {
 		return "", errors.WithMessage(err, fmt.Sprintf("Registration of '%s' failed", req.Name))
@@ -136,7 +136,7 @@ func validateAffiliation(req *api.RegistrationRequest, ctx *serverRequestContext
 }
 
 // registerUserID registers a new user and its enrollmentID, role and state
-func registerUserID(req *api.RegistrationRequest, ca *CA) (string, error) {
+func registerUserID(req *api.RegistrationRequest, registrar string, ca *CA) (string, error) {
 	log.Debugf("Registering user id: %s\n", req.Name)
 	var err error
 
@@ -163,6 +163,7 @@ func registerUserID(req *api.RegistrationRequest, ca *CA) (string, error) {
 		Attributes:     req.Attributes,
 		MaxEnrollments: req.MaxEnrollments,
 		Level:          ca.server.levels.Identity,
+		CreatedBy:      registrar,
 	}
 
 	registry := ca.registry
@@ -130,7 +130,11 @@ func revokeHandler(ctx *serverRequestContextImpl) (interface{}, error) {
 				}
 			}
 
-			err = user.Revoke()
+			if dbUser, ok := user.(*DBUser); ok {
+				err = dbUser.RevokeWithReason(reason)
+			} else {
+				err = user.Revoke()
+			}
 			if err != nil {
 				return nil, newHTTPErr(500, ErrRevokeUpdateUser, "Failed to revoke user: %s", err)
 			}
@@ -21,6 +21,8 @@ limitations under the License.
 package spi
 
 import (
+	"time"
+
 	"github.com/hyperledger/fabric-ca/api"
 	"github.com/jmoiron/sqlx"
 )
@@ -35,6 +37,17 @@ type UserInfo struct {
 	State          int
 	MaxEnrollments int
 	Level          int
+	// CreatedBy is the identity that is creating this user, if any
+	CreatedBy string
+	// ExpiresAt is the time after which this user can no longer login; the
+	// zero time means the user does not expire
+	ExpiresAt time.Time
+	// SecretExpiresAt is the time after which this user can no longer login
+	// with its secret; the zero time means the secret does not expire
+	SecretExpiresAt time.Time
+	// IsBootstrap is true for the bootstrap admin registered when the CA was
+	// initialized, which can not be deleted
+	IsBootstrap bool
 }
 
 // DbTxResult returns information on any affiliations and/or identities affected